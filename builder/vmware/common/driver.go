@@ -15,6 +15,7 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-version"
@@ -365,19 +366,11 @@ func (d *VmwareDriver) GuestAddress(state multistep.StateBag) (string, error) {
 		return "", err
 	}
 
-	var ok bool
-	macAddress := ""
-	if macAddress, ok = vmxData["ethernet0.address"]; !ok || macAddress == "" {
-		if macAddress, ok = vmxData["ethernet0.generatedaddress"]; !ok || macAddress == "" {
-			return "", errors.New("unable to determine MAC address")
-		}
-	}
-	log.Printf("[INFO] GuestAddress discovered MAC address: %s", macAddress)
-
-	res, err := net.ParseMAC(macAddress)
+	res, err := VmxMACAddress(vmxData, 0)
 	if err != nil {
 		return "", err
 	}
+	log.Printf("[INFO] GuestAddress discovered MAC address: %s", res)
 
 	return res.String(), nil
 }
@@ -426,7 +419,7 @@ func (d *VmwareDriver) PotentialGuestIP(state multistep.StateBag) ([]string, err
 
 	// iterate through all of the devices and collect all the dhcp lease entries
 	// that we possibly can.
-	var availableLeaseEntries []dhcpLeaseEntry
+	var availableLeaseEntries []DhcpLeaseEntry
 
 	for _, device := range devices {
 		// figure out the correct dhcp leases
@@ -452,11 +445,11 @@ func (d *VmwareDriver) PotentialGuestIP(state multistep.StateBag) ([]string, err
 
 		// Parse our MAC address again. There's no need to check for an
 		// error because we've already parsed this successfully.
-		hwaddr, _ := net.ParseMAC(MACAddress)
+		hwaddr, _ := parseMAC(MACAddress)
 
 		// Go through our available lease entries and see which ones are within
 		// scope, and that match to our hardware address.
-		results := make([]dhcpLeaseEntry, 0)
+		results := make([]DhcpLeaseEntry, 0)
 		for _, entry := range leaseEntries {
 
 			// First check for leases that are still valid. The timestamp for
@@ -533,7 +526,7 @@ func (d *VmwareDriver) PotentialGuestIP(state multistep.StateBag) ([]string, err
 
 			// Parse our MAC address again. There's no need to check for an
 			// error because we've already parsed this successfully.
-			hwaddr, _ := net.ParseMAC(MACAddress)
+			hwaddr, _ := parseMAC(MACAddress)
 
 			// Go through our available lease entries and see which ones are within
 			// scope, and that match to our hardware address.
@@ -732,20 +725,45 @@ func GetOvfTool() string {
 	return ovftool
 }
 
-// CheckOvfToolVersion checks the version of the VMware OVF Tool.
-func CheckOvfToolVersion(ovftoolPath string) error {
+// The versions of the VMware OVF Tool that have been probed, keyed by path.
+var ovfToolVersions = struct {
+	sync.Mutex
+	versions map[string]string
+}{versions: make(map[string]string)}
+
+// ProbeOvfToolVersion returns the version of the VMware OVF Tool at the given
+// path. The result is cached, so the tool is only run once for each path.
+func ProbeOvfToolVersion(ovftoolPath string) (string, error) {
+	ovfToolVersions.Lock()
+	defer ovfToolVersions.Unlock()
+
+	if v, ok := ovfToolVersions.versions[ovftoolPath]; ok {
+		return v, nil
+	}
+
 	output, err := exec.Command(ovftoolPath, "--version").CombinedOutput()
 	if err != nil {
 		log.Printf("[WARN] Error running 'ovftool --version': %v.", err)
 		log.Printf("[WARN] Returned: %s", string(output))
-		return errors.New("failed to execute ovftool")
+		return "", errors.New("failed to execute ovftool")
 	}
 	versionOutput := string(output)
 	log.Printf("[INFO] Returned ovftool version: %s.", versionOutput)
 
 	versionString := ovfToolVersion.FindString(versionOutput)
 	if versionString == "" {
-		return errors.New("unable to determine the version of ovftool")
+		return "", errors.New("unable to determine the version of ovftool")
+	}
+
+	ovfToolVersions.versions[ovftoolPath] = versionString
+	return versionString, nil
+}
+
+// CheckOvfToolVersion checks the version of the VMware OVF Tool.
+func CheckOvfToolVersion(ovftoolPath string) error {
+	versionString, err := ProbeOvfToolVersion(ovftoolPath)
+	if err != nil {
+		return err
 	}
 
 	currentVersion, err := version.NewVersion(versionString)
@@ -38,6 +38,10 @@ type DriverMock struct {
 
 	ExportCalled bool
 	ExportArgs   []string
+	ExportErr    error
+	// ExportFunc, if set, is called to simulate the side effects of an
+	// export, and its error is returned instead of ExportErr.
+	ExportFunc func([]string) error
 
 	IsRunningCalled bool
 	IsRunningPath   string
@@ -118,6 +122,11 @@ func (m *NetworkMapperMock) NameIntoDevices(name string) ([]string, error) {
 	return make([]string, 0), nil
 }
 
+func (m *NetworkMapperMock) NameIntoDevice(name string) (string, error) {
+	m.NameIntoDeviceCalled++
+	return "", nil
+}
+
 func (m *NetworkMapperMock) DeviceIntoName(device string) (string, error) {
 	m.DeviceIntoNameCalled++
 	return "", nil
@@ -280,7 +289,10 @@ func (d *DriverMock) Verify() error {
 func (d *DriverMock) Export(args []string) error {
 	d.ExportCalled = true
 	d.ExportArgs = args
-	return nil
+	if d.ExportFunc != nil {
+		return d.ExportFunc(args)
+	}
+	return d.ExportErr
 }
 
 func (d *DriverMock) GetVmwareDriver() VmwareDriver {
@@ -4,19 +4,26 @@
 package common
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -138,6 +145,10 @@ func tokenizeDhcpConfig(in chan byte) chan string {
 type tkParameter struct {
 	name    string
 	operand []string
+
+	// groups is the number of groups that were declared before the
+	// parameter within its group, which places it among them.
+	groups int
 }
 
 func (e *tkParameter) String() string {
@@ -184,8 +195,9 @@ func parseTokenParameter(in chan string) tkParameter {
 		}
 
 		// If encounter any braces or line-terminators, then we're done parsing.
-		// Anything else we find are just operands we need to keep track of.
-		if strings.ContainsAny("{};", token) {
+		// Anything else we find are just operands we need to keep track of,
+		// including quoted strings that happen to contain those characters.
+		if token == "{" || token == "}" || token == ";" {
 			break
 		}
 		result.operand = append(result.operand, token)
@@ -255,6 +267,7 @@ func parseDhcpConfig(in chan string) (tkGroup, error) {
 			// to our current tree node.
 
 			arg := toParameter(tokens)
+			arg.groups = len(node.groups)
 			node.params = append(node.params, arg)
 			tokens = []string{}
 
@@ -478,6 +491,20 @@ type pParameterOption struct {
 
 func (e pParameterOption) repr() string { return fmt.Sprintf("option:%s=%s", e.name, e.value) }
 
+// option my-option code 224 = text
+type pParameterOptionDef struct {
+	name     string
+	code     int
+	dataType string
+}
+
+func (e pParameterOptionDef) repr() string {
+	return fmt.Sprintf("option-def:%s,code=%d,type=%s", e.name, e.code, e.dataType)
+}
+
+// optionDefRe matches the definition of an option, which follows its name.
+var optionDefRe = regexp.MustCompile(`(?i)^code\s+(\d+)\s*=\s*(.+)$`)
+
 // allow some-kind-of-something
 type pParameterGrant struct {
 	verb      string // allow,deny,ignore
@@ -498,6 +525,15 @@ func (e pParameterAddress6) repr() string {
 	return fmt.Sprintf("fixed-address6:%s", strings.Join(e, ","))
 }
 
+// hardwareAddressLengths are the number of octets in the address of each
+// hardware class that dhcpd knows of.
+var hardwareAddressLengths = map[string]int{
+	"ethernet":   6,
+	"token-ring": 6,
+	"fddi":       6,
+	"infiniband": 20,
+}
+
 // hardware address 00:00:00:00:00:00
 type pParameterHardware struct {
 	class   string
@@ -521,6 +557,14 @@ type pParameterBoolean struct {
 
 func (e pParameterBoolean) repr() string { return fmt.Sprintf("boolean:%s=%v", e.parameter, e.truancy) }
 
+// flag returns the value of the parameter as it's spelled by dhcpd.
+func (e pParameterBoolean) flag() string {
+	if e.truancy {
+		return "on"
+	}
+	return "off"
+}
+
 type pParameterClientMatch struct {
 	name string
 	data string
@@ -530,19 +574,29 @@ func (e pParameterClientMatch) repr() string {
 	return fmt.Sprintf("match-client:%s=%s", e.name, e.data)
 }
 
-// range 127.0.0.1 127.0.0.255
+// range [dynamic-bootp] 127.0.0.1 127.0.0.255
 type pParameterRange4 struct {
-	min net.IP
-	max net.IP
+	min   net.IP
+	max   net.IP
+	bootp bool
+
+	// singleton is set when the range was declared with a single address.
+	singleton bool
 }
 
 func (e pParameterRange4) repr() string {
+	if e.bootp {
+		return fmt.Sprintf("range4:bootp:%s-%s", e.min.String(), e.max.String())
+	}
 	return fmt.Sprintf("range4:%s-%s", e.min.String(), e.max.String())
 }
 
 type pParameterRange6 struct {
 	min net.IP
 	max net.IP
+
+	// singleton is set when the range was declared with a single address.
+	singleton bool
 }
 
 func (e pParameterRange6) repr() string {
@@ -576,6 +630,16 @@ func (e pParameterExpression) repr() string {
 	return fmt.Sprintf("parameter-expression:%s=\"%s\"", e.parameter, e.expression)
 }
 
+// statement preserved verbatim without being interpreted
+type pParameterRaw struct {
+	name    string
+	operand []string
+}
+
+func (e pParameterRaw) repr() string {
+	return fmt.Sprintf("raw:%s", strings.Join(append([]string{e.name}, e.operand...), " "))
+}
+
 type pDeclarationIdentifier interface {
 	repr() string
 }
@@ -639,23 +703,147 @@ type pDeclarationGroup struct{}
 
 func (e pDeclarationGroup) repr() string { return "{group}" }
 
+// key "name" { algorithm hmac-md5; secret "..."; }
+type pDeclarationKey struct {
+	name      string
+	algorithm string
+
+	// The secret is referenced by a pointer so that formatting any structure
+	// containing the key only reveals its address.
+	secret *string
+}
+
+func (e pDeclarationKey) repr() string {
+	return fmt.Sprintf("{key name:%s algorithm:%s secret:%s}", e.name, e.algorithm, redactedDhcpSecret)
+}
+
+// String and GoString ensure the secret is redacted even when the identifier
+// is formatted directly, such as within an error message.
+func (e pDeclarationKey) String() string   { return e.repr() }
+func (e pDeclarationKey) GoString() string { return e.repr() }
+
+// failover peer "name" { primary; address ...; peer address ...; ... }
+type pDeclarationFailover struct {
+	name        string
+	role        string
+	address     string
+	peerAddress string
+	port        string
+	peerPort    string
+	mclt        string
+}
+
+func (e pDeclarationFailover) repr() string {
+	return fmt.Sprintf("{failover peer name:%s}", e.name)
+}
+
+// class "name" { ... }
+type pDeclarationClass struct {
+	name string
+
+	// leaseLimit is the number of leases that the clients of the class may
+	// hold at once, which is only set if limited is.
+	leaseLimit int
+	limited    bool
+
+	// spawn is the expression of `spawn with`, by whose value a subclass is
+	// spawned for each client.
+	spawn string
+}
+
+func (e pDeclarationClass) repr() string {
+	res := []string{"name:" + e.name}
+	if e.limited {
+		res = append(res, fmt.Sprintf("lease-limit:%d", e.leaseLimit))
+	}
+	if e.spawn != "" {
+		res = append(res, "spawn:"+e.spawn)
+	}
+	return fmt.Sprintf("{class %s}", strings.Join(res, " "))
+}
+
+// declaration that could not be parsed
+type pDeclarationUnknown struct {
+	name    string
+	operand []string
+}
+
+func (e pDeclarationUnknown) repr() string {
+	return fmt.Sprintf("{unknown %s}", strings.Join(append([]string{e.name}, e.operand...), " "))
+}
+
+// on commit or release { ... }
+type pDeclarationEvent struct{ events []string }
+
+func (e pDeclarationEvent) repr() string { return "{on " + strings.Join(e.events, " or ") + "}" }
+
+// if condition { ... } elsif condition { ... } else { ... }
+type pDeclarationConditional struct {
+	keyword   string
+	condition string
+}
+
+func (e pDeclarationConditional) repr() string {
+	if e.condition == "" {
+		return fmt.Sprintf("{%s}", e.keyword)
+	}
+	return fmt.Sprintf("{%s %s}", e.keyword, e.condition)
+}
+
 /** parsers */
+
+// redactedDhcpSecret replaces secrets whenever a declaration is rendered.
+const redactedDhcpSecret = "<redacted>"
+
+// unquoteDhcpString removes the quotes surrounding a string if it has any.
+func unquoteDhcpString(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
 func parseParameter(val tkParameter) (pParameter, error) {
 	switch val.name {
 	case "include":
-		if len(val.operand) != 2 {
+		if len(val.operand) != 1 {
 			return nil, fmt.Errorf("invalid number of parameters for pParameterInclude : %v", val.operand)
 		}
 
-		name := val.operand[0]
+		name := unquoteDhcpString(val.operand[0])
 		return pParameterInclude{filename: name}, nil
 
 	case "option":
-		if len(val.operand) != 2 {
+		if len(val.operand) < 2 {
 			return nil, fmt.Errorf("invalid number of parameters for pParameterOption : %v", val.operand)
 		}
 
-		name, value := val.operand[0], val.operand[1]
+		// An option is defined by giving it a code and a type, rather than a
+		// value, as in `option my-option code 224 = text;`.
+		if strings.EqualFold(val.operand[1], "code") {
+			matches := optionDefRe.FindStringSubmatch(strings.Join(val.operand[1:], " "))
+			if matches == nil {
+				return nil, fmt.Errorf("invalid definition for pParameterOptionDef : %v", val.operand)
+			}
+			code, err := strconv.Atoi(matches[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid code for pParameterOptionDef : %v", matches[1])
+			}
+			return pParameterOptionDef{name: val.operand[0], code: code, dataType: matches[2]}, nil
+		}
+
+		// Options such as routers can take a comma-separated list of values,
+		// but anything else separated by whitespace isn't a valid value.
+		name, value := val.operand[0], joinDhcpOptionValue(val.operand[1:])
+		words := 1
+		if dhcpOptionPairedValues[strings.ToLower(name)] {
+			words = 2
+		}
+		for _, count := range countDhcpOptionWords(value) {
+			if count > words {
+				return nil, fmt.Errorf("invalid value for pParameterOption : %v", val.operand)
+			}
+		}
 		return pParameterOption{name: name, value: value}, nil
 
 	case "allow":
@@ -667,7 +855,12 @@ func parseParameter(val tkParameter) (pParameter, error) {
 			return nil, fmt.Errorf("invalid number of parameters for pParameterGrant : %v", val.operand)
 		}
 
+		// Well-known attributes are case-insensitive, so normalize them to
+		// be able to look them up. Anything else is kept as-is.
 		attribute := strings.Join(val.operand, " ")
+		if _, ok := knownGrantAttributes[strings.ToLower(attribute)]; ok {
+			attribute = strings.ToLower(attribute)
+		}
 		return pParameterGrant{verb: strings.ToLower(val.name), attribute: attribute}, nil
 
 	case "range":
@@ -675,19 +868,25 @@ func parseParameter(val tkParameter) (pParameter, error) {
 			return nil, fmt.Errorf("invalid number of parameters for pParameterRange4 : %v", val.operand)
 		}
 
-		idxAddress := map[bool]int{true: 1, false: 0}[strings.ToLower(val.operand[0]) == "bootp"]
+		// dhcpd spells the flag as dynamic-bootp, but bootp is accepted too.
+		flag := strings.ToLower(val.operand[0])
+		idxAddress := map[bool]int{true: 1, false: 0}[flag == "bootp" || flag == "dynamic-bootp"]
 		if len(val.operand) > 2+idxAddress {
 			return nil, fmt.Errorf("invalid number of parameters for pParameterRange : %v", val.operand)
 		}
 
 		if idxAddress+1 > len(val.operand) {
+			return nil, fmt.Errorf("invalid number of parameters for pParameterRange : %v", val.operand)
+		}
+
+		if idxAddress+2 > len(val.operand) {
 			res := net.ParseIP(val.operand[idxAddress])
-			return pParameterRange4{min: res, max: res}, nil
+			return pParameterRange4{min: res, max: res, bootp: idxAddress > 0, singleton: true}, nil
 		}
 
 		addr1 := net.ParseIP(val.operand[idxAddress])
 		addr2 := net.ParseIP(val.operand[idxAddress+1])
-		return pParameterRange4{min: addr1, max: addr2}, nil
+		return pParameterRange4{min: addr1, max: addr2, bootp: idxAddress > 0}, nil
 
 	case "range6":
 		if len(val.operand) == 1 {
@@ -699,33 +898,32 @@ func parseParameter(val tkParameter) (pParameter, error) {
 				}
 
 				address := net.ParseIP(cidr[0])
+				if address == nil {
+					return nil, fmt.Errorf("unknown ipv6 format : %v", cidr[0])
+				}
 
 				bits, err := strconv.Atoi(cidr[1])
 				if err != nil {
 					return nil, err
 				}
 				mask := net.CIDRMask(bits, net.IPv6len*8)
+				if mask == nil {
+					return nil, fmt.Errorf("invalid prefix length for pParameterRange6 : %v", cidr[1])
+				}
 
 				// figure out the network address
 				network := address.Mask(mask)
 
-				// make a broadcast address
-				broadcast := network
-				networkSize, totalSize := mask.Size()
-				hostSize := totalSize - networkSize
-				for i := networkSize / 8; i < totalSize/8; i++ {
-					broadcast[i] = byte(0xff)
+				// make a broadcast address by setting all of the host bits
+				broadcast := make(net.IP, len(network))
+				for i := range network {
+					broadcast[i] = network[i] | ^mask[i]
 				}
 
-				octetIndex := network[networkSize/8]
-				bitsLeft := (uint32)(hostSize % 8)
-				broadcast[octetIndex] = network[octetIndex] | ((1 << bitsLeft) - 1)
-
-				// FIXME: check that the broadcast address was made correctly
 				return pParameterRange6{min: network, max: broadcast}, nil
 			}
 			res := net.ParseIP(address)
-			return pParameterRange6{min: res, max: res}, nil
+			return pParameterRange6{min: res, max: res, singleton: true}, nil
 		}
 
 		if len(val.operand) == 2 {
@@ -758,12 +956,17 @@ func parseParameter(val tkParameter) (pParameter, error) {
 			return nil, fmt.Errorf("invalid number of parameters for pParameterHardware : %v", val.operand)
 		}
 
-		class := val.operand[0]
+		class := strings.ToLower(val.operand[0])
+		length, ok := hardwareAddressLengths[class]
+		if !ok {
+			return nil, fmt.Errorf("unknown hardware class %q", val.operand[0])
+		}
+
 		octets := strings.Split(val.operand[1], ":")
-		if len(octets) != 6 {
-			return nil, fmt.Errorf("invalid MAC address format")
+		if len(octets) != length {
+			return nil, fmt.Errorf("invalid %s hardware address %q, expected %d octets", class, val.operand[1], length)
 		}
-		address := make([]byte, 6)
+		address := make([]byte, length)
 		for i, v := range octets {
 			b, err := strconv.ParseUint(v, 16, 8)
 			if err != nil {
@@ -784,6 +987,22 @@ func parseParameter(val tkParameter) (pParameter, error) {
 		copy(ip6addrs, val.operand)
 		return ip6addrs, nil
 
+	case "interface":
+		if len(val.operand) != 1 {
+			return nil, fmt.Errorf("invalid number of parameters for interface : %v", val.operand)
+		}
+
+		// The name of the interface is usually quoted, so store it without.
+		return pParameterOther{parameter: val.name, value: unquoteDhcpString(val.operand[0])}, nil
+
+	case "failover":
+		if len(val.operand) != 2 || strings.ToLower(val.operand[0]) != "peer" {
+			return nil, fmt.Errorf("invalid number of parameters for failover : %v", val.operand)
+		}
+
+		// A pool refers to its failover peer by name.
+		return pParameterOther{parameter: "failover peer", value: unquoteDhcpString(val.operand[1])}, nil
+
 	case "host-identifier":
 		if len(val.operand) != 3 {
 			return nil, fmt.Errorf("invalid number of parameters for pParameterClientMatch : %v", val.operand)
@@ -821,6 +1040,71 @@ func parseParameter(val tkParameter) (pParameter, error) {
 	}
 }
 
+// joinDhcpOptionValue rebuilds the value of an option from its tokens. A
+// comma can end up in a token of its own or at the start of the next one when
+// it follows a quoted string, so each comma outside of quotes is normalized to
+// be followed by a single space.
+func joinDhcpOptionValue(tokens []string) string {
+	joined := strings.Join(tokens, " ")
+
+	var result strings.Builder
+	quote := false
+	for i := 0; i < len(joined); i++ {
+		by := joined[i]
+		switch {
+		case by == '"':
+			quote = !quote
+		case by == ',' && !quote:
+			trimmed := strings.TrimRight(result.String(), " ")
+			result.Reset()
+			result.WriteString(trimmed)
+			result.WriteString(", ")
+			for i+1 < len(joined) && joined[i+1] == ' ' {
+				i++
+			}
+			continue
+		}
+		result.WriteByte(by)
+	}
+	return result.String()
+}
+
+// dhcpOptionPairedValues are the options whose entries are each a
+// destination followed by a gateway, such as `10.0.0.0 10.0.0.1`.
+var dhcpOptionPairedValues = map[string]bool{
+	"static-routes":                   true,
+	"classless-static-routes":         true,
+	"rfc3442-classless-static-routes": true,
+}
+
+// countDhcpOptionWords returns the number of whitespace-separated words in
+// each comma-separated entry of an option value. Quoted strings are a single
+// word regardless of what they contain.
+func countDhcpOptionWords(value string) []int {
+	counts := []int{0}
+	quote, word := false, false
+	for _, by := range value {
+		switch {
+		case by == '"':
+			if !quote && !word {
+				counts[len(counts)-1]++
+				word = true
+			}
+			quote = !quote
+		case quote:
+		case by == ',':
+			counts = append(counts, 0)
+			word = false
+		case by == ' ' || by == '\t':
+			word = false
+		case !word:
+			counts[len(counts)-1]++
+			word = true
+		}
+	}
+	return counts
+}
+
 func parseTokenGroup(val tkGroup) (*pDeclaration, error) {
 	params := val.id.operand
 
@@ -837,25 +1121,38 @@ func parseTokenGroup(val tkGroup) (*pDeclaration, error) {
 		}
 
 	case "subnet":
+		if len(params) < 2 || strings.ToLower(params[1]) != "netmask" {
+			token := ""
+			if len(params) > 0 {
+				token = params[len(params)-1]
+			}
+			if len(params) > 1 {
+				token = params[1]
+			}
+			return nil, fmt.Errorf("missing netmask keyword in subnet declaration, got %q", token)
+		}
 		if len(params) != 3 {
 			return nil, fmt.Errorf("invalid number of parameters")
 		}
 
-		if strings.ToLower(params[1]) == "netmask" {
-			addr := make([]byte, 4)
-			for i, v := range strings.SplitN(params[2], ".", 4) {
-				res, err := strconv.ParseUint(v, 10, 8)
-				if err != nil {
-					return nil, fmt.Errorf("invalid octet %q: %s", v, err)
-				}
-				addr[i] = byte(res)
-			}
-			if subnet, mask := net.ParseIP(params[0]), net.IPv4Mask(addr[0], addr[1], addr[2], addr[3]); subnet != nil && mask != nil {
-				return &pDeclaration{id: pDeclarationSubnet4{net.IPNet{IP: subnet, Mask: mask}}}, nil
-			}
+		subnet := net.ParseIP(params[0])
+		if subnet == nil || subnet.To4() == nil {
+			return nil, fmt.Errorf("invalid subnet address %q", params[0])
 		}
 
-		return nil, fmt.Errorf("invalid parameters")
+		octets := strings.Split(params[2], ".")
+		if len(octets) != 4 {
+			return nil, fmt.Errorf("unparseable netmask %q, expected 4 octets", params[2])
+		}
+		addr := make([]byte, 4)
+		for i, v := range octets {
+			res, err := strconv.ParseUint(v, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("unparseable netmask octet %q in %q", v, params[2])
+			}
+			addr[i] = byte(res)
+		}
+		return &pDeclaration{id: pDeclarationSubnet4{net.IPNet{IP: subnet, Mask: net.IPv4Mask(addr[0], addr[1], addr[2], addr[3])}}}, nil
 
 	case "subnet6":
 		if len(params) != 1 {
@@ -879,6 +1176,59 @@ func parseTokenGroup(val tkGroup) (*pDeclaration, error) {
 			return &pDeclaration{id: pDeclarationShared{name: params[0]}}, nil
 		}
 
+	case "key":
+		if len(params) == 1 {
+			return &pDeclaration{id: pDeclarationKey{name: unquoteDhcpString(params[0])}}, nil
+		}
+
+	case "failover":
+		if len(params) == 2 && strings.ToLower(params[0]) == "peer" {
+			return &pDeclaration{id: pDeclarationFailover{name: unquoteDhcpString(params[1])}}, nil
+		}
+
+	case "class":
+		if len(params) == 1 {
+			return &pDeclaration{id: pDeclarationClass{name: unquoteDhcpString(params[0])}}, nil
+		}
+
+	case "on":
+		if len(params) < 1 || len(params)%2 == 0 {
+			return nil, fmt.Errorf("invalid number of parameters for pDeclarationEvent : %v", params)
+		}
+
+		var events []string
+		for i, v := range params {
+			if i%2 == 1 {
+				if strings.ToLower(v) != "or" {
+					return nil, fmt.Errorf("expected \"or\" between events : %v", params)
+				}
+				continue
+			}
+
+			event := strings.ToLower(v)
+			if event != "commit" && event != "release" && event != "expiry" {
+				return nil, fmt.Errorf("unknown event for pDeclarationEvent : %v", v)
+			}
+			events = append(events, event)
+		}
+		return &pDeclaration{id: pDeclarationEvent{events: events}}, nil
+
+	case "if", "elsif":
+		if len(params) == 0 {
+			return nil, fmt.Errorf("missing condition for pDeclarationConditional : %v", val.id.name)
+		}
+		return &pDeclaration{id: pDeclarationConditional{keyword: val.id.name, condition: strings.Join(params, " ")}}, nil
+
+	case "else":
+		// An `else if` is the same as an `elsif`.
+		if len(params) > 0 {
+			if params[0] != "if" || len(params) == 1 {
+				return nil, fmt.Errorf("invalid parameters for pDeclarationConditional : %v", params)
+			}
+			return &pDeclaration{id: pDeclarationConditional{keyword: "elsif", condition: strings.Join(params[1:], " ")}}, nil
+		}
+		return &pDeclaration{id: pDeclarationConditional{keyword: "else"}}, nil
+
 	case "":
 		return &pDeclaration{id: pDeclarationGlobal{}}, nil
 	}
@@ -886,41 +1236,167 @@ func parseTokenGroup(val tkGroup) (*pDeclaration, error) {
 }
 
 func flattenDhcpConfig(root tkGroup) (*pDeclaration, error) {
-	result, err := parseTokenGroup(root)
+	var errs []error
+
+	result := flattenDhcpConfigLenient(root, &errs)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return result, nil
+}
 
+// flattenDhcpConfigLenient flattens the tree like flattenDhcpConfig, but
+// instead of stopping at the first problem it records the error and then
+// preserves whatever it was unable to parse.
+func flattenDhcpConfigLenient(root tkGroup, errs *[]error) *pDeclaration {
+	result, err := parseTokenGroup(root)
 	if err != nil {
-		return nil, err
+		*errs = append(*errs, err)
+		result = &pDeclaration{id: pDeclarationUnknown{name: root.id.name, operand: root.id.operand}}
+	}
+
+	// The parameters of a key are its algorithm and secret, which we keep
+	// with the identifier so that the secret never lands in the options.
+	if key, ok := result.id.(pDeclarationKey); ok {
+		for _, p := range root.params {
+			if len(p.operand) != 1 {
+				*errs = append(*errs, fmt.Errorf("invalid number of parameters for pDeclarationKey : %v", p.operand))
+				continue
+			}
+
+			switch strings.ToLower(p.name) {
+			case "algorithm":
+				key.algorithm = p.operand[0]
+			case "secret":
+				secret := unquoteDhcpString(p.operand[0])
+				key.secret = &secret
+			default:
+				*errs = append(*errs, fmt.Errorf("unknown parameter for pDeclarationKey : %v", p.name))
+			}
+		}
+		result.id = key
+		return result
+	}
+
+	// The statements of a failover peer describe its relationship with the
+	// other server, so we keep them with the identifier. Anything else is
+	// preserved as-is.
+	if failover, ok := result.id.(pDeclarationFailover); ok {
+		for _, p := range root.params {
+			name := strings.ToLower(strings.Join(append([]string{p.name}, p.operand...), " "))
+			switch {
+			case name == "primary" || name == "secondary":
+				failover.role = name
+			case p.name == "address" && len(p.operand) == 1:
+				failover.address = p.operand[0]
+			case p.name == "port" && len(p.operand) == 1:
+				failover.port = p.operand[0]
+			case p.name == "mclt" && len(p.operand) == 1:
+				failover.mclt = p.operand[0]
+			case p.name == "peer" && len(p.operand) == 2 && p.operand[0] == "address":
+				failover.peerAddress = p.operand[1]
+			case p.name == "peer" && len(p.operand) == 2 && p.operand[0] == "port":
+				failover.peerPort = p.operand[1]
+			default:
+				result.parameters = append(result.parameters, pParameterRaw{name: p.name, operand: p.operand})
+			}
+		}
+		result.id = failover
+		return result
+	}
+
+	// The lease limit and spawn expression of a class are kept with the
+	// identifier. Its match statements are expressions that are evaluated by
+	// dhcpd, so they're preserved as-is. Anything else, such as its options,
+	// is parsed like any other declaration's.
+	if class, ok := result.id.(pDeclarationClass); ok {
+		var params []tkParameter
+		for _, p := range root.params {
+			switch {
+			case p.name == "lease" && len(p.operand) > 0 && p.operand[0] == "limit":
+				if len(p.operand) != 2 {
+					*errs = append(*errs, fmt.Errorf("invalid number of parameters for lease limit : %v", p.operand))
+					continue
+				}
+				limit, err := strconv.Atoi(p.operand[1])
+				if err != nil || limit < 0 {
+					*errs = append(*errs, fmt.Errorf("invalid lease limit for pDeclarationClass : %v", p.operand[1]))
+					continue
+				}
+				class.leaseLimit, class.limited = limit, true
+			case p.name == "spawn":
+				if len(p.operand) < 2 || p.operand[0] != "with" {
+					*errs = append(*errs, fmt.Errorf("invalid parameters for spawn with : %v", p.operand))
+					continue
+				}
+				class.spawn = strings.Join(p.operand[1:], " ")
+			case p.name == "match":
+				result.parameters = append(result.parameters, pParameterRaw{name: p.name, operand: p.operand})
+			default:
+				params = append(params, p)
+			}
+		}
+		result.id = class
+		root.params = params
 	}
 
 	for _, p := range root.params {
+		// Statements within an event are executed by dhcpd rather than
+		// configuring it, so we preserve them as-is instead of parsing them.
+		// The same goes for the branches of a conditional, which are only
+		// evaluated by dhcpd when a client is being served.
+		switch result.id.(type) {
+		case pDeclarationEvent, pDeclarationConditional:
+			result.parameters = append(result.parameters, pParameterRaw{name: p.name, operand: p.operand})
+			continue
+		}
+
 		param, err := parseParameter(p)
 		if err != nil {
-			return nil, err
+			*errs = append(*errs, err)
+			param = pParameterRaw{name: p.name, operand: p.operand}
 		}
 		result.parameters = append(result.parameters, param)
 	}
 
 	for _, p := range root.groups {
-		group, err := flattenDhcpConfig(*p)
-		if err != nil {
-			return nil, err
-		}
+		group := flattenDhcpConfigLenient(*p, errs)
 		group.parent = result
 		result.declarations = append(result.declarations, *group)
 	}
 
-	return result, nil
+	return result
 }
 
 /** reduce the tree into the things that we care about */
-type grant uint
 
+// Grant represents whether an allow, ignore, or deny statement applies to an
+// attribute such as unknown-clients.
+type Grant uint
+
+const (
+	ALLOW  Grant = iota
+	IGNORE Grant = iota
+	DENY   Grant = iota
+)
+
+// Well-known attributes of allow, ignore, and deny statements.
 const (
-	ALLOW  grant = iota
-	IGNORE grant = iota
-	DENY   grant = iota
+	GrantAttributeLeaseQuery          = "leasequery"
+	GrantAttributeClientUpdates       = "client-updates"
+	GrantAttributeDynamicBootpClients = "dynamic-bootp-clients"
+	GrantAttributeUnknownClients      = "unknown-clients"
+	GrantAttributeDuplicates          = "duplicates"
 )
 
+var knownGrantAttributes = map[string]bool{
+	GrantAttributeLeaseQuery:          true,
+	GrantAttributeClientUpdates:       true,
+	GrantAttributeDynamicBootpClients: true,
+	GrantAttributeUnknownClients:      true,
+	GrantAttributeDuplicates:          true,
+}
+
 type ConfigDeclaration struct {
 	id         []pDeclarationIdentifier
 	composites []pDeclaration
@@ -928,12 +1404,28 @@ type ConfigDeclaration struct {
 	address []pParameter
 
 	options     map[string]string
-	grants      map[string]grant
+	grants      map[string]Grant
 	attributes  map[string]bool
 	parameters  map[string]string
 	expressions map[string]string
 
+	// scopedGrants holds the grants of each composite separately, so that a
+	// grant declared within a pool can be told apart from one declared by
+	// its enclosing subnet.
+	scopedGrants []map[string]Grant
+
+	// shadowed holds the values of each option that were overridden by a
+	// different value in a more deeply nested declaration, from the
+	// outermost inwards.
+	shadowed map[string][]string
+
+	// optionDefs holds the custom options that were defined with a code and
+	// a type, by their name.
+	optionDefs map[string]OptionDefinition
+
 	hostid []pParameterClientMatch
+
+	statements []pParameterRaw
 }
 
 func createDeclaration(node pDeclaration) ConfigDeclaration {
@@ -947,26 +1439,43 @@ func createDeclaration(node pDeclaration) ConfigDeclaration {
 	result.address = make([]pParameter, 0)
 
 	result.options = make(map[string]string)
-	result.grants = make(map[string]grant)
+	result.grants = make(map[string]Grant)
 	result.attributes = make(map[string]bool)
+	result.scopedGrants = make([]map[string]Grant, len(hierarchy))
 	result.parameters = make(map[string]string)
 	result.expressions = make(map[string]string)
+	result.shadowed = make(map[string][]string)
+	result.optionDefs = make(map[string]OptionDefinition)
 
 	result.hostid = make([]pParameterClientMatch, 0)
+	result.statements = make([]pParameterRaw, 0)
+
+	// The level of the declaration that set each option, so that an option
+	// overridden by a deeper level can be told apart from one that was only
+	// repeated within the same declaration.
+	optionLevels := make(map[string]int)
 
 	// walk from globals to pDeclaration collecting all parameters
 	for i := len(hierarchy) - 1; i >= 0; i-- {
 		result.composites = append(result.composites, hierarchy[(len(hierarchy)-1)-i])
 		result.id = append(result.id, hierarchy[(len(hierarchy)-1)-i].id)
+		result.scopedGrants[i] = make(map[string]Grant)
 
 		// update configDeclaration parameters
 		for _, p := range hierarchy[i].parameters {
 			switch p := p.(type) {
 			case pParameterOption:
+				if previous, ok := result.options[p.name]; ok && previous != p.value && optionLevels[p.name] != i {
+					result.shadowed[p.name] = append(result.shadowed[p.name], previous)
+				}
 				result.options[p.name] = p.value
+				optionLevels[p.name] = i
+			case pParameterOptionDef:
+				result.optionDefs[p.name] = OptionDefinition{Name: p.name, Code: p.code, Type: p.dataType}
 			case pParameterGrant:
-				Grant := map[string]grant{"ignore": IGNORE, "allow": ALLOW, "deny": DENY}
-				result.grants[p.attribute] = Grant[p.verb]
+				verbs := map[string]Grant{"ignore": IGNORE, "allow": ALLOW, "deny": DENY}
+				result.grants[p.attribute] = verbs[p.verb]
+				result.scopedGrants[i][p.attribute] = verbs[p.verb]
 			case pParameterBoolean:
 				result.attributes[p.parameter] = p.truancy
 			case pParameterClientMatch:
@@ -975,6 +1484,12 @@ func createDeclaration(node pDeclaration) ConfigDeclaration {
 				result.expressions[p.parameter] = p.expression
 			case pParameterOther:
 				result.parameters[p.parameter] = p.value
+			case pParameterRaw:
+				// Raw statements belong only to the declaration that contains
+				// them, so they aren't inherited by any of its children.
+				if i == 0 {
+					result.statements = append(result.statements, p)
+				}
 			default:
 				result.address = append(result.address, p)
 			}
@@ -1000,20 +1515,25 @@ func (e *ConfigDeclaration) repr() string {
 		result = append(result, fmt.Sprintf("address : %v", strings.Join(res, ",")))
 	}
 
+	// The maps are rendered with their keys sorted, so that the result is the
+	// same every time.
 	if len(e.options) > 0 {
-		result = append(result, fmt.Sprintf("options : %v", e.options))
+		result = append(result, fmt.Sprintf("options : %s", reprSortedMap(e.options)))
+	}
+	if len(e.optionDefs) > 0 {
+		result = append(result, fmt.Sprintf("option-definitions : %s", reprSortedMap(e.optionDefs)))
 	}
 	if len(e.grants) > 0 {
-		result = append(result, fmt.Sprintf("grants : %v", e.grants))
+		result = append(result, fmt.Sprintf("grants : %s", reprSortedMap(e.grants)))
 	}
 	if len(e.attributes) > 0 {
-		result = append(result, fmt.Sprintf("attributes : %v", e.attributes))
+		result = append(result, fmt.Sprintf("attributes : %s", reprSortedMap(e.attributes)))
 	}
 	if len(e.parameters) > 0 {
-		result = append(result, fmt.Sprintf("parameters : %v", e.parameters))
+		result = append(result, fmt.Sprintf("parameters : %s", reprSortedMap(e.parameters)))
 	}
 	if len(e.expressions) > 0 {
-		result = append(result, fmt.Sprintf("parameter-expressions : %v", e.expressions))
+		result = append(result, fmt.Sprintf("parameter-expressions : %s", reprSortedMap(e.expressions)))
 	}
 
 	if len(e.hostid) > 0 {
@@ -1024,10 +1544,111 @@ func (e *ConfigDeclaration) repr() string {
 		result = append(result, fmt.Sprintf("hostid : %v", strings.Join(res, " ")))
 	}
 
+	if len(e.statements) > 0 {
+		res := make([]string, 0)
+		for _, v := range e.statements {
+			res = append(res, v.repr())
+		}
+		result = append(result, fmt.Sprintf("statements : %v", strings.Join(res, ",")))
+	}
+
 	return strings.Join(result, "\n") + "\n"
 }
 
-func (e *ConfigDeclaration) IP4() (net.IP, error) {
+// reprSortedMap renders a map like the `%v` verb, as `map[key:value ...]`,
+// with its keys in sorted order.
+func reprSortedMap[V any](m map[string]V) string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	res := make([]string, 0, len(keys))
+	for _, key := range keys {
+		res = append(res, fmt.Sprintf("%s:%v", key, m[key]))
+	}
+	return "map[" + strings.Join(res, " ") + "]"
+}
+
+// signature describes everything that a declaration resolves to, in a form
+// that doesn't depend on the order in which it was written.
+func (e *ConfigDeclaration) signature() string {
+	res := make([]string, 0, len(e.address))
+	for _, v := range e.address {
+		res = append(res, v.repr())
+	}
+	sort.Strings(res)
+
+	sorted := *e
+	sorted.address = nil
+	return sorted.repr() + strings.Join(res, ",")
+}
+
+// ClientMatch is a host-identifier statement, which matches a client by the
+// value of an option that it sends.
+type ClientMatch struct {
+	Option string
+	Data   string
+}
+
+// HostIdentifiers returns the host-identifier statements of the declaration.
+// The data is unquoted if it was a quoted string.
+func (e *ConfigDeclaration) HostIdentifiers() []ClientMatch {
+	result := make([]ClientMatch, 0, len(e.hostid))
+	for _, v := range e.hostid {
+		result = append(result, ClientMatch{Option: v.name, Data: unquoteDhcpString(v.data)})
+	}
+	return result
+}
+
+// LocalOptions returns the options that are set on the declaration itself,
+// excluding any that are only inherited from its enclosing declarations.
+func (e *ConfigDeclaration) LocalOptions() map[string]string {
+	result := make(map[string]string)
+	for _, p := range e.composites[0].parameters {
+		if option, ok := p.(pParameterOption); ok {
+			result[option.name] = option.value
+		}
+	}
+	return result
+}
+
+// LocalParameters returns the parameters that are set on the declaration
+// itself, excluding any that are only inherited from its enclosing
+// declarations.
+func (e *ConfigDeclaration) LocalParameters() map[string]string {
+	result := make(map[string]string)
+	for _, p := range e.composites[0].parameters {
+		if other, ok := p.(pParameterOther); ok {
+			result[other.parameter] = other.value
+		}
+	}
+	return result
+}
+
+// Statements returns the uninterpreted statements contained directly within
+// the declaration, such as those of an `on commit` event. Each statement is
+// rebuilt from its tokens joined by a single space.
+func (e *ConfigDeclaration) Statements() []string {
+	result := make([]string, 0, len(e.statements))
+	for _, v := range e.statements {
+		result = append(result, strings.Join(append([]string{v.name}, v.operand...), " "))
+	}
+	return result
+}
+
+// Condition returns the condition of a branch of an `if` statement, and
+// whether the declaration is such a branch. The condition isn't evaluated,
+// and is empty for an `else` branch.
+func (e *ConfigDeclaration) Condition() (string, bool) {
+	conditional, ok := e.id[0].(pDeclarationConditional)
+	return conditional.condition, ok
+}
+
+// fixedAddress4 returns the single IPv4 fixed-address operand of the
+// declaration without attempting to resolve it.
+func (e *ConfigDeclaration) fixedAddress4() (string, error) {
 	var result []string
 
 	for _, entry := range e.address {
@@ -1040,27 +1661,36 @@ func (e *ConfigDeclaration) IP4() (net.IP, error) {
 	}
 
 	if len(result) > 1 {
-		return nil, fmt.Errorf("more than one ipv4 address returned : %v", result)
+		return "", fmt.Errorf("more than one ipv4 address returned : %v", result)
 
 	} else if len(result) == 0 {
-		return nil, errors.New("no IPv4 address found")
-	}
-
-	// Try and parse it as an IP4. If so, then it's good to return it as-is.
-	if res := net.ParseIP(result[0]); res != nil {
-		return res, nil
+		return "", errors.New("no IPv4 address found")
 	}
+	return result[0], nil
+}
 
-	// Otherwise make an attempt to resolve it to an address.
-	res, err := net.ResolveIPAddr("ip4", result[0])
-	if err != nil {
-		return nil, err
+// FixedAddressSpec returns the fixed-address operands of the declaration as
+// written, which may be literal addresses or hostnames. Unlike IP4, nothing is
+// resolved, so callers can decide when to do so.
+func (e *ConfigDeclaration) FixedAddressSpec() []string {
+	result := make([]string, 0)
+	for _, entry := range e.address {
+		if v, ok := entry.(pParameterAddress4); ok {
+			for _, operand := range v {
+				for _, address := range strings.Split(operand, ",") {
+					if address = strings.TrimSpace(address); address != "" {
+						result = append(result, address)
+					}
+				}
+			}
+		}
 	}
-
-	return res.IP, nil
+	return result
 }
 
-func (e *ConfigDeclaration) IP6() (net.IP, error) {
+// fixedAddress6 returns the single IPv6 fixed-address operand of the
+// declaration without attempting to resolve it.
+func (e *ConfigDeclaration) fixedAddress6() (string, error) {
 	var result []string
 
 	for _, entry := range e.address {
@@ -1073,809 +1703,3300 @@ func (e *ConfigDeclaration) IP6() (net.IP, error) {
 	}
 
 	if len(result) > 1 {
-		return nil, fmt.Errorf("more than one ipv6 address returned : %v", result)
+		return "", fmt.Errorf("more than one ipv6 address returned : %v", result)
 
 	} else if len(result) == 0 {
-		return nil, errors.New("no IPv6 address found")
+		return "", errors.New("no IPv6 address found")
 	}
+	return result[0], nil
+}
 
-	// If we were able to parse it into an IP, then we can just return it.
-	if res := net.ParseIP(result[0]); res != nil {
-		return res, nil
-	}
+// DhcpKey represents a TSIG key declared for dynamic DNS updates.
+type DhcpKey struct {
+	Name      string
+	Algorithm string
+	Secret    string
+}
+
+// String returns a representation of the key with its secret redacted.
+func (k DhcpKey) String() string {
+	return fmt.Sprintf("key %s (algorithm %s, secret %s)", k.Name, k.Algorithm, redactedDhcpSecret)
+}
+
+// GoString returns a representation of the key with its secret redacted.
+func (k DhcpKey) GoString() string {
+	return fmt.Sprintf("DhcpKey{Name:%q, Algorithm:%q, Secret:%q}", k.Name, k.Algorithm, redactedDhcpSecret)
+}
+
+// Key returns the TSIG key for a key declaration.
+func (e *ConfigDeclaration) Key() (DhcpKey, error) {
+	key, ok := e.id[0].(pDeclarationKey)
+	if !ok {
+		return DhcpKey{}, fmt.Errorf("declaration is not a key : %s", e.id[0].repr())
+	}
+	result := DhcpKey{Name: key.name, Algorithm: key.algorithm}
+	if key.secret != nil {
+		result.Secret = *key.secret
+	}
+	return result, nil
+}
+
+// IP4 returns the IPv4 fixed-address of the declaration. If the operand is
+// not a literal address, then it is resolved using DNS.
+func (e *ConfigDeclaration) IP4() (net.IP, error) {
+	address, err := e.fixedAddress4()
+	if err != nil {
+		return nil, err
+	}
+	return resolveAddress4(address)
+}
+
+// resolveAddress4 parses an IPv4 address, resolving it using DNS if it isn't a
+// literal address.
+func resolveAddress4(address string) (net.IP, error) {
+	// Try and parse it as an IP4. If so, then it's good to return it as-is.
+	if res := net.ParseIP(address); res != nil {
+		return res, nil
+	}
+
+	// Otherwise make an attempt to resolve it to an address.
+	res, err := net.ResolveIPAddr("ip4", address)
+	if err != nil {
+		return nil, err
+	}
 
-	// Otherwise, try to resolve it into an address.
-	res, err := net.ResolveIPAddr("ip6", result[0])
-	if err != nil {
-		return nil, err
-	}
 	return res.IP, nil
 }
 
-func (e *ConfigDeclaration) Hardware() (net.HardwareAddr, error) {
-	var result []pParameterHardware
+// class returns the class that the declaration represents.
+func (e *ConfigDeclaration) class() (pDeclarationClass, error) {
+	class, ok := e.id[0].(pDeclarationClass)
+	if !ok {
+		return pDeclarationClass{}, fmt.Errorf("declaration is not a class : %s", e.id[0].repr())
+	}
+	return class, nil
+}
 
-	for _, addr := range e.address {
-		switch v := addr.(type) {
-		case pParameterHardware:
-			result = append(result, v)
-		}
+// LeaseLimit returns the number of leases that the clients of a class may
+// hold at once, as set by `lease limit`.
+func (e *ConfigDeclaration) LeaseLimit() (int, error) {
+	class, err := e.class()
+	if err != nil {
+		return 0, err
 	}
+	if !class.limited {
+		return 0, fmt.Errorf("no lease limit found for class %s", class.name)
+	}
+	return class.leaseLimit, nil
+}
 
-	if len(result) > 0 {
-		return nil, fmt.Errorf("more than one hardware address returned : %v", result)
+// SpawnWith returns the expression of a class's `spawn with` statement, by
+// whose value dhcpd spawns a subclass for each client, such as
+// `option agent.circuit-id`.
+func (e *ConfigDeclaration) SpawnWith() (string, error) {
+	class, err := e.class()
+	if err != nil {
+		return "", err
+	}
+	if class.spawn == "" {
+		return "", fmt.Errorf("no spawn with found for class %s", class.name)
 	}
+	return class.spawn, nil
+}
 
-	res := make(net.HardwareAddr, 0)
-	for _, by := range result[0].address {
-		res = append(res, by)
+// failover returns the failover peer that the declaration represents.
+func (e *ConfigDeclaration) failover() (pDeclarationFailover, error) {
+	failover, ok := e.id[0].(pDeclarationFailover)
+	if !ok {
+		return pDeclarationFailover{}, fmt.Errorf("declaration is not a failover peer : %s", e.id[0].repr())
+	}
+	return failover, nil
+}
+
+// failoverValue returns a statement of a failover peer, or an error naming it
+// if it wasn't present.
+func (e *ConfigDeclaration) failoverValue(name string, value func(pDeclarationFailover) string) (string, error) {
+	failover, err := e.failover()
+	if err != nil {
+		return "", err
+	}
+	if v := value(failover); v != "" {
+		return v, nil
+	}
+	return "", fmt.Errorf("no %s found for failover peer %s", name, failover.name)
+}
+
+// failoverNumber returns a numeric statement of a failover peer.
+func (e *ConfigDeclaration) failoverNumber(name string, value func(pDeclarationFailover) string) (int, error) {
+	v, err := e.failoverValue(name, value)
+	if err != nil {
+		return 0, err
+	}
+	res, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s for failover peer : %v", name, v)
 	}
 	return res, nil
 }
 
-// DhcpConfiguration represents a list of configuration declarations parsed from a DHCP configuration file.
-type DhcpConfiguration []ConfigDeclaration
+// FailoverRole returns whether a failover peer is the primary or secondary.
+func (e *ConfigDeclaration) FailoverRole() (string, error) {
+	return e.failoverValue("primary or secondary", func(f pDeclarationFailover) string { return f.role })
+}
 
-func ReadDhcpConfiguration(fd *os.File) (DhcpConfiguration, error) {
-	fromfile := consumeFile(fd)
-	uncommented := uncomment(fromfile)
-	tokenized := tokenizeDhcpConfig(uncommented)
+// Address returns the address of this server in a failover peer. If it is not
+// a literal address, then it is resolved using DNS.
+func (e *ConfigDeclaration) Address() (net.IP, error) {
+	address, err := e.failoverValue("address", func(f pDeclarationFailover) string { return f.address })
+	if err != nil {
+		return nil, err
+	}
+	return resolveAddress4(address)
+}
 
-	// Parse the tokenized DHCP configuration into a tree. We need it as a tree
-	// because DHCP declarations can inherit options from their parent
-	parsetree, err := parseDhcpConfig(tokenized)
+// PeerAddress returns the address of the other server in a failover peer. If
+// it is not a literal address, then it is resolved using DNS.
+func (e *ConfigDeclaration) PeerAddress() (net.IP, error) {
+	address, err := e.failoverValue("peer address", func(f pDeclarationFailover) string { return f.peerAddress })
 	if err != nil {
 		return nil, err
 	}
+	return resolveAddress4(address)
+}
 
-	// Flatten the tree into a list of pDeclaration objects. This is responsible
-	// for actually propagating options from the parent pDeclaration into all of
-	// its children.
-	global, err := flattenDhcpConfig(parsetree)
+// Port returns the port of this server in a failover peer.
+func (e *ConfigDeclaration) Port() (int, error) {
+	return e.failoverNumber("port", func(f pDeclarationFailover) string { return f.port })
+}
+
+// PeerPort returns the port of the other server in a failover peer.
+func (e *ConfigDeclaration) PeerPort() (int, error) {
+	return e.failoverNumber("peer port", func(f pDeclarationFailover) string { return f.peerPort })
+}
+
+// MCLT returns the maximum client lead time of a failover peer.
+func (e *ConfigDeclaration) MCLT() (time.Duration, error) {
+	seconds, err := e.failoverNumber("mclt", func(f pDeclarationFailover) string { return f.mclt })
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// IP4Literal returns the IPv4 fixed-address of the declaration only if it is
+// a literal address. Unlike IP4, it never performs a DNS lookup.
+func (e *ConfigDeclaration) IP4Literal() (net.IP, error) {
+	address, err := e.fixedAddress4()
 	if err != nil {
 		return nil, err
 	}
 
-	// This closure is just to the goroutine that follows it in recursively
-	// walking through all the declarations and writing them individually to a
-	// channel.
-	var walkDeclarations func(root pDeclaration, out chan *ConfigDeclaration)
+	res := net.ParseIP(address)
+	if res == nil || res.To4() == nil {
+		return nil, fmt.Errorf("fixed-address %q is not a literal IPv4 address", address)
+	}
+	return res, nil
+}
 
-	walkDeclarations = func(root pDeclaration, out chan *ConfigDeclaration) {
-		res := createDeclaration(root)
-		out <- &res
-		for _, p := range root.declarations {
-			walkDeclarations(p, out)
-		}
+// IP6 returns the IPv6 fixed-address of the declaration. If the operand is
+// not a literal address, then it is resolved using DNS.
+func (e *ConfigDeclaration) IP6() (net.IP, error) {
+	address, err := e.fixedAddress6()
+	if err != nil {
+		return nil, err
 	}
 
-	// That way this goroutine can take each individual declaration and write
-	// it to a channel.
-	each := make(chan *ConfigDeclaration)
-	go func(out chan *ConfigDeclaration) {
-		walkDeclarations(*global, out)
-		out <- nil
-	}(each)
+	// If we were able to parse it into an IP, then we can just return it.
+	if res := net.ParseIP(address); res != nil {
+		return res, nil
+	}
 
-	// For this loop to convert it into an itemized list.
-	var result DhcpConfiguration
-	for decl := <-each; decl != nil; decl = <-each {
-		result = append(result, *decl)
+	// Otherwise, try to resolve it into an address.
+	res, err := net.ResolveIPAddr("ip6", address)
+	if err != nil {
+		return nil, err
 	}
-	return result, nil
+	return res.IP, nil
 }
 
-func (e *DhcpConfiguration) Global() ConfigDeclaration {
-	result := (*e)[0]
-	if len(result.id) != 1 {
-		panic(fmt.Errorf("unexpected error : %v", result.id))
+// IP6Literal returns the IPv6 fixed-address of the declaration only if it is
+// a literal address. Unlike IP6, it never performs a DNS lookup.
+func (e *ConfigDeclaration) IP6Literal() (net.IP, error) {
+	address, err := e.fixedAddress6()
+	if err != nil {
+		return nil, err
 	}
-	return result
+
+	res := net.ParseIP(address)
+	if res == nil || res.To4() != nil {
+		return nil, fmt.Errorf("fixed-address6 %q is not a literal IPv6 address", address)
+	}
+	return res, nil
 }
 
-func (e *DhcpConfiguration) SubnetByAddress(address net.IP) (ConfigDeclaration, error) {
-	var result []ConfigDeclaration
-	for _, entry := range *e {
-		switch entry.id[0].(type) {
-		case pDeclarationSubnet4:
-			id := entry.id[0].(pDeclarationSubnet4)
-			if id.Contains(address) {
-				result = append(result, entry)
-			}
-		case pDeclarationSubnet6:
-			id := entry.id[0].(pDeclarationSubnet6)
-			if id.Contains(address) {
-				result = append(result, entry)
-			}
+func (e *ConfigDeclaration) Hardware() (net.HardwareAddr, error) {
+	var result []pParameterHardware
+
+	for _, addr := range e.address {
+		switch v := addr.(type) {
+		case pParameterHardware:
+			result = append(result, v)
 		}
 	}
+
 	if len(result) == 0 {
-		return ConfigDeclaration{}, fmt.Errorf("no network declarations containing %s found", address.String())
+		return nil, errors.New("no hardware address found")
 	}
 	if len(result) > 1 {
-		return ConfigDeclaration{}, fmt.Errorf("more than one network declaration found : %v", result)
+		return nil, fmt.Errorf("more than one hardware address returned : %v", result)
 	}
-	return result[0], nil
+
+	res := make(net.HardwareAddr, 0)
+	for _, by := range result[0].address {
+		res = append(res, by)
+	}
+	return res, nil
 }
 
-func (e *DhcpConfiguration) HostByName(host string) (ConfigDeclaration, error) {
-	var result []ConfigDeclaration
-	for _, entry := range *e {
-		switch entry.id[0].(type) {
-		case pDeclarationHost:
-			id := entry.id[0].(pDeclarationHost)
-			if strings.EqualFold(id.name, host) {
-				result = append(result, entry)
-			}
-		}
+// Grants returns a copy of the grants for the declaration, including those
+// inherited from its enclosing declarations, keyed by their attribute.
+func (e *ConfigDeclaration) Grants() map[string]Grant {
+	result := make(map[string]Grant, len(e.grants))
+	for attribute, grant := range e.grants {
+		result[attribute] = grant
 	}
-	if len(result) == 0 {
-		return ConfigDeclaration{}, fmt.Errorf("no host declarations containing %s found", host)
+	return result
+}
+
+// GrantFor returns the grant for an attribute of the declaration, including
+// one inherited from an enclosing declaration, and whether it was present.
+func (e *ConfigDeclaration) GrantFor(attribute string) (Grant, bool) {
+	if _, ok := knownGrantAttributes[strings.ToLower(attribute)]; ok {
+		attribute = strings.ToLower(attribute)
 	}
-	if len(result) > 1 {
-		return ConfigDeclaration{}, fmt.Errorf("more than one host declaration found : %v", result)
+	grant, ok := e.grants[attribute]
+	return grant, ok
+}
+
+// LocalGrants returns the grants that are declared by the declaration itself,
+// such as the grants of a pool, excluding any from its enclosing declarations.
+func (e *ConfigDeclaration) LocalGrants() map[string]Grant {
+	return e.ScopeGrants(0)
+}
+
+// ScopeGrants returns the grants that are declared at a single level of the
+// declaration's composites, where 0 is the declaration itself, 1 is the
+// declaration enclosing it, and so on. Nothing is returned for a level that
+// doesn't exist.
+func (e *ConfigDeclaration) ScopeGrants(level int) map[string]Grant {
+	result := make(map[string]Grant)
+	if level < 0 || level >= len(e.scopedGrants) {
+		return result
 	}
-	return result[0], nil
+	for attribute, grant := range e.scopedGrants[level] {
+		result[attribute] = grant
+	}
+	return result
 }
 
-// NetworkMap represents a collection of configurations, where each configuration is a map of string key-value pairs.
-type NetworkMap []map[string]string
+// LeaseQueryGrant returns the grant for leasequery, and whether it was present.
+func (e *ConfigDeclaration) LeaseQueryGrant() (Grant, bool) {
+	return e.GrantFor(GrantAttributeLeaseQuery)
+}
 
-type NetworkNameMapper interface {
-	NameIntoDevices(string) ([]string, error)
-	DeviceIntoName(string) (string, error)
+// ClientUpdatesGrant returns the grant for client-updates, and whether it was
+// present.
+func (e *ConfigDeclaration) ClientUpdatesGrant() (Grant, bool) {
+	return e.GrantFor(GrantAttributeClientUpdates)
 }
 
-func ReadNetworkMap(fd *os.File) (NetworkMap, error) {
-	fromfile := consumeFile(fd)
-	uncommented := uncomment(fromfile)
-	tokenized := tokenizeNetworkMapConfig(uncommented)
+// DynamicBootpClientsGrant returns the grant for dynamic-bootp-clients, and
+// whether it was present.
+func (e *ConfigDeclaration) DynamicBootpClientsGrant() (Grant, bool) {
+	return e.GrantFor(GrantAttributeDynamicBootpClients)
+}
 
-	// Now that we've tokenized the network map, we just need to parse it into
-	// a list of maps.
-	result, err := parseNetworkMapConfig(tokenized)
-	if err != nil {
-		return nil, err
+// RangeContains returns whether the address falls within one of the ranges of
+// the declaration.
+func (e *ConfigDeclaration) RangeContains(ip net.IP) bool {
+	for _, entry := range e.address {
+		switch v := entry.(type) {
+		case pParameterRange4:
+			if ipInRange(ip, v.min, v.max) {
+				return true
+			}
+		case pParameterRange6:
+			if ipInRange(ip, v.min, v.max) {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	return result, nil
+// IPRange is an inclusive range of addresses declared by a range or range6
+// statement. Bootp is set when the range also serves dynamic BOOTP clients.
+type IPRange struct {
+	Min   net.IP
+	Max   net.IP
+	Bootp bool
+
+	singleton bool
 }
 
-func (e NetworkMap) NameIntoDevices(name string) ([]string, error) {
-	var devices []string
+// IsSingleton returns whether the range was declared with a single address,
+// such as `range 10.0.0.5;`, rather than with a minimum and maximum that
+// happen to be equal.
+func (r IPRange) IsSingleton() bool {
+	return r.singleton
+}
 
-	for _, val := range e {
-		if strings.EqualFold(val["name"], name) {
-			devices = append(devices, val["device"])
+// Ranges returns the ranges of the declaration in the order that they were
+// declared, which is the order that dhcpd prefers when allocating. Ranges
+// inherited from an enclosing declaration come first.
+func (e *ConfigDeclaration) Ranges() []IPRange {
+	result := make([]IPRange, 0)
+	for _, entry := range e.address {
+		switch v := entry.(type) {
+		case pParameterRange4:
+			result = append(result, IPRange{Min: v.min, Max: v.max, Bootp: v.bootp, singleton: v.singleton})
+		case pParameterRange6:
+			result = append(result, IPRange{Min: v.min, Max: v.max, singleton: v.singleton})
 		}
 	}
+	return result
+}
 
-	if len(devices) > 0 {
-		return devices, nil
+// Serves returns whether the declaration would serve the address, meaning
+// that it falls within one of its ranges and clients aren't denied. If not,
+// then the reason is also returned.
+func (e *ConfigDeclaration) Serves(ip net.IP) (bool, string) {
+	if !e.RangeContains(ip) {
+		return false, fmt.Sprintf("address %s is outside of every range", ip)
 	}
 
-	return make([]string, 0), fmt.Errorf("error finding network name : %v", name)
-}
-func (e NetworkMap) DeviceIntoName(device string) (string, error) {
-	for _, val := range e {
-		if strings.EqualFold(val["device"], device) {
-			return val["name"], nil
+	for _, attribute := range []string{"all clients", "booting"} {
+		if grant, ok := e.grants[attribute]; ok && grant != ALLOW {
+			return false, fmt.Sprintf("address %s is in range but %s is denied", ip, attribute)
 		}
 	}
-
-	return "", fmt.Errorf("error finding device name : %v", device)
+	return true, ""
 }
-func (e *NetworkMap) repr() string {
-	var result []string
 
-	for idx, val := range *e {
-		result = append(result, fmt.Sprintf("network%d.name = \"%s\"", idx, val["name"]))
-		result = append(result, fmt.Sprintf("network%d.device = \"%s\"", idx, val["device"]))
+// FreeAddresses returns up to limit addresses within the ranges of the
+// declaration that aren't held by an active lease at the given time, in the
+// order that dhcpd would allocate them. A limit is required, since a range can
+// hold far more addresses than could reasonably be returned.
+func (e *ConfigDeclaration) FreeAddresses(leases []DhcpLeaseEntry, now time.Time, limit int) ([]net.IP, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid limit %d, expected a positive number of addresses", limit)
 	}
 
-	return strings.Join(result, "\n")
-}
+	ranges := e.Ranges()
+	if len(ranges) == 0 {
+		return nil, errors.New("no ranges found")
+	}
 
-/*** parser for VMware Fusion's networking file */
-func tokenizeNetworkingConfig(in chan byte) chan string {
-	var state string
-	var repeatNewline bool
+	held := make(map[string]bool)
+	for _, lease := range leases {
+		if ip := net.ParseIP(lease.address); ip != nil && lease.Active(now) {
+			held[ip.To16().String()] = true
+		}
+	}
 
-	out := make(chan string)
-	go func(out chan string) {
-		for {
-			by, ok := <-in
-			if !ok {
-				break
+	result := make([]net.IP, 0)
+	for _, r := range ranges {
+		min, max := r.Min.To16(), r.Max.To16()
+		if min == nil || max == nil {
+			continue
+		}
+
+		for ip := min; ip != nil && bytes.Compare(ip, max) <= 0; ip = nextIP(ip) {
+			if held[ip.String()] {
+				continue
+			}
+			if r.Min.To4() != nil {
+				result = append(result, ip.To4())
+			} else {
+				result = append(result, ip)
+			}
+			if len(result) == limit {
+				return result, nil
 			}
+		}
+	}
+	return result, nil
+}
 
-			switch by {
-			case '\t':
-				fallthrough
-			case ' ':
-				// Ignore whitespace.
-				if len(state) == 0 {
-					continue
-				}
-				out <- state
-				state = ""
+// nextIP returns a copy of the address after ip, or nil if ip is the last
+// address.
+func nextIP(ip net.IP) net.IP {
+	next := slices.Clone(ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return nil
+}
 
-			case '\r':
-				// If windows has tampered with our newlines, then we normalize
-				// things by converting its value from 0x0d to 0x0a.
-				fallthrough
-			case '\n':
-				// Newlines can repeat, so this case is responsible for writing
-				// to the chan, and consolidating multiple newlines into a single.
-				if repeatNewline {
-					continue
-				}
-				if len(state) > 0 {
-					out <- state
-				}
-				out <- "\n"
-				state = ""
-				repeatNewline = true
-				continue
+// ipInRange returns whether the address falls between min and max inclusive.
+func ipInRange(ip, min, max net.IP) bool {
+	ip, min, max = ip.To16(), min.To16(), max.To16()
+	if ip == nil || min == nil || max == nil {
+		return false
+	}
+	return bytes.Compare(ip, min) >= 0 && bytes.Compare(ip, max) <= 0
+}
 
-			default:
-				// Anything other bytes just need to be aggregated into a string.
-				state += string(by)
-			}
-			repeatNewline = false
-		}
+// ShadowedOptions returns the options of the declaration that were set to a
+// different value by an enclosing declaration, such as the global one, and
+// then overridden. The overridden values of each option are listed from the
+// outermost declaration inwards, and its effective value is given by Option.
+func (e *ConfigDeclaration) ShadowedOptions() map[string][]string {
+	result := make(map[string][]string, len(e.shadowed))
+	for name, values := range e.shadowed {
+		result[name] = slices.Clone(values)
+	}
+	return result
+}
 
-		// If there's anything left in our state after the chan has been closed,
-		// then the input just wasn't terminated properly. It's still valid, so
-		// write we have to the channel.
-		if len(state) > 0 {
-			out <- state
-		}
-		close(out)
-	}(out)
-	return out
+// OptionDefinition is a custom option that was defined with a code and a type,
+// such as `option my-option code 224 = text;`.
+type OptionDefinition struct {
+	Name string
+	Code int
+	Type string
 }
 
-func splitNetworkingConfig(in chan string) chan []string {
-	out := make(chan []string)
+// OptionDefinition returns the definition of a custom option, including one
+// inherited from an enclosing declaration, and whether it was defined. This is
+// separate from any value that the option is assigned, which is returned by
+// Option.
+func (e *ConfigDeclaration) OptionDefinition(name string) (OptionDefinition, bool) {
+	definition, ok := e.optionDefs[name]
+	return definition, ok
+}
 
-	// This goroutine is simple in that it takes a chan of tokens, and splits
-	// them across the newlines.
+// OptionDefinitions returns the definitions of the custom options, ordered by
+// name.
+func (e *ConfigDeclaration) OptionDefinitions() []OptionDefinition {
+	names := make([]string, 0, len(e.optionDefs))
+	for name := range e.optionDefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	go func(out chan []string) {
-		row := make([]string, 0)
-		for {
-			tk, ok := <-in
-			if !ok {
-				break
-			}
+	result := make([]OptionDefinition, 0, len(names))
+	for _, name := range names {
+		result = append(result, e.optionDefs[name])
+	}
+	return result
+}
 
-			if tk == "\n" {
-				// If we received a newline token, then we need to write our
-				// aggregated list of tokens and reset our "splitting" state.
+// Option returns the raw value of an option for the declaration, including
+// one inherited from an enclosing declaration, and whether it was present.
+func (e *ConfigDeclaration) Option(name string) (string, bool) {
+	value, ok := e.options[name]
+	return value, ok
+}
 
-				if len(row) > 0 {
-					out <- row
-				}
+// OptionKind represents the kind of value that an option was detected as.
+type OptionKind int
 
-				row = make([]string, 0)
+const (
+	OptionKindString OptionKind = iota + 1
+	OptionKindInt
+	OptionKindIP
+	OptionKindBool
+	OptionKindIPList
+)
 
-			} else {
-				// Anything else just requires us to aggregate the token into
-				// our list.
-				row = append(row, tk)
-			}
-		}
+func (k OptionKind) String() string {
+	switch k {
+	case OptionKindString:
+		return "string"
+	case OptionKindInt:
+		return "int"
+	case OptionKindIP:
+		return "ip"
+	case OptionKindBool:
+		return "bool"
+	case OptionKindIPList:
+		return "iplist"
+	}
+	return fmt.Sprintf("unknown kind %d", int(k))
+}
 
-		if len(row) > 0 {
-			out <- row
+// The kinds of the values of well-known options. Any other option has its
+// kind detected from the shape of its value.
+var optionKinds = map[string]OptionKind{
+	"domain-name":          OptionKindString,
+	"domain-search":        OptionKindString,
+	"host-name":            OptionKindString,
+	"netbios-scope":        OptionKindString,
+	"time-offset":          OptionKindInt,
+	"interface-mtu":        OptionKindInt,
+	"default-ip-ttl":       OptionKindInt,
+	"dhcp-lease-time":      OptionKindInt,
+	"ip-forwarding":        OptionKindBool,
+	"all-subnets-local":    OptionKindBool,
+	"subnet-mask":          OptionKindIP,
+	"broadcast-address":    OptionKindIP,
+	"routers":              OptionKindIPList,
+	"domain-name-servers":  OptionKindIPList,
+	"ntp-servers":          OptionKindIPList,
+	"netbios-name-servers": OptionKindIPList,
+}
+
+// OptionVal represents the value of an option, along with the kind that it
+// was detected as.
+type OptionVal struct {
+	Kind OptionKind
+	Raw  string
+
+	str     string
+	integer int64
+	boolean bool
+	ips     []net.IP
+}
+
+// Str returns the value of a string option, without any quotes.
+func (v OptionVal) Str() (string, error) {
+	if v.Kind != OptionKindString {
+		return "", fmt.Errorf("option value %s is not a string", v.Raw)
+	}
+	return v.str, nil
+}
+
+// Strs returns the values of a string option that is a comma-separated list,
+// such as domain-search, each without any quotes. A single value is returned
+// as a list of one.
+func (v OptionVal) Strs() ([]string, error) {
+	if v.Kind != OptionKindString {
+		return nil, fmt.Errorf("option value %s is not a string", v.Raw)
+	}
+
+	var result []string
+	var current strings.Builder
+	quote := false
+	for _, by := range []byte(v.Raw) {
+		switch {
+		case by == '"':
+			quote = !quote
+		case by == ',' && !quote:
+			result = append(result, unquoteDhcpString(strings.TrimSpace(current.String())))
+			current.Reset()
+			continue
 		}
-		close(out)
-	}(out)
-	return out
+		current.WriteByte(by)
+	}
+	if quote {
+		return nil, fmt.Errorf("unterminated quote in option value %s", v.Raw)
+	}
+	return append(result, unquoteDhcpString(strings.TrimSpace(current.String()))), nil
 }
 
-// All token types in networking file.
-// VERSION token
-type networkingVERSION struct {
-	value string
+// Int returns the value of an integer option.
+func (v OptionVal) Int() (int64, error) {
+	if v.Kind != OptionKindInt {
+		return 0, fmt.Errorf("option value %s is not an integer", v.Raw)
+	}
+	return v.integer, nil
 }
 
-func networkingReadVersion(row []string) (*networkingVERSION, error) {
-	if len(row) != 1 {
-		return nil, fmt.Errorf("unexpected format for version : %v", row)
+// Bool returns the value of a boolean option.
+func (v OptionVal) Bool() (bool, error) {
+	if v.Kind != OptionKindBool {
+		return false, fmt.Errorf("option value %s is not a boolean", v.Raw)
 	}
-	res := &networkingVERSION{value: row[0]}
-	if !res.Valid() {
-		return nil, fmt.Errorf("unexpected format for version : %v", row)
+	return v.boolean, nil
+}
+
+// IP returns the value of an address option.
+func (v OptionVal) IP() (net.IP, error) {
+	if v.Kind != OptionKindIP {
+		return nil, fmt.Errorf("option value %s is not an address", v.Raw)
 	}
-	return res, nil
+	return v.ips[0], nil
 }
 
-func (s networkingVERSION) Repr() string {
-	if !s.Valid() {
-		return fmt.Sprintf("VERSION{INVALID=\"%v\"}", s.value)
+// IPs returns the value of an address list option. A single address is
+// returned as a list of one.
+func (v OptionVal) IPs() ([]net.IP, error) {
+	if v.Kind != OptionKindIPList && v.Kind != OptionKindIP {
+		return nil, fmt.Errorf("option value %s is not a list of addresses", v.Raw)
 	}
-	return fmt.Sprintf("VERSION{%f}", s.Number())
+	return append([]net.IP(nil), v.ips...), nil
 }
 
-func (s networkingVERSION) Valid() bool {
-	tokens := strings.SplitN(s.value, "=", 2)
-	if len(tokens) != 2 || tokens[0] != "VERSION" {
-		return false
+// parseOptionIPs parses a comma-separated list of literal addresses.
+func parseOptionIPs(value string) ([]net.IP, bool) {
+	var result []net.IP
+	for _, field := range strings.Split(value, ",") {
+		ip := net.ParseIP(strings.TrimSpace(field))
+		if ip == nil {
+			return nil, false
+		}
+		result = append(result, ip)
 	}
+	return result, true
+}
 
-	tokens = strings.Split(tokens[1], ",")
-	if len(tokens) != 2 {
-		return false
+// parseOptionBool parses the ways that dhcpd allows a flag to be written.
+func parseOptionBool(value string) (bool, bool) {
+	switch strings.ToLower(value) {
+	case "true", "on":
+		return true, true
+	case "false", "off":
+		return false, true
 	}
+	return false, false
+}
 
-	for _, t := range tokens {
-		_, err := strconv.ParseUint(t, 10, 64)
+// parseOptionValue converts the raw value of an option into the given kind.
+func parseOptionValue(value string, kind OptionKind) (OptionVal, error) {
+	result := OptionVal{Kind: kind, Raw: value}
+	switch kind {
+	case OptionKindString:
+		result.str = value
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			result.str = unquoted
+		}
+	case OptionKindInt:
+		n, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
-			return false
+			return OptionVal{}, fmt.Errorf("unparseable integer : %v", value)
 		}
+		result.integer = n
+	case OptionKindBool:
+		b, ok := parseOptionBool(value)
+		if !ok {
+			return OptionVal{}, fmt.Errorf("unparseable boolean : %v", value)
+		}
+		result.boolean = b
+	case OptionKindIP, OptionKindIPList:
+		ips, ok := parseOptionIPs(value)
+		if !ok || (kind == OptionKindIP && len(ips) != 1) {
+			return OptionVal{}, fmt.Errorf("unparseable address : %v", value)
+		}
+		result.ips = ips
 	}
-	return true
+	return result, nil
 }
 
-func (s networkingVERSION) Number() float64 {
-	var result float64
-	tokens := strings.SplitN(s.value, "=", 2)
-	tokens = strings.Split(tokens[1], ",")
+// OptionValue returns the value of an option for the declaration, including
+// one inherited from an enclosing declaration. The kind of the value is known
+// for well-known options, and otherwise detected from the shape of the value.
+func (e *ConfigDeclaration) OptionValue(name string) (OptionVal, error) {
+	value, ok := e.options[name]
+	if !ok {
+		return OptionVal{}, fmt.Errorf("no %s option found", name)
+	}
 
-	integer, err := strconv.ParseUint(tokens[0], 10, 64)
-	if err != nil {
-		integer = 0
+	if kind, ok := optionKinds[name]; ok {
+		res, err := parseOptionValue(value, kind)
+		if err != nil {
+			return OptionVal{}, fmt.Errorf("option %s has an %s", name, err)
+		}
+		return res, nil
 	}
-	result = float64(integer)
 
-	mantissa, err := strconv.ParseUint(tokens[1], 10, 64)
+	if strings.HasPrefix(value, "\"") {
+		return parseOptionValue(value, OptionKindString)
+	}
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return parseOptionValue(value, OptionKindInt)
+	}
+	if _, ok := parseOptionBool(value); ok {
+		return parseOptionValue(value, OptionKindBool)
+	}
+	if ips, ok := parseOptionIPs(value); ok {
+		if len(ips) == 1 {
+			return parseOptionValue(value, OptionKindIP)
+		}
+		return parseOptionValue(value, OptionKindIPList)
+	}
+	return parseOptionValue(value, OptionKindString)
+}
+
+// ServerIdentifier returns the address of the server-identifier option for
+// the declaration, including one inherited from an enclosing declaration. The
+// address is resolved using DNS if it isn't a literal address.
+func (e *ConfigDeclaration) ServerIdentifier() (net.IP, error) {
+	value, ok := e.options["server-identifier"]
+	if !ok {
+		return nil, errors.New("no server-identifier option found")
+	}
+
+	res, err := resolveAddress4(value)
 	if err != nil {
-		return result
+		return nil, fmt.Errorf("unable to resolve server-identifier %s: %w", value, err)
 	}
-	denomination := math.Pow(10.0, float64(len(tokens[1])))
-	return result + (float64(mantissa) / denomination)
+	return res, nil
 }
 
-// VNET_X token
-type networkingVNET struct {
-	value string
+// Route is a classless static route, as given by the classless-static-routes
+// option.
+type Route struct {
+	Dest    net.IPNet
+	Gateway net.IP
 }
 
-func (s networkingVNET) Valid() bool {
-	tokens := strings.SplitN(s.value, "_", 3)
-	if len(tokens) != 3 || tokens[0] != "VNET" {
-		return false
+// ClasslessStaticRoutes returns the routes of the classless-static-routes
+// option (option 121) for the declaration, including one inherited from an
+// enclosing declaration. The option is commonly defined under the name
+// rfc3442-classless-static-routes, so that name is also accepted.
+//
+// The value can be given in the dotted form, where each comma-separated route
+// is a destination descriptor such as `24.192.168.1` followed by its gateway,
+// or in the encoded form as a list of octets, either comma-separated decimal
+// or colon-separated hexadecimal.
+func (e *ConfigDeclaration) ClasslessStaticRoutes() ([]Route, error) {
+	value, ok := e.options["classless-static-routes"]
+	if !ok {
+		value, ok = e.options["rfc3442-classless-static-routes"]
+	}
+	if !ok {
+		return nil, errors.New("no classless-static-routes option found")
+	}
+	return parseClasslessStaticRoutes(value)
+}
+
+// parseClasslessStaticRoutes parses the value of a classless-static-routes
+// option in either its dotted or its encoded form.
+func parseClasslessStaticRoutes(value string) ([]Route, error) {
+	fields := strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(fields) == 0 {
+		return nil, errors.New("empty classless-static-routes")
 	}
-	_, err := strconv.ParseUint(tokens[1], 10, 64)
-	return strings.ToUpper(s.value) == s.value && err == nil
+
+	// A single field of colon-separated octets is the encoded form in hex.
+	if len(fields) == 1 && strings.Contains(fields[0], ":") {
+		var octets []byte
+		for _, field := range strings.Split(fields[0], ":") {
+			n, err := strconv.ParseUint(field, 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("unparseable octet %q in classless-static-routes : %v", field, value)
+			}
+			octets = append(octets, byte(n))
+		}
+		return decodeClasslessStaticRoutes(octets)
+	}
+
+	// If every field is a decimal octet, then this is the encoded form.
+	var octets []byte
+	for _, field := range fields {
+		n, err := strconv.ParseUint(field, 10, 8)
+		if err != nil {
+			octets = nil
+			break
+		}
+		octets = append(octets, byte(n))
+	}
+	if octets != nil {
+		return decodeClasslessStaticRoutes(octets)
+	}
+
+	// Otherwise, each comma-separated entry is a descriptor and a gateway.
+	var result []Route
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("expected a destination and a gateway in classless-static-routes, got %q", strings.TrimSpace(entry))
+		}
+
+		var descriptor []byte
+		for _, field := range strings.Split(fields[0], ".") {
+			n, err := strconv.ParseUint(field, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("unparseable destination %q in classless-static-routes", fields[0])
+			}
+			descriptor = append(descriptor, byte(n))
+		}
+
+		gateway := net.ParseIP(fields[1]).To4()
+		if gateway == nil {
+			return nil, fmt.Errorf("unparseable gateway %q in classless-static-routes", fields[1])
+		}
+
+		width, significant := int(descriptor[0]), descriptor[1:]
+		if width > 32 || len(significant) != (width+7)/8 {
+			return nil, fmt.Errorf("invalid destination %q in classless-static-routes, expected %d significant octets", fields[0], (width+7)/8)
+		}
+		route, err := newClasslessRoute(width, significant, gateway)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, route)
+	}
+	return result, nil
 }
 
-func (s networkingVNET) Number() int {
-	tokens := strings.SplitN(s.value, "_", 3)
-	res, err := strconv.Atoi(tokens[1])
-	if err != nil {
-		return ^0
+// decodeClasslessStaticRoutes decodes the octets of the encoded form, where
+// each route is the width of its destination, the significant octets of the
+// destination, and then the four octets of its gateway.
+func decodeClasslessStaticRoutes(octets []byte) ([]Route, error) {
+	var result []Route
+	for i := 0; i < len(octets); {
+		width := int(octets[i])
+		if width > 32 {
+			return nil, fmt.Errorf("invalid destination width %d at octet %d of classless-static-routes", width, i)
+		}
+
+		n := (width + 7) / 8
+		if i+1+n+net.IPv4len > len(octets) {
+			return nil, fmt.Errorf("truncated route at octet %d of classless-static-routes", i)
+		}
+		significant := octets[i+1 : i+1+n]
+		gateway := net.IP(slices.Clone(octets[i+1+n : i+1+n+net.IPv4len]))
+
+		route, err := newClasslessRoute(width, significant, gateway)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, route)
+		i += 1 + n + net.IPv4len
 	}
-	return res
+	return result, nil
 }
 
-func (s networkingVNET) Option() string {
-	tokens := strings.SplitN(s.value, "_", 3)
-	if len(tokens) == 3 {
-		return tokens[2]
+// newClasslessRoute creates a route to a destination of the given width from
+// its significant octets.
+func newClasslessRoute(width int, significant []byte, gateway net.IP) (Route, error) {
+	dest := net.IPNet{IP: make(net.IP, net.IPv4len), Mask: net.CIDRMask(width, 32)}
+	copy(dest.IP, significant)
+	if !dest.IP.Mask(dest.Mask).Equal(dest.IP) {
+		return Route{}, fmt.Errorf("destination %s has bits set outside of its /%d prefix in classless-static-routes", dest.IP, width)
 	}
-	return ""
+	return Route{Dest: dest, Gateway: gateway}, nil
 }
 
-func (s networkingVNET) Repr() string {
-	if !s.Valid() {
-		tokens := strings.SplitN(s.value, "_", 3)
-		return fmt.Sprintf("VNET{INVALID=%v}", tokens)
+// Interface returns the name of the interface that the declaration is bound
+// to by an interface statement, and whether one was present.
+func (e *ConfigDeclaration) Interface() (string, bool) {
+	name, ok := e.parameters["interface"]
+	return name, ok
+}
+
+// DdnsUpdateStyle returns the ddns-update-style of the declaration, such as
+// "interim" or "standard". Dynamic DNS updates are disabled by default, so
+// this is "none" when it isn't set.
+func (e *ConfigDeclaration) DdnsUpdateStyle() string {
+	if style, ok := e.parameters["ddns-update-style"]; ok {
+		return strings.ToLower(style)
 	}
-	return fmt.Sprintf("VNET{%d} %s", s.Number(), s.Option())
+	return "none"
 }
 
-// Interface name
-type networkingInterface struct {
-	name string
+// DdnsDomainName returns the unquoted ddns-domainname of the declaration.
+func (e *ConfigDeclaration) DdnsDomainName() (string, error) {
+	name, ok := e.parameters["ddns-domainname"]
+	if !ok {
+		return "", errors.New("no ddns-domainname found")
+	}
+	return unquoteDhcpString(name), nil
 }
 
-func (s networkingInterface) Interface() (*net.Interface, error) {
-	return net.InterfaceByName(s.name)
+// UpdateStaticLeases returns whether update-static-leases is enabled for the
+// declaration, either with a flag such as `on` or by itself.
+func (e *ConfigDeclaration) UpdateStaticLeases() bool {
+	return e.flag("update-static-leases", false)
 }
 
-// networking command entry types
-type networkingCommandEntryAnswer struct {
-	vnet  networkingVNET
-	value string
+// DenyDuplicates returns whether a client that already holds a lease is denied
+// another, as set by `deny duplicates;` or `ignore duplicates;`. Duplicates
+// are allowed by default.
+func (e *ConfigDeclaration) DenyDuplicates() bool {
+	grant, ok := e.GrantFor(GrantAttributeDuplicates)
+	return ok && grant != ALLOW
 }
-type networkingCommandEntryRemoveAnswer struct {
-	vnet networkingVNET
+
+// OneLeasePerClient returns whether dhcpd frees the other leases of a client
+// when it requests a new one, as set by `one-lease-per-client`.
+func (e *ConfigDeclaration) OneLeasePerClient() bool {
+	return e.flag("one-lease-per-client", false)
 }
-type networkingCommandEntryAddNatPortFwd struct {
-	vnet       int
-	protocol   string
-	port       int
-	targetHost net.IP
-	targetPort int
+
+// AlwaysBroadcast returns whether dhcpd broadcasts its responses regardless
+// of the broadcast flag of the client, as set by `always-broadcast`.
+func (e *ConfigDeclaration) AlwaysBroadcast() bool {
+	return e.flag("always-broadcast", false)
 }
-type networkingCommandEntryRemoveNatPortFwd struct {
-	vnet     int
-	protocol string
-	port     int
+
+// DynamicBootp returns whether addresses may be allocated dynamically to BOOTP
+// clients. Unlike the other flags, this is set with the grant
+// `allow dynamic-bootp-clients;` and is disabled by default.
+func (e *ConfigDeclaration) DynamicBootp() bool {
+	grant, ok := e.DynamicBootpClientsGrant()
+	return ok && grant == ALLOW
 }
-type networkingCommandEntryAddDhcpMacToIp struct {
-	vnet int
-	mac  net.HardwareAddr
-	ip   net.IP
-}
-type networkingCommandEntryRemoveDhcpMacToIp struct {
-	vnet int
-	mac  net.HardwareAddr
-}
-type networkingCommandEntryAddBridgeMapping struct {
-	intf networkingInterface
-	vnet int
+
+// flag returns the value of a statement that takes a flag such as `on` or
+// `false`, or is enabled by itself. If it isn't present, then the default is
+// returned.
+func (e *ConfigDeclaration) flag(name string, def bool) bool {
+	if value, ok := e.parameters[name]; ok {
+		switch strings.ToLower(value) {
+		case "on", "true", "yes":
+			return true
+		}
+		return false
+	}
+	if value, ok := e.attributes[name]; ok {
+		return value
+	}
+	return def
 }
-type networkingCommandEntryRemoveBridgeMapping struct {
-	intf networkingInterface
+
+// LogFacility returns the syslog facility that dhcpd logs to, and whether a
+// log-facility statement was present.
+func (e *ConfigDeclaration) LogFacility() (string, bool) {
+	facility, ok := e.parameters["log-facility"]
+	return facility, ok
 }
-type networkingCommandEntryAddNatPrefix struct {
-	vnet   int
-	prefix int
+
+// PingCheck returns whether dhcpd pings an address before offering it. This
+// is enabled by default.
+func (e *ConfigDeclaration) PingCheck() bool {
+	return e.flag("ping-check", true)
 }
-type networkingCommandEntryRemoveNatPrefix struct {
-	vnet   int
-	prefix int
+
+// PingTimeout returns how long dhcpd waits for a reply to the ping of an
+// address before offering it. This defaults to one second.
+func (e *ConfigDeclaration) PingTimeout() (time.Duration, error) {
+	value, ok := e.parameters["ping-timeout"]
+	if !ok {
+		return time.Second, nil
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid ping-timeout : %v", value)
+	}
+	return time.Duration(seconds) * time.Second, nil
 }
 
-type networkingCommandEntry struct {
-	entry               interface{}
-	answer              *networkingCommandEntryAnswer
-	removeAnswer        *networkingCommandEntryRemoveAnswer
-	addNatPortFwd       *networkingCommandEntryAddNatPortFwd
-	removeNatPortFwd    *networkingCommandEntryRemoveNatPortFwd
-	addDhcpMacToIp      *networkingCommandEntryAddDhcpMacToIp
-	removeDhcpMacToIp   *networkingCommandEntryRemoveDhcpMacToIp
-	addBridgeMapping    *networkingCommandEntryAddBridgeMapping
-	removeBridgeMapping *networkingCommandEntryRemoveBridgeMapping
-	addNatPrefix        *networkingCommandEntryAddNatPrefix
-	removeNatPrefix     *networkingCommandEntryRemoveNatPrefix
+// EffectiveNetmask returns the netmask of a subnet declaration. If the
+// subnet-mask option is also set, then it must agree with the netmask.
+func (e *ConfigDeclaration) EffectiveNetmask() (net.IPMask, error) {
+	subnet, ok := e.id[0].(pDeclarationSubnet4)
+	if !ok {
+		return nil, fmt.Errorf("declaration is not an IPv4 subnet : %s", e.id[0].repr())
+	}
+
+	value, ok := e.options["subnet-mask"]
+	if !ok {
+		return subnet.Mask, nil
+	}
+
+	option := net.ParseIP(value).To4()
+	if option == nil {
+		return nil, fmt.Errorf("unparseable address for option subnet-mask : %v", value)
+	}
+	if !bytes.Equal(option, subnet.Mask) {
+		return nil, fmt.Errorf("option subnet-mask %s disagrees with netmask %s of subnet %s", value, net.IP(subnet.Mask), subnet.IP)
+	}
+	return subnet.Mask, nil
 }
 
-func (e networkingCommandEntry) Name() string {
-	switch e.entry.(type) {
-	case networkingCommandEntryAnswer:
-		return "answer"
-	case networkingCommandEntryRemoveAnswer:
-		return "remove_answer"
-	case networkingCommandEntryAddNatPortFwd:
-		return "add_nat_portfwd"
-	case networkingCommandEntryRemoveNatPortFwd:
-		return "remove_nat_portfwd"
-	case networkingCommandEntryAddDhcpMacToIp:
-		return "add_dhcp_mac_to_ip"
-	case networkingCommandEntryRemoveDhcpMacToIp:
-		return "remove_dhcp_mac_to_ip"
-	case networkingCommandEntryAddBridgeMapping:
-		return "add_bridge_mapping"
-	case networkingCommandEntryRemoveBridgeMapping:
-		return "remove_bridge_mapping"
-	case networkingCommandEntryAddNatPrefix:
-		return "add_nat_prefix"
-	case networkingCommandEntryRemoveNatPrefix:
-		return "remove_nat_prefix"
+// Subnet returns the network of a subnet or subnet6 declaration. The result is
+// a copy, so it can be modified without affecting the declaration.
+func (e *ConfigDeclaration) Subnet() (*net.IPNet, error) {
+	var subnet net.IPNet
+	switch id := e.id[0].(type) {
+	case pDeclarationSubnet4:
+		subnet = id.IPNet
+	case pDeclarationSubnet6:
+		subnet = id.IPNet
+	default:
+		return nil, fmt.Errorf("declaration is not a subnet : %s", e.id[0].repr())
 	}
-	return ""
+	return &net.IPNet{IP: slices.Clone(subnet.IP), Mask: slices.Clone(subnet.Mask)}, nil
 }
 
-func (e networkingCommandEntry) Entry() reflect.Value {
-	this := reflect.ValueOf(e)
-	switch e.entry.(type) {
-	case networkingCommandEntryAnswer:
-		return reflect.Indirect(this.FieldByName("answer"))
-	case networkingCommandEntryRemoveAnswer:
-		return reflect.Indirect(this.FieldByName("remove_answer"))
-	case networkingCommandEntryAddNatPortFwd:
-		return reflect.Indirect(this.FieldByName("add_nat_portfwd"))
-	case networkingCommandEntryRemoveNatPortFwd:
-		return reflect.Indirect(this.FieldByName("remove_nat_portfwd"))
-	case networkingCommandEntryAddDhcpMacToIp:
-		return reflect.Indirect(this.FieldByName("add_dhcp_mac_to_ip"))
-	case networkingCommandEntryRemoveDhcpMacToIp:
-		return reflect.Indirect(this.FieldByName("remove_dhcp_mac_to_ip"))
-	case networkingCommandEntryAddBridgeMapping:
-		return reflect.Indirect(this.FieldByName("add_bridge_mapping"))
-	case networkingCommandEntryRemoveBridgeMapping:
-		return reflect.Indirect(this.FieldByName("remove_bridge_mapping"))
-	case networkingCommandEntryAddNatPrefix:
-		return reflect.Indirect(this.FieldByName("add_nat_prefix"))
-	case networkingCommandEntryRemoveNatPrefix:
-		return reflect.Indirect(this.FieldByName("remove_nat_prefix"))
+// Network returns the network address of a subnet or subnet6 declaration,
+// which is its address with the host bits cleared.
+func (e *ConfigDeclaration) Network() (net.IP, error) {
+	switch id := e.id[0].(type) {
+	case pDeclarationSubnet4:
+		return id.IP.To4().Mask(id.Mask), nil
+	case pDeclarationSubnet6:
+		return id.IP.Mask(id.Mask), nil
 	}
-	return reflect.Value{}
+	return nil, fmt.Errorf("declaration is not a subnet : %s", e.id[0].repr())
 }
 
-func (e networkingCommandEntry) Repr() string {
-	result := make(map[string]interface{})
+// Broadcast returns the broadcast address of a subnet declaration, which is
+// its address with the host bits set. IPv6 has no broadcast address, so an
+// error is returned for a subnet6 declaration.
+func (e *ConfigDeclaration) Broadcast() (net.IP, error) {
+	subnet, ok := e.id[0].(pDeclarationSubnet4)
+	if !ok {
+		return nil, fmt.Errorf("declaration is not an IPv4 subnet : %s", e.id[0].repr())
+	}
 
-	entryN, entry := e.Name(), e.Entry()
-	entryT := entry.Type()
-	for i := 0; i < entry.NumField(); i++ {
-		fld, fldT := entry.Field(i), entryT.Field(i)
-		result[fldT.Name] = fld
+	network, mask := subnet.IP.To4().Mask(subnet.Mask), subnet.Mask
+	result := make(net.IP, len(network))
+	for i := range network {
+		result[i] = network[i] | ^mask[i]
 	}
-	return fmt.Sprintf("%s -> %v", entryN, result)
+	return result, nil
 }
 
-// networking command entry parsers
-func parseNetworkingCommandAnswer(row []string) (*networkingCommandEntry, error) {
-	if len(row) != 2 {
-		return nil, fmt.Errorf("expected %d arguments but received %d", 2, len(row))
+// Router returns the first address of the routers option for the
+// declaration, which is usually the gateway of a host-only subnet. The option
+// may be inherited from an enclosing declaration.
+func (e *ConfigDeclaration) Router() (net.IP, error) {
+	value, ok := e.options["routers"]
+	if !ok {
+		return nil, errors.New("no routers option found")
 	}
 
-	vnet := networkingVNET{value: row[0]}
-	if !vnet.Valid() {
-		return nil, fmt.Errorf("invalid format for VNET")
+	first := strings.TrimSpace(strings.Split(value, ",")[0])
+	res := net.ParseIP(first)
+	if res == nil {
+		return nil, fmt.Errorf("unparseable address for option routers : %v", value)
 	}
-
-	result := networkingCommandEntryAnswer{vnet: vnet, value: row[1]}
-	return &networkingCommandEntry{entry: result, answer: &result}, nil
+	return res, nil
 }
-func parseNetworkingCommandRemoveAnswer(row []string) (*networkingCommandEntry, error) {
-	if len(row) != 1 {
-		return nil, fmt.Errorf("expected %d argument but received %d", 1, len(row))
+
+// DhcpConfiguration represents a list of configuration declarations parsed from a DHCP configuration file.
+// The declarations are in the order that they were written in the file, with
+// the global declaration first and each declaration followed by the ones that
+// it contains. The declarations of an included file take the place of its
+// include statement.
+type DhcpConfiguration []ConfigDeclaration
+
+func ReadDhcpConfiguration(fd *os.File) (DhcpConfiguration, error) {
+	fromfile := consumeFile(fd)
+	uncommented := uncomment(fromfile)
+	tokenized := tokenizeDhcpConfig(uncommented)
+
+	// Parse the tokenized DHCP configuration into a tree. We need it as a tree
+	// because DHCP declarations can inherit options from their parent
+	parsetree, err := parseDhcpConfig(tokenized)
+	if err != nil {
+		return nil, err
 	}
-	vnet := networkingVNET{value: row[0]}
-	if !vnet.Valid() {
-		return nil, fmt.Errorf("invalid format for VNET")
+
+	// Flatten the tree into a list of pDeclaration objects. This is responsible
+	// for actually propagating options from the parent pDeclaration into all of
+	// its children.
+	global, err := flattenDhcpConfig(parsetree)
+	if err != nil {
+		return nil, err
 	}
 
-	result := networkingCommandEntryRemoveAnswer{vnet: vnet}
-	return &networkingCommandEntry{entry: result, removeAnswer: &result}, nil
+	return collectDhcpDeclarations(*global), nil
 }
-func parseNetworkingCommandAddNatPortFwd(row []string) (*networkingCommandEntry, error) {
-	if len(row) != 5 {
-		return nil, fmt.Errorf("expected %d arguments but received %d", 5, len(row))
-	}
 
-	vnet, err := strconv.Atoi(row[0])
+// DhcpIncludeOptions controls how the files named by include statements are
+// resolved when they are followed.
+type DhcpIncludeOptions struct {
+	// ExpandPaths expands a leading `~` to the home directory of the user,
+	// and environment variables such as `$VAR` or `${VAR}`, in the names of
+	// included files.
+	ExpandPaths bool
+}
+
+// dhcpIncludeDepth is the deepest that include statements are followed, which
+// guards against a file that includes itself.
+const dhcpIncludeDepth = 16
+
+// ReadDhcpConfigurationWithIncludes reads a configuration like
+// ReadDhcpConfiguration, but replaces each include statement with the contents
+// of the file that it names. Relative names are resolved against the directory
+// of the file containing the statement.
+func ReadDhcpConfigurationWithIncludes(fd *os.File, options DhcpIncludeOptions) (DhcpConfiguration, error) {
+	parsetree, err := parseDhcpConfig(tokenizeDhcpConfig(uncomment(consumeFile(fd))))
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse first argument as an integer : %v", row[0])
+		return nil, err
 	}
 
-	protocol := strings.ToLower(row[1])
-	if protocol != "tcp" && protocol != "udp" {
-		return nil, fmt.Errorf("expected \"tcp\" or \"udp\" for second argument : %v", row[1])
+	if err := followDhcpIncludes(&parsetree, filepath.Dir(fd.Name()), options, 0); err != nil {
+		return nil, err
 	}
 
-	sport, err := strconv.Atoi(row[2])
+	global, err := flattenDhcpConfig(parsetree)
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse third argument as an integer : %v", row[2])
+		return nil, err
 	}
+	return collectDhcpDeclarations(*global), nil
+}
 
-	dest := net.ParseIP(row[3])
-	if dest == nil {
-		return nil, fmt.Errorf("unable to parse fourth argument as an IPv4 address : %v", row[2])
+// followDhcpIncludes replaces the include statements within a group and its
+// children with the parameters and groups of the files that they name.
+func followDhcpIncludes(node *tkGroup, dir string, options DhcpIncludeOptions, depth int) error {
+	// The groups of an included file have already had their includes
+	// followed, so only the groups declared within this one are walked.
+	for _, group := range node.groups {
+		if err := followDhcpIncludes(group, dir, options, depth); err != nil {
+			return err
+		}
 	}
 
-	dport, err := strconv.Atoi(row[4])
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse fifth argument as an integer : %v", row[4])
-	}
+	params := make([]tkParameter, 0, len(node.params))
+	groups := make([]*tkGroup, 0, len(node.groups))
+	next := 0
+	for _, p := range node.params {
+		if p.name != "include" || len(p.operand) != 1 {
+			params = append(params, p)
+			continue
+		}
 
-	result := networkingCommandEntryAddNatPortFwd{vnet: vnet - 1, protocol: protocol, port: sport, targetHost: dest, targetPort: dport}
-	return &networkingCommandEntry{entry: result, addNatPortFwd: &result}, nil
+		if depth >= dhcpIncludeDepth {
+			return fmt.Errorf("includes nested more than %d deep : %v", dhcpIncludeDepth, p.operand[0])
+		}
+
+		path, err := resolveDhcpInclude(unquoteDhcpString(p.operand[0]), dir, options)
+		if err != nil {
+			return err
+		}
+
+		included, err := readDhcpInclude(path)
+		if err != nil {
+			return fmt.Errorf("error reading included file %s: %w", path, err)
+		}
+		if err := followDhcpIncludes(&included, filepath.Dir(path), options, depth+1); err != nil {
+			return err
+		}
+
+		// The groups of the included file are spliced in where the include
+		// statement was, between the groups that were declared around it.
+		if p.groups > next && p.groups <= len(node.groups) {
+			groups = append(groups, node.groups[next:p.groups]...)
+			next = p.groups
+		}
+		params = append(params, included.params...)
+		for _, group := range included.groups {
+			group.parent = node
+			groups = append(groups, group)
+		}
+	}
+	node.params = params
+	node.groups = append(groups, node.groups[next:]...)
+	return nil
 }
-func parseNetworkingCommandRemoveNatPortFwd(row []string) (*networkingCommandEntry, error) {
-	if len(row) != 3 {
-		return nil, fmt.Errorf("expected %d arguments but received %d", 3, len(row))
+
+// resolveDhcpInclude returns the path of the file named by an include
+// statement, expanding it if requested.
+func resolveDhcpInclude(name string, dir string, options DhcpIncludeOptions) (string, error) {
+	path := name
+	if options.ExpandPaths {
+		if path == "~" || strings.HasPrefix(path, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", fmt.Errorf("unable to expand %s: %w", name, err)
+			}
+			path = filepath.Join(home, path[1:])
+		}
+		path = os.ExpandEnv(path)
 	}
 
-	vnet, err := strconv.Atoi(row[0])
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse first argument as an integer : %v", row[0])
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
 	}
 
-	protocol := strings.ToLower(row[1])
-	if protocol != "tcp" && protocol != "udp" {
-		return nil, fmt.Errorf("expected \"tcp\" or \"udp\" for second argument : %v", row[1])
+	if _, err := os.Stat(path); err != nil {
+		if path != name {
+			return "", fmt.Errorf("included file %s (from %s) does not exist", path, name)
+		}
+		return "", fmt.Errorf("included file %s does not exist", path)
 	}
+	return path, nil
+}
 
-	sport, err := strconv.Atoi(row[2])
+// readDhcpInclude parses an included file into a tree.
+func readDhcpInclude(path string) (tkGroup, error) {
+	fd, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse third argument as an integer : %v", row[2])
+		return tkGroup{}, err
 	}
+	defer fd.Close()
 
-	result := networkingCommandEntryRemoveNatPortFwd{vnet: vnet - 1, protocol: protocol, port: sport}
-	return &networkingCommandEntry{entry: result, removeNatPortFwd: &result}, nil
+	return parseDhcpConfig(tokenizeDhcpConfig(uncomment(consumeFile(fd))))
 }
-func parseNetworkingCommandAddDhcpMacToIp(row []string) (*networkingCommandEntry, error) {
-	if len(row) != 3 {
-		return nil, fmt.Errorf("expected %d arguments but received %d", 3, len(row))
+
+// collectDhcpDeclarations converts a flattened tree into the list of
+// declarations that compose a DhcpConfiguration. The tree is walked depth-first
+// visiting each declaration before its children, which are kept in the order
+// that they were parsed, so the list is in the same order as the source. Any
+// includes have already been spliced into the tree where they were declared.
+func collectDhcpDeclarations(global pDeclaration) DhcpConfiguration {
+
+	// This closure is just to the goroutine that follows it in recursively
+	// walking through all the declarations and writing them individually to a
+	// channel.
+	var walkDeclarations func(root pDeclaration, out chan *ConfigDeclaration)
+
+	walkDeclarations = func(root pDeclaration, out chan *ConfigDeclaration) {
+		res := createDeclaration(root)
+		out <- &res
+		for _, p := range root.declarations {
+			walkDeclarations(p, out)
+		}
 	}
 
-	vnet, err := strconv.Atoi(row[0])
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse first argument as an integer : %v", row[0])
+	// That way this goroutine can take each individual declaration and write
+	// it to a channel.
+	each := make(chan *ConfigDeclaration)
+	go func(out chan *ConfigDeclaration) {
+		walkDeclarations(global, out)
+		out <- nil
+	}(each)
+
+	// For this loop to convert it into an itemized list.
+	var result DhcpConfiguration
+	for decl := <-each; decl != nil; decl = <-each {
+		result = append(result, *decl)
 	}
+	return result
+}
+
+// ValidateDhcpConfiguration parses a DHCP configuration leniently and returns
+// every problem that was found with it, rather than stopping at the first.
+func ValidateDhcpConfiguration(r io.Reader) []error {
+	fromfile := consumeFile(r)
+	uncommented := uncomment(fromfile)
+	tokenized := tokenizeDhcpConfig(uncommented)
 
-	mac, err := net.ParseMAC(row[1])
+	// If the structure of the file itself is broken, then there's nothing
+	// that we can reasonably check.
+	parsetree, err := parseDhcpConfig(tokenized)
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse second argument as hardware address : %v", row[1])
+		// Drain the tokenizer so that its goroutines are able to exit.
+		for range tokenized {
+		}
+		return []error{err}
+	}
+
+	var errs []error
+	global := flattenDhcpConfigLenient(parsetree, &errs)
+
+	config := collectDhcpDeclarations(*global)
+	return append(errs, config.Validate()...)
+}
+
+// Validate checks the declarations of the configuration for semantic problems
+// and returns all that were found.
+func (e DhcpConfiguration) Validate() []error {
+	var errs []error
+	for index := range e {
+		errs = append(errs, e[index].validate()...)
+	}
+	errs = append(errs, e.validateSubnets()...)
+	errs = append(errs, e.validateReservations()...)
+	return errs
+}
+
+// validate checks the parameters defined by the declaration itself, ignoring
+// any that were inherited as those are validated by their own declaration.
+func (e *ConfigDeclaration) validate() []error {
+	var errs []error
+
+	// A subnet must be aligned to its netmask.
+	switch id := e.id[0].(type) {
+	case pDeclarationSubnet4:
+		if !id.IP.Equal(id.IP.Mask(id.Mask)) {
+			errs = append(errs, fmt.Errorf("subnet %s is not aligned to its netmask %s", id.IP, net.IP(id.Mask)))
+		}
+
+		// An unparseable subnet-mask option is reported along with the
+		// other options, so only check one that disagrees.
+		if value, ok := e.options["subnet-mask"]; ok && net.ParseIP(value) != nil {
+			if _, err := e.EffectiveNetmask(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	case pDeclarationSubnet6:
+		if !id.IP.Equal(id.IP.Mask(id.Mask)) {
+			errs = append(errs, fmt.Errorf("subnet6 %s is not aligned to its prefix", id.String()))
+		}
+	}
+
+	// Ranges must fall within the closest enclosing subnet.
+	var subnet *net.IPNet
+	for _, id := range e.id {
+		if v, ok := id.(pDeclarationSubnet4); ok {
+			subnet = &v.IPNet
+			break
+		}
+		if v, ok := id.(pDeclarationSubnet6); ok {
+			subnet = &v.IPNet
+			break
+		}
+	}
+
+	for _, p := range e.composites[0].parameters {
+		switch p := p.(type) {
+		case pParameterRange4:
+			if p.min == nil || p.max == nil {
+				errs = append(errs, fmt.Errorf("unparseable address in %s", p.repr()))
+			} else if subnet != nil && (!subnet.Contains(p.min) || !subnet.Contains(p.max)) {
+				errs = append(errs, fmt.Errorf("%s is outside of subnet %s", p.repr(), subnet))
+			}
+		case pParameterRange6:
+			if p.min == nil || p.max == nil {
+				errs = append(errs, fmt.Errorf("unparseable address in %s", p.repr()))
+			} else if subnet != nil && (!subnet.Contains(p.min) || !subnet.Contains(p.max)) {
+				errs = append(errs, fmt.Errorf("%s is outside of subnet %s", p.repr(), subnet))
+			}
+		case pParameterPrefix6:
+			if p.bits < 0 || p.bits > net.IPv6len*8 {
+				errs = append(errs, fmt.Errorf("prefix6 length /%d is out of range", p.bits))
+			}
+		case pParameterOption:
+			switch p.name {
+			case "subnet-mask", "broadcast-address":
+				if net.ParseIP(p.value) == nil {
+					errs = append(errs, fmt.Errorf("unparseable address for option %s : %v", p.name, p.value))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// validateSubnets checks that no two subnets overlap.
+func (e DhcpConfiguration) validateSubnets() []error {
+	var errs []error
+
+	var subnets []net.IPNet
+	for _, entry := range e {
+		switch id := entry.id[0].(type) {
+		case pDeclarationSubnet4:
+			subnets = append(subnets, id.IPNet)
+		case pDeclarationSubnet6:
+			subnets = append(subnets, id.IPNet)
+		}
+	}
+
+	for i := 0; i < len(subnets); i++ {
+		for j := i + 1; j < len(subnets); j++ {
+			if subnets[i].Contains(subnets[j].IP) || subnets[j].Contains(subnets[i].IP) {
+				errs = append(errs, fmt.Errorf("subnet %s overlaps with subnet %s", subnets[i].String(), subnets[j].String()))
+			}
+		}
+	}
+	return errs
+}
+
+// validateReservations checks that no two hosts share the same hardware
+// address or fixed-address.
+func (e DhcpConfiguration) validateReservations() []error {
+	var errs []error
+
+	hardware := make(map[string]string)
+	addresses := make(map[string]string)
+	for _, entry := range e {
+		host, ok := entry.id[0].(pDeclarationHost)
+		if !ok {
+			continue
+		}
+
+		for _, p := range entry.composites[0].parameters {
+			switch p := p.(type) {
+			case pParameterHardware:
+				address := normalizeMAC(p.address)
+				if other, ok := hardware[address]; ok {
+					errs = append(errs, fmt.Errorf("hardware address %s is reserved by both host %s and host %s", address, other, host.name))
+					continue
+				}
+				hardware[address] = host.name
+
+			case pParameterAddress4:
+				for _, address := range p {
+					if other, ok := addresses[address]; ok {
+						errs = append(errs, fmt.Errorf("fixed-address %s is reserved by both host %s and host %s", address, other, host.name))
+						continue
+					}
+					addresses[address] = host.name
+				}
+
+			case pParameterAddress6:
+				for _, address := range p {
+					if other, ok := addresses[address]; ok {
+						errs = append(errs, fmt.Errorf("fixed-address6 %s is reserved by both host %s and host %s", address, other, host.name))
+						continue
+					}
+					addresses[address] = host.name
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// Equal returns whether two configurations are semantically identical. The
+// declarations are compared by what they resolve to, regardless of the order
+// in which they or their parameters were written.
+func (e DhcpConfiguration) Equal(other DhcpConfiguration) bool {
+	if len(e) != len(other) {
+		return false
+	}
+
+	counts := make(map[string]int)
+	for i := range e {
+		counts[e[i].signature()]++
+	}
+	for i := range other {
+		signature := other[i].signature()
+		if counts[signature] == 0 {
+			return false
+		}
+		counts[signature]--
+	}
+	return true
+}
+
+// DeclarationDiffKind is the way that a declaration differs between two
+// configurations.
+type DeclarationDiffKind int
+
+const (
+	DeclarationAdded DeclarationDiffKind = iota + 1
+	DeclarationRemoved
+	DeclarationModified
+)
+
+func (k DeclarationDiffKind) String() string {
+	switch k {
+	case DeclarationAdded:
+		return "added"
+	case DeclarationRemoved:
+		return "removed"
+	case DeclarationModified:
+		return "modified"
+	}
+	return fmt.Sprintf("DeclarationDiffKind(%d)", int(k))
+}
+
+// DeclarationDiff is a declaration that differs between two configurations.
+type DeclarationDiff struct {
+	Kind DeclarationDiffKind
+
+	// ID identifies the declaration by its own identifier followed by those
+	// of the declarations enclosing it, such as
+	// `{subnet4 10.0.0.0/24},{global}`.
+	ID string
+
+	// Changes describes the parameters of a modified declaration that were
+	// added, removed, or changed, such as its options, grants, and ranges.
+	Changes []string
+}
+
+func (d DeclarationDiff) String() string {
+	if len(d.Changes) == 0 {
+		return fmt.Sprintf("%s %s", d.Kind, d.ID)
+	}
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.ID, strings.Join(d.Changes, "; "))
+}
+
+// DiffDhcpConfigurations compares two configurations by their declarations,
+// returning those that were removed from or modified in the first, in its
+// order, followed by those that were added in the second, in its order. A
+// declaration is matched by its identifier, and is only modified if the
+// parameters declared directly within it differ, so a change that is merely
+// inherited from an enclosing declaration is only reported for that one.
+// Configurations that are Equal have no differences.
+func DiffDhcpConfigurations(a, b DhcpConfiguration) []DeclarationDiff {
+	if a.Equal(b) {
+		return nil
+	}
+
+	before, beforeIDs := indexDeclarations(a)
+	after, afterIDs := indexDeclarations(b)
+
+	var result []DeclarationDiff
+	for _, id := range beforeIDs {
+		other, ok := after[id]
+		if !ok {
+			result = append(result, DeclarationDiff{Kind: DeclarationRemoved, ID: id})
+			continue
+		}
+		if changes := diffDeclarationParameters(before[id], other); len(changes) > 0 {
+			result = append(result, DeclarationDiff{Kind: DeclarationModified, ID: id, Changes: changes})
+		}
+	}
+	for _, id := range afterIDs {
+		if _, ok := before[id]; !ok {
+			result = append(result, DeclarationDiff{Kind: DeclarationAdded, ID: id})
+		}
+	}
+	return result
+}
+
+// indexDeclarations returns the declarations of a configuration by their
+// identifier, along with the identifiers in order. Declarations that share an
+// identifier, such as the pools of a subnet, are numbered by their position.
+func indexDeclarations(config DhcpConfiguration) (map[string]*ConfigDeclaration, []string) {
+	index := make(map[string]*ConfigDeclaration, len(config))
+	ids := make([]string, 0, len(config))
+	seen := make(map[string]int)
+	for i := range config {
+		res := make([]string, 0, len(config[i].id))
+		for _, v := range config[i].id {
+			res = append(res, v.repr())
+		}
+		id := strings.Join(res, ",")
+
+		seen[id]++
+		if seen[id] > 1 {
+			id = fmt.Sprintf("%s#%d", id, seen[id])
+		}
+		index[id] = &config[i]
+		ids = append(ids, id)
+	}
+	return index, ids
+}
+
+// diffDeclarationParameters describes how the parameters declared directly
+// within two declarations differ, in sorted order.
+func diffDeclarationParameters(a, b *ConfigDeclaration) []string {
+	keyedA, unkeyedA := declarationParameters(a)
+	keyedB, unkeyedB := declarationParameters(b)
+
+	var result []string
+	for key, value := range keyedA {
+		if other, ok := keyedB[key]; !ok {
+			result = append(result, fmt.Sprintf("%s %s removed", key, value))
+		} else if other != value {
+			result = append(result, fmt.Sprintf("%s changed from %s to %s", key, value, other))
+		}
+	}
+	for key, value := range keyedB {
+		if _, ok := keyedA[key]; !ok {
+			result = append(result, fmt.Sprintf("%s %s added", key, value))
+		}
+	}
+	for repr := range unkeyedA {
+		if !unkeyedB[repr] {
+			result = append(result, fmt.Sprintf("%s removed", repr))
+		}
+	}
+	for repr := range unkeyedB {
+		if !unkeyedA[repr] {
+			result = append(result, fmt.Sprintf("%s added", repr))
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// declarationParameters returns the parameters declared directly within a
+// declaration. Those that can only be set once, such as options and grants,
+// are keyed by what they set, and the rest, such as ranges, are returned as a
+// set of their representations.
+func declarationParameters(e *ConfigDeclaration) (map[string]string, map[string]bool) {
+	keyed := make(map[string]string)
+	unkeyed := make(map[string]bool)
+	for _, p := range e.composites[0].parameters {
+		switch p := p.(type) {
+		case pParameterOption:
+			keyed["option "+p.name] = p.value
+		case pParameterGrant:
+			keyed["grant "+p.attribute] = p.verb
+		case pParameterBoolean:
+			keyed[p.parameter] = p.flag()
+		case pParameterOther:
+			keyed[p.parameter] = p.value
+		case pParameterExpression:
+			keyed[p.parameter] = p.expression
+		default:
+			unkeyed[p.repr()] = true
+		}
+	}
+	return keyed, unkeyed
+}
+
+// String returns a compact tree of the declarations, with each one indented
+// beneath the declaration that encloses it and followed by the parameters
+// declared directly within it.
+func (e DhcpConfiguration) String() string {
+	var result []string
+	for _, entry := range e {
+		res := []string{entry.id[0].repr()}
+		for _, p := range entry.composites[0].parameters {
+			res = append(res, p.repr())
+		}
+		indent := strings.Repeat("  ", len(entry.id)-1)
+		result = append(result, indent+strings.Join(res, " "))
+	}
+	return strings.Join(result, "\n") + "\n"
+}
+
+// FilterByOption returns the declarations whose option satisfies match,
+// including an option that is inherited from an enclosing declaration. If
+// match is nil, then every declaration with the option is returned.
+func (e DhcpConfiguration) FilterByOption(name string, match func(value string) bool) []ConfigDeclaration {
+	result := make([]ConfigDeclaration, 0)
+	for _, entry := range e {
+		value, ok := entry.options[name]
+		if !ok || (match != nil && !match(value)) {
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// Global returns the global scope of the configuration, or an error if the
+// configuration is empty or doesn't begin with it.
+func (e *DhcpConfiguration) Global() (ConfigDeclaration, error) {
+	if len(*e) == 0 {
+		return ConfigDeclaration{}, errors.New("no global declaration found")
+	}
+
+	result := (*e)[0]
+	if len(result.id) != 1 {
+		return ConfigDeclaration{}, fmt.Errorf("unexpected global declaration : %v", result.id)
+	}
+	if _, ok := result.id[0].(pDeclarationGlobal); !ok {
+		return ConfigDeclaration{}, fmt.Errorf("unexpected global declaration : %v", result.id[0].repr())
+	}
+	return result, nil
+}
+
+func (e *DhcpConfiguration) SubnetByAddress(address net.IP) (ConfigDeclaration, error) {
+	var result []ConfigDeclaration
+	for _, entry := range *e {
+		switch entry.id[0].(type) {
+		case pDeclarationSubnet4:
+			id := entry.id[0].(pDeclarationSubnet4)
+			if id.Contains(address) {
+				result = append(result, entry)
+			}
+		case pDeclarationSubnet6:
+			id := entry.id[0].(pDeclarationSubnet6)
+			if id.Contains(address) {
+				result = append(result, entry)
+			}
+		}
+	}
+	if len(result) == 0 {
+		return ConfigDeclaration{}, fmt.Errorf("no network declarations containing %s found", address.String())
+	}
+	if len(result) > 1 {
+		return ConfigDeclaration{}, fmt.Errorf("more than one network declaration found : %v", result)
+	}
+	return result[0], nil
+}
+
+// PreflightAddress checks that the address would be served by the
+// configuration, meaning that it falls within a subnet that has a range,
+// either of its own or within one of its pools, which includes it and doesn't
+// deny clients. A descriptive error is returned if it wouldn't be.
+func (e DhcpConfiguration) PreflightAddress(ip net.IP) error {
+	subnet, err := e.SubnetByAddress(ip)
+	if err != nil {
+		return fmt.Errorf("address %s is not in any subnet: %w", ip, err)
+	}
+
+	var reasons []string
+	for _, entry := range e {
+		descendant := slices.ContainsFunc(entry.id, func(id pDeclarationIdentifier) bool {
+			return id.repr() == subnet.id[0].repr()
+		})
+		if !descendant || !entry.RangeContains(ip) {
+			continue
+		}
+
+		ok, reason := entry.Serves(ip)
+		if ok {
+			return nil
+		}
+		reasons = append(reasons, reason)
+	}
+
+	if len(reasons) > 0 {
+		return fmt.Errorf("address %s would not be served by subnet %s: %s", ip, subnet.id[0].repr(), strings.Join(reasons, "; "))
+	}
+	return fmt.Errorf("address %s is in subnet %s but outside of every range", ip, subnet.id[0].repr())
+}
+
+// HostsInSharedNetwork returns the host declarations that are enclosed by the
+// named shared-network, whether directly or within one of its subnets, pools
+// or groups, in the order that they were declared.
+func (e DhcpConfiguration) HostsInSharedNetwork(name string) ([]ConfigDeclaration, error) {
+	name = unquoteDhcpString(name)
+	isNamed := func(id pDeclarationIdentifier) bool {
+		shared, ok := id.(pDeclarationShared)
+		return ok && unquoteDhcpString(shared.name) == name
+	}
+
+	found := false
+	result := make([]ConfigDeclaration, 0)
+	for _, entry := range e {
+		if isNamed(entry.id[0]) {
+			found = true
+			continue
+		}
+		if _, ok := entry.id[0].(pDeclarationHost); !ok {
+			continue
+		}
+
+		for _, composite := range entry.composites[1:] {
+			if isNamed(composite.id) {
+				result = append(result, entry)
+				break
+			}
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("no shared-network declaration named %s found", name)
+	}
+	return result, nil
+}
+
+func (e *DhcpConfiguration) HostByName(host string) (ConfigDeclaration, error) {
+	var result []ConfigDeclaration
+	for _, entry := range *e {
+		switch entry.id[0].(type) {
+		case pDeclarationHost:
+			id := entry.id[0].(pDeclarationHost)
+			if strings.EqualFold(id.name, host) {
+				result = append(result, entry)
+			}
+		}
+	}
+	if len(result) == 0 {
+		return ConfigDeclaration{}, fmt.Errorf("no host declarations containing %s found", host)
+	}
+	if len(result) > 1 {
+		return ConfigDeclaration{}, fmt.Errorf("more than one host declaration found : %v", result)
+	}
+	return result[0], nil
+}
+
+// NetworkMap represents a collection of configurations, where each configuration is a map of string key-value pairs.
+type NetworkMap []map[string]string
+
+type NetworkNameMapper interface {
+	NameIntoDevices(string) ([]string, error)
+	NameIntoDevice(string) (string, error)
+	DeviceIntoName(string) (string, error)
+}
+
+// defaultNetworkDevices are the devices that VMware creates for each of the
+// standard network names.
+var defaultNetworkDevices = map[string]string{
+	"bridged":  "vmnet0",
+	"hostonly": "vmnet1",
+	"nat":      "vmnet8",
+}
+
+// networkNameAliases maps each accepted spelling of the standard network names,
+// in lowercase, to the name that it stands for.
+var networkNameAliases = map[string]string{
+	"bridged":   "bridged",
+	"bridge":    "bridged",
+	"hostonly":  "hostonly",
+	"host-only": "hostonly",
+	"host_only": "hostonly",
+	"nat":       "nat",
+}
+
+// NormalizeNetworkName returns the standard network name that a name stands
+// for, ignoring case, such as `hostonly` for `Host-Only`. Any other name, such
+// as that of a custom network, is returned unchanged.
+func NormalizeNetworkName(name string) string {
+	if normalized, ok := networkNameAliases[strings.ToLower(name)]; ok {
+		return normalized
+	}
+	return name
+}
+
+// canonicalNetworkDevice chooses a single device out of the devices matching
+// a network name. If more than one device matches, then the default device for
+// the name, using the given prefix for device names, is chosen if it is one of
+// them. Otherwise the name is ambiguous.
+func canonicalNetworkDevice(name string, prefix string, devices []string) (string, error) {
+	var unique []string
+	for _, device := range devices {
+		if !slices.Contains(unique, device) {
+			unique = append(unique, device)
+		}
+	}
+
+	switch len(unique) {
+	case 0:
+		return "", fmt.Errorf("error finding network name : %v", name)
+	case 1:
+		return unique[0], nil
+	}
+
+	if device, ok := defaultNetworkDevices[NormalizeNetworkName(name)]; ok {
+		device = prefix + strings.TrimPrefix(device, NetworkingInterfacePrefix)
+		if slices.Contains(unique, device) {
+			return device, nil
+		}
+	}
+	return "", fmt.Errorf("network name %v is ambiguous, matching devices : %s", name, strings.Join(unique, ", "))
+}
+
+func ReadNetworkMap(fd *os.File) (NetworkMap, error) {
+	fromfile := consumeFile(fd)
+	uncommented := uncomment(fromfile)
+	tokenized := tokenizeNetworkMapConfig(uncommented)
+
+	// Now that we've tokenized the network map, we just need to parse it into
+	// a list of maps.
+	result, err := parseNetworkMapConfig(tokenized)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (e NetworkMap) NameIntoDevices(name string) ([]string, error) {
+	var devices []string
+
+	for _, val := range e {
+		if strings.EqualFold(val["name"], name) {
+			devices = append(devices, val["device"])
+		}
+	}
+
+	if len(devices) > 0 {
+		return devices, nil
+	}
+
+	return make([]string, 0), networkNameError(name, e.AvailableNetworks())
+}
+
+// AvailableNetworks returns the names of the networks in the map, in the order
+// of their entries.
+func (e NetworkMap) AvailableNetworks() []string {
+	result := make([]string, 0, len(e))
+	for _, val := range e {
+		name, ok := val["name"]
+		if !ok || slices.ContainsFunc(result, func(other string) bool { return strings.EqualFold(other, name) }) {
+			continue
+		}
+		result = append(result, name)
+	}
+	return result
+}
+
+// networkNameError describes a network name that couldn't be resolved, along
+// with the networks that are available instead.
+func networkNameError(name string, available []string) error {
+	if len(available) == 0 {
+		return fmt.Errorf("error finding network name : %v (no networks are available)", name)
+	}
+	return fmt.Errorf("error finding network name : %v (available: %s)", name, strings.Join(available, ", "))
+}
+
+// NameIntoDevice returns the single device for a network name.
+func (e NetworkMap) NameIntoDevice(name string) (string, error) {
+	devices, err := e.NameIntoDevices(name)
+	if err != nil {
+		return "", err
+	}
+	return canonicalNetworkDevice(name, NetworkingInterfacePrefix, devices)
+}
+
+func (e NetworkMap) DeviceIntoName(device string) (string, error) {
+	for _, val := range e {
+		if strings.EqualFold(val["device"], device) {
+			return val["name"], nil
+		}
+	}
+
+	return "", fmt.Errorf("error finding device name : %v", device)
+}
+
+// attr returns the raw value of an attribute of the network with the given
+// device.
+func (e NetworkMap) attr(device string, attr string) (string, error) {
+	for _, val := range e {
+		if !strings.EqualFold(val["device"], device) {
+			continue
+		}
+		value, ok := val[attr]
+		if !ok {
+			return "", fmt.Errorf("error finding attribute %s for device : %v", attr, device)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("error finding device : %v", device)
+}
+
+// BoolAttr returns the value of a boolean attribute, such as `dhcp`, of the
+// network with the given device. The value can be written as `true`, `false`,
+// `1`, or `0`.
+func (e NetworkMap) BoolAttr(device string, attr string) (bool, error) {
+	value, err := e.attr(device, attr)
+	if err != nil {
+		return false, err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "1":
+		return true, nil
+	case "false", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("unparseable boolean for attribute %s of device %s : %v", attr, device, value)
+}
+
+// IntAttr returns the value of an integer attribute of the network with the
+// given device.
+func (e NetworkMap) IntAttr(device string, attr string) (int, error) {
+	value, err := e.attr(device, attr)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("unparseable integer for attribute %s of device %s : %v", attr, device, value)
+	}
+	return res, nil
+}
+
+func (e *NetworkMap) repr() string {
+	var result []string
+
+	for idx, val := range *e {
+		result = append(result, fmt.Sprintf("network%d.name = \"%s\"", idx, val["name"]))
+		result = append(result, fmt.Sprintf("network%d.device = \"%s\"", idx, val["device"]))
+	}
+
+	return strings.Join(result, "\n")
+}
+
+/*** parser for VMware's vmnetnat.conf */
+
+// VmnetNatConf represents the configuration of the NAT service of a virtual
+// network, which is read from vmnetnat.conf (or nat.conf). It's composed of
+// sections containing `key = value` pairs.
+type VmnetNatConf struct {
+	sections map[string]map[string]string
+}
+
+// NatPortForward is the destination of a port forwarded by the NAT service.
+type NatPortForward struct {
+	IP   net.IP
+	Port int
+}
+
+// ReadVmnetNatConf reads the sections of a vmnetnat.conf. Section names are
+// case-insensitive, and comments begin with either `#` or `;`.
+func ReadVmnetNatConf(r io.Reader) (VmnetNatConf, error) {
+	result := VmnetNatConf{sections: make(map[string]map[string]string)}
+
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if index := strings.IndexAny(line, "#;"); index >= 0 {
+			line = line[:index]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return VmnetNatConf{}, fmt.Errorf("line %d: unterminated section name : %v", lineno, line)
+			}
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if _, ok := result.sections[section]; !ok {
+				result.sections[section] = make(map[string]string)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return VmnetNatConf{}, fmt.Errorf("line %d: expected a key and value : %v", lineno, line)
+		}
+		if section == "" {
+			return VmnetNatConf{}, fmt.Errorf("line %d: key outside of a section : %v", lineno, line)
+		}
+		result.sections[section][strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return VmnetNatConf{}, err
+	}
+	return result, nil
+}
+
+// Value returns the value of a key within a section, and whether it was
+// present.
+func (e VmnetNatConf) Value(section string, key string) (string, bool) {
+	value, ok := e.sections[strings.ToLower(section)][key]
+	return value, ok
+}
+
+// GatewayIP returns the address of the NAT gateway from the host section.
+func (e VmnetNatConf) GatewayIP() (net.IP, error) {
+	value, ok := e.Value("host", "ip")
+	if !ok {
+		return nil, errors.New("no gateway ip found in host section")
+	}
+
+	// Some versions specify the gateway along with the prefix length.
+	address, _, _ := strings.Cut(value, "/")
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("unparseable gateway ip : %v", value)
+	}
+	return ip, nil
+}
+
+// Netmask returns the netmask of the virtual network from the host section.
+func (e VmnetNatConf) Netmask() (net.IPMask, error) {
+	value, ok := e.Value("host", "netmask")
+	if !ok {
+		return nil, errors.New("no netmask found in host section")
+	}
+
+	mask := net.ParseIP(value).To4()
+	if mask == nil {
+		return nil, fmt.Errorf("unparseable netmask : %v", value)
+	}
+	return net.IPMask(mask), nil
+}
+
+// DNSPolicy returns the policy used for forwarding DNS requests, such as
+// `order`, `rotate`, or `burst`, and whether it was present.
+func (e VmnetNatConf) DNSPolicy() (string, bool) {
+	return e.Value("dns", "policy")
+}
+
+// IncomingTCP returns the TCP ports that are forwarded to virtual machines,
+// keyed by the port on the host.
+func (e VmnetNatConf) IncomingTCP() (map[int]NatPortForward, error) {
+	return e.incoming("incomingtcp")
+}
+
+// IncomingUDP returns the UDP ports that are forwarded to virtual machines,
+// keyed by the port on the host.
+func (e VmnetNatConf) IncomingUDP() (map[int]NatPortForward, error) {
+	return e.incoming("incomingudp")
+}
+
+func (e VmnetNatConf) incoming(section string) (map[int]NatPortForward, error) {
+	result := make(map[int]NatPortForward)
+	for key, value := range e.sections[section] {
+		port, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in %s section : %v", section, key)
+		}
+
+		host, targetPort, err := net.SplitHostPort(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination for port %d in %s section : %v", port, section, value)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid destination for port %d in %s section : %v", port, section, value)
+		}
+		target, err := strconv.Atoi(targetPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination for port %d in %s section : %v", port, section, value)
+		}
+		result[port] = NatPortForward{IP: ip, Port: target}
+	}
+	return result, nil
+}
+
+/*** parser for VMware Fusion's networking file */
+func tokenizeNetworkingConfig(in chan byte) chan string {
+	var state string
+	var quote bool
+	var repeatNewline bool
+
+	out := make(chan string)
+	go func(out chan string) {
+		for {
+			by, ok := <-in
+			if !ok {
+				break
+			}
+
+			// If we're in a quote, then we continue until we're not in a quote
+			// so that any whitespace within it is kept as part of the token.
+			if quote {
+				if by == '"' {
+					quote = false
+				}
+				state += string(by)
+				continue
+			}
+
+			switch by {
+			case '"':
+				// Otherwise we're outside any quotes, so we need to transition
+				// into our quote-parsing state.
+				quote = true
+				state += string(by)
+			case '\t':
+				fallthrough
+			case ' ':
+				// Ignore whitespace.
+				if len(state) == 0 {
+					continue
+				}
+				out <- state
+				state = ""
+
+			case '\r':
+				// If windows has tampered with our newlines, then we normalize
+				// things by converting its value from 0x0d to 0x0a.
+				fallthrough
+			case '\n':
+				// Newlines can repeat, so this case is responsible for writing
+				// to the chan, and consolidating multiple newlines into a single.
+				if repeatNewline {
+					continue
+				}
+				if len(state) > 0 {
+					out <- state
+				}
+				out <- "\n"
+				state = ""
+				repeatNewline = true
+				continue
+
+			default:
+				// Anything other bytes just need to be aggregated into a string.
+				state += string(by)
+			}
+			repeatNewline = false
+		}
+
+		// If there's anything left in our state after the chan has been closed,
+		// then the input just wasn't terminated properly. It's still valid, so
+		// write we have to the channel.
+		if len(state) > 0 {
+			out <- state
+		}
+		close(out)
+	}(out)
+	return out
+}
+
+func splitNetworkingConfig(in chan string) chan []string {
+	out := make(chan []string)
+
+	// This goroutine is simple in that it takes a chan of tokens, and splits
+	// them across the newlines.
+
+	go func(out chan []string) {
+		row := make([]string, 0)
+		for {
+			tk, ok := <-in
+			if !ok {
+				break
+			}
+
+			if tk == "\n" {
+				// If we received a newline token, then we need to write our
+				// aggregated list of tokens and reset our "splitting" state.
+
+				if len(row) > 0 {
+					out <- row
+				}
+
+				row = make([]string, 0)
+
+			} else {
+				// Anything else just requires us to aggregate the token into
+				// our list.
+				row = append(row, tk)
+			}
+		}
+
+		if len(row) > 0 {
+			out <- row
+		}
+		close(out)
+	}(out)
+	return out
+}
+
+// All token types in networking file.
+// VERSION token
+type networkingVERSION struct {
+	value string
+}
+
+func networkingReadVersion(row []string) (*networkingVERSION, error) {
+	if len(row) != 1 {
+		return nil, fmt.Errorf("unexpected format for version : %v", row)
+	}
+	res := &networkingVERSION{value: row[0]}
+	if !res.Valid() {
+		return nil, fmt.Errorf("unexpected format for version : %v", row)
+	}
+	return res, nil
+}
+
+func (s networkingVERSION) Repr() string {
+	if !s.Valid() {
+		return fmt.Sprintf("VERSION{INVALID=\"%v\"}", s.value)
+	}
+	return fmt.Sprintf("VERSION{%f}", s.Number())
+}
+
+func (s networkingVERSION) Valid() bool {
+	tokens := strings.SplitN(s.value, "=", 2)
+	if len(tokens) != 2 || tokens[0] != "VERSION" {
+		return false
+	}
+
+	tokens = strings.Split(tokens[1], ",")
+	if len(tokens) != 2 {
+		return false
+	}
+
+	for _, t := range tokens {
+		_, err := strconv.ParseUint(t, 10, 64)
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (s networkingVERSION) Number() float64 {
+	var result float64
+	tokens := strings.SplitN(s.value, "=", 2)
+	tokens = strings.Split(tokens[1], ",")
+
+	integer, err := strconv.ParseUint(tokens[0], 10, 64)
+	if err != nil {
+		integer = 0
+	}
+	result = float64(integer)
+
+	mantissa, err := strconv.ParseUint(tokens[1], 10, 64)
+	if err != nil {
+		return result
+	}
+	denomination := math.Pow(10.0, float64(len(tokens[1])))
+	return result + (float64(mantissa) / denomination)
+}
+
+// VNET_X token
+type networkingVNET struct {
+	value string
+}
+
+func (s networkingVNET) Valid() bool {
+	tokens := strings.SplitN(s.value, "_", 3)
+	if len(tokens) != 3 || tokens[0] != "VNET" {
+		return false
+	}
+	_, err := strconv.ParseUint(tokens[1], 10, 64)
+	return strings.ToUpper(s.value) == s.value && err == nil
+}
+
+func (s networkingVNET) Number() int {
+	tokens := strings.SplitN(s.value, "_", 3)
+	res, err := strconv.Atoi(tokens[1])
+	if err != nil {
+		return ^0
+	}
+	return res
+}
+
+func (s networkingVNET) Option() string {
+	tokens := strings.SplitN(s.value, "_", 3)
+	if len(tokens) == 3 {
+		return tokens[2]
+	}
+	return ""
+}
+
+func (s networkingVNET) Repr() string {
+	if !s.Valid() {
+		tokens := strings.SplitN(s.value, "_", 3)
+		return fmt.Sprintf("VNET{INVALID=%v}", tokens)
+	}
+	return fmt.Sprintf("VNET{%d} %s", s.Number(), s.Option())
+}
+
+// Interface name
+type networkingInterface struct {
+	name string
+}
+
+func (s networkingInterface) Interface() (*net.Interface, error) {
+	return net.InterfaceByName(s.name)
+}
+
+// networking command entry types
+type networkingCommandEntryAnswer struct {
+	vnet  networkingVNET
+	value string
+}
+type networkingCommandEntryRemoveAnswer struct {
+	vnet networkingVNET
+}
+type networkingCommandEntryAddNatPortFwd struct {
+	vnet       int
+	protocol   string
+	port       int
+	targetHost net.IP
+	targetPort int
+}
+type networkingCommandEntryRemoveNatPortFwd struct {
+	vnet     int
+	protocol string
+	port     int
+}
+type networkingCommandEntryAddDhcpMacToIp struct {
+	vnet int
+	mac  net.HardwareAddr
+	ip   net.IP
+}
+type networkingCommandEntryRemoveDhcpMacToIp struct {
+	vnet int
+	mac  net.HardwareAddr
+}
+type networkingCommandEntryAddBridgeMapping struct {
+	intf networkingInterface
+	vnet int
+}
+type networkingCommandEntryRemoveBridgeMapping struct {
+	intf networkingInterface
+}
+type networkingCommandEntryAddNatPrefix struct {
+	vnet   int
+	prefix int
+}
+type networkingCommandEntryRemoveNatPrefix struct {
+	vnet   int
+	prefix int
+}
+
+type networkingCommandEntry struct {
+	entry               interface{}
+	answer              *networkingCommandEntryAnswer
+	removeAnswer        *networkingCommandEntryRemoveAnswer
+	addNatPortFwd       *networkingCommandEntryAddNatPortFwd
+	removeNatPortFwd    *networkingCommandEntryRemoveNatPortFwd
+	addDhcpMacToIp      *networkingCommandEntryAddDhcpMacToIp
+	removeDhcpMacToIp   *networkingCommandEntryRemoveDhcpMacToIp
+	addBridgeMapping    *networkingCommandEntryAddBridgeMapping
+	removeBridgeMapping *networkingCommandEntryRemoveBridgeMapping
+	addNatPrefix        *networkingCommandEntryAddNatPrefix
+	removeNatPrefix     *networkingCommandEntryRemoveNatPrefix
+}
+
+func (e networkingCommandEntry) Name() string {
+	switch e.entry.(type) {
+	case networkingCommandEntryAnswer:
+		return "answer"
+	case networkingCommandEntryRemoveAnswer:
+		return "remove_answer"
+	case networkingCommandEntryAddNatPortFwd:
+		return "add_nat_portfwd"
+	case networkingCommandEntryRemoveNatPortFwd:
+		return "remove_nat_portfwd"
+	case networkingCommandEntryAddDhcpMacToIp:
+		return "add_dhcp_mac_to_ip"
+	case networkingCommandEntryRemoveDhcpMacToIp:
+		return "remove_dhcp_mac_to_ip"
+	case networkingCommandEntryAddBridgeMapping:
+		return "add_bridge_mapping"
+	case networkingCommandEntryRemoveBridgeMapping:
+		return "remove_bridge_mapping"
+	case networkingCommandEntryAddNatPrefix:
+		return "add_nat_prefix"
+	case networkingCommandEntryRemoveNatPrefix:
+		return "remove_nat_prefix"
+	}
+	return ""
+}
+
+func (e networkingCommandEntry) Entry() reflect.Value {
+	this := reflect.ValueOf(e)
+	switch e.entry.(type) {
+	case networkingCommandEntryAnswer:
+		return reflect.Indirect(this.FieldByName("answer"))
+	case networkingCommandEntryRemoveAnswer:
+		return reflect.Indirect(this.FieldByName("remove_answer"))
+	case networkingCommandEntryAddNatPortFwd:
+		return reflect.Indirect(this.FieldByName("add_nat_portfwd"))
+	case networkingCommandEntryRemoveNatPortFwd:
+		return reflect.Indirect(this.FieldByName("remove_nat_portfwd"))
+	case networkingCommandEntryAddDhcpMacToIp:
+		return reflect.Indirect(this.FieldByName("add_dhcp_mac_to_ip"))
+	case networkingCommandEntryRemoveDhcpMacToIp:
+		return reflect.Indirect(this.FieldByName("remove_dhcp_mac_to_ip"))
+	case networkingCommandEntryAddBridgeMapping:
+		return reflect.Indirect(this.FieldByName("add_bridge_mapping"))
+	case networkingCommandEntryRemoveBridgeMapping:
+		return reflect.Indirect(this.FieldByName("remove_bridge_mapping"))
+	case networkingCommandEntryAddNatPrefix:
+		return reflect.Indirect(this.FieldByName("add_nat_prefix"))
+	case networkingCommandEntryRemoveNatPrefix:
+		return reflect.Indirect(this.FieldByName("remove_nat_prefix"))
+	}
+	return reflect.Value{}
+}
+
+func (e networkingCommandEntry) Repr() string {
+	result := make(map[string]interface{})
+
+	entryN, entry := e.Name(), e.Entry()
+	entryT := entry.Type()
+	for i := 0; i < entry.NumField(); i++ {
+		fld, fldT := entry.Field(i), entryT.Field(i)
+		result[fldT.Name] = fld
+	}
+	return fmt.Sprintf("%s -> %v", entryN, result)
+}
+
+// networking command entry parsers
+func parseNetworkingCommandAnswer(row []string) (*networkingCommandEntry, error) {
+	if len(row) != 2 {
+		return nil, fmt.Errorf("expected %d arguments but received %d", 2, len(row))
+	}
+
+	vnet := networkingVNET{value: row[0]}
+	if !vnet.Valid() {
+		return nil, fmt.Errorf("invalid format for VNET")
+	}
+
+	// Values containing whitespace are quoted, so we need to unquote them.
+	// The quotes are stripped literally, as backslashes (such as those in a
+	// windows path) are not escapes.
+	result := networkingCommandEntryAnswer{vnet: vnet, value: unquoteDhcpString(row[1])}
+	return &networkingCommandEntry{entry: result, answer: &result}, nil
+}
+func parseNetworkingCommandRemoveAnswer(row []string) (*networkingCommandEntry, error) {
+	if len(row) != 1 {
+		return nil, fmt.Errorf("expected %d argument but received %d", 1, len(row))
+	}
+	vnet := networkingVNET{value: row[0]}
+	if !vnet.Valid() {
+		return nil, fmt.Errorf("invalid format for VNET")
+	}
+
+	result := networkingCommandEntryRemoveAnswer{vnet: vnet}
+	return &networkingCommandEntry{entry: result, removeAnswer: &result}, nil
+}
+func parseNetworkingCommandAddNatPortFwd(row []string) (*networkingCommandEntry, error) {
+	if len(row) != 5 {
+		return nil, fmt.Errorf("expected %d arguments but received %d", 5, len(row))
+	}
+
+	vnet, err := strconv.Atoi(row[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse first argument as an integer : %v", row[0])
+	}
+
+	protocol := strings.ToLower(row[1])
+	if protocol != "tcp" && protocol != "udp" {
+		return nil, fmt.Errorf("expected \"tcp\" or \"udp\" for second argument : %v", row[1])
+	}
+
+	sport, err := strconv.Atoi(row[2])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse third argument as an integer : %v", row[2])
+	}
+
+	dest := net.ParseIP(row[3])
+	if dest == nil {
+		return nil, fmt.Errorf("unable to parse fourth argument as an IPv4 address : %v", row[2])
+	}
+
+	dport, err := strconv.Atoi(row[4])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse fifth argument as an integer : %v", row[4])
+	}
+
+	result := networkingCommandEntryAddNatPortFwd{vnet: vnet - 1, protocol: protocol, port: sport, targetHost: dest, targetPort: dport}
+	return &networkingCommandEntry{entry: result, addNatPortFwd: &result}, nil
+}
+func parseNetworkingCommandRemoveNatPortFwd(row []string) (*networkingCommandEntry, error) {
+	if len(row) != 3 {
+		return nil, fmt.Errorf("expected %d arguments but received %d", 3, len(row))
+	}
+
+	vnet, err := strconv.Atoi(row[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse first argument as an integer : %v", row[0])
+	}
+
+	protocol := strings.ToLower(row[1])
+	if protocol != "tcp" && protocol != "udp" {
+		return nil, fmt.Errorf("expected \"tcp\" or \"udp\" for second argument : %v", row[1])
+	}
+
+	sport, err := strconv.Atoi(row[2])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse third argument as an integer : %v", row[2])
+	}
+
+	result := networkingCommandEntryRemoveNatPortFwd{vnet: vnet - 1, protocol: protocol, port: sport}
+	return &networkingCommandEntry{entry: result, removeNatPortFwd: &result}, nil
+}
+func parseNetworkingCommandAddDhcpMacToIp(row []string) (*networkingCommandEntry, error) {
+	if len(row) != 3 {
+		return nil, fmt.Errorf("expected %d arguments but received %d", 3, len(row))
+	}
+
+	vnet, err := strconv.Atoi(row[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse first argument as an integer : %v", row[0])
+	}
+
+	mac, err := parseMAC(row[1])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse second argument as hardware address : %v", row[1])
+	}
+
+	ip := net.ParseIP(row[2])
+	if ip == nil {
+		return nil, fmt.Errorf("unable to parse third argument as IPv4 address : %v", row[2])
+	}
+
+	result := networkingCommandEntryAddDhcpMacToIp{vnet: vnet - 1, mac: mac, ip: ip}
+	return &networkingCommandEntry{entry: result, addDhcpMacToIp: &result}, nil
+}
+func parseNetworkingCommandRemoveDhcpMacToIp(row []string) (*networkingCommandEntry, error) {
+	if len(row) != 2 {
+		return nil, fmt.Errorf("expected %d arguments but received %d", 2, len(row))
+	}
+
+	vnet, err := strconv.Atoi(row[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse first argument as an integer : %v", row[0])
+	}
+
+	mac, err := parseMAC(row[1])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse second argument as hardware address : %v", row[1])
+	}
+
+	result := networkingCommandEntryRemoveDhcpMacToIp{vnet: vnet - 1, mac: mac}
+	return &networkingCommandEntry{entry: result, removeDhcpMacToIp: &result}, nil
+}
+func parseNetworkingCommandAddBridgeMapping(row []string) (*networkingCommandEntry, error) {
+	if len(row) != 2 {
+		return nil, fmt.Errorf("expected %d arguments but received %d", 2, len(row))
+	}
+	intf := networkingInterface{name: row[0]}
+
+	vnet, err := strconv.Atoi(row[1])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse second argument as an integer : %v", row[2])
+	}
+
+	result := networkingCommandEntryAddBridgeMapping{intf: intf, vnet: vnet - 1}
+	return &networkingCommandEntry{entry: result, addBridgeMapping: &result}, nil
+}
+func parseNetworkingCommandRemoveBridgeMapping(row []string) (*networkingCommandEntry, error) {
+	if len(row) != 1 {
+		return nil, fmt.Errorf("expected %d argument but received %d", 1, len(row))
+	}
+	intf := networkingInterface{name: row[0]}
+	/*
+		number, err := strconv.Atoi(row[0])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse first argument as an integer. : %v", row[0])
+		}
+	*/
+	result := networkingCommandEntryRemoveBridgeMapping{intf: intf}
+	return &networkingCommandEntry{entry: result, removeBridgeMapping: &result}, nil
+}
+func parseNetworkingCommandAddNatPrefix(row []string) (*networkingCommandEntry, error) {
+	if len(row) != 2 {
+		return nil, fmt.Errorf("expected %d arguments but received %d", 2, len(row))
+	}
+
+	vnet, err := strconv.Atoi(row[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse first argument as an integer : %v", row[0])
+	}
+
+	if !strings.HasPrefix(row[1], "/") {
+		return nil, fmt.Errorf("expected second argument to begin with \"/\" : %v", row[1])
+	}
+
+	prefix, err := strconv.Atoi(row[1][1:])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse prefix from second argument : %v", row[1])
+	}
+
+	result := networkingCommandEntryAddNatPrefix{vnet: vnet - 1, prefix: prefix}
+	return &networkingCommandEntry{entry: result, addNatPrefix: &result}, nil
+}
+func parseNetworkingCommandRemoveNatPrefix(row []string) (*networkingCommandEntry, error) {
+	if len(row) != 2 {
+		return nil, fmt.Errorf("expected %d arguments but received %d", 2, len(row))
+	}
+
+	vnet, err := strconv.Atoi(row[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse first argument as an integer : %v", row[0])
+	}
+
+	if !strings.HasPrefix(row[1], "/") {
+		return nil, fmt.Errorf("expected second argument to begin with \"/\" : %v", row[1])
+	}
+
+	prefix, err := strconv.Atoi(row[1][1:])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse prefix out of second argument : %v", row[1])
+	}
+
+	result := networkingCommandEntryRemoveNatPrefix{vnet: vnet - 1, prefix: prefix}
+	return &networkingCommandEntry{entry: result, removeNatPrefix: &result}, nil
+}
+
+type networkingCommandParser struct {
+	command  string
+	callback func([]string) (*networkingCommandEntry, error)
+}
+
+var NetworkingCommandParsers = []networkingCommandParser{
+	/* DictRecordParseFunct */ {command: "answer", callback: parseNetworkingCommandAnswer},
+	/* DictRecordParseFunct */ {command: "remove_answer", callback: parseNetworkingCommandRemoveAnswer},
+	/* NatFwdRecordParseFunct */ {command: "add_nat_portfwd", callback: parseNetworkingCommandAddNatPortFwd},
+	/* NatFwdRecordParseFunct */ {command: "remove_nat_portfwd", callback: parseNetworkingCommandRemoveNatPortFwd},
+	/* DhcpMacRecordParseFunct */ {command: "add_dhcp_mac_to_ip", callback: parseNetworkingCommandAddDhcpMacToIp},
+	/* DhcpMacRecordParseFunct */ {command: "remove_dhcp_mac_to_ip", callback: parseNetworkingCommandRemoveDhcpMacToIp},
+	/* BridgeMappingRecordParseFunct */ {command: "add_bridge_mapping", callback: parseNetworkingCommandAddBridgeMapping},
+	/* BridgeMappingRecordParseFunct */ {command: "remove_bridge_mapping", callback: parseNetworkingCommandRemoveBridgeMapping},
+	/* NatPrefixRecordParseFunct */ {command: "add_nat_prefix", callback: parseNetworkingCommandAddNatPrefix},
+	/* NatPrefixRecordParseFunct */ {command: "remove_nat_prefix", callback: parseNetworkingCommandRemoveNatPrefix},
+}
+
+func NetworkingParserByCommand(command string) *func([]string) (*networkingCommandEntry, error) {
+	for _, p := range NetworkingCommandParsers {
+		if p.command == command {
+			return &p.callback
+		}
+	}
+	return nil
+}
+
+func parseNetworkingConfig(rows chan []string) chan networkingCommandEntry {
+	out := make(chan networkingCommandEntry)
+
+	go func(in chan []string, out chan networkingCommandEntry) {
+		for {
+			row, ok := <-in
+			if !ok {
+				break
+			}
+
+			if len(row) >= 1 {
+				parser := NetworkingParserByCommand(row[0])
+				if parser == nil {
+					log.Printf("invalid command : %v", row)
+					continue
+				}
+
+				callback := *parser
+
+				entry, err := callback(row[1:])
+				if err != nil {
+					log.Printf("unable to parse command : %v %v", err, row)
+					continue
+				}
+				out <- *entry
+			}
+		}
+		close(out)
+	}(rows, out)
+	return out
+}
+
+type NetworkingConfig struct {
+	answer      map[int]map[string]string
+	natPortFwd  map[int]map[string]string
+	dhcpMacToIp map[int]map[string]net.IP
+	//bridge_mapping map[net.Interface]uint64	// XXX: we don't need the actual interface for anything but informing the user.
+	bridgeMapping map[string]int
+	natPrefix     map[int][]int
+
+	// bridgeMappingEntries retains the bridge mapping commands in the order
+	// that they were read, since flattening them loses any conflicts.
+	bridgeMappingEntries []networkingCommandEntry
+
+	// dhcpMacToIpEntries likewise retains the reservation commands, since
+	// flattening them loses a hardware address that was reserved more than
+	// one address.
+	dhcpMacToIpEntries []networkingCommandEntry
+
+	// types memoizes the classification of each vmnet by its networking
+	// type. It is replaced whenever the answers or bridge mappings change.
+	types *networkingTypesCache
+
+	// prefix is the prefix of the device names, which defaults to
+	// NetworkingInterfacePrefix when it's empty.
+	prefix string
+}
+
+// interfacePrefix returns the prefix of the device names of the configuration.
+func (e NetworkingConfig) interfacePrefix() string {
+	if e.prefix == "" {
+		return NetworkingInterfacePrefix
+	}
+	return e.prefix
+}
+
+// networkingTypesCache holds the networking type of each vmnet, which is
+// computed the first time that it's needed.
+type networkingTypesCache struct {
+	once   sync.Once
+	types  map[int]NetworkingType
+	vmnets map[NetworkingType][]int
+}
+
+// networkingTypes returns the networking type of each vmnet, and the vmnets
+// of each networking type. The result is shared and must not be modified.
+func (e NetworkingConfig) networkingTypes() (map[int]NetworkingType, map[NetworkingType][]int) {
+	if e.types == nil {
+		return networkingConfigInterfaceTypes(e), networkingConfigNamesToVmnet(e)
+	}
+	e.types.once.Do(func() {
+		e.types.types = networkingConfigInterfaceTypes(e)
+		e.types.vmnets = networkingConfigNamesToVmnet(e)
+	})
+	return e.types.types, e.types.vmnets
+}
+
+// invalidateTypes discards the memoized networking types. A new cache is used
+// rather than clearing the current one, since it may be shared by copies of
+// the configuration.
+func (e *NetworkingConfig) invalidateTypes() {
+	e.types = new(networkingTypesCache)
+}
+
+// String returns a readable rendering of the configuration, which is the same
+// every time for the same configuration, so that it can be compared against a
+// golden file. The vmnets and keys are sorted, while the nat prefixes of a
+// vmnet keep their order, since it's significant.
+func (c NetworkingConfig) String() string {
+	return c.repr()
+}
+
+func (c NetworkingConfig) repr() string {
+	var b strings.Builder
+
+	b.WriteString("answer ->")
+	for _, vmnet := range sortedVmnets(c.answer) {
+		fmt.Fprintf(&b, "\n  %d:", vmnet)
+		writeSortedStrings(&b, c.answer[vmnet])
+	}
+
+	b.WriteString("\nnat_portfwd ->")
+	for _, vmnet := range sortedVmnets(c.natPortFwd) {
+		fmt.Fprintf(&b, "\n  %d:", vmnet)
+		writeSortedStrings(&b, c.natPortFwd[vmnet])
+	}
+
+	b.WriteString("\ndhcp_mac_to_ip ->")
+	for _, vmnet := range sortedVmnets(c.dhcpMacToIp) {
+		fmt.Fprintf(&b, "\n  %d:", vmnet)
+		macs := make([]string, 0, len(c.dhcpMacToIp[vmnet]))
+		for mac := range c.dhcpMacToIp[vmnet] {
+			macs = append(macs, mac)
+		}
+		sort.Strings(macs)
+		for _, mac := range macs {
+			fmt.Fprintf(&b, " %s=%s", mac, c.dhcpMacToIp[vmnet][mac])
+		}
+	}
+
+	b.WriteString("\nbridge_mapping ->")
+	interfaces := make([]string, 0, len(c.bridgeMapping))
+	for intf := range c.bridgeMapping {
+		interfaces = append(interfaces, intf)
+	}
+	sort.Strings(interfaces)
+	for _, intf := range interfaces {
+		fmt.Fprintf(&b, " %s=%d", intf, c.bridgeMapping[intf])
+	}
+
+	b.WriteString("\nnat_prefix ->")
+	for _, vmnet := range sortedVmnets(c.natPrefix) {
+		fmt.Fprintf(&b, "\n  %d: %v", vmnet, c.natPrefix[vmnet])
+	}
+	return b.String()
+}
+
+// sortedVmnets returns the vmnets of a map in ascending order.
+func sortedVmnets[V any](m map[int]V) []int {
+	vmnets := make([]int, 0, len(m))
+	for vmnet := range m {
+		vmnets = append(vmnets, vmnet)
+	}
+	sort.Ints(vmnets)
+	return vmnets
+}
+
+// writeSortedStrings writes the pairs of a map as `key=value`, ordered by key.
+func writeSortedStrings(b *strings.Builder, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(b, " %s=%s", key, m[key])
+	}
+}
+
+// Answer returns the raw value of the answer for the given vmnet and option,
+// such as "NAT" for `VNET_8_NAT`, and whether it was present.
+func (e NetworkingConfig) Answer(vmnet int, option string) (string, bool) {
+	answers, ok := e.answer[vmnet]
+	if !ok {
+		return "", false
+	}
+	value, ok := answers[option]
+	return value, ok
+}
+
+// Disabled returns whether the vmnet is marked as disabled by its answers,
+// such as with `answer VNET_2_DISABLED yes`. A disabled vmnet isn't given a
+// networking type, so it isn't returned for any network name.
+func (e NetworkingConfig) Disabled(vmnet int) bool {
+	return networkingAnswerDisabled(e.answer[vmnet])
+}
+
+// networkingAnswerDisabled returns whether an answer table marks its vmnet as
+// disabled.
+func networkingAnswerDisabled(table map[string]string) bool {
+	return strings.EqualFold(table["DISABLED"], "yes")
+}
+
+// NewNetworkingConfig returns an empty networking configuration that can be
+// populated with its mutation methods.
+func NewNetworkingConfig() NetworkingConfig {
+	return NetworkingConfig{
+		answer:        make(map[int]map[string]string),
+		natPortFwd:    make(map[int]map[string]string),
+		dhcpMacToIp:   make(map[int]map[string]net.IP),
+		bridgeMapping: make(map[string]int),
+		natPrefix:     make(map[int][]int),
+		types:         new(networkingTypesCache),
+	}
+}
+
+// init ensures that the maps of a zero configuration can be written to.
+func (e *NetworkingConfig) init() {
+	if e.answer == nil {
+		e.answer = make(map[int]map[string]string)
+	}
+	if e.natPortFwd == nil {
+		e.natPortFwd = make(map[int]map[string]string)
+	}
+	if e.dhcpMacToIp == nil {
+		e.dhcpMacToIp = make(map[int]map[string]net.IP)
+	}
+	if e.bridgeMapping == nil {
+		e.bridgeMapping = make(map[string]int)
+	}
+	if e.natPrefix == nil {
+		e.natPrefix = make(map[int][]int)
+	}
+}
+
+// The mutation methods below take the vmnet as it would be written in the
+// networking file, and each returns whether the configuration was changed.
+
+// SetAnswer sets the answer for an option of a vmnet, such as "NAT" for
+// `VNET_8_NAT`.
+func (e *NetworkingConfig) SetAnswer(vmnet int, option string, value string) bool {
+	e.init()
+	answers, exists := e.answer[vmnet]
+	if !exists {
+		answers = make(map[string]string)
+		e.answer[vmnet] = answers
+	}
+	if current, ok := answers[option]; ok && current == value {
+		return false
+	}
+	answers[option] = value
+	e.invalidateTypes()
+	return true
+}
+
+// RemoveAnswer removes the answer for an option of a vmnet.
+func (e *NetworkingConfig) RemoveAnswer(vmnet int, option string) bool {
+	if _, ok := e.answer[vmnet][option]; !ok {
+		return false
+	}
+	delete(e.answer[vmnet], option)
+	e.invalidateTypes()
+	return true
+}
+
+// AddNatPortForward forwards a port on the host to a port on a guest.
+func (e *NetworkingConfig) AddNatPortForward(vmnet int, protocol string, port int, targetHost net.IP, targetPort int) bool {
+	e.init()
+	protoport := fmt.Sprintf("%s/%d", protocol, port)
+	target := fmt.Sprintf("%s:%d", targetHost, targetPort)
+
+	portfwds, exists := e.natPortFwd[vmnet-1]
+	if !exists {
+		portfwds = make(map[string]string)
+		e.natPortFwd[vmnet-1] = portfwds
+	}
+	if current, ok := portfwds[protoport]; ok && current == target {
+		return false
+	}
+	portfwds[protoport] = target
+	return true
+}
+
+// RemoveNatPortForward removes the forward of a port on the host.
+func (e *NetworkingConfig) RemoveNatPortForward(vmnet int, protocol string, port int) bool {
+	protoport := fmt.Sprintf("%s/%d", protocol, port)
+	if _, ok := e.natPortFwd[vmnet-1][protoport]; !ok {
+		return false
+	}
+	delete(e.natPortFwd[vmnet-1], protoport)
+	return true
+}
+
+// AddDhcpMacToIp reserves an address for a hardware address.
+func (e *NetworkingConfig) AddDhcpMacToIp(vmnet int, mac net.HardwareAddr, ip net.IP) bool {
+	e.init()
+	dhcpmacs, exists := e.dhcpMacToIp[vmnet-1]
+	if !exists {
+		dhcpmacs = make(map[string]net.IP)
+		e.dhcpMacToIp[vmnet-1] = dhcpmacs
+	}
+	if current, ok := dhcpmacs[normalizeMAC(mac)]; ok && current.Equal(ip) {
+		return false
+	}
+	entry := networkingCommandEntryAddDhcpMacToIp{vnet: vmnet - 1, mac: mac, ip: ip}
+	e.dhcpMacToIpEntries = append(e.dhcpMacToIpEntries, networkingCommandEntry{entry: entry, addDhcpMacToIp: &entry})
+	dhcpmacs[normalizeMAC(mac)] = ip
+	return true
+}
+
+// RemoveDhcpMacToIp removes the reservation for a hardware address.
+func (e *NetworkingConfig) RemoveDhcpMacToIp(vmnet int, mac net.HardwareAddr) bool {
+	if _, ok := e.dhcpMacToIp[vmnet-1][normalizeMAC(mac)]; !ok {
+		return false
+	}
+	entry := networkingCommandEntryRemoveDhcpMacToIp{vnet: vmnet - 1, mac: mac}
+	e.dhcpMacToIpEntries = append(e.dhcpMacToIpEntries, networkingCommandEntry{entry: entry, removeDhcpMacToIp: &entry})
+	delete(e.dhcpMacToIp[vmnet-1], normalizeMAC(mac))
+	return true
+}
+
+// AddBridgeMapping bridges a vmnet to a host interface.
+func (e *NetworkingConfig) AddBridgeMapping(intf string, vmnet int) bool {
+	e.init()
+	if current, ok := e.bridgeMapping[intf]; ok && current == vmnet-1 {
+		return false
+	}
+	entry := networkingCommandEntryAddBridgeMapping{intf: networkingInterface{name: intf}, vnet: vmnet - 1}
+	e.bridgeMappingEntries = append(e.bridgeMappingEntries, networkingCommandEntry{entry: entry, addBridgeMapping: &entry})
+	e.bridgeMapping[intf] = vmnet - 1
+	e.invalidateTypes()
+	return true
+}
+
+// RemoveBridgeMapping removes the bridge for a host interface.
+func (e *NetworkingConfig) RemoveBridgeMapping(intf string) bool {
+	if _, ok := e.bridgeMapping[intf]; !ok {
+		return false
+	}
+	entry := networkingCommandEntryRemoveBridgeMapping{intf: networkingInterface{name: intf}}
+	e.bridgeMappingEntries = append(e.bridgeMappingEntries, networkingCommandEntry{entry: entry, removeBridgeMapping: &entry})
+	delete(e.bridgeMapping, intf)
+	e.invalidateTypes()
+	return true
+}
+
+// AddNatPrefix adds a prefix length to a vmnet.
+func (e *NetworkingConfig) AddNatPrefix(vmnet int, prefix int) bool {
+	e.init()
+	for _, current := range e.natPrefix[vmnet-1] {
+		if current == prefix {
+			return false
+		}
+	}
+	e.natPrefix[vmnet-1] = append(e.natPrefix[vmnet-1], prefix)
+	return true
+}
+
+// RemoveNatPrefix removes a prefix length from a vmnet.
+func (e *NetworkingConfig) RemoveNatPrefix(vmnet int, prefix int) bool {
+	prefixes := e.natPrefix[vmnet-1]
+	for index := range prefixes {
+		if prefixes[index] == prefix {
+			e.natPrefix[vmnet-1] = append(prefixes[:index], prefixes[index+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// BridgeMappingConflicts returns a description of each conflict between the
+// bridge mappings, which is either an interface that was bridged to more than
+// one vmnet without being removed in between, or a vmnet that is bridged to
+// more than one interface.
+func (e NetworkingConfig) BridgeMappingConflicts() []string {
+	var result []string
+
+	// Walk the commands in order, since a later mapping for an interface
+	// replaces an earlier one when flattened.
+	mapped := make(map[string]int)
+	for _, entry := range e.bridgeMappingEntries {
+		switch entry.entry.(type) {
+		case networkingCommandEntryAddBridgeMapping:
+			name, vnet := entry.addBridgeMapping.intf.name, entry.addBridgeMapping.vnet
+			if previous, exists := mapped[name]; exists && previous != vnet {
+				result = append(result, fmt.Sprintf("interface %s is bridged to both %s%d and %s%d", name, NetworkingInterfacePrefix, previous+1, NetworkingInterfacePrefix, vnet+1))
+			}
+			mapped[name] = vnet
+
+		case networkingCommandEntryRemoveBridgeMapping:
+			delete(mapped, entry.removeBridgeMapping.intf.name)
+		}
 	}
 
-	ip := net.ParseIP(row[2])
-	if ip == nil {
-		return nil, fmt.Errorf("unable to parse third argument as IPv4 address : %v", row[2])
+	shared := make(map[int][]string)
+	for name, vnet := range e.bridgeMapping {
+		shared[vnet] = append(shared[vnet], name)
 	}
 
-	result := networkingCommandEntryAddDhcpMacToIp{vnet: vnet - 1, mac: mac, ip: ip}
-	return &networkingCommandEntry{entry: result, addDhcpMacToIp: &result}, nil
-}
-func parseNetworkingCommandRemoveDhcpMacToIp(row []string) (*networkingCommandEntry, error) {
-	if len(row) != 2 {
-		return nil, fmt.Errorf("expected %d arguments but received %d", 2, len(row))
+	vnets := make([]int, 0, len(shared))
+	for vnet := range shared {
+		vnets = append(vnets, vnet)
 	}
+	sort.Ints(vnets)
 
-	vnet, err := strconv.Atoi(row[0])
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse first argument as an integer : %v", row[0])
+	for _, vnet := range vnets {
+		if names := shared[vnet]; len(names) > 1 {
+			sort.Strings(names)
+			result = append(result, fmt.Sprintf("%s%d is bridged to multiple interfaces: %s", NetworkingInterfacePrefix, vnet+1, strings.Join(names, ", ")))
+		}
 	}
+	return result
+}
 
-	mac, err := net.ParseMAC(row[1])
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse second argument as hardware address : %v", row[1])
-	}
+// DhcpReservationConflicts returns a description of each hardware address
+// that was reserved a different address within the same vmnet by more than
+// one `add_dhcp_mac_to_ip` command, without being removed in between. Only the
+// last of these takes effect, but the earlier ones usually mean that another
+// virtual machine is expecting the address.
+func (e NetworkingConfig) DhcpReservationConflicts() []string {
+	var result []string
 
-	result := networkingCommandEntryRemoveDhcpMacToIp{vnet: vnet - 1, mac: mac}
-	return &networkingCommandEntry{entry: result, removeDhcpMacToIp: &result}, nil
-}
-func parseNetworkingCommandAddBridgeMapping(row []string) (*networkingCommandEntry, error) {
-	if len(row) != 2 {
-		return nil, fmt.Errorf("expected %d arguments but received %d", 2, len(row))
+	// Walk the commands in order, since a later reservation for a hardware
+	// address replaces an earlier one when flattened.
+	type reservation struct {
+		vnet int
+		mac  string
 	}
-	intf := networkingInterface{name: row[0]}
+	reserved := make(map[reservation]net.IP)
+	for _, entry := range e.dhcpMacToIpEntries {
+		switch entry.entry.(type) {
+		case networkingCommandEntryAddDhcpMacToIp:
+			key := reservation{vnet: entry.addDhcpMacToIp.vnet, mac: normalizeMAC(entry.addDhcpMacToIp.mac)}
+			ip := entry.addDhcpMacToIp.ip
+			if previous, exists := reserved[key]; exists && !previous.Equal(ip) {
+				result = append(result, fmt.Sprintf("hardware address %s on %s%d is reserved both %s and %s", key.mac, NetworkingInterfacePrefix, key.vnet+1, previous, ip))
+			}
+			reserved[key] = ip
 
-	vnet, err := strconv.Atoi(row[1])
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse second argument as an integer : %v", row[2])
+		case networkingCommandEntryRemoveDhcpMacToIp:
+			delete(reserved, reservation{vnet: entry.removeDhcpMacToIp.vnet, mac: normalizeMAC(entry.removeDhcpMacToIp.mac)})
+		}
 	}
-
-	result := networkingCommandEntryAddBridgeMapping{intf: intf, vnet: vnet - 1}
-	return &networkingCommandEntry{entry: result, addBridgeMapping: &result}, nil
+	return result
 }
-func parseNetworkingCommandRemoveBridgeMapping(row []string) (*networkingCommandEntry, error) {
-	if len(row) != 1 {
-		return nil, fmt.Errorf("expected %d argument but received %d", 1, len(row))
+
+// DhcpConfPath returns the path of the dhcpd.conf for a vmnet, as given by
+// its VNET_x_DHCP_CONF answer.
+func (e NetworkingConfig) DhcpConfPath(vmnet int) (string, bool) {
+	path, ok := e.Answer(vmnet, "DHCP_CONF")
+	if !ok || path == "" {
+		return "", false
 	}
-	intf := networkingInterface{name: row[0]}
-	/*
-		number, err := strconv.Atoi(row[0])
-		if err != nil {
-			return nil, fmt.Errorf("Unable to parse first argument as an integer. : %v", row[0])
-		}
-	*/
-	result := networkingCommandEntryRemoveBridgeMapping{intf: intf}
-	return &networkingCommandEntry{entry: result, removeBridgeMapping: &result}, nil
+	return path, true
 }
-func parseNetworkingCommandAddNatPrefix(row []string) (*networkingCommandEntry, error) {
-	if len(row) != 2 {
-		return nil, fmt.Errorf("expected %d arguments but received %d", 2, len(row))
-	}
 
-	vnet, err := strconv.Atoi(row[0])
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse first argument as an integer : %v", row[0])
+// vmnetSubnet returns the subnet of a vmnet as given by its HOSTONLY_SUBNET
+// and HOSTONLY_NETMASK answers, and whether both were present.
+func (e NetworkingConfig) vmnetSubnet(vmnet int) (net.IPNet, bool, error) {
+	address, ok := e.Answer(vmnet, "HOSTONLY_SUBNET")
+	if !ok {
+		return net.IPNet{}, false, nil
 	}
-
-	if !strings.HasPrefix(row[1], "/") {
-		return nil, fmt.Errorf("expected second argument to begin with \"/\" : %v", row[1])
+	netmask, ok := e.Answer(vmnet, "HOSTONLY_NETMASK")
+	if !ok {
+		return net.IPNet{}, false, nil
 	}
 
-	prefix, err := strconv.Atoi(row[1][1:])
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse prefix from second argument : %v", row[1])
+	ip, mask := net.ParseIP(address).To4(), net.ParseIP(netmask).To4()
+	if ip == nil || mask == nil {
+		return net.IPNet{}, true, fmt.Errorf("%s%d has an invalid subnet (%s/%s)", NetworkingInterfacePrefix, vmnet, address, netmask)
 	}
-
-	result := networkingCommandEntryAddNatPrefix{vnet: vnet - 1, prefix: prefix}
-	return &networkingCommandEntry{entry: result, addNatPrefix: &result}, nil
+	return net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}, true, nil
 }
-func parseNetworkingCommandRemoveNatPrefix(row []string) (*networkingCommandEntry, error) {
-	if len(row) != 2 {
-		return nil, fmt.Errorf("expected %d arguments but received %d", 2, len(row))
-	}
 
-	vnet, err := strconv.Atoi(row[0])
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse first argument as an integer : %v", row[0])
+// VmnetForSubnet returns the vmnet whose HOSTONLY_SUBNET and HOSTONLY_NETMASK
+// answers describe the given subnet.
+func (e NetworkingConfig) VmnetForSubnet(subnet net.IPNet) (int, error) {
+	vmnets := make([]int, 0, len(e.answer))
+	for vmnet := range e.answer {
+		vmnets = append(vmnets, vmnet)
 	}
+	sort.Ints(vmnets)
 
-	if !strings.HasPrefix(row[1], "/") {
-		return nil, fmt.Errorf("expected second argument to begin with \"/\" : %v", row[1])
-	}
+	for _, vmnet := range vmnets {
+		candidate, ok, err := e.vmnetSubnet(vmnet)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			log.Printf("%s. Ignoring..", err)
+			continue
+		}
 
-	prefix, err := strconv.Atoi(row[1][1:])
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse prefix out of second argument : %v", row[1])
+		ones, _ := candidate.Mask.Size()
+		if wanted, _ := subnet.Mask.Size(); ones == wanted && candidate.IP.Equal(subnet.IP.Mask(subnet.Mask)) {
+			return vmnet, nil
+		}
 	}
-
-	result := networkingCommandEntryRemoveNatPrefix{vnet: vnet - 1, prefix: prefix}
-	return &networkingCommandEntry{entry: result, removeNatPrefix: &result}, nil
+	return 0, fmt.Errorf("no host-only %s found for subnet %s", NetworkingInterfacePrefix, subnet.String())
 }
 
-type networkingCommandParser struct {
-	command  string
-	callback func([]string) (*networkingCommandEntry, error)
+// NatPrefixes returns the prefix lengths that were added to a vmnet by its
+// `add_nat_prefix` commands, in the order that they were added.
+func (e NetworkingConfig) NatPrefixes(vmnet int) []int {
+	return slices.Clone(e.natPrefix[vmnet-1])
 }
 
-var NetworkingCommandParsers = []networkingCommandParser{
-	/* DictRecordParseFunct */ {command: "answer", callback: parseNetworkingCommandAnswer},
-	/* DictRecordParseFunct */ {command: "remove_answer", callback: parseNetworkingCommandRemoveAnswer},
-	/* NatFwdRecordParseFunct */ {command: "add_nat_portfwd", callback: parseNetworkingCommandAddNatPortFwd},
-	/* NatFwdRecordParseFunct */ {command: "remove_nat_portfwd", callback: parseNetworkingCommandRemoveNatPortFwd},
-	/* DhcpMacRecordParseFunct */ {command: "add_dhcp_mac_to_ip", callback: parseNetworkingCommandAddDhcpMacToIp},
-	/* DhcpMacRecordParseFunct */ {command: "remove_dhcp_mac_to_ip", callback: parseNetworkingCommandRemoveDhcpMacToIp},
-	/* BridgeMappingRecordParseFunct */ {command: "add_bridge_mapping", callback: parseNetworkingCommandAddBridgeMapping},
-	/* BridgeMappingRecordParseFunct */ {command: "remove_bridge_mapping", callback: parseNetworkingCommandRemoveBridgeMapping},
-	/* NatPrefixRecordParseFunct */ {command: "add_nat_prefix", callback: parseNetworkingCommandAddNatPrefix},
-	/* NatPrefixRecordParseFunct */ {command: "remove_nat_prefix", callback: parseNetworkingCommandRemoveNatPrefix},
-}
+// NatPrefixCIDRs returns the NAT prefixes of a vmnet as networks, by applying
+// each prefix length to the subnet of the vmnet. An error is returned if the
+// subnet isn't known from the answers of the vmnet.
+func (e NetworkingConfig) NatPrefixCIDRs(vmnet int) ([]net.IPNet, error) {
+	subnet, ok, err := e.vmnetSubnet(vmnet)
+	if !ok {
+		return nil, fmt.Errorf("no subnet found for %s%d", NetworkingInterfacePrefix, vmnet)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-func NetworkingParserByCommand(command string) *func([]string) (*networkingCommandEntry, error) {
-	for _, p := range NetworkingCommandParsers {
-		if p.command == command {
-			return &p.callback
+	result := make([]net.IPNet, 0, len(e.natPrefix[vmnet-1]))
+	for _, prefix := range e.natPrefix[vmnet-1] {
+		if prefix < 0 || prefix > net.IPv4len*8 {
+			return nil, fmt.Errorf("invalid prefix length /%d for %s%d", prefix, NetworkingInterfacePrefix, vmnet)
 		}
+		mask := net.CIDRMask(prefix, net.IPv4len*8)
+		result = append(result, net.IPNet{IP: subnet.IP.Mask(mask), Mask: mask})
 	}
-	return nil
+	return result, nil
 }
 
-func parseNetworkingConfig(rows chan []string) chan networkingCommandEntry {
-	out := make(chan networkingCommandEntry)
+// waitForInterfacesInterval is how long to wait between checks for the
+// bridge-mapped interfaces when waiting for them to appear.
+const waitForInterfacesInterval = 250 * time.Millisecond
 
-	go func(in chan []string, out chan networkingCommandEntry) {
-		for {
-			row, ok := <-in
-			if !ok {
-				break
-			}
+// WaitForInterfaces waits until every interface that is bridged to a vmnet is
+// present on the host, since some (such as those of a VPN or a USB adapter)
+// only appear some time after the configuration was read. An error naming the
+// interfaces that are still missing is returned if the timeout elapses first.
+func (e NetworkingConfig) WaitForInterfaces(ctx context.Context, timeout time.Duration) error {
+	return e.waitForInterfaces(ctx, timeout, net.Interfaces)
+}
 
-			if len(row) >= 1 {
-				parser := NetworkingParserByCommand(row[0])
-				if parser == nil {
-					log.Printf("invalid command : %v", row)
-					continue
-				}
+func (e NetworkingConfig) waitForInterfaces(ctx context.Context, timeout time.Duration, interfaces func() ([]net.Interface, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-				callback := *parser
+	for {
+		present, err := interfaces()
+		if err != nil {
+			return fmt.Errorf("unable to list the host interfaces: %w", err)
+		}
 
-				entry, err := callback(row[1:])
-				if err != nil {
-					log.Printf("unable to parse command : %v %v", err, row)
-					continue
-				}
-				out <- *entry
+		names := make(map[string]bool, len(present))
+		for _, intf := range present {
+			names[intf.Name] = true
+		}
+
+		var missing []string
+		for name := range e.bridgeMapping {
+			if !names[name] {
+				missing = append(missing, name)
 			}
 		}
-		close(out)
-	}(rows, out)
-	return out
+		if len(missing) == 0 {
+			return nil
+		}
+
+		select {
+		case <-time.After(waitForInterfacesInterval):
+		case <-ctx.Done():
+			sort.Strings(missing)
+			return fmt.Errorf("bridged interfaces not found after %s: %s", timeout, strings.Join(missing, ", "))
+		}
+	}
 }
 
-type NetworkingConfig struct {
-	answer      map[int]map[string]string
-	natPortFwd  map[int]map[string]string
-	dhcpMacToIp map[int]map[string]net.IP
-	//bridge_mapping map[net.Interface]uint64	// XXX: we don't need the actual interface for anything but informing the user.
-	bridgeMapping map[string]int
-	natPrefix     map[int][]int
+// LoadDhcpConf opens and parses the dhcpd.conf for a vmnet, as given by its
+// VNET_x_DHCP_CONF answer.
+func (e NetworkingConfig) LoadDhcpConf(vmnet int) (DhcpConfiguration, error) {
+	path, ok := e.DhcpConfPath(vmnet)
+	if !ok {
+		return nil, fmt.Errorf("no dhcp configuration path found for %s%d", NetworkingInterfacePrefix, vmnet)
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return ReadDhcpConfiguration(fd)
 }
 
-func (c NetworkingConfig) repr() string {
-	return fmt.Sprintf("answer -> %v\nnat_portfwd -> %v\ndhcp_mac_to_ip -> %v\nbridge_mapping -> %v\nnat_prefix -> %v", c.answer, c.natPortFwd, c.dhcpMacToIp, c.bridgeMapping, c.natPrefix)
+// Vmnets returns the sorted list of every vmnet referenced by the
+// configuration, regardless of which command referenced it.
+func (e NetworkingConfig) Vmnets() []int {
+	seen := make(map[int]bool)
+
+	for vmnet := range e.answer {
+		seen[vmnet] = true
+	}
+
+	// Every command other than `answer` stores its vmnet offset by one.
+	for vmnet := range e.natPortFwd {
+		seen[vmnet+1] = true
+	}
+	for vmnet := range e.dhcpMacToIp {
+		seen[vmnet+1] = true
+	}
+	for _, vmnet := range e.bridgeMapping {
+		seen[vmnet+1] = true
+	}
+	for vmnet := range e.natPrefix {
+		seen[vmnet+1] = true
+	}
+
+	result := make([]int, 0, len(seen))
+	for vmnet := range seen {
+		result = append(result, vmnet)
+	}
+	sort.Ints(result)
+	return result
 }
 
 func flattenNetworkingConfig(in chan networkingCommandEntry) NetworkingConfig {
@@ -1887,6 +5008,7 @@ func flattenNetworkingConfig(in chan networkingCommandEntry) NetworkingConfig {
 	result.dhcpMacToIp = make(map[int]map[string]net.IP)
 	result.bridgeMapping = make(map[string]int)
 	result.natPrefix = make(map[int][]int)
+	result.types = new(networkingTypesCache)
 
 	for {
 		e, ok := <-in
@@ -1935,24 +5057,27 @@ func flattenNetworkingConfig(in chan networkingCommandEntry) NetworkingConfig {
 			}
 
 		case networkingCommandEntryAddDhcpMacToIp:
+			result.dhcpMacToIpEntries = append(result.dhcpMacToIpEntries, e)
 			vmnet = e.addDhcpMacToIp.vnet
 			dhcpmacs, exists := result.dhcpMacToIp[vmnet]
 			if !exists {
 				dhcpmacs = make(map[string]net.IP)
 				result.dhcpMacToIp[vmnet] = dhcpmacs
 			}
-			dhcpmacs[e.addDhcpMacToIp.mac.String()] = e.addDhcpMacToIp.ip
+			dhcpmacs[normalizeMAC(e.addDhcpMacToIp.mac)] = e.addDhcpMacToIp.ip
 
 		case networkingCommandEntryRemoveDhcpMacToIp:
+			result.dhcpMacToIpEntries = append(result.dhcpMacToIpEntries, e)
 			vmnet = e.removeDhcpMacToIp.vnet
 			dhcpmacs, exists := result.dhcpMacToIp[vmnet]
 			if exists {
-				delete(dhcpmacs, e.removeDhcpMacToIp.mac.String())
+				delete(dhcpmacs, normalizeMAC(e.removeDhcpMacToIp.mac))
 			} else {
 				log.Printf("unable to remove dhcp_mac_to_ip entry %v from interface %s%d as specified by `remove_dhcp_mac_to_ip`\n", e.removeDhcpMacToIp, NetworkingInterfacePrefix, vmnet)
 			}
 
 		case networkingCommandEntryAddBridgeMapping:
+			result.bridgeMappingEntries = append(result.bridgeMappingEntries, e)
 			intf := e.addBridgeMapping.intf
 			if _, err := intf.Interface(); err != nil {
 				log.Printf("interface \"%s\" as specified by `add_bridge_mapping` was not found on the current platform; ignoring", intf.name)
@@ -1960,6 +5085,7 @@ func flattenNetworkingConfig(in chan networkingCommandEntry) NetworkingConfig {
 			result.bridgeMapping[intf.name] = e.addBridgeMapping.vnet
 
 		case networkingCommandEntryRemoveBridgeMapping:
+			result.bridgeMappingEntries = append(result.bridgeMappingEntries, e)
 			intf := e.removeBridgeMapping.intf
 			if _, err := intf.Interface(); err != nil {
 				log.Printf("interface \"%s\" as specified by `remove_bridge_mapping` was not found on the current platform; ignoring", intf.name)
@@ -1986,42 +5112,247 @@ func flattenNetworkingConfig(in chan networkingCommandEntry) NetworkingConfig {
 					}
 				}
 
-			} else {
-				log.Printf("unable to remove nat prefix /%d from interface %s%d as specified by `remove_nat_prefix`\n", e.removeNatPrefix.prefix, NetworkingInterfacePrefix, vmnet)
-			}
+			} else {
+				log.Printf("unable to remove nat prefix /%d from interface %s%d as specified by `remove_nat_prefix`\n", e.removeNatPrefix.prefix, NetworkingInterfacePrefix, vmnet)
+			}
+		}
+	}
+	return result
+}
+
+// networkingPaths are the conventional locations of the networking file for
+// each operating system. Each is given a function to look up environment
+// variables, so that they can be tested.
+var networkingPaths = map[string]func(getenv func(string) string) (string, error){
+	osMacOS: func(func(string) string) (string, error) {
+		return filepath.Join("/", "Library", "Preferences", "VMware Fusion", "networking"), nil
+	},
+	osLinux: func(func(string) string) (string, error) {
+		return filepath.Join(linuxDefaultPath, "networking"), nil
+	},
+	osWindows: func(getenv func(string) string) (string, error) {
+		programData := getenv("ProgramData")
+		if programData == "" {
+			return "", errors.New("unable to locate the networking file: ProgramData is not set")
+		}
+		return filepath.Join(programData, "VMware", "networking"), nil
+	},
+}
+
+// networkingPath returns the conventional location of the networking file for
+// an operating system.
+func networkingPath(goos string, getenv func(string) string) (string, error) {
+	path, ok := networkingPaths[goos]
+	if !ok {
+		return "", fmt.Errorf("no default location of the networking file for %s", goos)
+	}
+	return path(getenv)
+}
+
+// DefaultNetworkingPath returns the conventional location of the networking
+// file for the current operating system.
+func DefaultNetworkingPath() (string, error) {
+	return networkingPath(runtime.GOOS, os.Getenv)
+}
+
+// ReadDefaultNetworkingConfig reads the networking file from its conventional
+// location for the current operating system.
+func ReadDefaultNetworkingConfig() (NetworkingConfig, error) {
+	path, err := DefaultNetworkingPath()
+	if err != nil {
+		return NetworkingConfig{}, err
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return NetworkingConfig{}, err
+	}
+	defer fd.Close()
+
+	return ReadNetworkingConfig(fd)
+}
+
+// NetworkingConfigOptions controls how a networking configuration file is
+// interpreted.
+type NetworkingConfigOptions struct {
+	// InterfacePrefix is the prefix of the device names that a network name
+	// resolves to, such as `vmnet` for `vmnet8`. Defaults to
+	// NetworkingInterfacePrefix.
+	InterfacePrefix string
+}
+
+// ReadNetworkingConfigWithOptions reads and parses a networking configuration
+// file like ReadNetworkingConfig, interpreting it with the given options.
+func ReadNetworkingConfigWithOptions(fd *os.File, options NetworkingConfigOptions) (NetworkingConfig, error) {
+	result, err := ReadNetworkingConfig(fd)
+	if err != nil {
+		return NetworkingConfig{}, err
+	}
+	result.prefix = options.InterfacePrefix
+	return result, nil
+}
+
+// ReadNetworkingConfig reads and parses a networking configuration file.
+func ReadNetworkingConfig(fd *os.File) (NetworkingConfig, error) {
+
+	// start piecing together all the different parts of the file and split
+	// it into its individual rows.
+	fromfile := consumeFile(fd)
+	tokenized := tokenizeNetworkingConfig(fromfile)
+	rows := splitNetworkingConfig(tokenized)
+
+	// consume the version _first_. this is important because if the version is
+	// wrong, then there's likely tokens that we won't know how to interpret.
+	// a file that is only a version is fine, but one without it isn't.
+	versionRow, ok := <-rows
+	if !ok {
+		return NetworkingConfig{}, errors.New("missing version in networking file")
+	}
+	parsedVersion, err := networkingReadVersion(versionRow)
+	if err != nil {
+		return NetworkingConfig{}, err
+	}
+
+	// verify that it's 1.0 since that's all we support for now.
+	if version := parsedVersion.Number(); version != 1.0 {
+		return NetworkingConfig{}, fmt.Errorf("expected version %f of networking file but received version %f", 1.0, version)
+	}
+
+	// now that our version has been confirmed, we can proceed to parse the
+	// rest of the file and parseNetworkingConfig is free to consume rows as
+	// much as it wants to.
+	entries := parseNetworkingConfig(rows)
+
+	// convert what we've parsed into a configuration that's easy to interpret
+	return flattenNetworkingConfig(entries), nil
+}
+
+// WriteNetworkingConfig writes the configuration in the format of VMware's
+// networking file. The output is in a canonical form so that writing the same
+// configuration always produces the same bytes:
+//
+//	VERSION=1,0
+//	answer VNET_1_DHCP yes
+//	answer VNET_1_NAT no
+//
+//	answer VNET_8_NAT yes
+//	add_nat_portfwd 8 tcp 2222 172.16.41.129 22
+//	add_dhcp_mac_to_ip 8 00:50:56:00:00:01 172.16.41.129
+//	add_bridge_mapping en0 8
+//	add_nat_prefix 8 /24
+//
+// Each vmnet is written as a group of lines, in ascending order, with a blank
+// line between groups. Within a group, the answers are sorted by key, then
+// the port forwards by protocol and port, then the reservations by hardware
+// address, then the bridge mappings by interface, and finally the prefixes
+// in the order they were added.
+func WriteNetworkingConfig(fd io.Writer, config NetworkingConfig) error {
+	// Commands other than answers are stored against one less than the vmnet
+	// that they were read from, so translate them back.
+	groups := make(map[int][]string)
+	for vmnet, answers := range config.answer {
+		keys := make([]string, 0, len(answers))
+		for key := range answers {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			groups[vmnet] = append(groups[vmnet], fmt.Sprintf("answer VNET_%d_%s %s", vmnet, key, quoteNetworkingAnswer(answers[key])))
+		}
+	}
+
+	for vmnet, portfwds := range config.natPortFwd {
+		type portfwd struct {
+			protocol string
+			port     int
+			target   string
+		}
+
+		entries := make([]portfwd, 0, len(portfwds))
+		for protoport, target := range portfwds {
+			protocol, port, _ := strings.Cut(protoport, "/")
+			number, err := strconv.Atoi(port)
+			if err != nil {
+				return fmt.Errorf("invalid nat port-forward %s for interface %s%d", protoport, NetworkingInterfacePrefix, vmnet+1)
+			}
+			entries = append(entries, portfwd{protocol: protocol, port: number, target: target})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].protocol != entries[j].protocol {
+				return entries[i].protocol < entries[j].protocol
+			}
+			return entries[i].port < entries[j].port
+		})
+
+		for _, entry := range entries {
+			host, port, err := net.SplitHostPort(entry.target)
+			if err != nil {
+				return fmt.Errorf("invalid nat port-forward target %s for interface %s%d", entry.target, NetworkingInterfacePrefix, vmnet+1)
+			}
+			groups[vmnet+1] = append(groups[vmnet+1], fmt.Sprintf("add_nat_portfwd %d %s %d %s %s", vmnet+1, entry.protocol, entry.port, host, port))
+		}
+	}
+
+	for vmnet, dhcpmacs := range config.dhcpMacToIp {
+		macs := make([]string, 0, len(dhcpmacs))
+		for mac := range dhcpmacs {
+			macs = append(macs, mac)
+		}
+		sort.Strings(macs)
+
+		for _, mac := range macs {
+			groups[vmnet+1] = append(groups[vmnet+1], fmt.Sprintf("add_dhcp_mac_to_ip %d %s %s", vmnet+1, mac, dhcpmacs[mac]))
 		}
 	}
-	return result
-}
 
-// ReadNetworkingConfig reads and parses a networking configuration file.
-func ReadNetworkingConfig(fd *os.File) (NetworkingConfig, error) {
+	intfs := make([]string, 0, len(config.bridgeMapping))
+	for intf := range config.bridgeMapping {
+		intfs = append(intfs, intf)
+	}
+	sort.Strings(intfs)
 
-	// start piecing together all the different parts of the file and split
-	// it into its individual rows.
-	fromfile := consumeFile(fd)
-	tokenized := tokenizeNetworkingConfig(fromfile)
-	rows := splitNetworkingConfig(tokenized)
+	for _, intf := range intfs {
+		vmnet := config.bridgeMapping[intf] + 1
+		groups[vmnet] = append(groups[vmnet], fmt.Sprintf("add_bridge_mapping %s %d", intf, vmnet))
+	}
 
-	// consume the version _first_. this is important because if the version is
-	// wrong, then there's likely tokens that we won't know how to interpret.
-	parsedVersion, err := networkingReadVersion(<-rows)
-	if err != nil {
-		return NetworkingConfig{}, err
+	for vmnet, prefixes := range config.natPrefix {
+		for _, prefix := range prefixes {
+			groups[vmnet+1] = append(groups[vmnet+1], fmt.Sprintf("add_nat_prefix %d /%d", vmnet+1, prefix))
+		}
 	}
 
-	// verify that it's 1.0 since that's all we support for now.
-	if version := parsedVersion.Number(); version != 1.0 {
-		return NetworkingConfig{}, fmt.Errorf("expected version %f of networking file but received version %f", 1.0, version)
+	vmnets := make([]int, 0, len(groups))
+	for vmnet := range groups {
+		vmnets = append(vmnets, vmnet)
 	}
+	sort.Ints(vmnets)
 
-	// now that our version has been confirmed, we can proceed to parse the
-	// rest of the file and parseNetworkingConfig is free to consume rows as
-	// much as it wants to.
-	entries := parseNetworkingConfig(rows)
+	var b strings.Builder
+	b.WriteString("VERSION=1,0\n")
+	for i, vmnet := range vmnets {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		for _, line := range groups[vmnet] {
+			b.WriteString(line)
+			b.WriteString("\n")
+		}
+	}
 
-	// convert what we've parsed into a configuration that's easy to interpret
-	return flattenNetworkingConfig(entries), nil
+	_, err := io.WriteString(fd, b.String())
+	return err
+}
+
+// quoteNetworkingAnswer quotes an answer value if it would otherwise not be
+// read back as a single token. The quotes are stripped literally when the
+// value is read, so nothing within them is escaped.
+func quoteNetworkingAnswer(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t") || strings.HasPrefix(value, "\"") {
+		return "\"" + value + "\""
+	}
+	return value
 }
 
 // NetworkingType represents the type of network configuration.
@@ -2049,6 +5380,12 @@ func networkingConfigInterfaceTypes(config NetworkingConfig) map[int]NetworkingT
 	// walk through answers finding out which ones are nat versus hostonly
 	for vmnet, table := range config.answer {
 
+		// a disabled interface isn't usable, whatever its type would be.
+		if networkingAnswerDisabled(table) {
+			delete(result, vmnet)
+			continue
+		}
+
 		// everything should be defined as a virtual adapter...
 		if table["VIRTUAL_ADAPTER"] == "yes" {
 
@@ -2097,9 +5434,12 @@ func networkingConfigNamesToVmnet(config NetworkingConfig) map[NetworkingType][]
 
 const NetworkingInterfacePrefix = "vmnet"
 
+// NameIntoDevices returns the devices of a standard network name, which is one
+// of `hostonly`, `nat`, or `bridged`, ignoring case. The aliases `host-only` and
+// `host_only` are accepted for `hostonly`, and `bridge` for `bridged`.
 func (e NetworkingConfig) NameIntoDevices(name string) ([]string, error) {
-	netmapper := networkingConfigNamesToVmnet(e)
-	name = strings.ToLower(name)
+	_, netmapper := e.networkingTypes()
+	name = NormalizeNetworkName(name)
 
 	var vmnets []string
 	var networkingType NetworkingType
@@ -2113,23 +5453,63 @@ func (e NetworkingConfig) NameIntoDevices(name string) ([]string, error) {
 		networkingType = NetworkingTypeBridged
 
 	} else {
-		return make([]string, 0), fmt.Errorf("error finding network name : %v", name)
+		return make([]string, 0), networkNameError(name, e.AvailableNetworks())
 	}
 
 	for i := 0; i < len(netmapper[networkingType]); i++ {
-		vmnets = append(vmnets, fmt.Sprintf("%s%d", NetworkingInterfacePrefix, netmapper[networkingType][i]))
+		vmnets = append(vmnets, fmt.Sprintf("%s%d", e.interfacePrefix(), netmapper[networkingType][i]))
 	}
 	return vmnets, nil
 }
 
+// AvailableNetworks returns the standard network names that have at least one
+// device, followed by every device of the configuration.
+func (e NetworkingConfig) AvailableNetworks() []string {
+	types, netmapper := e.networkingTypes()
+
+	var result []string
+	for _, network := range []struct {
+		name           string
+		networkingType NetworkingType
+	}{
+		{"hostonly", NetworkingTypeHostonly},
+		{"nat", NetworkingTypeNat},
+		{"bridged", NetworkingTypeBridged},
+	} {
+		if len(netmapper[network.networkingType]) > 0 {
+			result = append(result, network.name)
+		}
+	}
+
+	vmnets := make([]int, 0, len(types))
+	for vmnet := range types {
+		vmnets = append(vmnets, vmnet)
+	}
+	sort.Ints(vmnets)
+	for _, vmnet := range vmnets {
+		result = append(result, fmt.Sprintf("%s%d", e.interfacePrefix(), vmnet))
+	}
+	return result
+}
+
+// NameIntoDevice returns the single device for a network name.
+func (e NetworkingConfig) NameIntoDevice(name string) (string, error) {
+	devices, err := e.NameIntoDevices(name)
+	if err != nil {
+		return "", err
+	}
+	return canonicalNetworkDevice(name, e.interfacePrefix(), devices)
+}
+
 func (e NetworkingConfig) DeviceIntoName(device string) (string, error) {
-	types := networkingConfigInterfaceTypes(e)
+	types, _ := e.networkingTypes()
+	prefix := strings.ToLower(e.interfacePrefix())
 
 	lowerdevice := strings.ToLower(device)
-	if !strings.HasPrefix(lowerdevice, NetworkingInterfacePrefix) {
+	if !strings.HasPrefix(lowerdevice, prefix) {
 		return device, nil
 	}
-	vmnet, err := strconv.Atoi(lowerdevice[len(NetworkingInterfacePrefix):])
+	vmnet, err := strconv.Atoi(lowerdevice[len(prefix):])
 	if err != nil {
 		return "", err
 	}
@@ -2144,11 +5524,11 @@ func (e NetworkingConfig) DeviceIntoName(device string) (string, error) {
 	case NetworkingTypeBridged:
 		return "bridged", nil
 	}
-	return "", fmt.Errorf("unable to determine network type for device %s%d", NetworkingInterfacePrefix, vmnet)
+	return "", fmt.Errorf("unable to determine network type for device %s%d", e.interfacePrefix(), vmnet)
 }
 
 /** generic async file reader */
-func consumeFile(fd *os.File) chan byte {
+func consumeFile(fd io.Reader) chan byte {
 	fromFile := make(chan byte)
 	go func() {
 		b := make([]byte, 1)
@@ -2166,6 +5546,52 @@ func consumeFile(fd *os.File) chan byte {
 	return fromFile
 }
 
+// consumeFileContext writes each byte of a reader to a channel like
+// consumeFile, but closes the channel as soon as the context is done. A read
+// that is in progress can't be interrupted, so the goroutine performing it
+// exits once it returns.
+func consumeFileContext(ctx context.Context, fd io.Reader) chan byte {
+	read := make(chan byte)
+	go func() {
+		defer close(read)
+		b := make([]byte, 1)
+		for {
+			n, err := fd.Read(b)
+			if n > 0 {
+				select {
+				case read <- b[0]:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	fromFile := make(chan byte)
+	go func() {
+		defer close(fromFile)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case by, ok := <-read:
+				if !ok {
+					return
+				}
+				select {
+				case fromFile <- by:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return fromFile
+}
+
 /** Consume a byte channel until a terminal byte is reached, and write each list of bytes to a channel */
 func consumeUntilSentinel(sentinel byte, in chan byte) (result []byte, ok bool) {
 
@@ -2250,6 +5676,28 @@ func consumeOpenClosePair(openByte, closeByte byte, in chan byte) ([]byte, chan
 	return result, out
 }
 
+// normalizeMAC returns the canonical form of a hardware address, which is
+// lowercase with each octet written as two digits separated by colons. It's
+// used to key hardware addresses, which are otherwise compared as bytes.
+func normalizeMAC(mac net.HardwareAddr) string {
+	return mac.String()
+}
+
+// parseMAC parses a hardware address like net.ParseMAC, but also accepts
+// octets that are written without a leading zero, such as `0:50:56:...`.
+func parseMAC(s string) (net.HardwareAddr, error) {
+	if strings.Contains(s, ":") {
+		octets := strings.Split(s, ":")
+		for i, octet := range octets {
+			if len(octet) == 1 {
+				octets[i] = "0" + octet
+			}
+		}
+		s = strings.Join(octets, ":")
+	}
+	return net.ParseMAC(s)
+}
+
 // Basic decoding of a dhcpd lease address
 func decodeDhcpdLeaseBytes(input string) ([]byte, error) {
 	processed := &bytes.Buffer{}
@@ -2279,7 +5727,9 @@ func decodeDhcpdLeaseBytes(input string) ([]byte, error) {
 }
 
 /*** Dhcp Leases */
-type dhcpLeaseEntry struct {
+
+// DhcpLeaseEntry represents a lease parsed from a dhcpd leases file.
+type DhcpLeaseEntry struct {
 	address                    string
 	starts, ends               time.Time
 	startsWeekday, endsWeekday int
@@ -2287,7 +5737,195 @@ type dhcpLeaseEntry struct {
 	extra                      []string
 }
 
-func readDhcpdLeaseEntry(in chan byte) (entry *dhcpLeaseEntry, err error) {
+// Address returns the address of the lease.
+func (e DhcpLeaseEntry) Address() string {
+	return e.address
+}
+
+// HardwareAddress returns the hardware address of the client holding the
+// lease.
+func (e DhcpLeaseEntry) HardwareAddress() net.HardwareAddr {
+	return net.HardwareAddr(e.ether)
+}
+
+// UIDString returns the client identifier of the lease in a readable form.
+// An identifier that is printable ASCII, optionally prefixed by a type byte of
+// zero, is returned as that text. Anything else, such as a type byte followed
+// by a hardware address, is returned as colon-separated hex.
+func (e DhcpLeaseEntry) UIDString() string {
+	if text := e.uid; len(text) > 0 {
+		if len(text) > 1 && text[0] == 0 {
+			text = text[1:]
+		}
+		if isPrintableASCII(text) {
+			return string(text)
+		}
+	}
+
+	octets := make([]string, len(e.uid))
+	for i, b := range e.uid {
+		octets[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(octets, ":")
+}
+
+// DhcpLeaseEntries is a list of leases parsed from a dhcpd leases file.
+type DhcpLeaseEntries []DhcpLeaseEntry
+
+// Active returns whether the lease holds its address at the given time. A
+// lease without an end, such as one that ends `never`, never expires.
+func (e DhcpLeaseEntry) Active(now time.Time) bool {
+	if now.Before(e.starts) {
+		return false
+	}
+	return e.ends.IsZero() || now.Before(e.ends)
+}
+
+// ActiveLeaseForIP returns the lease that holds an address at the given time,
+// so that an address can be checked to be free before it's assigned. If more
+// than one lease holds it, then the one that started last is returned. Nil is
+// returned if the address is free.
+func (entries DhcpLeaseEntries) ActiveLeaseForIP(ip net.IP, now time.Time) (*DhcpLeaseEntry, error) {
+	if ip == nil {
+		return nil, errors.New("no address was given")
+	}
+
+	var result *DhcpLeaseEntry
+	for i := range entries {
+		entry := &entries[i]
+		if !ip.Equal(net.ParseIP(entry.address)) || !entry.Active(now) {
+			continue
+		}
+		if result == nil || entry.starts.After(result.starts) {
+			result = entry
+		}
+	}
+	return result, nil
+}
+
+// isPrintableASCII returns whether every byte is a printable ASCII character.
+func isPrintableASCII(data []byte) bool {
+	for _, b := range data {
+		if b < 0x20 || b > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// LeaseFileHeader holds the global statements that precede the lease entries
+// of a dhcpd leases file.
+type LeaseFileHeader struct {
+	// AuthoringByteOrder is the byte order of the host that wrote the file,
+	// such as `little-endian`.
+	AuthoringByteOrder string
+
+	// ServerDuid is the DHCPv6 unique identifier of the server.
+	ServerDuid []byte
+}
+
+// dhcpdLeasePreambleStatements are the global statements that may precede the
+// lease entries of a dhcpd leases file.
+var dhcpdLeasePreambleStatements = map[string]bool{
+	"authoring-byte-order": true,
+	"server-duid":          true,
+}
+
+// nextDhcpdLeaseStatement returns the first statement of the text that ends
+// with a semicolon, ignoring any semicolon within a quoted string, and the
+// offset of the text that follows it. The offset is -1 if there isn't one.
+func nextDhcpdLeaseStatement(text []byte) (string, int) {
+	var quoted, escaped bool
+	for i, by := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case by == '\\' && quoted:
+			escaped = true
+		case by == '"':
+			quoted = !quoted
+		case by == ';' && !quoted:
+			return strings.TrimSpace(string(text[:i])), i + 1
+		}
+	}
+	return "", -1
+}
+
+// parse records a preamble statement in the header, returning whether the
+// statement was one.
+func (h *LeaseFileHeader) parse(statement string) (bool, error) {
+	name, value := statement, ""
+	if i := strings.IndexAny(statement, " \t\n"); i >= 0 {
+		name, value = statement[:i], strings.TrimSpace(statement[i:])
+	}
+	if !dhcpdLeasePreambleStatements[name] {
+		return false, nil
+	}
+	if value == "" {
+		return true, fmt.Errorf("missing value for %s", name)
+	}
+
+	switch name {
+	case "authoring-byte-order":
+		h.AuthoringByteOrder = value
+	case "server-duid":
+		if strings.HasPrefix(value, `"`) {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return true, fmt.Errorf("invalid server-duid %s: %w", value, err)
+			}
+			h.ServerDuid = []byte(unquoted)
+			break
+		}
+		duid, err := decodeDhcpdLeaseBytes(value)
+		if err != nil {
+			return true, fmt.Errorf("invalid server-duid %s: %w", value, err)
+		}
+		h.ServerDuid = duid
+	}
+	return true, nil
+}
+
+// ReadDhcpdLeaseFileHeader reads the global statements that precede the lease
+// entries of a dhcpd leases file, such as `authoring-byte-order` and
+// `server-duid`.
+func ReadDhcpdLeaseFileHeader(r io.Reader) (LeaseFileHeader, error) {
+	var preamble []byte
+	var found bool
+	for by := range uncomment(consumeFile(r)) {
+		if by == '{' {
+			found = true
+		}
+		if !found {
+			preamble = append(preamble, by)
+		}
+	}
+
+	var header LeaseFileHeader
+	for {
+		statement, n := nextDhcpdLeaseStatement(preamble)
+		if n < 0 {
+			break
+		}
+		if ok, err := header.parse(statement); err != nil {
+			return header, err
+		} else if !ok {
+			break
+		}
+		preamble = preamble[n:]
+	}
+	return header, nil
+}
+
+func readDhcpdLeaseEntry(in chan byte) (entry *DhcpLeaseEntry, err error) {
+	line := 1
+	return readDhcpdLeaseEntryAt(in, &line)
+}
+
+// readDhcpdLeaseEntryAt reads a lease entry like readDhcpdLeaseEntry, but it
+// also keeps track of the line that it's on by counting the newlines that it
+// consumes. Any error includes the line where the entry begins.
+func readDhcpdLeaseEntryAt(in chan byte, line *int) (entry *DhcpLeaseEntry, err error) {
 
 	// Build the regexes we'll use to legitimately parse each item
 	ipLineRe := regexp.MustCompile(`lease\s+(.+?)\s*$`)
@@ -2298,28 +5936,54 @@ func readDhcpdLeaseEntry(in chan byte) (entry *dhcpLeaseEntry, err error) {
 
 	// Read up to the lease item and validate that it actually matches
 	lease, ch := consumeOpenClosePair('{', '}', in)
+	*line += bytes.Count(lease, []byte{'\n'})
+
+	// The goroutine yielding the block only exits once the whole block has
+	// been received, which isn't the case when we bail early.
+	defer func() {
+		for range ch {
+		}
+	}()
+
+	// The global statements at the beginning of the file, such as
+	// `authoring-byte-order`, aren't part of the lease and are skipped.
+	for {
+		statement, n := nextDhcpdLeaseStatement(lease)
+		if n < 0 {
+			break
+		}
+		if ok, _ := new(LeaseFileHeader).parse(statement); !ok {
+			break
+		}
+		lease = lease[n:]
+	}
 
 	// If we couldn't read the lease, then this item is mangled and we should
 	// bail.
-	if len(lease) == 0 {
+	if len(bytes.TrimSpace(lease)) == 0 {
 		return nil, nil
 	}
 
+	// The entry begins at its first non-whitespace byte, which may be after
+	// any blank lines separating it from the previous one.
+	leading := len(lease) - len(bytes.TrimLeft(lease, " \t\n"))
+	entryLine := *line - bytes.Count(lease[leading:], []byte{'\n'})
+
 	matches := ipLineRe.FindStringSubmatch(string(lease))
 	if matches == nil {
 		res := strings.TrimSpace(string(lease))
-		return &dhcpLeaseEntry{extra: []string{res}}, fmt.Errorf("unable to parse lease entry (%#v)", string(lease))
+		return &DhcpLeaseEntry{extra: []string{res}}, fmt.Errorf("line %d: unable to parse lease entry (%#v)", entryLine, res)
 	}
 
 	if by, ok := <-ch; ok && by == '{' {
 		// If we found a lease match, and we're definitely beginning a lease
 		// entry, then create our storage.
-		entry = &dhcpLeaseEntry{address: matches[1]}
+		entry = &DhcpLeaseEntry{address: matches[1]}
 
 	} else if ok {
 		// If we didn't see a starting brace, then this entry is mangled which
 		// means that we should probably bail.
-		return &dhcpLeaseEntry{address: matches[1]}, fmt.Errorf("missing parameters for lease entry %v", matches[1])
+		return &DhcpLeaseEntry{address: matches[1]}, fmt.Errorf("line %d: missing parameters for lease entry %v", entryLine, matches[1])
 
 	} else if !ok {
 		// If our channel is closed, so we bail "cleanly".
@@ -2330,6 +5994,7 @@ func readDhcpdLeaseEntry(in chan byte) (entry *dhcpLeaseEntry, err error) {
 	for insideBraces := true; insideBraces; {
 		item, ok := consumeUntilSentinel(';', ch)
 		itemS := string(item)
+		*line += bytes.Count(item, []byte{'\n'})
 
 		if !ok {
 			insideBraces = false
@@ -2390,17 +6055,155 @@ func readDhcpdLeaseEntry(in chan byte) (entry *dhcpLeaseEntry, err error) {
 	return entry, nil
 }
 
-func ReadDhcpdLeaseEntries(fd *os.File) ([]dhcpLeaseEntry, error) {
-	fch := consumeFile(fd)
+// followDhcpdLeasesInterval is how long to wait for more data when following
+// a dhcpd leases file that has reached its end.
+const followDhcpdLeasesInterval = 250 * time.Millisecond
+
+// followFile is like consumeFile, but it waits for more data when the end of
+// the reader is reached instead of stopping. The channel is closed when the
+// context is done or the reader fails.
+func followFile(ctx context.Context, fd io.Reader, failed func(error)) chan byte {
+	fromFile := make(chan byte)
+	go func() {
+		defer close(fromFile)
+
+		b := make([]byte, 1)
+		for {
+			n, err := fd.Read(b)
+			if n > 0 {
+				select {
+				case fromFile <- b[0]:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			if err != nil && err != io.EOF {
+				failed(err)
+				return
+			}
+
+			// We're at the end of what has been written so far, so wait for
+			// more to arrive.
+			select {
+			case <-time.After(followDhcpdLeasesInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return fromFile
+}
+
+// FollowDhcpdLeases parses dhcpd lease entries from the reader as they arrive,
+// such as from a leases file that is still being written to, and calls fn for
+// each complete entry. Reaching the end of the reader doesn't stop it, and it
+// waits for more data until the context is done. Entries that fail to parse
+// are logged and skipped. The callback is never called after this returns.
+func FollowDhcpdLeases(ctx context.Context, fd io.Reader, fn func(DhcpLeaseEntry)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	readErr := make(chan error, 1)
+	failed := func(err error) {
+		readErr <- err
+		cancel()
+	}
+
+	fch := followFile(ctx, fd, failed)
+	uncommentedch := uncomment(fch)
+	wch := filterOutCharacters([]byte{'\r', '\v'}, uncommentedch)
+
+	var mu sync.Mutex
+	var stopped bool
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		line := 1
+		for i := 0; ; i++ {
+			entry, err := readDhcpdLeaseEntryAt(wch, &line)
+			if entry == nil {
+				return
+			}
+
+			if err != nil {
+				log.Printf("error parsing dhcpd lease entry #%d: %s", 1+i, err)
+				continue
+			}
+
+			// An entry that was interrupted by the context being done is
+			// incomplete, so it shouldn't be reported.
+			mu.Lock()
+			if !stopped && ctx.Err() == nil {
+				fn(*entry)
+			}
+			mu.Unlock()
+		}
+	}()
+
+	// The reader may be blocked indefinitely, so don't wait for the parsing
+	// to finish once the context is done.
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	mu.Lock()
+	stopped = true
+	mu.Unlock()
+
+	select {
+	case err := <-readErr:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
+
+func ReadDhcpdLeaseEntries(fd *os.File) ([]DhcpLeaseEntry, error) {
+	return readDhcpdLeaseEntries(fd)
+}
+
+func readDhcpdLeaseEntries(r io.Reader) ([]DhcpLeaseEntry, error) {
+	return readDhcpdLeaseEntriesFrom(context.Background(), consumeFile(r))
+}
+
+// ReadDhcpdLeaseEntriesContext reads the lease entries from a reader like
+// ReadDhcpdLeaseEntries, but stops once the context is done. The entries that
+// were parsed by then are returned along with the error of the context. An
+// entry that was still being read is discarded, since it may be incomplete.
+func ReadDhcpdLeaseEntriesContext(ctx context.Context, r io.Reader) ([]DhcpLeaseEntry, error) {
+	return readDhcpdLeaseEntriesFrom(ctx, consumeFileContext(ctx, r))
+}
+
+// readDhcpdLeaseEntriesFrom reads the lease entries from a byte channel until
+// it's closed or the context is done.
+func readDhcpdLeaseEntriesFrom(ctx context.Context, fch chan byte) ([]DhcpLeaseEntry, error) {
 	uncommentedch := uncomment(fch)
-	wch := filterOutCharacters([]byte{'\n', '\r', '\v'}, uncommentedch)
 
-	result := make([]dhcpLeaseEntry, 0)
+	// Newlines are kept so that the line of each entry can be reported.
+	wch := filterOutCharacters([]byte{'\r', '\v'}, uncommentedch)
+
+	result := make([]DhcpLeaseEntry, 0)
 	errorList := make([]error, 0)
 
 	// Consume dhcpd lease entries from the channel until we just plain run out.
+	line := 1
 	for i := 0; ; i++ {
-		if entry, err := readDhcpdLeaseEntry(wch); entry == nil {
+		entry, err := readDhcpdLeaseEntryAt(wch, &line)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			// The stages of the pipeline only exit once their input has been
+			// closed, so the rest of it is drained to let them finish.
+			go func() {
+				for range wch {
+				}
+			}()
+			return result, fmt.Errorf("reading dhcpd lease entries stopped after %d entries: %w", len(result), ctxErr)
+		}
+
+		if entry == nil {
 			// If our entry is nil, then we've run out of input and finished
 			// parsing the file to completion.
 			break
@@ -2425,6 +6228,40 @@ func ReadDhcpdLeaseEntries(fd *os.File) ([]dhcpLeaseEntry, error) {
 	return result, nil
 }
 
+// ReadDhcpdLeasesMerged reads the lease entries from several dhcpd leases
+// files, such as `dhcpd.leases` and its backup `dhcpd.leases~`, and keeps only
+// the entry that starts last for each hardware address. Entries without a
+// hardware address are all kept. The entries are returned in the order that
+// their hardware address was first seen, along with the errors of every file.
+func ReadDhcpdLeasesMerged(readers ...io.Reader) ([]DhcpLeaseEntry, error) {
+	result := make([]DhcpLeaseEntry, 0)
+	index := make(map[string]int)
+	var errs []error
+
+	for i, r := range readers {
+		entries, err := readDhcpdLeaseEntries(r)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("lease file #%d: %w", 1+i, err))
+		}
+
+		for _, entry := range entries {
+			if len(entry.ether) == 0 {
+				result = append(result, entry)
+				continue
+			}
+
+			mac := normalizeMAC(entry.HardwareAddress())
+			if at, ok := index[mac]; !ok {
+				index[mac] = len(result)
+				result = append(result, entry)
+			} else if !entry.starts.Before(result[at].starts) {
+				result[at] = entry
+			}
+		}
+	}
+	return result, errors.Join(errs...)
+}
+
 /*** Apple Dhcp Leases */
 
 // Here is what an Apple DHCPD lease entry looks like:
@@ -2563,3 +6400,122 @@ func ReadAppleDhcpdLeaseEntries(fd *os.File) ([]appleDhcpLeaseEntry, error) {
 	}
 	return result, nil
 }
+
+/*** Reading multiple files */
+
+// FileFormat represents the format of a file that can be read by ReadAll.
+type FileFormat int
+
+const (
+	FileFormatDhcpConfig FileFormat = iota + 1
+	FileFormatDhcpLeases
+	FileFormatAppleDhcpLeases
+	FileFormatNetworking
+	FileFormatNetmap
+)
+
+func (f FileFormat) String() string {
+	switch f {
+	case FileFormatDhcpConfig:
+		return "dhcpd configuration"
+	case FileFormatDhcpLeases:
+		return "dhcpd leases"
+	case FileFormatAppleDhcpLeases:
+		return "apple dhcpd leases"
+	case FileFormatNetworking:
+		return "networking"
+	case FileFormatNetmap:
+		return "netmap"
+	}
+	return fmt.Sprintf("unknown format %d", int(f))
+}
+
+// FileSpec represents a file to be read by ReadAll, and the format to parse
+// it as.
+type FileSpec struct {
+	Path   string
+	Format FileFormat
+}
+
+// FileResult represents the result of reading a FileSpec. Only the field
+// that corresponds to the format of the file is set.
+type FileResult struct {
+	Spec FileSpec
+	Err  error
+
+	DhcpConfig      DhcpConfiguration
+	DhcpLeases      []DhcpLeaseEntry
+	AppleDhcpLeases []appleDhcpLeaseEntry
+	Networking      NetworkingConfig
+	Netmap          NetworkMap
+}
+
+// Results represents the results of ReadAll, in the same order as the specs
+// that were read.
+type Results []FileResult
+
+func readFileSpec(spec FileSpec) FileResult {
+	result := FileResult{Spec: spec}
+
+	fd, err := os.Open(spec.Path)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer fd.Close()
+
+	switch spec.Format {
+	case FileFormatDhcpConfig:
+		result.DhcpConfig, result.Err = ReadDhcpConfiguration(fd)
+	case FileFormatDhcpLeases:
+		result.DhcpLeases, result.Err = ReadDhcpdLeaseEntries(fd)
+	case FileFormatAppleDhcpLeases:
+		result.AppleDhcpLeases, result.Err = ReadAppleDhcpdLeaseEntries(fd)
+	case FileFormatNetworking:
+		result.Networking, result.Err = ReadNetworkingConfig(fd)
+	case FileFormatNetmap:
+		result.Netmap, result.Err = ReadNetworkMap(fd)
+	default:
+		result.Err = fmt.Errorf("unsupported file format : %v", spec.Format)
+	}
+	return result
+}
+
+// ReadAll reads and parses the files concurrently, with at most GOMAXPROCS
+// files being parsed at once.
+func ReadAll(specs []FileSpec) (Results, error) {
+	return ReadAllWithLimit(specs, runtime.GOMAXPROCS(0))
+}
+
+// ReadAllWithLimit reads and parses the files concurrently, with at most
+// limit files being parsed at once. The returned error describes every file
+// that failed to be read, and the error for each file is also available in its
+// result.
+func ReadAllWithLimit(specs []FileSpec, limit int) (Results, error) {
+	if limit < 1 {
+		limit = 1
+	}
+
+	results := make(Results, len(specs))
+	sem := make(chan struct{}, limit)
+
+	var wg sync.WaitGroup
+	for i, spec := range specs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, spec FileSpec) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = readFileSpec(spec)
+		}(i, spec)
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("error reading %s file %s: %w", result.Spec.Format, result.Spec.Path, result.Err))
+		}
+	}
+	return results, errors.Join(errs...)
+}
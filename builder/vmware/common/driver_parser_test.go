@@ -7,10 +7,19 @@ import (
 	"testing"
 
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 )
 
 func consumeString(s string) (out chan byte) {
@@ -371,841 +380,4466 @@ parameters : map[default-lease-time:1800 max-lease-time:7200]
 	}
 }
 
-func TestParserTokenizeNetworkMap(t *testing.T) {
+func TestParserDhcpConfigReprStable(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+subnet 192.168.1.0 netmask 255.255.255.0 {
+	option routers 192.168.1.1;
+	option domain-name "example.com";
+	option broadcast-address 192.168.1.255;
+	option subnet-mask 255.255.255.0;
+	default-lease-time 600;
+	max-lease-time 7200;
+	min-lease-time 300;
+	allow unknown-clients;
+	deny bootp;
+	ignore duplicates;
+	authoritative;
+	range 192.168.1.10 192.168.1.20;
+}
+`)
 
-	test1 := "group.attribute = \"string\""
-	expected := []string{
-		"group.attribute", "=", "\"string\"",
-	}
-	result := tokenizeDhcpConfigFromString(test1)
-	if len(result) != len(expected) {
-		t.Fatalf("length of token lists do not match (%d != %d)", len(result), len(expected))
+	subnet, err := config.SubnetByAddress(net.ParseIP("192.168.1.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
 	}
 
-	for index := range expected {
-		if expected[index] != result[index] {
-			t.Errorf("unexpected token at index %d: %v != %v", index, expected[index], result[index])
+	result := subnet.repr()
+	for i := 0; i < 10; i++ {
+		if repeated := subnet.repr(); repeated != result {
+			t.Fatalf("expected the same representation every time, got:\n%s\nthen:\n%s", result, repeated)
 		}
 	}
 
-	test2 := "attribute == \""
-	expected = []string{
-		"attribute", "==", "\"",
+	expected := "options : map[broadcast-address:192.168.1.255 domain-name:\"example.com\" routers:192.168.1.1 subnet-mask:255.255.255.0]"
+	if !strings.Contains(result, expected) {
+		t.Errorf("expected the options to be sorted as %q, got:\n%s", expected, result)
 	}
-	result = tokenizeDhcpConfigFromString(test2)
-	if len(result) != len(expected) {
-		t.Fatalf("length of token lists do not match (%d != %d)", len(result), len(expected))
+	expected = "parameters : map[default-lease-time:600 max-lease-time:7200 min-lease-time:300]"
+	if !strings.Contains(result, expected) {
+		t.Errorf("expected the parameters to be sorted as %q, got:\n%s", expected, result)
 	}
+}
 
-	test3 := "attribute ....... ======\nnew lines should make no difference"
-	expected = []string{
-		"attribute", ".......", "======", "new", "lines", "should", "make", "no", "difference",
-	}
-	result = tokenizeDhcpConfigFromString(test3)
-	if len(result) != len(expected) {
-		t.Fatalf("length of token lists do not match (%d != %d)", len(result), len(expected))
+func readDhcpConfigurationFromString(t *testing.T, s string) DhcpConfiguration {
+	path := filepath.Join(t.TempDir(), "dhcpd.conf")
+	if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+		t.Fatalf("Unable to write dhcpd.conf sample: %s", err)
 	}
 
-	test4 := "\t\t\t\t    thishadwhitespacebeforebeingparsed\t \t \t \t\n\n"
-	expected = []string{
-		"thishadwhitespacebeforebeingparsed",
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unable to open dhcpd.conf sample: %s", err)
 	}
-	result = tokenizeDhcpConfigFromString(test4)
-	if len(result) != len(expected) {
-		t.Fatalf("length of token lists do not match (%d != %d)", len(result), len(expected))
+	defer f.Close()
+
+	config, err := ReadDhcpConfiguration(f)
+	if err != nil {
+		t.Fatalf("Unable to read dhcpd.conf sample: %s", err)
 	}
+	return config
 }
 
-func TestParserReadNetworkMap(t *testing.T) {
-	f, err := os.Open(filepath.Join("testdata", "netmap-example.conf"))
+func TestParserDhcpConfigLiteralAddress(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+host literal {
+	fixed-address 172.33.33.1;
+	fixed-address6 fd00::1;
+}
+host named {
+	fixed-address unresolvable.packer.invalid;
+	fixed-address6 unresolvable.packer.invalid;
+}
+host mismatched {
+	fixed-address6 10.0.0.1;
+}
+`)
+
+	literal, err := config.HostByName("literal")
 	if err != nil {
-		t.Fatalf("Unable to open netmap.conf sample: %s", err)
+		t.Fatalf("Unable to find host declaration: %s", err)
 	}
-	defer f.Close()
 
-	netmap, err := ReadNetworkMap(f)
+	ip4, err := literal.IP4Literal()
 	if err != nil {
-		t.Fatalf("Unable to read netmap.conf sample: %s", err)
+		t.Errorf("expected literal IPv4 address, got error: %s", err)
+	} else if !ip4.Equal(net.ParseIP("172.33.33.1")) {
+		t.Errorf("expected %s, got %s", "172.33.33.1", ip4)
 	}
 
-	expectedKeys := []string{"device", "name"}
-	for _, item := range netmap {
-		for _, name := range expectedKeys {
-			_, ok := item[name]
-			if !ok {
-				t.Errorf("unable to find expected key %v in map: %v", name, item)
-			}
-		}
+	ip6, err := literal.IP6Literal()
+	if err != nil {
+		t.Errorf("expected literal IPv6 address, got error: %s", err)
+	} else if !ip6.Equal(net.ParseIP("fd00::1")) {
+		t.Errorf("expected %s, got %s", "fd00::1", ip6)
 	}
 
-	expectedVmnet0 := [][]string{
-		{"device", "vmnet0"},
-		{"name", "Bridged"},
-	}
-	for _, item := range netmap {
-		if item["device"] != "vmnet0" {
-			continue
-		}
-		for _, expectPair := range expectedVmnet0 {
-			name := expectPair[0]
-			value := expectPair[1]
-			if item[name] != value {
-				t.Errorf("expected value %v for attribute %v, got %v", value, name, item[name])
-			}
-		}
+	named, err := config.HostByName("named")
+	if err != nil {
+		t.Fatalf("Unable to find host declaration: %s", err)
 	}
 
-	expectedVmnet1 := [][]string{
-		{"device", "vmnet1"},
-		{"name", "HostOnly"},
+	if _, err := named.IP4Literal(); err == nil {
+		t.Errorf("expected an error for a hostname IPv4 fixed-address")
 	}
-	for _, item := range netmap {
-		if item["device"] != "vmnet1" {
-			continue
-		}
-		for _, expectPair := range expectedVmnet1 {
-			name := expectPair[0]
-			value := expectPair[1]
-			if item[name] != value {
-				t.Errorf("expected value %v for attribute %v, got %v", value, name, item[name])
-			}
-		}
+	if _, err := named.IP6Literal(); err == nil {
+		t.Errorf("expected an error for a hostname IPv6 fixed-address")
 	}
 
-	expectedVmnet8 := [][]string{
-		{"device", "vmnet8"},
-		{"name", "NAT"},
+	mismatched, err := config.HostByName("mismatched")
+	if err != nil {
+		t.Fatalf("Unable to find host declaration: %s", err)
 	}
-	for _, item := range netmap {
-		if item["device"] != "vmnet8" {
-			continue
-		}
-		for _, expectPair := range expectedVmnet8 {
-			name := expectPair[0]
-			value := expectPair[1]
-			if item[name] != value {
-				t.Errorf("expected value %v for attribute %v, got %v", value, name, item[name])
-			}
-		}
+	if ip6, err := mismatched.IP6Literal(); err == nil {
+		t.Errorf("expected an error for an IPv4 fixed-address6, got %s", ip6)
 	}
 }
 
-func collectIntoString(in chan byte) string {
-	result := ""
-	for item := range in {
-		result += string(item)
+func TestParserDhcpConfigEvent(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	range 172.33.33.128 172.33.33.254;
+	option routers 172.33.33.2;
+	on commit {
+		set ClientIP = binary-to-ascii(10, 8, ".", leased-address);
+		execute("/usr/local/bin/on-commit", ClientIP);
 	}
-	return result
 }
+host vmnet8 {
+	fixed-address 172.33.33.1;
+}
+`)
 
-func TestParserConsumeUntilSentinel(t *testing.T) {
-
-	test1 := "consume until a semicolon; yeh?"
-	expected1 := "consume until a semicolon"
-
-	ch := consumeString(test1)
-	resultch, _ := consumeUntilSentinel(';', ch)
-	result := string(resultch)
-	if expected1 != result {
-		t.Errorf("expected %#v, got %#v", expected1, result)
+	if len(config) != 4 {
+		t.Fatalf("expected %d entries, got %d", 4, len(config))
 	}
 
-	test2 := "; this is only a semi"
-	expected2 := ""
-
-	ch = consumeString(test2)
-	resultch, _ = consumeUntilSentinel(';', ch)
-	result = string(resultch)
-	if expected2 != result {
-		t.Errorf("expected %#v, got %#v", expected2, result)
+	event := config[2]
+	if event.id[0].repr() != "{on commit}" {
+		t.Fatalf("expected event declaration, got %s", event.id[0].repr())
 	}
-}
-
-func TestParserFilterCharacters(t *testing.T) {
-
-	test1 := []string{" ", "ignore all spaces"}
-	expected1 := "ignoreallspaces"
 
-	ch := consumeString(test1[1])
-	outch := filterOutCharacters(bytes.NewBufferString(test1[0]).Bytes(), ch)
-	result := collectIntoString(outch)
-	if result != expected1 {
-		t.Errorf("expected %#v, got %#v", expected1, result)
+	// Statements are rebuilt from their tokens, so quoted strings are
+	// always separated from what follows them.
+	statements := event.Statements()
+	expected := []string{
+		`set ClientIP = binary-to-ascii(10, 8, "." , leased-address)`,
+		`execute("/usr/local/bin/on-commit" , ClientIP)`,
+	}
+	if !compareSlice(statements, expected) {
+		t.Errorf("expected statements %v, got %v", expected, statements)
 	}
 
-	test2 := []string{"\n\v\t\r ", "ignore\nall\rwhite\v\v space                "}
-	expected2 := "ignoreallwhitespace"
-
-	ch = consumeString(test2[1])
-	outch = filterOutCharacters(bytes.NewBufferString(test2[0]).Bytes(), ch)
-	result = collectIntoString(outch)
-	if result != expected2 {
-		t.Errorf("expected %#v, got %#v", expected2, result)
+	// The statements within the event should not leak into the options of
+	// the enclosing subnet or its siblings.
+	subnet := config[1]
+	if len(subnet.Statements()) != 0 {
+		t.Errorf("expected no statements for subnet, got %v", subnet.Statements())
+	}
+	host := config[3]
+	if len(host.Statements()) != 0 || len(host.options) != 0 {
+		t.Errorf("expected no statements or options for host, got %v %v", host.Statements(), host.options)
 	}
 }
 
-func TestParserConsumeOpenClosePair(t *testing.T) {
-	test1 := "(everything)"
-	expected1 := []string{"", test1}
-
-	testch := consumeString(test1)
-	prefix, ch := consumeOpenClosePair('(', ')', testch)
-	if string(prefix) != expected1[0] {
-		t.Errorf("expected prefix %#v, got %#v", expected1[0], prefix)
-	}
-	result := collectIntoString(ch)
-	if result != expected1[1] {
-		t.Errorf("expected %#v, got %#v", expected1[1], test1)
+func TestParserDhcpConfigConditional(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	range 172.33.33.128 172.33.33.254;
+	option routers 172.33.33.2;
+	if option vendor-class-identifier = "PXEClient" {
+		filename "pxelinux.0";
+		next-server 172.33.33.3;
+	} elsif exists user-class {
+		filename "ipxe.efi";
+	} else {
+		option domain-name "example.com";
+		ddns-updates off;
 	}
+}
+`)
+
+	if len(config) != 5 {
+		t.Fatalf("expected %d entries, got %d", 5, len(config))
+	}
+
+	for i, expected := range []struct {
+		repr       string
+		condition  string
+		statements []string
+	}{
+		{`{if option vendor-class-identifier = "PXEClient"}`, `option vendor-class-identifier = "PXEClient"`, []string{`filename "pxelinux.0"`, "next-server 172.33.33.3"}},
+		{"{elsif exists user-class}", "exists user-class", []string{`filename "ipxe.efi"`}},
+		{"{else}", "", []string{`option domain-name "example.com"`, "ddns-updates off"}},
+	} {
+		branch := config[i+2]
+		if branch.id[0].repr() != expected.repr {
+			t.Fatalf("expected conditional declaration %s, got %s", expected.repr, branch.id[0].repr())
+		}
 
-	test2 := "prefixed (everything)"
-	expected2 := []string{"prefixed ", "(everything)"}
+		condition, ok := branch.Condition()
+		if !ok || condition != expected.condition {
+			t.Errorf("expected condition %q for %s, got %q (%v)", expected.condition, expected.repr, condition, ok)
+		}
+		if statements := branch.Statements(); !compareSlice(statements, expected.statements) {
+			t.Errorf("expected statements %v for %s, got %v", expected.statements, expected.repr, statements)
+		}
+	}
 
-	testch = consumeString(test2)
-	prefix, ch = consumeOpenClosePair('(', ')', testch)
-	if string(prefix) != expected2[0] {
-		t.Errorf("expected prefix %#v, got %#v", expected2[0], prefix)
+	// The branches aren't evaluated, so none of their statements apply to the
+	// enclosing subnet.
+	subnet := config[1]
+	if _, ok := subnet.Condition(); ok {
+		t.Errorf("expected subnet to not be a conditional")
 	}
-	result = collectIntoString(ch)
-	if result != expected2[1] {
-		t.Errorf("expected %#v, got %#v", expected2[1], test2)
+	if _, ok := subnet.Option("domain-name"); ok || len(subnet.Statements()) != 0 {
+		t.Errorf("expected no statements from the branches for subnet, got %v %v", subnet.options, subnet.Statements())
 	}
 
-	test3 := "this(is()suffixed"
-	expected3 := []string{"this", "(is()"}
+	// An `else if` is the same as an `elsif`.
+	config = readDhcpConfigurationFromString(t, `
+if exists user-class { filename "ipxe.efi"; } else if exists vendor-class-identifier { filename "pxelinux.0"; }
+`)
+	if len(config) != 3 || config[2].id[0].repr() != "{elsif exists vendor-class-identifier}" {
+		t.Errorf("expected an elsif declaration, got %v", config)
+	}
+}
 
-	testch = consumeString(test3)
-	prefix, ch = consumeOpenClosePair('(', ')', testch)
-	if string(prefix) != expected3[0] {
-		t.Errorf("expected prefix %#v, got %#v", expected3[0], prefix)
+func TestParserDhcpConfigPreflightAddress(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	range 172.33.33.128 172.33.33.191;
+	pool {
+		range 172.33.33.200 172.33.33.220;
 	}
-	result = collectIntoString(ch)
-	if result != expected3[1] {
-		t.Errorf("expected %#v, got %#v", expected3[1], test2)
+	pool {
+		range 172.33.33.230 172.33.33.240;
+		deny all clients;
 	}
 }
+subnet 172.33.34.0 netmask 255.255.255.0 {
+}
+`)
 
-func TestParserCombinators(t *testing.T) {
-
-	test1 := "across # ignore\nmultiple lines;"
-	expected1 := "across multiple lines"
-
-	ch := consumeString(test1)
-	inch := uncomment(ch)
-	whch := filterOutCharacters([]byte{'\n'}, inch)
-	resultch, _ := consumeUntilSentinel(';', whch)
-	result := string(resultch)
-	if expected1 != result {
-		t.Errorf("expected %#v, got %#v", expected1, result)
+	for _, ip := range []string{"172.33.33.128", "172.33.33.150", "172.33.33.210"} {
+		if err := config.PreflightAddress(net.ParseIP(ip)); err != nil {
+			t.Errorf("expected address %s to be served, got %s", ip, err)
+		}
 	}
 
-	test2 := "lease blah {\n    blah\r\n# skipping this line\nblahblah  # ignore semicolon;\n last item;\n\n };;;;;;"
-	expected2 := []string{"lease blah ", "{    blahblahblah   last item; }"}
-
-	ch = consumeString(test2)
-	inch = uncomment(ch)
-	whch = filterOutCharacters([]byte{'\n', '\v', '\r'}, inch)
-	prefix, pairch := consumeOpenClosePair('{', '}', whch)
+	for ip, expected := range map[string]string{
+		"172.33.33.10":  "address 172.33.33.10 is in subnet {subnet4 172.33.33.0/24} but outside of every range",
+		"172.33.33.235": "address 172.33.33.235 would not be served by subnet {subnet4 172.33.33.0/24}: address 172.33.33.235 is in range but all clients is denied",
+		"172.33.34.10":  "address 172.33.34.10 is in subnet {subnet4 172.33.34.0/24} but outside of every range",
+		"10.0.0.1":      "address 10.0.0.1 is not in any subnet",
+	} {
+		if err := config.PreflightAddress(net.ParseIP(ip)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error for address %s to contain %q, got %v", ip, expected, err)
+		}
+	}
+}
 
-	result = collectIntoString(pairch)
-	if string(prefix) != expected2[0] {
-		t.Errorf("expected prefix %#v, got %#v", expected2[0], prefix)
+func TestParserDhcpConfigHostsInSharedNetwork(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+host lobby { hardware ethernet 00:50:56:00:00:01; }
+shared-network office {
+	host printer { hardware ethernet 00:50:56:00:00:02; }
+	subnet 172.33.33.0 netmask 255.255.255.0 {
+		host desk { hardware ethernet 00:50:56:00:00:03; }
+		pool {
+			range 172.33.33.128 172.33.33.254;
+		}
 	}
-	if result != expected2[1] {
-		t.Errorf("expected %#v, got %#v", expected2[1], result)
+	group {
+		host phone { hardware ethernet 00:50:56:00:00:04; }
 	}
-
-	test3 := "lease blah { # comment\n item 1;\n item 2;\n } not imortant"
-	expected3Prefix := "lease blah "
-	expected3 := []string{"{  item 1", " item 2", " }"}
-
-	sch := consumeString(test3)
-	inch = uncomment(sch)
-	wch := filterOutCharacters([]byte{'\n', '\v', '\r'}, inch)
-	lease, itemch := consumeOpenClosePair('{', '}', wch)
-	if string(lease) != expected3Prefix {
-		t.Errorf("expected %#v, got %#v", expected3Prefix, string(lease))
+}
+shared-network "lab" {
+	subnet 172.33.34.0 netmask 255.255.255.0 {
+		host bench { hardware ethernet 00:50:56:00:00:05; }
 	}
+}
+shared-network empty {
+	subnet 172.33.35.0 netmask 255.255.255.0 { }
+}
+`)
 
-	var result3 []string
-	for reading := true; reading; {
-		item, ok := consumeUntilSentinel(';', itemch)
-		result3 = append(result3, string(item))
-		if !ok {
-			reading = false
+	names := func(hosts []ConfigDeclaration) []string {
+		var result []string
+		for _, host := range hosts {
+			result = append(result, host.id[0].(pDeclarationHost).name)
 		}
+		return result
 	}
 
-	for index := range expected3 {
-		if expected3[index] != result3[index] {
-			t.Errorf("expected index %d as %#v, got %#v", index, expected3[index], result3[index])
+	for shared, expected := range map[string][]string{
+		"office": {"printer", "desk", "phone"},
+		"lab":    {"bench"},
+		`"lab"`:  {"bench"},
+		"empty":  nil,
+	} {
+		hosts, err := config.HostsInSharedNetwork(shared)
+		if err != nil {
+			t.Fatalf("Unable to list hosts in shared-network %s: %s", shared, err)
 		}
+		if result := names(hosts); !compareSlice(result, expected) {
+			t.Errorf("expected hosts %v in shared-network %s, got %v", expected, shared, result)
+		}
+	}
+
+	if _, err := config.HostsInSharedNetwork("warehouse"); err == nil {
+		t.Errorf("expected an error for a missing shared-network")
 	}
 }
 
-func TestParserDhcpdLeaseBytesDecoder(t *testing.T) {
-	test1 := "00:0d:0e:0a:0d:00"
-	expected1 := []byte{0, 13, 14, 10, 13, 0}
+func TestParserDhcpConfigShadowedOptions(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+option domain-name "example.com";
+option routers 172.33.33.1;
+option ntp-servers 172.33.33.3;
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	option domain-name "lab.example.com";
+	option routers 172.33.33.1;
+	host desk {
+		option domain-name "desk.example.com";
+	}
+}
+`)
 
-	result, err := decodeDhcpdLeaseBytes(test1)
+	global, err := config.Global()
 	if err != nil {
-		t.Errorf("unable to decode address: %s", err)
+		t.Fatalf("Unable to retrieve global configuration: %s", err)
 	}
-	if !bytes.Equal(result, expected1) {
-		t.Errorf("expected %v, got %v", expected1, result)
+	if shadowed := global.ShadowedOptions(); len(shadowed) != 0 {
+		t.Errorf("expected no shadowed options for the global declaration, got %v", shadowed)
 	}
 
-	test2 := "11"
-	expected2 := []byte{17}
-
-	result, err = decodeDhcpdLeaseBytes(test2)
+	// Setting routers to the same value isn't an override.
+	subnet, err := config.SubnetByAddress(net.ParseIP("172.33.33.0"))
 	if err != nil {
-		t.Errorf("unable to decode address: %s", err)
-	}
-	if !bytes.Equal(result, expected2) {
-		t.Errorf("expected %v, got %v", expected2, result)
+		t.Fatalf("Unable to find subnet: %s", err)
 	}
-
-	failtest1 := ""
-	_, err = decodeDhcpdLeaseBytes(failtest1)
-	if err == nil {
-		t.Errorf("expected decoding error: %s", err)
+	expected := map[string][]string{"domain-name": {`"example.com"`}}
+	if shadowed := subnet.ShadowedOptions(); !reflect.DeepEqual(shadowed, expected) {
+		t.Errorf("expected shadowed options %v for the subnet, got %v", expected, shadowed)
 	}
 
-	failtest2 := "000000"
-	_, err = decodeDhcpdLeaseBytes(failtest2)
-	if err == nil {
-		t.Errorf("expected decoding error: %s", err)
+	host, err := config.HostByName("desk")
+	if err != nil {
+		t.Fatalf("Unable to find host: %s", err)
 	}
-
-	failtest3 := "000:00"
-	_, err = decodeDhcpdLeaseBytes(failtest3)
-	if err == nil {
-		t.Errorf("expected decoding error: %s", err)
+	expected = map[string][]string{"domain-name": {`"example.com"`, `"lab.example.com"`}}
+	if shadowed := host.ShadowedOptions(); !reflect.DeepEqual(shadowed, expected) {
+		t.Errorf("expected shadowed options %v for the host, got %v", expected, shadowed)
 	}
-
-	failtest4 := "00:00:"
-	_, err = decodeDhcpdLeaseBytes(failtest4)
-	if err == nil {
-		t.Errorf("expected decoding error: %s", err)
+	if value, _ := host.Option("domain-name"); value != `"desk.example.com"` {
+		t.Errorf("expected the innermost domain-name to apply, got %s", value)
 	}
 }
 
-func consumeLeaseString(s string) chan byte {
-	sch := consumeString(s)
-	uncommentedch := uncomment(sch)
-	return filterOutCharacters([]byte{'\n', '\r', '\v'}, uncommentedch)
+func TestParserDhcpConfigServerIdentifier(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+option server-identifier 172.33.33.1;
+subnet 172.33.33.0 netmask 255.255.255.0 {
 }
+subnet 172.33.34.0 netmask 255.255.255.0 {
+	option server-identifier 172.33.34.1;
+}
+`)
 
-func TestParserReadDhcpdLeaseEntry(t *testing.T) {
-	test1 := "lease 127.0.0.1 {\nhardware ethernet 00:11:22:33  ;\nuid 00:11  ;\n }"
-	expected1 := map[string]string{
-		"address": "127.0.0.1",
-		"ether":   "00112233",
-		"uid":     "0011",
+	for subnet, expected := range map[string]string{
+		"172.33.33.0": "172.33.33.1",
+		"172.33.34.0": "172.33.34.1",
+	} {
+		declaration, err := config.SubnetByAddress(net.ParseIP(subnet))
+		if err != nil {
+			t.Fatalf("Unable to find subnet %s: %s", subnet, err)
+		}
+		if ip, err := declaration.ServerIdentifier(); err != nil || !ip.Equal(net.ParseIP(expected)) {
+			t.Errorf("expected server-identifier %s for subnet %s, got %v (%v)", expected, subnet, ip, err)
+		}
 	}
 
-	result, err := readDhcpdLeaseEntry(consumeLeaseString(test1))
+	config = readDhcpConfigurationFromString(t, `
+subnet 172.33.33.0 netmask 255.255.255.0 {
+}
+`)
+	subnet, err := config.SubnetByAddress(net.ParseIP("172.33.33.0"))
 	if err != nil {
-		t.Errorf("error parsing entry: %s", err)
+		t.Fatalf("Unable to find subnet: %s", err)
 	}
-	if result.address != expected1["address"] {
-		t.Errorf("expected address %v, got %v", expected1["address"], result.address)
+	if _, err := subnet.ServerIdentifier(); err == nil {
+		t.Errorf("expected an error without a server-identifier")
 	}
-	if hex.EncodeToString(result.ether) != expected1["ether"] {
-		t.Errorf("expected ether %v, got %v", expected1["ether"], hex.EncodeToString(result.ether))
+}
+
+func TestParserDhcpConfigOrder(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+option domain-name "example.com";
+host zulu { hardware ethernet 00:50:56:00:00:01; }
+subnet 192.168.3.0 netmask 255.255.255.0 {
+	pool { range 192.168.3.10 192.168.3.20; }
+	host yankee { hardware ethernet 00:50:56:00:00:02; }
+}
+shared-network lab {
+	subnet 192.168.2.0 netmask 255.255.255.0 { }
+	subnet 192.168.1.0 netmask 255.255.255.0 {
+		pool { range 192.168.1.10 192.168.1.20; }
 	}
-	if hex.EncodeToString(result.uid) != expected1["uid"] {
-		t.Errorf("expected uid %v, got %v", expected1["uid"], hex.EncodeToString(result.uid))
+}
+host alpha { hardware ethernet 00:50:56:00:00:03; }
+group {
+	host bravo { hardware ethernet 00:50:56:00:00:04; }
+}
+`)
+
+	expected := []string{
+		"{global}",
+		"{host name:zulu}",
+		"{subnet4 192.168.3.0/24}",
+		"{pool}",
+		"{host name:yankee}",
+		"{shared-network lab}",
+		"{subnet4 192.168.2.0/24}",
+		"{subnet4 192.168.1.0/24}",
+		"{pool}",
+		"{host name:alpha}",
+		"{group}",
+		"{host name:bravo}",
+	}
+
+	var result []string
+	for _, declaration := range config {
+		result = append(result, declaration.id[0].repr())
+	}
+	if !compareSlice(result, expected) {
+		t.Errorf("expected declarations in order %v, got %v", expected, result)
 	}
+}
 
-	test2 := "  \n\t lease 192.168.21.254{ hardware\n   ethernet 44:55:66:77:88:99;uid 00:1\n1:22:3\r3:44;\n starts 57005 2006/01/02 15:04:05;ends 57005 2006/01/03 15:04:05;\tunknown item1; unknown item2;  }     "
-	expected2 := map[string]string{
-		"address": "192.168.21.254",
-		"ether":   "445566778899",
-		"uid":     "0011223344",
-		"starts":  "2006-01-02 15:04:05 +0000 UTC",
-		"ends":    "2006-01-03 15:04:05 +0000 UTC",
+func TestParserDhcpConfigOrderWithIncludes(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "dhcpd-include-order.conf"))
+	if err != nil {
+		t.Fatalf("Unable to open dhcpd-include-order.conf sample: %s", err)
 	}
-	result, err = readDhcpdLeaseEntry(consumeLeaseString(test2))
+	defer f.Close()
+
+	config, err := ReadDhcpConfigurationWithIncludes(f, DhcpIncludeOptions{})
 	if err != nil {
-		t.Errorf("error parsing entry: %s", err)
+		t.Fatalf("Error reading dhcpd-include-order.conf: %s", err)
 	}
-	if result.address != expected2["address"] {
-		t.Errorf("expected address %v, got %v", expected2["address"], result.address)
+
+	expected := []string{
+		"{global}",
+		"{subnet4 192.168.1.0/24}",
+		"{subnet4 192.168.2.0/24}",
+		"{host name:charlie}",
+		"{subnet4 192.168.3.0/24}",
 	}
-	if hex.EncodeToString(result.ether) != expected2["ether"] {
-		t.Errorf("expected ether %v, got %v", expected2["ether"], hex.EncodeToString(result.ether))
+
+	var result []string
+	for _, declaration := range config {
+		result = append(result, declaration.id[0].repr())
 	}
-	if hex.EncodeToString(result.uid) != expected2["uid"] {
-		t.Errorf("expected uid %v, got %v", expected2["uid"], hex.EncodeToString(result.uid))
+	if !compareSlice(result, expected) {
+		t.Errorf("expected declarations in order %v, got %v", expected, result)
 	}
-	if result.starts.String() != expected2["starts"] {
-		t.Errorf("expected starts %v, got %v", expected2["starts"], result.starts)
+}
+
+func TestParserDhcpConfigFilterByOption(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	option routers 172.33.33.2;
+}
+shared-network vmnet2 {
+	option routers 172.33.34.1;
+	subnet 172.33.34.0 netmask 255.255.255.0 {
 	}
-	if result.ends.String() != expected2["ends"] {
-		t.Errorf("expected ends %v, got %v", expected2["ends"], result.ends)
+}
+subnet 172.33.35.0 netmask 255.255.255.0 {
+	option domain-name "example.com";
+}
+`)
+
+	// subnets returns the addresses of the subnets among the declarations.
+	subnets := func(decls []ConfigDeclaration) []string {
+		result := make([]string, 0)
+		for _, decl := range decls {
+			if id, ok := decl.id[0].(pDeclarationSubnet4); ok {
+				result = append(result, id.IP.String())
+			}
+		}
+		return result
 	}
-	if result.startsWeekday != 57005 {
-		t.Errorf("expected starts weekday %v, got %v", 57005, result.startsWeekday)
+
+	// The subnet within the shared network inherits its routers, and the
+	// subnet without any isn't returned.
+	if result := subnets(config.FilterByOption("routers", nil)); !compareSlice(result, []string{"172.33.33.0", "172.33.34.0"}) {
+		t.Errorf("expected subnets %v to set routers, got %v", []string{"172.33.33.0", "172.33.34.0"}, result)
 	}
-	if result.endsWeekday != 57005 {
-		t.Errorf("expected ends weekday %v, got %v", 57005, result.endsWeekday)
+
+	match := func(value string) bool { return strings.HasPrefix(value, "172.33.34.") }
+	if result := subnets(config.FilterByOption("routers", match)); !compareSlice(result, []string{"172.33.34.0"}) {
+		t.Errorf("expected subnets %v to match, got %v", []string{"172.33.34.0"}, result)
 	}
-}
 
-func TestParserReadDhcpdLeases(t *testing.T) {
-	f, err := os.Open(filepath.Join("testdata", "dhcpd-example.leases"))
-	if err != nil {
-		t.Fatalf("Unable to open dhcpd.leases sample: %s", err)
+	if result := config.FilterByOption("ntp-servers", nil); len(result) != 0 {
+		t.Errorf("expected no declarations to set ntp-servers, got %d", len(result))
 	}
-	defer f.Close()
+}
 
-	results, err := ReadDhcpdLeaseEntries(f)
-	if err != nil {
-		t.Fatalf("Error reading lease: %s", err)
+func TestParserDhcpConfigRouter(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	option routers 172.33.33.2, 172.33.33.3;
+}
+shared-network vmnet2 {
+	option routers 172.33.34.1;
+	subnet 172.33.34.0 netmask 255.255.255.0 {
+		range 172.33.34.128 172.33.34.254;
 	}
+}
+subnet 172.33.35.0 netmask 255.255.255.0 {
+	range 172.33.35.128 172.33.35.254;
+}
+`)
 
-	// some simple utilities
-	filterAddress := func(address string, items []dhcpLeaseEntry) (result []dhcpLeaseEntry) {
-		for _, item := range items {
-			if item.address == address {
-				result = append(result, item)
-			}
-		}
-		return
+	tests := []struct {
+		subnet   string
+		expected string
+	}{
+		{"172.33.33.0", "172.33.33.2"},
+		{"172.33.34.0", "172.33.34.1"},
 	}
+	for _, test := range tests {
+		subnet, err := config.SubnetByAddress(net.ParseIP(test.subnet))
+		if err != nil {
+			t.Fatalf("Unable to find subnet %s: %s", test.subnet, err)
+		}
 
-	findUid := func(uid string, items []dhcpLeaseEntry) *dhcpLeaseEntry {
-		for _, item := range items {
-			if uid == hex.EncodeToString(item.uid) {
-				return &item
-			}
+		router, err := subnet.Router()
+		if err != nil {
+			t.Errorf("expected a router for subnet %s, got error: %s", test.subnet, err)
+		} else if !router.Equal(net.ParseIP(test.expected)) {
+			t.Errorf("expected %s, got %s", test.expected, router)
 		}
-		return nil
 	}
 
-	findEther := func(ether string, items []dhcpLeaseEntry) *dhcpLeaseEntry {
-		for _, item := range items {
-			if ether == hex.EncodeToString(item.ether) {
-				return &item
-			}
-		}
-		return nil
+	subnet, err := config.SubnetByAddress(net.ParseIP("172.33.35.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
 	}
+	if _, err := subnet.Router(); err == nil {
+		t.Errorf("expected an error for a subnet without a routers option")
+	}
+}
 
-	// actual unit tests
-	test1 := map[string]string{
-		"address": "127.0.0.19",
-		"uid":     "010dead099aabb",
-		"ether":   "0dead099aabb",
+func TestParserDhcpConfigGrants(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+deny unknown-clients;
+ignore bootp;
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	range 172.33.33.128 172.33.33.254;
+}
+subnet 172.33.34.0 netmask 255.255.255.0 {
+	allow unknown-clients;
+}
+`)
+
+	tests := []struct {
+		subnet   string
+		expected map[string]Grant
+	}{
+		{"172.33.33.0", map[string]Grant{"unknown-clients": DENY, "bootp": IGNORE}},
+		{"172.33.34.0", map[string]Grant{"unknown-clients": ALLOW, "bootp": IGNORE}},
 	}
-	test1Findings := filterAddress(test1["address"], results)
-	if len(test1Findings) != 2 {
-		t.Errorf("expected %d matching entries, got %d", 2, len(test1Findings))
-	} else {
-		res := findEther(test1["ether"], test1Findings)
-		if res == nil {
-			t.Errorf("unable to find item with ether %v", test1["ether"])
-		} else if hex.EncodeToString(res.uid) != test1["uid"] {
-			t.Errorf("expected uid %s, got %s", test1["uid"], hex.EncodeToString(res.uid))
+	for _, test := range tests {
+		subnet, err := config.SubnetByAddress(net.ParseIP(test.subnet))
+		if err != nil {
+			t.Fatalf("Unable to find subnet %s: %s", test.subnet, err)
+		}
+
+		grants := subnet.Grants()
+		if !reflect.DeepEqual(grants, test.expected) {
+			t.Errorf("expected grants %v for subnet %s, got %v", test.expected, test.subnet, grants)
+		}
+
+		// The result is a copy, so modifying it shouldn't affect the subnet.
+		grants["unknown-clients"] = IGNORE
+		if subnet.Grants()["unknown-clients"] != test.expected["unknown-clients"] {
+			t.Errorf("expected grants of subnet %s to be unchanged", test.subnet)
 		}
 	}
+}
 
-	test2 := map[string]string{
-		"address": "127.0.0.19",
-		"uid":     "010dead0667788",
-		"ether":   "0dead0667788",
+func TestParserDhcpConfigPoolGrants(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	deny unknown-clients;
+	pool {
+		allow members of "trusted";
+		range 172.33.33.10 172.33.33.19;
 	}
-	test2Findings := filterAddress(test2["address"], results)
-	if len(test2Findings) != 2 {
-		t.Errorf("expected %d matching entries, got %d", 2, len(test2Findings))
-	} else {
-		res := findEther(test2["ether"], test2Findings)
-		if res == nil {
-			t.Errorf("unable to find item with ether %v", test2["ether"])
-		} else if hex.EncodeToString(res.uid) != test2["uid"] {
-			t.Errorf("expected uid %s, got %s", test2["uid"], hex.EncodeToString(res.uid))
+	pool {
+		deny members of "trusted";
+		allow members of "guests";
+		range 172.33.33.20 172.33.33.29;
+	}
+}
+`)
+
+	var pools []ConfigDeclaration
+	for _, decl := range config {
+		if _, ok := decl.id[0].(pDeclarationPool); ok {
+			pools = append(pools, decl)
 		}
 	}
+	if len(pools) != 2 {
+		t.Fatalf("expected 2 pools, got %d", len(pools))
+	}
 
-	test3 := map[string]string{
-		"address": "127.0.0.17",
-		"uid":     "010dead0334455",
-		"ether":   "0dead0667788",
+	expected := []map[string]Grant{
+		{`members of "trusted"`: ALLOW},
+		{`members of "trusted"`: DENY, `members of "guests"`: ALLOW},
 	}
-	test3Findings := filterAddress(test3["address"], results)
-	if len(test3Findings) != 2 {
-		t.Errorf("expected %d matching entries, got %d", 2, len(test3Findings))
-	} else {
-		res := findUid(test3["uid"], test3Findings)
-		if res == nil {
-			t.Errorf("unable to find item with uid %v", test3["uid"])
-		} else if hex.EncodeToString(res.ether) != test3["ether"] {
-			t.Errorf("expected ethernet hardware %s, got %s", test3["ether"], hex.EncodeToString(res.ether))
+	for i, pool := range pools {
+		if grants := pool.LocalGrants(); !reflect.DeepEqual(grants, expected[i]) {
+			t.Errorf("expected grants %v for pool %d, got %v", expected[i], i, grants)
+		}
+		if grants, subnet := pool.ScopeGrants(1), map[string]Grant{"unknown-clients": DENY}; !reflect.DeepEqual(grants, subnet) {
+			t.Errorf("expected grants %v for the subnet of pool %d, got %v", subnet, i, grants)
+		}
+		if grants := pool.ScopeGrants(3); len(grants) != 0 {
+			t.Errorf("expected no grants beyond the global scope of pool %d, got %v", i, grants)
+		}
+		if grant, ok := pool.GrantFor("unknown-clients"); !ok || grant != DENY {
+			t.Errorf("expected pool %d to inherit the grant for unknown-clients, got %v (%v)", i, grant, ok)
 		}
 	}
 
-	test4 := map[string]string{
-		"address": "127.0.0.17",
-		"uid":     "010dead0001122",
-		"ether":   "0dead0667788",
+	subnet, err := config.SubnetByAddress(net.ParseIP("172.33.33.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
 	}
-	test4Findings := filterAddress(test4["address"], results)
-	if len(test4Findings) != 2 {
-		t.Errorf("expected %d matching entries, got %d", 2, len(test4Findings))
-	} else {
-		res := findUid(test4["uid"], test4Findings)
-		if res == nil {
-			t.Errorf("unable to find item with uid %v", test4["uid"])
-		} else if hex.EncodeToString(res.ether) != test4["ether"] {
-			t.Errorf("expected ethernet hardware %s, got %s", test4["ether"], hex.EncodeToString(res.ether))
-		}
+	if grants := subnet.LocalGrants(); !reflect.DeepEqual(grants, map[string]Grant{"unknown-clients": DENY}) {
+		t.Errorf("expected the subnet's grants to exclude those of its pools, got %v", grants)
 	}
 }
 
-func consumeAppleLeaseString(s string) chan byte {
-	sch := consumeString(s)
-	uncommentedch := uncomment(sch)
-	return filterOutCharacters([]byte{'\r', '\v'}, uncommentedch)
+func TestParserDhcpConfigGrantFor(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+allow leasequery;
+deny client-updates;
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	range 172.33.33.128 172.33.33.254;
 }
-
-func TestParserReadAppleDhcpdLeaseEntry(t *testing.T) {
-	test1 := `{
-		ip_address=192.168.111.3
-		hw_address=1,0:c:56:3c:e7:22
-		identifier=1,0:c:56:3c:e7:22
-		lease=0x5fd78ae2
-		name=vagrant-2019
-		fake=field
-	}`
-	expected1 := map[string]string{
-		"ipAddress": "192.168.111.3",
-		"hwAddress": "000c563ce722",
-		"id":        "000c563ce722",
-		"lease":     "0x5fd78ae2",
-		"name":      "vagrant-2019",
-	}
-	expectedExtra1 := map[string]string{
-		"fake": "field",
+subnet 172.33.34.0 netmask 255.255.255.0 {
+	deny LeaseQuery;
+	allow client-updates;
+	pool {
+		allow members of "vmware";
+		deny dynamic-bootp-clients;
 	}
+}
+`)
 
-	result, err := readAppleDhcpdLeaseEntry(consumeAppleLeaseString(test1))
+	subnet, err := config.SubnetByAddress(net.ParseIP("172.33.33.0"))
 	if err != nil {
-		t.Errorf("error parsing entry: %s", err)
+		t.Fatalf("Unable to find subnet: %s", err)
 	}
-	if result.ipAddress != expected1["ipAddress"] {
-		t.Errorf("expected ipAddress %v, got %v", expected1["ipAddress"], result.ipAddress)
+	if grant, ok := subnet.LeaseQueryGrant(); !ok || grant != ALLOW {
+		t.Errorf("expected leasequery to be inherited as allowed, got %v (%v)", grant, ok)
 	}
-	if hex.EncodeToString(result.hwAddress) != expected1["hwAddress"] {
-		t.Errorf("expected hwAddress %v, got %v", expected1["hwAddress"], hex.EncodeToString(result.hwAddress))
+	if grant, ok := subnet.ClientUpdatesGrant(); !ok || grant != DENY {
+		t.Errorf("expected client-updates to be inherited as denied, got %v (%v)", grant, ok)
 	}
-	if hex.EncodeToString(result.id) != expected1["id"] {
-		t.Errorf("expected id %v, got %v", expected1["id"], hex.EncodeToString(result.id))
+	if _, ok := subnet.DynamicBootpClientsGrant(); ok {
+		t.Errorf("expected dynamic-bootp-clients to be missing")
 	}
-	if result.lease != expected1["lease"] {
-		t.Errorf("expected lease %v, got %v", expected1["lease"], result.lease)
+
+	subnet, err = config.SubnetByAddress(net.ParseIP("172.33.34.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
 	}
-	if result.name != expected1["name"] {
-		t.Errorf("expected name %v, got %v", expected1["name"], result.name)
+	if grant, ok := subnet.LeaseQueryGrant(); !ok || grant != DENY {
+		t.Errorf("expected leasequery to be overridden as denied, got %v (%v)", grant, ok)
 	}
-	if result.extra["fake"] != expectedExtra1["fake"] {
-		t.Errorf("expected extra %v, got %v", expectedExtra1["fake"], result.extra["fake"])
+	if grant, ok := subnet.ClientUpdatesGrant(); !ok || grant != ALLOW {
+		t.Errorf("expected client-updates to be overridden as allowed, got %v (%v)", grant, ok)
 	}
 
-	test2 := `{
-		ip_address=192.168.111.4
-		hw_address=1,0:c:56:3c:e7:23
-		identifier=1,0:c:56:3c:e7:23
-	}`
-	expected2 := map[string]string{
-		"ipAddress": "192.168.111.4",
-		"hwAddress": "000c563ce723",
-		"id":        "000c563ce723",
+	// Arbitrary attributes are still captured as they were written.
+	pool := config[len(config)-1]
+	if grant, ok := pool.DynamicBootpClientsGrant(); !ok || grant != DENY {
+		t.Errorf("expected dynamic-bootp-clients to be denied, got %v (%v)", grant, ok)
 	}
+	if grant, ok := pool.GrantFor(`members of "vmware"`); !ok || grant != ALLOW {
+		t.Errorf("expected members of class to be allowed, got %v (%v)", grant, ok)
+	}
+}
 
-	result, err = readAppleDhcpdLeaseEntry(consumeAppleLeaseString(test2))
+func TestParserDhcpConfigServes(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	range 172.33.33.128 172.33.33.254;
+}
+subnet 172.33.34.0 netmask 255.255.255.0 {
+	pool {
+		range 172.33.34.128 172.33.34.254;
+		deny all clients;
+	}
+}
+`)
+
+	subnet, err := config.SubnetByAddress(net.ParseIP("172.33.33.0"))
 	if err != nil {
-		t.Errorf("error parsing entry: %s", err)
+		t.Fatalf("Unable to find subnet: %s", err)
 	}
-	if result.ipAddress != expected2["ipAddress"] {
-		t.Errorf("expected ipAddress %v, got %v", expected2["ipAddress"], result.ipAddress)
+	if ok, reason := subnet.Serves(net.ParseIP("172.33.33.200")); !ok {
+		t.Errorf("expected in-range address to be served, got %q", reason)
 	}
-	if hex.EncodeToString(result.hwAddress) != expected2["hwAddress"] {
-		t.Errorf("expected hwAddress %v, got %v", expected2["hwAddress"], hex.EncodeToString(result.hwAddress))
+	if ok, reason := subnet.Serves(net.ParseIP("172.33.33.10")); ok {
+		t.Errorf("expected out-of-range address not to be served")
+	} else if !strings.Contains(reason, "outside of every range") {
+		t.Errorf("unexpected reason for out-of-range address: %q", reason)
 	}
-	if hex.EncodeToString(result.id) != expected2["id"] {
-		t.Errorf("expected id %v, got %v", expected2["id"], hex.EncodeToString(result.id))
+
+	pool := config[len(config)-1]
+	if ok, reason := pool.Serves(net.ParseIP("172.33.34.200")); ok {
+		t.Errorf("expected denied address not to be served")
+	} else if !strings.Contains(reason, "all clients is denied") {
+		t.Errorf("unexpected reason for denied address: %q", reason)
 	}
 }
 
-func TestParserReadAppleDhcpdLeases(t *testing.T) {
-	f, err := os.Open(filepath.Join("testdata", "apple-dhcpd-example.leases"))
+func TestParserDhcpConfigQuotedOptionValues(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+option domain-name "my lab";
+option domain-search "a.com", "b.com";
+option nis-domain "lab, west","east";
+option routers 172.33.33.2 ,172.33.33.3;
+option domain-name-servers 1.1.1.1, 8.8.8.8;
+`)
+
+	global, err := config.Global()
 	if err != nil {
-		t.Fatalf("Unable to open dhcpd.leases sample: %s", err)
+		t.Fatalf("Unable to retrieve global configuration: %s", err)
+	}
+
+	for name, expected := range map[string]string{
+		"domain-name":         `"my lab"`,
+		"domain-search":       `"a.com", "b.com"`,
+		"nis-domain":          `"lab, west", "east"`,
+		"routers":             "172.33.33.2, 172.33.33.3",
+		"domain-name-servers": "1.1.1.1, 8.8.8.8",
+	} {
+		if value, ok := global.Option(name); !ok || value != expected {
+			t.Errorf("expected option %s to be %s, got %s", name, expected, value)
+		}
 	}
-	defer f.Close()
 
-	results, err := ReadAppleDhcpdLeaseEntries(f)
+	name, err := global.OptionValue("domain-name")
 	if err != nil {
-		t.Fatalf("Error reading lease: %s", err)
+		t.Fatalf("Unable to parse domain-name: %s", err)
+	}
+	if v, err := name.Str(); err != nil || v != "my lab" {
+		t.Errorf("expected domain-name %q, got %q (%v)", "my lab", v, err)
 	}
 
-	// some simple utilities
-	filterIpAddress := func(ipAddress string, items []appleDhcpLeaseEntry) (result []appleDhcpLeaseEntry) {
-		for _, item := range items {
-			if item.ipAddress == ipAddress {
-				result = append(result, item)
-			}
+	for option, expected := range map[string][]string{
+		"domain-name":   {"my lab"},
+		"domain-search": {"a.com", "b.com"},
+		"nis-domain":    {"lab, west", "east"},
+	} {
+		value, err := global.OptionValue(option)
+		if err != nil {
+			t.Fatalf("Unable to parse %s: %s", option, err)
+		}
+		if v, err := value.Strs(); err != nil || !compareSlice(v, expected) {
+			t.Errorf("expected %s values %v, got %v (%v)", option, expected, v, err)
 		}
-		return
 	}
 
-	findId := func(id string, items []appleDhcpLeaseEntry) *appleDhcpLeaseEntry {
-		for _, item := range items {
-			if id == hex.EncodeToString(item.id) {
-				return &item
-			}
-		}
-		return nil
+	routers, err := global.OptionValue("routers")
+	if err != nil {
+		t.Fatalf("Unable to parse routers: %s", err)
+	}
+	if ips, err := routers.IPs(); err != nil || len(ips) != 2 {
+		t.Errorf("expected %d routers, got %v (%v)", 2, ips, err)
 	}
+}
 
-	findHardwareAddress := func(hwAddr string, items []appleDhcpLeaseEntry) *appleDhcpLeaseEntry {
-		for _, item := range items {
-			if hwAddr == hex.EncodeToString(item.hwAddress) {
-				return &item
-			}
-		}
-		return nil
+func TestParserDhcpConfigOptionValue(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+option domain-name "packer.test";
+option time-offset -18000;
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	option routers 172.33.33.2, 172.33.33.3;
+	option ip-forwarding off;
+	option broadcast-address 172.33.33.255;
+	option time-offset twelve;
+}
+`)
+
+	global, err := config.Global()
+	if err != nil {
+		t.Fatalf("Unable to retrieve global scope: %s", err)
+	}
+	domain, err := global.OptionValue("domain-name")
+	if err != nil {
+		t.Fatalf("error getting option domain-name: %s", err)
+	}
+	if v, err := domain.Str(); domain.Kind != OptionKindString || err != nil || v != "packer.test" {
+		t.Errorf("expected string %q, got %s %q (%v)", "packer.test", domain.Kind, v, err)
+	}
+	if _, err := domain.Int(); err == nil {
+		t.Errorf("expected an error getting a string option as an integer")
+	}
+	if raw, ok := global.Option("domain-name"); !ok || raw != `"packer.test"` {
+		t.Errorf("expected raw value %q, got %q (%v)", `"packer.test"`, raw, ok)
 	}
 
-	// actual unit tests
-	test1 := map[string]string{
-		"ipAddress": "127.0.0.19",
-		"id":        "0dead099aabb",
-		"hwAddress": "0dead099aabb",
+	offset, err := global.OptionValue("time-offset")
+	if err != nil {
+		t.Fatalf("error getting option time-offset: %s", err)
 	}
-	test1Findings := filterIpAddress(test1["ipAddress"], results)
-	if len(test1Findings) != 2 {
-		t.Errorf("expected %d matching entries, got %d", 2, len(test1Findings))
-	} else {
-		res := findHardwareAddress(test1["hwAddress"], test1Findings)
-		if res == nil {
-			t.Errorf("unable to find item with hwAddress %v", test1["hwAddress"])
-		} else if hex.EncodeToString(res.id) != test1["id"] {
-			t.Errorf("expected id %s, got %s", test1["id"], hex.EncodeToString(res.id))
-		}
+	if v, err := offset.Int(); offset.Kind != OptionKindInt || err != nil || v != -18000 {
+		t.Errorf("expected integer %d, got %s %d (%v)", -18000, offset.Kind, v, err)
 	}
 
-	test2 := map[string]string{
-		"ipAddress": "127.0.0.19",
-		"id":        "0dead0667788",
-		"hwAddress": "0dead0667788",
+	subnet, err := config.SubnetByAddress(net.ParseIP("172.33.33.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
 	}
-	test2Findings := filterIpAddress(test2["ipAddress"], results)
-	if len(test2Findings) != 2 {
-		t.Errorf("expected %d matching entries, got %d", 2, len(test2Findings))
-	} else {
-		res := findHardwareAddress(test2["hwAddress"], test2Findings)
-		if res == nil {
-			t.Errorf("unable to find item with hwAddress %v", test2["hwAddress"])
-		} else if hex.EncodeToString(res.id) != test2["id"] {
-			t.Errorf("expected id %s, got %s", test2["id"], hex.EncodeToString(res.id))
-		}
+
+	routers, err := subnet.OptionValue("routers")
+	if err != nil {
+		t.Fatalf("error getting option routers: %s", err)
+	}
+	ips, err := routers.IPs()
+	if routers.Kind != OptionKindIPList || err != nil || len(ips) != 2 || !ips[1].Equal(net.ParseIP("172.33.33.3")) {
+		t.Errorf("expected list of addresses, got %s %v (%v)", routers.Kind, ips, err)
 	}
 
-	test3 := map[string]string{
-		"ipAddress": "127.0.0.17",
-		"id":        "0dead0334455",
-		"hwAddress": "0dead0667788",
+	forwarding, err := subnet.OptionValue("ip-forwarding")
+	if err != nil {
+		t.Fatalf("error getting option ip-forwarding: %s", err)
 	}
-	test3Findings := filterIpAddress(test3["ipAddress"], results)
-	if len(test3Findings) != 2 {
-		t.Errorf("expected %d matching entries, got %d", 2, len(test3Findings))
-	} else {
-		res := findId(test3["id"], test3Findings)
-		if res == nil {
-			t.Errorf("unable to find item with id %v", test3["id"])
-		} else if hex.EncodeToString(res.hwAddress) != test3["hwAddress"] {
-			t.Errorf("expected hardware address %s, got %s", test3["hwAddress"], hex.EncodeToString(res.hwAddress))
-		}
+	if v, err := forwarding.Bool(); forwarding.Kind != OptionKindBool || err != nil || v {
+		t.Errorf("expected boolean false, got %s %v (%v)", forwarding.Kind, v, err)
 	}
 
-	test4 := map[string]string{
-		"ipAddress": "127.0.0.17",
-		"id":        "0dead0001122",
-		"hwAddress": "0dead0667788",
+	broadcast, err := subnet.OptionValue("broadcast-address")
+	if err != nil {
+		t.Fatalf("error getting option broadcast-address: %s", err)
 	}
-	test4Findings := filterIpAddress(test4["ipAddress"], results)
-	if len(test4Findings) != 2 {
-		t.Errorf("expected %d matching entries, got %d", 2, len(test4Findings))
-	} else {
-		res := findId(test4["id"], test4Findings)
-		if res == nil {
-			t.Errorf("unable to find item with id %v", test4["id"])
-		} else if hex.EncodeToString(res.hwAddress) != test4["hwAddress"] {
-			t.Errorf("expected hardware address %s, got %s", test4["hwAddress"], hex.EncodeToString(res.hwAddress))
-		}
+	if v, err := broadcast.IP(); broadcast.Kind != OptionKindIP || err != nil || !v.Equal(net.ParseIP("172.33.33.255")) {
+		t.Errorf("expected address, got %s %v (%v)", broadcast.Kind, v, err)
 	}
 
-	test5 := map[string]string{
-		"ipAddress": "127.0.0.20",
-		"id":        "0dead099aabc",
-		"hwAddress": "0dead099aabc",
+	// The subnet overrides the global time-offset with an invalid value.
+	if _, err := subnet.OptionValue("time-offset"); err == nil {
+		t.Errorf("expected an error for an unparseable integer option")
 	}
-	test5Findings := filterIpAddress(test5["ipAddress"], results)
-	if len(test5Findings) != 1 {
-		t.Errorf("expected %d matching entries, got %d", 1, len(test5Findings))
-	} else {
-		res := findId(test5["id"], test5Findings)
-		if res == nil {
-			t.Errorf("unable to find item with id %v", test5["id"])
-		} else if hex.EncodeToString(res.hwAddress) != test5["hwAddress"] {
-			t.Errorf("expected hardware address %s, got %s", test5["hwAddress"], hex.EncodeToString(res.hwAddress))
-		}
+	if _, err := subnet.OptionValue("missing"); err == nil {
+		t.Errorf("expected an error for a missing option")
 	}
 }
 
-func TestParserTokenizeNetworkingConfig(t *testing.T) {
-	tests := []string{
-		"words       words       words",
-		"newlines\n\n\n\n\n\n\n\nnewlines\r\r\r\r\r\r\r\rnewlines\n\n\n\n",
-		"       newline-less",
+func TestParserDhcpConfigInterface(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	interface "vmnet8";
+	range 172.33.33.128 172.33.33.254;
+}
+subnet 172.33.34.0 netmask 255.255.255.0 {
+	range 172.33.34.128 172.33.34.254;
+}
+`)
+
+	subnet, err := config.SubnetByAddress(net.ParseIP("172.33.33.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
 	}
-	expects := [][]string{
-		{"words", "words", "words"},
-		{"newlines", "\n", "newlines", "\n", "newlines", "\n"},
-		{"newline-less"},
+	if name, ok := subnet.Interface(); !ok || name != "vmnet8" {
+		t.Errorf("expected interface %q, got %q (%v)", "vmnet8", name, ok)
 	}
 
-	for testnum := 0; testnum < len(tests); testnum++ {
-		inCh := consumeString(tests[testnum])
-		outCh := tokenizeNetworkingConfig(inCh)
-		result := collectIntoStringList(outCh)
+	subnet, err = config.SubnetByAddress(net.ParseIP("172.33.34.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
+	}
+	if name, ok := subnet.Interface(); ok {
+		t.Errorf("expected no interface, got %q", name)
+	}
+}
 
-		expected := expects[testnum]
-		if len(result) != len(expected) {
-			t.Errorf("test %d expected %d items, got %d instead", 1+testnum, len(expected), len(result))
-			continue
+func TestParserDhcpConfigEffectiveNetmask(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	option subnet-mask 255.255.255.0;
+}
+subnet 172.33.34.0 netmask 255.255.255.0 {
+	option subnet-mask 255.255.0.0;
+}
+subnet 172.33.35.0 netmask 255.255.255.128 {
+}
+`)
+
+	tests := []struct {
+		subnet   string
+		expected net.IPMask
+		conflict bool
+	}{
+		{"172.33.33.0", net.CIDRMask(24, 32), false},
+		{"172.33.34.0", nil, true},
+		{"172.33.35.0", net.CIDRMask(25, 32), false},
+	}
+	for _, test := range tests {
+		subnet, err := config.SubnetByAddress(net.ParseIP(test.subnet))
+		if err != nil {
+			t.Fatalf("Unable to find subnet %s: %s", test.subnet, err)
 		}
 
-		ok := true
-		for index := 0; index < len(expected); index++ {
-			if result[index] != expected[index] {
-				ok = false
+		mask, err := subnet.EffectiveNetmask()
+		if test.conflict {
+			if err == nil {
+				t.Errorf("expected a conflicting netmask for subnet %s, got %s", test.subnet, mask)
 			}
+			continue
 		}
-		if !ok {
-			t.Errorf("test %d expected %#v, got %#v", 1+testnum, expects[testnum], result)
+		if err != nil {
+			t.Errorf("expected a netmask for subnet %s, got error: %s", test.subnet, err)
+		} else if mask.String() != test.expected.String() {
+			t.Errorf("expected netmask %s for subnet %s, got %s", test.expected, test.subnet, mask)
 		}
 	}
-}
 
-func TestParserSplitNetworkingConfig(t *testing.T) {
-	tests := []string{
-		"this is a story\n\n\nabout some newlines",
-		"\n\n\nthat can begin and end with newlines\n\n\n",
-		"   in\n\n\nsome\ncases\nit\ncan\nend\nwith\nan\nempty\nstring\n\n\n\n",
-		"\n\n\nand\nbegin\nwith\nan\nempty\nstring   ",
-	}
-	expects := [][]string{
-		{"this is a story", "about some newlines"},
-		{"that can begin and end with newlines"},
-		{"in", "some", "cases", "it", "can", "end", "with", "an", "empty", "string"},
-		{"and", "begin", "with", "an", "empty", "string"},
+	errs := config.Validate()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "disagrees with netmask") {
+		t.Errorf("expected a single conflicting netmask to be reported, got %v", errs)
 	}
 
-	for testnum := 0; testnum < len(tests); testnum++ {
-		inCh := consumeString(tests[testnum])
-		stringCh := tokenizeNetworkingConfig(inCh)
-		outCh := splitNetworkingConfig(stringCh)
-
-		result := make([]string, 0)
-		for item := range outCh {
-			result = append(result, strings.Join(item, " "))
-		}
+	global, err := config.Global()
+	if err != nil {
+		t.Fatalf("Unable to retrieve global scope: %s", err)
+	}
+	if _, err := global.EffectiveNetmask(); err == nil {
+		t.Errorf("expected an error for a declaration that isn't a subnet")
+	}
+}
 
-		expected := expects[testnum]
-		if len(result) != len(expected) {
-			t.Errorf("test %d expected %d items, got %d instead", 1+testnum, len(expected), len(result))
-			continue
+func TestParserDhcpConfigNetworkBroadcast(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+subnet 172.33.33.0 netmask 255.255.255.0 {
+}
+subnet 172.33.34.128 netmask 255.255.255.128 {
+}
+subnet6 fe80::/64 {
+}
+`)
+
+	tests := []struct {
+		subnet    string
+		network   string
+		broadcast string
+	}{
+		{"172.33.33.0", "172.33.33.0", "172.33.33.255"},
+		{"172.33.34.128", "172.33.34.128", "172.33.34.255"},
+	}
+	for _, test := range tests {
+		subnet, err := config.SubnetByAddress(net.ParseIP(test.subnet))
+		if err != nil {
+			t.Fatalf("Unable to find subnet %s: %s", test.subnet, err)
 		}
 
-		ok := true
-		for index := 0; index < len(expected); index++ {
-			if result[index] != expected[index] {
-				ok = false
-			}
+		if network, err := subnet.Network(); err != nil || network.String() != test.network {
+			t.Errorf("expected network %s for subnet %s, got %s (%v)", test.network, test.subnet, network, err)
 		}
-		if !ok {
-			t.Errorf("test %d expected %#v, got %#v", 1+testnum, expects[testnum], result)
+		if broadcast, err := subnet.Broadcast(); err != nil || broadcast.String() != test.broadcast {
+			t.Errorf("expected broadcast %s for subnet %s, got %s (%v)", test.broadcast, test.subnet, broadcast, err)
 		}
 	}
-}
 
-func TestParserParseNetworkingConfigVersion(t *testing.T) {
-	successTests := []string{"VERSION=4,2"}
-	failureTests := []string{
-		"VERSION=1=2",
-		"VERSION=3,4,5",
-		"VERSION=a,b",
+	subnet6, err := config.SubnetByAddress(net.ParseIP("fe80::1"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet6: %s", err)
+	}
+	if network, err := subnet6.Network(); err != nil || network.String() != "fe80::" {
+		t.Errorf("expected network %s for subnet6, got %s (%v)", "fe80::", network, err)
+	}
+	if broadcast, err := subnet6.Broadcast(); err == nil {
+		t.Errorf("expected an error for the broadcast of a subnet6, got %s", broadcast)
 	}
 
-	for testnum := 0; testnum < len(successTests); testnum++ {
-		test := []string{successTests[testnum]}
-		if _, err := networkingReadVersion(test); err != nil {
-			t.Errorf("success-test %d parsing failed: %v", 1+testnum, err)
-		}
+	global, err := config.Global()
+	if err != nil {
+		t.Fatalf("Unable to retrieve global scope: %s", err)
 	}
+	if _, err := global.Network(); err == nil {
+		t.Errorf("expected an error for a declaration that isn't a subnet")
+	}
+}
 
-	for testnum := 0; testnum < len(successTests); testnum++ {
-		test := []string{failureTests[testnum]}
-		if _, err := networkingReadVersion(test); err == nil {
-			t.Errorf("failure-test %d should have failed", 1+testnum)
-		}
+func TestParserDhcpConfigSubnet(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+subnet 172.33.34.128 netmask 255.255.255.128 {
+	pool {
+		range 172.33.34.200 172.33.34.210;
 	}
 }
+subnet6 fe80::/64 {
+}
+`)
 
-func TestParserParseNetworkingConfigEntries(t *testing.T) {
-	tests := []string{
-		"answer VNET_999_ANYTHING option",
-		"remove_answer VNET_123_ALSOANYTHING",
-		"add_nat_portfwd 24 udp 42 127.0.0.1 24",
-		"remove_nat_portfwd 42 tcp 2502",
-		"add_dhcp_mac_to_ip 57005 00:0d:0e:0a:0d:00 127.0.0.2",
-		"remove_dhcp_mac_to_ip 57005 00:0d:0e:0a:0d:00",
-		"add_bridge_mapping string 51",
-		"remove_bridge_mapping string",
-		"add_nat_prefix 57005 /24",
-		"remove_nat_prefix 57005 /31",
+	subnet, err := config.SubnetByAddress(net.ParseIP("172.33.34.130"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
+	}
+	network, err := subnet.Subnet()
+	if err != nil || network.String() != "172.33.34.128/25" {
+		t.Fatalf("expected subnet %s, got %v (%v)", "172.33.34.128/25", network, err)
+	}
+	if !network.Contains(net.ParseIP("172.33.34.200")) || network.Contains(net.ParseIP("172.33.34.1")) {
+		t.Errorf("expected subnet %s to contain only its own addresses", network)
 	}
 
-	for testnum := 0; testnum < len(tests); testnum++ {
-		test := strings.Split(tests[testnum], " ")
-		parser := NetworkingParserByCommand(test[0])
-		if parser == nil {
-			t.Errorf("test %d unable to parse command: %#v", 1+testnum, test)
+	// The result is a copy, so modifying it doesn't affect the declaration.
+	network.IP[3] = 0
+	if again, _ := subnet.Subnet(); again.String() != "172.33.34.128/25" {
+		t.Errorf("expected the declaration to be unchanged, got %s", again)
+	}
+
+	subnet6, err := config.SubnetByAddress(net.ParseIP("fe80::1"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet6: %s", err)
+	}
+	if network, err := subnet6.Subnet(); err != nil || network.String() != "fe80::/64" {
+		t.Errorf("expected subnet6 %s, got %v (%v)", "fe80::/64", network, err)
+	}
+
+	pool := config[2]
+	if network, err := pool.Subnet(); err == nil {
+		t.Errorf("expected an error for a pool, got %s", network)
+	}
+	global, err := config.Global()
+	if err != nil {
+		t.Fatalf("Unable to retrieve global scope: %s", err)
+	}
+	if network, err := global.Subnet(); err == nil {
+		t.Errorf("expected an error for the global scope, got %s", network)
+	}
+}
+
+func TestParserDhcpConfigClientBehavior(t *testing.T) {
+	tests := []struct {
+		config     string
+		duplicates bool
+		oneLease   bool
+	}{
+		{"deny duplicates;\none-lease-per-client;\n", true, true},
+		{"ignore duplicates;\none-lease-per-client true;\n", true, true},
+		{"allow duplicates;\none-lease-per-client off;\n", false, false},
+		{"authoritative;\n", false, false},
+	}
+	for _, test := range tests {
+		config := readDhcpConfigurationFromString(t, test.config+"subnet 192.168.1.0 netmask 255.255.255.0 {\n}\n")
+
+		global, err := config.Global()
+		if err != nil {
+			t.Fatalf("Unable to retrieve global scope: %s", err)
+		}
+		subnet, err := config.SubnetByAddress(net.ParseIP("192.168.1.0"))
+		if err != nil {
+			t.Fatalf("Unable to find subnet: %s", err)
+		}
+
+		// The subnet inherits the statements of the global scope.
+		for scope, decl := range map[string]ConfigDeclaration{"global": global, "subnet": subnet} {
+			if result := decl.DenyDuplicates(); result != test.duplicates {
+				t.Errorf("expected duplicates to be denied to be %v for the %s scope of %q, got %v", test.duplicates, scope, test.config, result)
+			}
+			if result := decl.OneLeasePerClient(); result != test.oneLease {
+				t.Errorf("expected one-lease-per-client to be %v for the %s scope of %q, got %v", test.oneLease, scope, test.config, result)
+			}
+		}
+	}
+
+	config := readDhcpConfigurationFromString(t, `
+deny duplicates;
+one-lease-per-client on;
+subnet 192.168.1.0 netmask 255.255.255.0 {
+	allow duplicates;
+	one-lease-per-client false;
+}
+`)
+	subnet, err := config.SubnetByAddress(net.ParseIP("192.168.1.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
+	}
+	if subnet.DenyDuplicates() || subnet.OneLeasePerClient() {
+		t.Errorf("expected the subnet to override the global scope")
+	}
+}
+
+func TestParserDhcpConfigDdns(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+ddns-update-style interim;
+ddns-domainname "example.com";
+update-static-leases on;
+subnet 192.168.1.0 netmask 255.255.255.0 {
+	update-static-leases off;
+}
+`)
+
+	global, err := config.Global()
+	if err != nil {
+		t.Fatalf("Unable to retrieve global scope: %s", err)
+	}
+	if style := global.DdnsUpdateStyle(); style != "interim" {
+		t.Errorf("expected ddns-update-style %q, got %q", "interim", style)
+	}
+	if name, err := global.DdnsDomainName(); err != nil || name != "example.com" {
+		t.Errorf("expected ddns-domainname %q, got %q (%v)", "example.com", name, err)
+	}
+	if !global.UpdateStaticLeases() {
+		t.Errorf("expected update-static-leases to be enabled")
+	}
+
+	subnet, err := config.SubnetByAddress(net.ParseIP("192.168.1.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
+	}
+	if subnet.UpdateStaticLeases() {
+		t.Errorf("expected update-static-leases to be disabled for the subnet")
+	}
+	// The remaining settings are inherited from the global scope.
+	if style := subnet.DdnsUpdateStyle(); style != "interim" {
+		t.Errorf("expected ddns-update-style %q, got %q", "interim", style)
+	}
+
+	empty := readDhcpConfigurationFromString(t, "authoritative;\n")
+	global, err = empty.Global()
+	if err != nil {
+		t.Fatalf("Unable to retrieve global scope: %s", err)
+	}
+	if style := global.DdnsUpdateStyle(); style != "none" {
+		t.Errorf("expected ddns-update-style %q, got %q", "none", style)
+	}
+	if _, err := global.DdnsDomainName(); err == nil {
+		t.Errorf("expected an error for a missing ddns-domainname")
+	}
+	if global.UpdateStaticLeases() {
+		t.Errorf("expected update-static-leases to be disabled")
+	}
+}
+
+func TestParserDhcpConfigOptionDefinitions(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+option build-tag code 224 = text;
+option pxe-servers code 225=array of ip-address;
+subnet 192.168.1.0 netmask 255.255.255.0 {
+	option build-tag "nightly";
+	option routers 192.168.1.1;
+}
+`)
+
+	subnet, err := config.SubnetByAddress(net.ParseIP("192.168.1.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
+	}
+
+	// The definitions are inherited from the global scope.
+	expected := []OptionDefinition{
+		{Name: "build-tag", Code: 224, Type: "text"},
+		{Name: "pxe-servers", Code: 225, Type: "array of ip-address"},
+	}
+	definitions := subnet.OptionDefinitions()
+	if len(definitions) != len(expected) {
+		t.Fatalf("expected definitions %v, got %v", expected, definitions)
+	}
+	for i := range expected {
+		if definitions[i] != expected[i] {
+			t.Errorf("expected definition %v, got %v", expected[i], definitions[i])
+		}
+	}
+
+	// A definition isn't an assignment, so only the subnet's value is set.
+	if definition, ok := subnet.OptionDefinition("build-tag"); !ok || definition.Code != 224 {
+		t.Errorf("expected a definition for build-tag, got %v", definition)
+	}
+	if value, ok := subnet.Option("build-tag"); !ok || value != `"nightly"` {
+		t.Errorf("expected build-tag to be assigned %q, got %q", `"nightly"`, value)
+	}
+	if value, ok := subnet.Option("pxe-servers"); ok {
+		t.Errorf("expected pxe-servers to be unassigned, got %q", value)
+	}
+	if _, ok := subnet.OptionDefinition("routers"); ok {
+		t.Errorf("expected no definition for routers")
+	}
+}
+
+func TestParserDhcpConfigBootpFlags(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+always-broadcast on;
+subnet 192.168.1.0 netmask 255.255.255.0 {
+	allow dynamic-bootp-clients;
+}
+subnet 192.168.2.0 netmask 255.255.255.0 {
+	always-broadcast off;
+	deny dynamic-bootp-clients;
+}
+`)
+
+	first, err := config.SubnetByAddress(net.ParseIP("192.168.1.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
+	}
+	// always-broadcast is inherited from the global scope.
+	if !first.AlwaysBroadcast() {
+		t.Errorf("expected always-broadcast to be enabled")
+	}
+	if !first.DynamicBootp() {
+		t.Errorf("expected dynamic-bootp-clients to be allowed")
+	}
+
+	second, err := config.SubnetByAddress(net.ParseIP("192.168.2.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
+	}
+	if second.AlwaysBroadcast() {
+		t.Errorf("expected always-broadcast to be disabled for the subnet")
+	}
+	if second.DynamicBootp() {
+		t.Errorf("expected dynamic-bootp-clients to be denied")
+	}
+
+	global, err := config.Global()
+	if err != nil {
+		t.Fatalf("Unable to retrieve global scope: %s", err)
+	}
+	if global.DynamicBootp() {
+		t.Errorf("expected dynamic-bootp-clients to be disabled by default")
+	}
+}
+
+func TestParserDhcpConfigGlobalDirectives(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+log-facility local7;
+ping-check false;
+ping-timeout 3;
+`)
+
+	global, err := config.Global()
+	if err != nil {
+		t.Fatalf("Unable to retrieve global scope: %s", err)
+	}
+
+	if facility, ok := global.LogFacility(); !ok || facility != "local7" {
+		t.Errorf("expected log-facility %q, got %q (%v)", "local7", facility, ok)
+	}
+	if global.PingCheck() {
+		t.Errorf("expected ping-check to be disabled")
+	}
+	if timeout, err := global.PingTimeout(); err != nil || timeout != 3*time.Second {
+		t.Errorf("expected ping-timeout %s, got %s (%v)", 3*time.Second, timeout, err)
+	}
+
+	// The defaults of dhcpd apply when the directives are missing.
+	config = readDhcpConfigurationFromString(t, "authoritative;\n")
+	global, err = config.Global()
+	if err != nil {
+		t.Fatalf("Unable to retrieve global scope: %s", err)
+	}
+
+	if facility, ok := global.LogFacility(); ok {
+		t.Errorf("expected no log-facility, got %q", facility)
+	}
+	if !global.PingCheck() {
+		t.Errorf("expected ping-check to be enabled")
+	}
+	if timeout, err := global.PingTimeout(); err != nil || timeout != time.Second {
+		t.Errorf("expected ping-timeout %s, got %s (%v)", time.Second, timeout, err)
+	}
+
+	config = readDhcpConfigurationFromString(t, "ping-timeout soon;\n")
+	global, err = config.Global()
+	if err != nil {
+		t.Fatalf("Unable to retrieve global scope: %s", err)
+	}
+	if _, err := global.PingTimeout(); err == nil {
+		t.Errorf("expected an error for an invalid ping-timeout")
+	}
+}
+
+func TestParserDhcpConfigLocalOptions(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+option domain-name "packer.test";
+default-lease-time 1800;
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	option routers 172.33.33.2;
+	max-lease-time 7200;
+}
+`)
+
+	subnet, err := config.SubnetByAddress(net.ParseIP("172.33.33.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
+	}
+
+	// Both options are visible through the inherited view.
+	if _, ok := subnet.Option("domain-name"); !ok {
+		t.Errorf("expected option domain-name to be inherited")
+	}
+
+	expected := map[string]string{"routers": "172.33.33.2"}
+	if options := subnet.LocalOptions(); !reflect.DeepEqual(options, expected) {
+		t.Errorf("expected local options %v, got %v", expected, options)
+	}
+
+	expected = map[string]string{"max-lease-time": "7200"}
+	if parameters := subnet.LocalParameters(); !reflect.DeepEqual(parameters, expected) {
+		t.Errorf("expected local parameters %v, got %v", expected, parameters)
+	}
+
+	global, err := config.Global()
+	if err != nil {
+		t.Fatalf("Unable to retrieve global scope: %s", err)
+	}
+	expected = map[string]string{"domain-name": "\"packer.test\""}
+	if options := global.LocalOptions(); !reflect.DeepEqual(options, expected) {
+		t.Errorf("expected local options %v, got %v", expected, options)
+	}
+}
+
+func TestParserDhcpConfigFixedAddressSpec(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+host unresolvable {
+	hardware ethernet 00:50:56:00:00:01;
+	fixed-address builder.invalid;
+}
+host multiple {
+	hardware ethernet 00:50:56:00:00:02;
+	fixed-address 172.33.33.10, 172.33.33.11;
+}
+`)
+
+	// The hostname can't be resolved, but the spec is still available.
+	unresolvable := config[1]
+	expected := []string{"builder.invalid"}
+	if spec := unresolvable.FixedAddressSpec(); !compareSlice(spec, expected) {
+		t.Errorf("expected fixed-address spec %v, got %v", expected, spec)
+	}
+
+	multiple := config[2]
+	expected = []string{"172.33.33.10", "172.33.33.11"}
+	if spec := multiple.FixedAddressSpec(); !compareSlice(spec, expected) {
+		t.Errorf("expected fixed-address spec %v, got %v", expected, spec)
+	}
+
+	global, err := config.Global()
+	if err != nil {
+		t.Fatalf("Unable to retrieve global scope: %s", err)
+	}
+	if spec := global.FixedAddressSpec(); len(spec) != 0 {
+		t.Errorf("expected no fixed-address spec, got %v", spec)
+	}
+}
+
+func TestParserDhcpConfigEqual(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+option domain-name "packer.test";
+default-lease-time 1800;
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	range 172.33.33.128 172.33.33.254;
+	range 172.33.33.10 172.33.33.20;
+	option routers 172.33.33.2;
+}
+host vmnet8 {
+	hardware ethernet 00:50:56:c0:00:08;
+	fixed-address 172.33.33.1;
+}
+`)
+
+	// The same configuration with its declarations and parameters reordered.
+	reordered := readDhcpConfigurationFromString(t, `
+host vmnet8 {
+	fixed-address 172.33.33.1;
+	hardware ethernet 00:50:56:c0:00:08;
+}
+default-lease-time 1800;
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	option routers 172.33.33.2;
+	range 172.33.33.10 172.33.33.20;
+	range 172.33.33.128 172.33.33.254;
+}
+option domain-name "packer.test";
+`)
+
+	if !config.Equal(reordered) || !reordered.Equal(config) {
+		t.Errorf("expected reordered configurations to be equal")
+	}
+
+	changed := readDhcpConfigurationFromString(t, `
+option domain-name "packer.test";
+default-lease-time 1800;
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	range 172.33.33.128 172.33.33.254;
+	range 172.33.33.10 172.33.33.20;
+	option routers 172.33.33.3;
+}
+host vmnet8 {
+	hardware ethernet 00:50:56:c0:00:08;
+	fixed-address 172.33.33.1;
+}
+`)
+
+	if config.Equal(changed) {
+		t.Errorf("expected configurations with a changed option to differ")
+	}
+	if config.Equal(config[:len(config)-1]) {
+		t.Errorf("expected configurations with a missing declaration to differ")
+	}
+}
+
+func TestParserDhcpConfigDiff(t *testing.T) {
+	before := readDhcpConfigurationFromString(t, `
+option domain-name "packer.test";
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	range 172.33.33.128 172.33.33.254;
+	option routers 172.33.33.2;
+	allow unknown-clients;
+}
+host vmnet8 {
+	hardware ethernet 00:50:56:c0:00:08;
+	fixed-address 172.33.33.1;
+}
+host retired {
+	hardware ethernet 00:50:56:c0:00:09;
+	fixed-address 172.33.33.9;
+}
+`)
+
+	// The routers option and a range are changed, the retired host is
+	// removed, and a subnet is added.
+	after := readDhcpConfigurationFromString(t, `
+option domain-name "packer.test";
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	range 172.33.33.100 172.33.33.254;
+	option routers 172.33.33.3;
+	allow unknown-clients;
+}
+host vmnet8 {
+	hardware ethernet 00:50:56:c0:00:08;
+	fixed-address 172.33.33.1;
+}
+subnet 172.33.34.0 netmask 255.255.255.0 {
+}
+`)
+
+	expected := []DeclarationDiff{
+		{Kind: DeclarationModified, ID: "{subnet4 172.33.33.0/24},{global}", Changes: []string{
+			"option routers changed from 172.33.33.2 to 172.33.33.3",
+			"range4:172.33.33.100-172.33.33.254 added",
+			"range4:172.33.33.128-172.33.33.254 removed",
+		}},
+		{Kind: DeclarationRemoved, ID: "{host name:retired},{global}"},
+		{Kind: DeclarationAdded, ID: "{subnet4 172.33.34.0/24},{global}"},
+	}
+
+	diffs := DiffDhcpConfigurations(before, after)
+	if len(diffs) != len(expected) {
+		t.Fatalf("expected %d differences, got %v", len(expected), diffs)
+	}
+	for i := range expected {
+		if diffs[i].String() != expected[i].String() {
+			t.Errorf("expected difference %q, got %q", expected[i], diffs[i])
+		}
+	}
+
+	if diffs := DiffDhcpConfigurations(before, before); len(diffs) != 0 {
+		t.Errorf("expected no differences for the same configuration, got %v", diffs)
+	}
+}
+
+func TestParserDiffDhcpConfigurationsBooleansAndOrder(t *testing.T) {
+	before := readDhcpConfigurationFromString(t, `
+authoritative;
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	pool { range 172.33.33.10 172.33.33.19; }
+	pool { range 172.33.33.20 172.33.33.29; }
+}
+`)
+
+	after := readDhcpConfigurationFromString(t, `
+not authoritative;
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	pool { range 172.33.33.10 172.33.33.19; }
+	pool { range 172.33.33.20 172.33.33.29; }
+}
+`)
+
+	diffs := DiffDhcpConfigurations(before, after)
+	if len(diffs) != 1 || len(diffs[0].Changes) != 1 {
+		t.Fatalf("expected a single change, got %v", diffs)
+	}
+	if expected := "authoritative changed from on to off"; diffs[0].Changes[0] != expected {
+		t.Errorf("expected change %q, got %q", expected, diffs[0].Changes[0])
+	}
+
+	// Pools share an identifier and are matched by their position, but the
+	// configurations are equal regardless of the order they're written in.
+	reordered := readDhcpConfigurationFromString(t, `
+authoritative;
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	pool { range 172.33.33.20 172.33.33.29; }
+	pool { range 172.33.33.10 172.33.33.19; }
+}
+`)
+	if diffs := DiffDhcpConfigurations(before, reordered); len(diffs) != 0 {
+		t.Errorf("expected no differences for equal configurations, got %v", diffs)
+	}
+}
+
+func TestParserDhcpConfigIncludeOrder(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "conf.d"), 0755); err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+
+	// The included subnet includes its own options relative to its file.
+	files := map[string]string{
+		filepath.Join(dir, "dhcpd.conf"): `subnet 10.0.1.0 netmask 255.255.255.0 { }
+include "conf.d/second.conf";
+subnet 10.0.3.0 netmask 255.255.255.0 { }
+`,
+		filepath.Join(dir, "conf.d", "second.conf"): `subnet 10.0.2.0 netmask 255.255.255.0 {
+	include "routers.conf";
+}
+`,
+		filepath.Join(dir, "conf.d", "routers.conf"): "option routers 10.0.2.1;\n",
+	}
+	for path, contents := range files {
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("Unable to write dhcpd.conf sample: %s", err)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "dhcpd.conf"))
+	if err != nil {
+		t.Fatalf("Unable to open dhcpd.conf sample: %s", err)
+	}
+	defer f.Close()
+
+	config, err := ReadDhcpConfigurationWithIncludes(f, DhcpIncludeOptions{})
+	if err != nil {
+		t.Fatalf("Error reading configuration with includes: %s", err)
+	}
+
+	var subnets []string
+	for _, declaration := range config {
+		if network, err := declaration.Subnet(); err == nil {
+			subnets = append(subnets, network.String())
+		}
+	}
+	expected := []string{"10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"}
+	if !compareSlice(subnets, expected) {
+		t.Errorf("expected the included subnet in place of the include %v, got %v", expected, subnets)
+	}
+
+	subnet, err := config.SubnetByAddress(net.ParseIP("10.0.2.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
+	}
+	if value, ok := subnet.Option("routers"); !ok || value != "10.0.2.1" {
+		t.Errorf("expected option routers from the nested include, got %q (%v)", value, ok)
+	}
+}
+
+func TestParserDhcpConfigIncludes(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	extra := t.TempDir()
+	t.Setenv("PACKER_DHCP_EXTRA", extra)
+
+	files := map[string]string{
+		filepath.Join(home, "hosts.conf"): `host vmnet8 {
+	hardware ethernet 00:50:56:c0:00:08;
+	fixed-address 172.33.33.1;
+}
+`,
+		filepath.Join(extra, "options.conf"): "option domain-name \"packer.test\";\n",
+	}
+	for path, contents := range files {
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("Unable to write included file: %s", err)
+		}
+	}
+
+	read := func(contents string, options DhcpIncludeOptions) (DhcpConfiguration, error) {
+		path := filepath.Join(t.TempDir(), "dhcpd.conf")
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("Unable to write dhcpd.conf sample: %s", err)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Unable to open dhcpd.conf sample: %s", err)
+		}
+		defer f.Close()
+		return ReadDhcpConfigurationWithIncludes(f, options)
+	}
+
+	sample := `include "~/hosts.conf";
+include "${PACKER_DHCP_EXTRA}/options.conf";
+`
+	config, err := read(sample, DhcpIncludeOptions{ExpandPaths: true})
+	if err != nil {
+		t.Fatalf("Error reading configuration with includes: %s", err)
+	}
+
+	global, err := config.Global()
+	if err != nil {
+		t.Fatalf("Unable to retrieve global scope: %s", err)
+	}
+	if value, ok := global.Option("domain-name"); !ok || value != "\"packer.test\"" {
+		t.Errorf("expected option domain-name from the included file, got %q (%v)", value, ok)
+	}
+
+	host, err := config.HostByName("vmnet8")
+	if err != nil {
+		t.Fatalf("expected host from the included file: %s", err)
+	}
+	if ip, err := host.IP4(); err != nil || !ip.Equal(net.ParseIP("172.33.33.1")) {
+		t.Errorf("expected fixed-address %s, got %s (%v)", "172.33.33.1", ip, err)
+	}
+
+	// Paths aren't expanded unless requested.
+	if _, err := read(sample, DhcpIncludeOptions{}); err == nil {
+		t.Errorf("expected an error for an unexpanded path")
+	}
+
+	_, err = read("include \"$PACKER_DHCP_EXTRA/missing.conf\";\n", DhcpIncludeOptions{ExpandPaths: true})
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(extra, "missing.conf")) {
+		t.Errorf("expected an error naming the expanded path, got %v", err)
+	}
+}
+
+func TestParserDhcpConfigHostIdentifiers(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+host relayed {
+	host-identifier option agent.circuit-id "rack1-port7";
+	fixed-address 172.33.33.20;
+}
+host direct {
+	hardware ethernet 00:50:56:00:00:01;
+}
+`)
+
+	relayed, err := config.HostByName("relayed")
+	if err != nil {
+		t.Fatalf("Unable to find host: %s", err)
+	}
+	expected := []ClientMatch{{Option: "agent.circuit-id", Data: "rack1-port7"}}
+	if ids := relayed.HostIdentifiers(); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected host identifiers %v, got %v", expected, ids)
+	}
+
+	direct, err := config.HostByName("direct")
+	if err != nil {
+		t.Fatalf("Unable to find host: %s", err)
+	}
+	if ids := direct.HostIdentifiers(); len(ids) != 0 {
+		t.Errorf("expected no host identifiers, got %v", ids)
+	}
+}
+
+func TestParserDhcpConfigRanges(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+subnet 172.33.33.0 netmask 255.255.255.0 {
+	pool {
+		range 172.33.33.200 172.33.33.254;
+		range dynamic-bootp 172.33.33.128 172.33.33.150;
+		range 172.33.33.100;
+	}
+}
+`)
+
+	pool := config[2]
+	expected := []IPRange{
+		{Min: net.ParseIP("172.33.33.200"), Max: net.ParseIP("172.33.33.254")},
+		{Min: net.ParseIP("172.33.33.128"), Max: net.ParseIP("172.33.33.150"), Bootp: true},
+		{Min: net.ParseIP("172.33.33.100"), Max: net.ParseIP("172.33.33.100")},
+	}
+
+	ranges := pool.Ranges()
+	if len(ranges) != len(expected) {
+		t.Fatalf("expected %d ranges, got %v", len(expected), ranges)
+	}
+	for i := range expected {
+		if !ranges[i].Min.Equal(expected[i].Min) || !ranges[i].Max.Equal(expected[i].Max) || ranges[i].Bootp != expected[i].Bootp {
+			t.Errorf("expected range %d to be %v, got %v", i, expected[i], ranges[i])
+		}
+	}
+
+	subnet := config[1]
+	if ranges := subnet.Ranges(); len(ranges) != 0 {
+		t.Errorf("expected no ranges for the subnet, got %v", ranges)
+	}
+}
+
+func TestParserDhcpConfigSingletonRanges(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+subnet 10.0.0.0 netmask 255.255.255.0 {
+	range 10.0.0.5;
+	range 10.0.0.5 10.0.0.5;
+	range 10.0.0.10 10.0.0.20;
+	range dynamic-bootp 10.0.0.30;
+}
+`)
+
+	subnet, err := config.SubnetByAddress(net.ParseIP("10.0.0.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
+	}
+	ranges := subnet.Ranges()
+	expected := []bool{true, false, false, true}
+	if len(ranges) != len(expected) {
+		t.Fatalf("expected %d ranges, got %v", len(expected), ranges)
+	}
+	for i, singleton := range expected {
+		if ranges[i].IsSingleton() != singleton {
+			t.Errorf("expected range %d (%s-%s) singleton to be %v", i, ranges[i].Min, ranges[i].Max, singleton)
+		}
+	}
+	for _, i := range []int{0, 1} {
+		if !ranges[i].Min.Equal(net.ParseIP("10.0.0.5")) || !ranges[i].Max.Equal(net.ParseIP("10.0.0.5")) {
+			t.Errorf("expected range %d to cover only 10.0.0.5, got %s-%s", i, ranges[i].Min, ranges[i].Max)
+		}
+	}
+}
+
+func TestParserDhcpConfigHardwareClasses(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+host ethernet { hardware ethernet 00:50:56:00:00:01; }
+host fddi { hardware FDDI 00:50:56:00:00:02; }
+host token-ring { hardware token-ring 00:50:56:00:00:03; }
+host infiniband { hardware infiniband 80:00:00:48:fe:80:00:00:00:00:00:00:00:02:c9:03:00:0a:bc:de; }
+`)
+
+	for name, expected := range map[string]string{
+		"ethernet":   "00:50:56:00:00:01",
+		"fddi":       "00:50:56:00:00:02",
+		"token-ring": "00:50:56:00:00:03",
+		"infiniband": "80:00:00:48:fe:80:00:00:00:00:00:00:00:02:c9:03:00:0a:bc:de",
+	} {
+		host, err := config.HostByName(name)
+		if err != nil {
+			t.Fatalf("Unable to find host %s: %s", name, err)
+		}
+		if address, err := host.Hardware(); err != nil || address.String() != expected {
+			t.Errorf("expected hardware address %s for host %s, got %s (%v)", expected, name, address, err)
+		}
+	}
+
+	for input, expected := range map[string]string{
+		"host a { hardware wifi 00:50:56:00:00:01; }":       `unknown hardware class "wifi"`,
+		"host a { hardware ethernet 00:50:56:00:01; }":      `invalid ethernet hardware address "00:50:56:00:01", expected 6 octets`,
+		"host a { hardware infiniband 00:50:56:00:00:01; }": `invalid infiniband hardware address "00:50:56:00:00:01", expected 20 octets`,
+	} {
+		path := filepath.Join(t.TempDir(), "dhcpd.conf")
+		if err := os.WriteFile(path, []byte(input), 0644); err != nil {
+			t.Fatalf("Unable to write dhcpd.conf sample: %s", err)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Unable to open dhcpd.conf sample: %s", err)
+		}
+		_, err = ReadDhcpConfiguration(f)
+		f.Close()
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error parsing %q to contain %s, got %v", input, expected, err)
+		}
+	}
+}
+
+func TestParserDhcpConfigClasslessStaticRoutes(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+option rfc3442-classless-static-routes code 121 = array of integer 8;
+subnet 192.168.1.0 netmask 255.255.255.0 {
+	option classless-static-routes 24.10.0.1 192.168.1.1, 0 192.168.1.254;
+}
+subnet 192.168.2.0 netmask 255.255.255.0 {
+	option rfc3442-classless-static-routes 16, 172, 16, 192, 168, 2, 1, 0, 192, 168, 2, 254;
+}
+subnet 192.168.3.0 netmask 255.255.255.0 {
+	option classless-static-routes 19:0a:00:80:00:c0:a8:03:01;
+}
+`)
+
+	for subnet, expected := range map[string][]string{
+		"192.168.1.0": {"10.0.1.0/24 via 192.168.1.1", "0.0.0.0/0 via 192.168.1.254"},
+		"192.168.2.0": {"172.16.0.0/16 via 192.168.2.1", "0.0.0.0/0 via 192.168.2.254"},
+		"192.168.3.0": {"10.0.128.0/25 via 192.168.3.1"},
+	} {
+		declaration, err := config.SubnetByAddress(net.ParseIP(subnet))
+		if err != nil {
+			t.Fatalf("Unable to find subnet %s: %s", subnet, err)
+		}
+
+		routes, err := declaration.ClasslessStaticRoutes()
+		if err != nil {
+			t.Fatalf("Unable to parse the routes of subnet %s: %s", subnet, err)
+		}
+
+		var result []string
+		for _, route := range routes {
+			result = append(result, fmt.Sprintf("%s via %s", route.Dest.String(), route.Gateway))
+		}
+		if !compareSlice(result, expected) {
+			t.Errorf("expected routes %v for subnet %s, got %v", expected, subnet, result)
+		}
+	}
+
+	global, err := config.Global()
+	if err != nil {
+		t.Fatalf("Unable to retrieve global configuration: %s", err)
+	}
+	if _, err := global.ClasslessStaticRoutes(); err == nil {
+		t.Errorf("expected an error for a declaration without classless-static-routes")
+	}
+
+	for value, expected := range map[string]string{
+		"24.10.0.1":                         "expected a destination and a gateway",
+		"24.10.0 192.168.1.1":               "expected 3 significant octets",
+		"24.10.0.1 bogus":                   `unparseable gateway "bogus"`,
+		"24.10.0.1.5 192.168.1.1":           "expected 3 significant octets",
+		"8.10.0.1 192.168.1.1":              "expected 1 significant octets",
+		"33, 10, 0, 0, 0, 0, 1, 2, 3":       "invalid destination width 33",
+		"24, 10, 0, 1, 192, 168":            "truncated route at octet 0",
+		"16, 10, 1, 192, 168, 1, 1, 24, 10": "truncated route at octet 7",
+		"1f:0a:00:00:01:c0:a8:01:01":        "bits set outside of its /31 prefix",
+		"18:0a:zz:01:c0:a8:01:01":           `unparseable octet "zz"`,
+	} {
+		if _, err := parseClasslessStaticRoutes(value); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error parsing %q to contain %s, got %v", value, expected, err)
+		}
+	}
+}
+
+func TestParserDhcpConfigClasslessStaticRoutesDotted(t *testing.T) {
+	for _, name := range []string{"classless-static-routes", "rfc3442-classless-static-routes"} {
+		config := readDhcpConfigurationFromString(t, fmt.Sprintf(`
+subnet 192.168.1.0 netmask 255.255.255.0 {
+	option %s 24.192.168.1 10.0.0.1, 0 192.168.1.254;
+}
+`, name))
+
+		declaration, err := config.SubnetByAddress(net.ParseIP("192.168.1.0"))
+		if err != nil {
+			t.Fatalf("Unable to find subnet for %s: %s", name, err)
+		}
+
+		routes, err := declaration.ClasslessStaticRoutes()
+		if err != nil {
+			t.Fatalf("Unable to parse the routes of %s: %s", name, err)
+		}
+
+		var result []string
+		for _, route := range routes {
+			result = append(result, fmt.Sprintf("%s via %s", route.Dest.String(), route.Gateway))
+		}
+		expected := []string{"192.168.1.0/24 via 10.0.0.1", "0.0.0.0/0 via 192.168.1.254"}
+		if !compareSlice(result, expected) {
+			t.Errorf("expected routes %v for %s, got %v", expected, name, result)
+		}
+	}
+}
+
+func TestParserDhcpConfigMalformed(t *testing.T) {
+	for _, input := range []string{
+		"range bootp;",
+		"range6 fe80::/129;",
+		"range6 bogus/64;",
+		"if { }",
+		"else exists user-class { }",
+		"option build-tag code two-twenty-four = text;",
+		"option build-tag code 224 text;",
+		"option build-tag code 224 =;",
+		"option routers 1.2.3.4 5.6.7.8;",
+		"option domain-name-servers 1.1.1.1, 8.8.8.8 8.8.4.4;",
+		"class \"limited\" { lease limit many; }",
+		"class \"limited\" { lease limit; }",
+		"class \"limited\" { spawn option agent.circuit-id; }",
+	} {
+		path := filepath.Join(t.TempDir(), "dhcpd.conf")
+		if err := os.WriteFile(path, []byte(input), 0644); err != nil {
+			t.Fatalf("Unable to write dhcpd.conf sample: %s", err)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Unable to open dhcpd.conf sample: %s", err)
+		}
+		_, err = ReadDhcpConfiguration(f)
+		f.Close()
+		if err == nil {
+			t.Errorf("expected an error parsing %q", input)
+		}
+	}
+
+	config := readDhcpConfigurationFromString(t, "host vmnet8 { fixed-address 10.0.0.1; }\n")
+	host := config[1]
+	if _, err := host.Hardware(); err == nil {
+		t.Errorf("expected an error for a host without a hardware address")
+	}
+}
+
+func TestParserDhcpConfigSubnetErrors(t *testing.T) {
+	for input, expected := range map[string]string{
+		"subnet 10.0.0.0/24 { }":                      `missing netmask keyword in subnet declaration, got "10.0.0.0/24"`,
+		"subnet 10.0.0.0 mask 255.255.255.0 { }":      `missing netmask keyword in subnet declaration, got "mask"`,
+		"subnet 10.0.0.0 netmask 255.255.2555.0 { }":  `unparseable netmask octet "2555" in "255.255.2555.0"`,
+		"subnet 10.0.0.0 netmask 255.255.255 { }":     `unparseable netmask "255.255.255", expected 4 octets`,
+		"subnet 10.0.0.300 netmask 255.255.255.0 { }": `invalid subnet address "10.0.0.300"`,
+		"subnet fe80:: netmask 255.255.255.0 { }":     `invalid subnet address "fe80::"`,
+	} {
+		path := filepath.Join(t.TempDir(), "dhcpd.conf")
+		if err := os.WriteFile(path, []byte(input), 0644); err != nil {
+			t.Fatalf("Unable to write dhcpd.conf sample: %s", err)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Unable to open dhcpd.conf sample: %s", err)
+		}
+		_, err = ReadDhcpConfiguration(f)
+		f.Close()
+		if err == nil {
+			t.Errorf("expected an error parsing %q", input)
+		} else if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error parsing %q to contain %s, got %s", input, expected, err)
+		}
+	}
+}
+
+func TestParserDhcpConfigGlobal(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, "subnet 10.0.0.0 netmask 255.255.255.0 { }\n")
+	global, err := config.Global()
+	if err != nil {
+		t.Fatalf("Unable to retrieve global scope: %s", err)
+	}
+	if global.id[0].repr() != "{global}" {
+		t.Errorf("expected the global scope, got %s", global.id[0].repr())
+	}
+
+	var empty DhcpConfiguration
+	if _, err := empty.Global(); err == nil {
+		t.Errorf("expected an error for an empty configuration")
+	}
+
+	// A configuration beginning with anything other than the global scope
+	// is malformed.
+	malformed := DhcpConfiguration{config[1]}
+	if _, err := malformed.Global(); err == nil {
+		t.Errorf("expected an error for a malformed global declaration")
+	}
+}
+
+func TestParserDhcpConfigClass(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+class "limited" {
+	match if exists agent.circuit-id;
+	lease limit 4;
+	spawn with option agent.circuit-id;
+	option domain-name "limited.test";
+}
+class "unlimited" {
+	match if substring (option vendor-class-identifier, 0, 9) = "PXEClient";
+}
+`)
+
+	limited := config[1]
+	if limited.id[0].repr() != "{class name:limited lease-limit:4 spawn:option agent.circuit-id}" {
+		t.Fatalf("expected class declaration, got %s", limited.id[0].repr())
+	}
+	if limit, err := limited.LeaseLimit(); err != nil || limit != 4 {
+		t.Errorf("expected lease limit %d, got %d (%v)", 4, limit, err)
+	}
+	if spawn, err := limited.SpawnWith(); err != nil || spawn != "option agent.circuit-id" {
+		t.Errorf("expected spawn with %q, got %q (%v)", "option agent.circuit-id", spawn, err)
+	}
+
+	// The other statements of the class are kept as usual.
+	if value, ok := limited.Option("domain-name"); !ok || value != `"limited.test"` {
+		t.Errorf("expected domain-name option %q, got %q", `"limited.test"`, value)
+	}
+	if _, ok := limited.parameters["lease"]; ok {
+		t.Errorf("expected the lease limit not to be kept as a parameter")
+	}
+
+	unlimited := config[2]
+	if _, err := unlimited.LeaseLimit(); err == nil {
+		t.Errorf("expected an error for a class without a lease limit")
+	}
+	if _, err := unlimited.SpawnWith(); err == nil {
+		t.Errorf("expected an error for a class without a spawn with")
+	}
+
+	global := config[0]
+	if _, err := global.LeaseLimit(); err == nil {
+		t.Errorf("expected an error for a declaration that isn't a class")
+	}
+}
+
+func TestParserDhcpConfigClassEqual(t *testing.T) {
+	read := func(limit int, spawn string) DhcpConfiguration {
+		return readDhcpConfigurationFromString(t, fmt.Sprintf(`
+class "limited" {
+	lease limit %d;
+	spawn with %s;
+}
+`, limit, spawn))
+	}
+
+	config := read(4, "option agent.circuit-id")
+	if !config.Equal(read(4, "option agent.circuit-id")) {
+		t.Errorf("expected identical classes to be equal")
+	}
+
+	for _, other := range []DhcpConfiguration{
+		read(9, "option agent.circuit-id"),
+		read(4, "option agent.remote-id"),
+	} {
+		if config.Equal(other) {
+			t.Errorf("expected classes with a different lease limit or spawn to differ:\n%s\n%s", config, other)
+		}
+		if diffs := DiffDhcpConfigurations(config, other); len(diffs) == 0 {
+			t.Errorf("expected differences between the classes:\n%s\n%s", config, other)
+		}
+	}
+}
+
+func TestParserDhcpConfigFailover(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+failover peer "vmnet8-failover" {
+	primary;
+	address 10.0.0.1;
+	port 647;
+	peer address 10.0.0.2;
+	peer port 847;
+	max-response-delay 60;
+	mclt 3600;
+	split 128;
+}
+subnet 10.0.0.0 netmask 255.255.255.0 {
+	pool {
+		failover peer "vmnet8-failover";
+		range 10.0.0.128 10.0.0.254;
+	}
+}
+`)
+
+	failover := config[1]
+	if failover.id[0].repr() != "{failover peer name:vmnet8-failover}" {
+		t.Fatalf("expected failover peer declaration, got %s", failover.id[0].repr())
+	}
+
+	if role, err := failover.FailoverRole(); err != nil || role != "primary" {
+		t.Errorf("expected role %q, got %q (%v)", "primary", role, err)
+	}
+	if ip, err := failover.Address(); err != nil || !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("expected address %s, got %s (%v)", "10.0.0.1", ip, err)
+	}
+	if ip, err := failover.PeerAddress(); err != nil || !ip.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("expected peer address %s, got %s (%v)", "10.0.0.2", ip, err)
+	}
+	if port, err := failover.Port(); err != nil || port != 647 {
+		t.Errorf("expected port %d, got %d (%v)", 647, port, err)
+	}
+	if port, err := failover.PeerPort(); err != nil || port != 847 {
+		t.Errorf("expected peer port %d, got %d (%v)", 847, port, err)
+	}
+	if mclt, err := failover.MCLT(); err != nil || mclt != time.Hour {
+		t.Errorf("expected mclt %s, got %s (%v)", time.Hour, mclt, err)
+	}
+
+	// Statements without an accessor are preserved.
+	expected := []string{"max-response-delay 60", "split 128"}
+	if statements := failover.Statements(); !compareSlice(statements, expected) {
+		t.Errorf("expected statements %v, got %v", expected, statements)
+	}
+
+	subnet, err := config.SubnetByAddress(net.ParseIP("10.0.0.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
+	}
+	if _, err := subnet.Address(); err == nil {
+		t.Errorf("expected an error for a declaration that isn't a failover peer")
+	}
+}
+
+func TestParserDhcpConfigKey(t *testing.T) {
+	secret := "c2VjcmV0LWZvci10ZXN0aW5n"
+	config := readDhcpConfigurationFromString(t, `
+ddns-update-style interim;
+key "DHCP_UPDATER" {
+	algorithm hmac-md5;
+	secret "`+secret+`";
+}
+`)
+
+	if len(config) != 2 {
+		t.Fatalf("expected %d entries, got %d", 2, len(config))
+	}
+
+	key, err := config[1].Key()
+	if err != nil {
+		t.Fatalf("Unable to read key declaration: %s", err)
+	}
+	if key.Name != "DHCP_UPDATER" {
+		t.Errorf("expected key name %s, got %s", "DHCP_UPDATER", key.Name)
+	}
+	if key.Algorithm != "hmac-md5" {
+		t.Errorf("expected key algorithm %s, got %s", "hmac-md5", key.Algorithm)
+	}
+	if key.Secret != secret {
+		t.Errorf("expected key secret %s, got %s", secret, key.Secret)
+	}
+
+	representations := []string{
+		config[1].repr(),
+		key.String(),
+		fmt.Sprintf("%v", key),
+		fmt.Sprintf("%#v", key),
+		fmt.Sprintf("%v", config[1]),
+		fmt.Sprintf("%+v", config),
+	}
+	for _, repr := range representations {
+		if strings.Contains(repr, secret) {
+			t.Errorf("secret was not redacted: %s", repr)
+		}
+	}
+
+	if _, err := config[0].Key(); err == nil {
+		t.Errorf("expected an error reading a key from the global declaration")
+	}
+}
+
+func TestParserDhcpConfigString(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "dhcpd-example.conf"))
+	if err != nil {
+		t.Fatalf("Unable to open dhcpd.conf sample: %s", err)
+	}
+	defer f.Close()
+
+	config, err := ReadDhcpConfiguration(f)
+	if err != nil {
+		t.Fatalf("Error reading config: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(config.String(), "\n"), "\n")
+	expected := []string{
+		"{global} grant:allow,unknown-clients",
+		"  {subnet4 172.33.33.0/24} range4:172.33.33.128-172.33.33.254",
+		"  {host name:vmnet8} hardware-address:ethernet[00:50:56:c0:00:08]",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %d:\n%s", len(expected), len(lines), config)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("expected line %d to begin with %q, got %q", i, prefix, lines[i])
+		}
+	}
+	if !strings.Contains(lines[1], "option:routers=172.33.33.2") {
+		t.Errorf("expected subnet to include its routers option, got %q", lines[1])
+	}
+
+	// The parameters are the ones declared directly, not inherited.
+	if strings.Contains(lines[2], "grant:allow,unknown-clients") {
+		t.Errorf("expected host not to include inherited parameters, got %q", lines[2])
+	}
+}
+
+func TestParserValidateDhcpConfig(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "dhcpd-invalid.conf"))
+	if err != nil {
+		t.Fatalf("Unable to open dhcpd.conf sample: %s", err)
+	}
+	defer f.Close()
+
+	expected := []string{
+		"invalid number of parameters for pParameterOption",
+		"subnet 172.33.33.5 is not aligned to its netmask 255.255.255.0",
+		"range4:172.33.34.128-172.33.34.254 is outside of subnet 172.33.33.5/24",
+		"unparseable address for option subnet-mask : 255.255.255.zero",
+		"prefix6 length /200 is out of range",
+		"subnet 172.33.33.5/24 overlaps with subnet 172.33.33.0/25",
+		"hardware address 00:50:56:c0:00:01 is reserved by both host vmnet1 and host vmnet8",
+		"fixed-address 172.33.33.1 is reserved by both host vmnet1 and host vmnet8",
+	}
+
+	errs := ValidateDhcpConfiguration(f)
+	if len(errs) != len(expected) {
+		t.Errorf("expected %d errors, got %d: %v", len(expected), len(errs), errs)
+	}
+
+	for _, message := range expected {
+		found := false
+		for _, err := range errs {
+			if strings.Contains(err.Error(), message) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected error containing %q, got %v", message, errs)
+		}
+	}
+
+	f, err = os.Open(filepath.Join("testdata", "dhcpd-example.conf"))
+	if err != nil {
+		t.Fatalf("Unable to open dhcpd.conf sample: %s", err)
+	}
+	defer f.Close()
+
+	if errs := ValidateDhcpConfiguration(f); len(errs) != 0 {
+		t.Errorf("expected no errors for a valid configuration, got %v", errs)
+	}
+}
+
+func TestParserTokenizeNetworkMap(t *testing.T) {
+
+	test1 := "group.attribute = \"string\""
+	expected := []string{
+		"group.attribute", "=", "\"string\"",
+	}
+	result := tokenizeDhcpConfigFromString(test1)
+	if len(result) != len(expected) {
+		t.Fatalf("length of token lists do not match (%d != %d)", len(result), len(expected))
+	}
+
+	for index := range expected {
+		if expected[index] != result[index] {
+			t.Errorf("unexpected token at index %d: %v != %v", index, expected[index], result[index])
+		}
+	}
+
+	test2 := "attribute == \""
+	expected = []string{
+		"attribute", "==", "\"",
+	}
+	result = tokenizeDhcpConfigFromString(test2)
+	if len(result) != len(expected) {
+		t.Fatalf("length of token lists do not match (%d != %d)", len(result), len(expected))
+	}
+
+	test3 := "attribute ....... ======\nnew lines should make no difference"
+	expected = []string{
+		"attribute", ".......", "======", "new", "lines", "should", "make", "no", "difference",
+	}
+	result = tokenizeDhcpConfigFromString(test3)
+	if len(result) != len(expected) {
+		t.Fatalf("length of token lists do not match (%d != %d)", len(result), len(expected))
+	}
+
+	test4 := "\t\t\t\t    thishadwhitespacebeforebeingparsed\t \t \t \t\n\n"
+	expected = []string{
+		"thishadwhitespacebeforebeingparsed",
+	}
+	result = tokenizeDhcpConfigFromString(test4)
+	if len(result) != len(expected) {
+		t.Fatalf("length of token lists do not match (%d != %d)", len(result), len(expected))
+	}
+}
+
+func TestParserReadNetworkMap(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "netmap-example.conf"))
+	if err != nil {
+		t.Fatalf("Unable to open netmap.conf sample: %s", err)
+	}
+	defer f.Close()
+
+	netmap, err := ReadNetworkMap(f)
+	if err != nil {
+		t.Fatalf("Unable to read netmap.conf sample: %s", err)
+	}
+
+	expectedKeys := []string{"device", "name"}
+	for _, item := range netmap {
+		for _, name := range expectedKeys {
+			_, ok := item[name]
+			if !ok {
+				t.Errorf("unable to find expected key %v in map: %v", name, item)
+			}
+		}
+	}
+
+	expectedVmnet0 := [][]string{
+		{"device", "vmnet0"},
+		{"name", "Bridged"},
+	}
+	for _, item := range netmap {
+		if item["device"] != "vmnet0" {
+			continue
+		}
+		for _, expectPair := range expectedVmnet0 {
+			name := expectPair[0]
+			value := expectPair[1]
+			if item[name] != value {
+				t.Errorf("expected value %v for attribute %v, got %v", value, name, item[name])
+			}
+		}
+	}
+
+	expectedVmnet1 := [][]string{
+		{"device", "vmnet1"},
+		{"name", "HostOnly"},
+	}
+	for _, item := range netmap {
+		if item["device"] != "vmnet1" {
+			continue
+		}
+		for _, expectPair := range expectedVmnet1 {
+			name := expectPair[0]
+			value := expectPair[1]
+			if item[name] != value {
+				t.Errorf("expected value %v for attribute %v, got %v", value, name, item[name])
+			}
+		}
+	}
+
+	expectedVmnet8 := [][]string{
+		{"device", "vmnet8"},
+		{"name", "NAT"},
+	}
+	for _, item := range netmap {
+		if item["device"] != "vmnet8" {
+			continue
+		}
+		for _, expectPair := range expectedVmnet8 {
+			name := expectPair[0]
+			value := expectPair[1]
+			if item[name] != value {
+				t.Errorf("expected value %v for attribute %v, got %v", value, name, item[name])
+			}
+		}
+	}
+}
+
+func TestParserNetworkMapAttributes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netmap.conf")
+	if err := os.WriteFile(path, []byte(`network0.name = "Bridged"
+network0.device = "vmnet0"
+network0.dhcp = "false"
+network1.name = "HostOnly"
+network1.device = "vmnet1"
+network1.dhcp = "1"
+network1.virtualAdapter = "TRUE"
+network1.mtu = "1500"
+network8.name = "NAT"
+network8.device = "vmnet8"
+network8.dhcp = "maybe"
+network8.mtu = "large"
+`), 0644); err != nil {
+		t.Fatalf("Unable to write netmap.conf sample: %s", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unable to open netmap.conf sample: %s", err)
+	}
+	defer f.Close()
+
+	netmap, err := ReadNetworkMap(f)
+	if err != nil {
+		t.Fatalf("Unable to read netmap.conf sample: %s", err)
+	}
+
+	for _, tc := range []struct {
+		device, attr string
+		expected     bool
+	}{
+		{"vmnet0", "dhcp", false},
+		{"vmnet1", "dhcp", true},
+		{"vmnet1", "virtualAdapter", true},
+	} {
+		if value, err := netmap.BoolAttr(tc.device, tc.attr); err != nil || value != tc.expected {
+			t.Errorf("expected %s of %s to be %v, got %v (%v)", tc.attr, tc.device, tc.expected, value, err)
+		}
+	}
+
+	if value, err := netmap.IntAttr("vmnet1", "mtu"); err != nil || value != 1500 {
+		t.Errorf("expected mtu of vmnet1 to be %d, got %d (%v)", 1500, value, err)
+	}
+
+	for _, tc := range []struct {
+		device, attr, expected string
+		integer                bool
+	}{
+		{"vmnet8", "dhcp", "unparseable boolean for attribute dhcp of device vmnet8", false},
+		{"vmnet8", "mtu", "unparseable integer for attribute mtu of device vmnet8", true},
+		{"vmnet0", "mtu", "error finding attribute mtu", true},
+		{"vmnet2", "dhcp", "error finding device", false},
+	} {
+		var err error
+		if tc.integer {
+			_, err = netmap.IntAttr(tc.device, tc.attr)
+		} else {
+			_, err = netmap.BoolAttr(tc.device, tc.attr)
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("expected error for %s of %s to contain %q, got %v", tc.attr, tc.device, tc.expected, err)
+		}
+	}
+}
+
+func TestParserNetworkMapAvailableNetworks(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "netmap-example.conf"))
+	if err != nil {
+		t.Fatalf("Unable to open netmap.conf sample: %s", err)
+	}
+	defer f.Close()
+
+	netmap, err := ReadNetworkMap(f)
+	if err != nil {
+		t.Fatalf("Unable to read netmap.conf sample: %s", err)
+	}
+
+	expected := []string{"Bridged", "HostOnly", "bleep bloop", "butneeds", "NAT"}
+	if result := netmap.AvailableNetworks(); !compareSlice(result, expected) {
+		t.Errorf("expected available networks %v, got %v", expected, result)
+	}
+
+	_, err = netmap.NameIntoDevices("natz")
+	if err == nil {
+		t.Fatal("expected an error for an unknown network name")
+	}
+	if message := "error finding network name : natz (available: Bridged, HostOnly, bleep bloop, butneeds, NAT)"; err.Error() != message {
+		t.Errorf("expected error %q, got %q", message, err)
+	}
+}
+
+func TestParserNetworkingConfigAvailableNetworks(t *testing.T) {
+	config := readNetworkingConfigFromString(t, `VERSION=1,0
+answer VNET_1_HOSTONLY_NETMASK 255.255.255.0
+answer VNET_1_HOSTONLY_SUBNET 192.168.70.0
+answer VNET_1_VIRTUAL_ADAPTER yes
+answer VNET_2_HOSTONLY_NETMASK 255.255.255.0
+answer VNET_2_HOSTONLY_SUBNET 192.168.71.0
+answer VNET_2_VIRTUAL_ADAPTER yes
+answer VNET_8_HOSTONLY_NETMASK 255.255.255.0
+answer VNET_8_HOSTONLY_SUBNET 172.16.41.0
+answer VNET_8_NAT yes
+answer VNET_8_VIRTUAL_ADAPTER yes
+`)
+
+	expected := []string{"hostonly", "nat", "bridged", "vmnet0", "vmnet1", "vmnet2", "vmnet8"}
+	if result := config.AvailableNetworks(); !compareSlice(result, expected) {
+		t.Errorf("expected available networks %v, got %v", expected, result)
+	}
+
+	_, err := config.NameIntoDevices("natz")
+	if err == nil {
+		t.Fatal("expected an error for an unknown network name")
+	}
+	if message := "error finding network name : natz (available: hostonly, nat, bridged, vmnet0, vmnet1, vmnet2, vmnet8)"; err.Error() != message {
+		t.Errorf("expected error %q, got %q", message, err)
+	}
+}
+
+func collectIntoString(in chan byte) string {
+	result := ""
+	for item := range in {
+		result += string(item)
+	}
+	return result
+}
+
+func TestParserConsumeUntilSentinel(t *testing.T) {
+
+	test1 := "consume until a semicolon; yeh?"
+	expected1 := "consume until a semicolon"
+
+	ch := consumeString(test1)
+	resultch, _ := consumeUntilSentinel(';', ch)
+	result := string(resultch)
+	if expected1 != result {
+		t.Errorf("expected %#v, got %#v", expected1, result)
+	}
+
+	test2 := "; this is only a semi"
+	expected2 := ""
+
+	ch = consumeString(test2)
+	resultch, _ = consumeUntilSentinel(';', ch)
+	result = string(resultch)
+	if expected2 != result {
+		t.Errorf("expected %#v, got %#v", expected2, result)
+	}
+}
+
+func TestParserFilterCharacters(t *testing.T) {
+
+	test1 := []string{" ", "ignore all spaces"}
+	expected1 := "ignoreallspaces"
+
+	ch := consumeString(test1[1])
+	outch := filterOutCharacters(bytes.NewBufferString(test1[0]).Bytes(), ch)
+	result := collectIntoString(outch)
+	if result != expected1 {
+		t.Errorf("expected %#v, got %#v", expected1, result)
+	}
+
+	test2 := []string{"\n\v\t\r ", "ignore\nall\rwhite\v\v space                "}
+	expected2 := "ignoreallwhitespace"
+
+	ch = consumeString(test2[1])
+	outch = filterOutCharacters(bytes.NewBufferString(test2[0]).Bytes(), ch)
+	result = collectIntoString(outch)
+	if result != expected2 {
+		t.Errorf("expected %#v, got %#v", expected2, result)
+	}
+}
+
+func TestParserConsumeOpenClosePair(t *testing.T) {
+	test1 := "(everything)"
+	expected1 := []string{"", test1}
+
+	testch := consumeString(test1)
+	prefix, ch := consumeOpenClosePair('(', ')', testch)
+	if string(prefix) != expected1[0] {
+		t.Errorf("expected prefix %#v, got %#v", expected1[0], prefix)
+	}
+	result := collectIntoString(ch)
+	if result != expected1[1] {
+		t.Errorf("expected %#v, got %#v", expected1[1], test1)
+	}
+
+	test2 := "prefixed (everything)"
+	expected2 := []string{"prefixed ", "(everything)"}
+
+	testch = consumeString(test2)
+	prefix, ch = consumeOpenClosePair('(', ')', testch)
+	if string(prefix) != expected2[0] {
+		t.Errorf("expected prefix %#v, got %#v", expected2[0], prefix)
+	}
+	result = collectIntoString(ch)
+	if result != expected2[1] {
+		t.Errorf("expected %#v, got %#v", expected2[1], test2)
+	}
+
+	test3 := "this(is()suffixed"
+	expected3 := []string{"this", "(is()"}
+
+	testch = consumeString(test3)
+	prefix, ch = consumeOpenClosePair('(', ')', testch)
+	if string(prefix) != expected3[0] {
+		t.Errorf("expected prefix %#v, got %#v", expected3[0], prefix)
+	}
+	result = collectIntoString(ch)
+	if result != expected3[1] {
+		t.Errorf("expected %#v, got %#v", expected3[1], test2)
+	}
+}
+
+func TestParserCombinators(t *testing.T) {
+
+	test1 := "across # ignore\nmultiple lines;"
+	expected1 := "across multiple lines"
+
+	ch := consumeString(test1)
+	inch := uncomment(ch)
+	whch := filterOutCharacters([]byte{'\n'}, inch)
+	resultch, _ := consumeUntilSentinel(';', whch)
+	result := string(resultch)
+	if expected1 != result {
+		t.Errorf("expected %#v, got %#v", expected1, result)
+	}
+
+	test2 := "lease blah {\n    blah\r\n# skipping this line\nblahblah  # ignore semicolon;\n last item;\n\n };;;;;;"
+	expected2 := []string{"lease blah ", "{    blahblahblah   last item; }"}
+
+	ch = consumeString(test2)
+	inch = uncomment(ch)
+	whch = filterOutCharacters([]byte{'\n', '\v', '\r'}, inch)
+	prefix, pairch := consumeOpenClosePair('{', '}', whch)
+
+	result = collectIntoString(pairch)
+	if string(prefix) != expected2[0] {
+		t.Errorf("expected prefix %#v, got %#v", expected2[0], prefix)
+	}
+	if result != expected2[1] {
+		t.Errorf("expected %#v, got %#v", expected2[1], result)
+	}
+
+	test3 := "lease blah { # comment\n item 1;\n item 2;\n } not imortant"
+	expected3Prefix := "lease blah "
+	expected3 := []string{"{  item 1", " item 2", " }"}
+
+	sch := consumeString(test3)
+	inch = uncomment(sch)
+	wch := filterOutCharacters([]byte{'\n', '\v', '\r'}, inch)
+	lease, itemch := consumeOpenClosePair('{', '}', wch)
+	if string(lease) != expected3Prefix {
+		t.Errorf("expected %#v, got %#v", expected3Prefix, string(lease))
+	}
+
+	var result3 []string
+	for reading := true; reading; {
+		item, ok := consumeUntilSentinel(';', itemch)
+		result3 = append(result3, string(item))
+		if !ok {
+			reading = false
+		}
+	}
+
+	for index := range expected3 {
+		if expected3[index] != result3[index] {
+			t.Errorf("expected index %d as %#v, got %#v", index, expected3[index], result3[index])
+		}
+	}
+}
+
+func TestParserDhcpdLeaseBytesDecoder(t *testing.T) {
+	test1 := "00:0d:0e:0a:0d:00"
+	expected1 := []byte{0, 13, 14, 10, 13, 0}
+
+	result, err := decodeDhcpdLeaseBytes(test1)
+	if err != nil {
+		t.Errorf("unable to decode address: %s", err)
+	}
+	if !bytes.Equal(result, expected1) {
+		t.Errorf("expected %v, got %v", expected1, result)
+	}
+
+	test2 := "11"
+	expected2 := []byte{17}
+
+	result, err = decodeDhcpdLeaseBytes(test2)
+	if err != nil {
+		t.Errorf("unable to decode address: %s", err)
+	}
+	if !bytes.Equal(result, expected2) {
+		t.Errorf("expected %v, got %v", expected2, result)
+	}
+
+	failtest1 := ""
+	_, err = decodeDhcpdLeaseBytes(failtest1)
+	if err == nil {
+		t.Errorf("expected decoding error: %s", err)
+	}
+
+	failtest2 := "000000"
+	_, err = decodeDhcpdLeaseBytes(failtest2)
+	if err == nil {
+		t.Errorf("expected decoding error: %s", err)
+	}
+
+	failtest3 := "000:00"
+	_, err = decodeDhcpdLeaseBytes(failtest3)
+	if err == nil {
+		t.Errorf("expected decoding error: %s", err)
+	}
+
+	failtest4 := "00:00:"
+	_, err = decodeDhcpdLeaseBytes(failtest4)
+	if err == nil {
+		t.Errorf("expected decoding error: %s", err)
+	}
+}
+
+func consumeLeaseString(s string) chan byte {
+	sch := consumeString(s)
+	uncommentedch := uncomment(sch)
+	return filterOutCharacters([]byte{'\n', '\r', '\v'}, uncommentedch)
+}
+
+func TestParserReadDhcpdLeaseEntry(t *testing.T) {
+	test1 := "lease 127.0.0.1 {\nhardware ethernet 00:11:22:33  ;\nuid 00:11  ;\n }"
+	expected1 := map[string]string{
+		"address": "127.0.0.1",
+		"ether":   "00112233",
+		"uid":     "0011",
+	}
+
+	result, err := readDhcpdLeaseEntry(consumeLeaseString(test1))
+	if err != nil {
+		t.Errorf("error parsing entry: %s", err)
+	}
+	if result.address != expected1["address"] {
+		t.Errorf("expected address %v, got %v", expected1["address"], result.address)
+	}
+	if hex.EncodeToString(result.ether) != expected1["ether"] {
+		t.Errorf("expected ether %v, got %v", expected1["ether"], hex.EncodeToString(result.ether))
+	}
+	if hex.EncodeToString(result.uid) != expected1["uid"] {
+		t.Errorf("expected uid %v, got %v", expected1["uid"], hex.EncodeToString(result.uid))
+	}
+
+	test2 := "  \n\t lease 192.168.21.254{ hardware\n   ethernet 44:55:66:77:88:99;uid 00:1\n1:22:3\r3:44;\n starts 57005 2006/01/02 15:04:05;ends 57005 2006/01/03 15:04:05;\tunknown item1; unknown item2;  }     "
+	expected2 := map[string]string{
+		"address": "192.168.21.254",
+		"ether":   "445566778899",
+		"uid":     "0011223344",
+		"starts":  "2006-01-02 15:04:05 +0000 UTC",
+		"ends":    "2006-01-03 15:04:05 +0000 UTC",
+	}
+	result, err = readDhcpdLeaseEntry(consumeLeaseString(test2))
+	if err != nil {
+		t.Errorf("error parsing entry: %s", err)
+	}
+	if result.address != expected2["address"] {
+		t.Errorf("expected address %v, got %v", expected2["address"], result.address)
+	}
+	if hex.EncodeToString(result.ether) != expected2["ether"] {
+		t.Errorf("expected ether %v, got %v", expected2["ether"], hex.EncodeToString(result.ether))
+	}
+	if hex.EncodeToString(result.uid) != expected2["uid"] {
+		t.Errorf("expected uid %v, got %v", expected2["uid"], hex.EncodeToString(result.uid))
+	}
+	if result.starts.String() != expected2["starts"] {
+		t.Errorf("expected starts %v, got %v", expected2["starts"], result.starts)
+	}
+	if result.ends.String() != expected2["ends"] {
+		t.Errorf("expected ends %v, got %v", expected2["ends"], result.ends)
+	}
+	if result.startsWeekday != 57005 {
+		t.Errorf("expected starts weekday %v, got %v", 57005, result.startsWeekday)
+	}
+	if result.endsWeekday != 57005 {
+		t.Errorf("expected ends weekday %v, got %v", 57005, result.endsWeekday)
+	}
+}
+
+func TestParserDhcpdLeaseEntryUIDString(t *testing.T) {
+	for uid, expected := range map[string]string{
+		// A type byte of zero followed by the text "host-1".
+		"00:68:6f:73:74:2d:31": "host-1",
+		// Printable text without a type byte.
+		"68:6f:73:74:2d:31": "host-1",
+		// A type byte of one followed by an ethernet address.
+		"01:00:50:56:c0:00:08": "01:00:50:56:c0:00:08",
+		// A lone type byte.
+		"00": "00",
+	} {
+		entry, err := readDhcpdLeaseEntry(consumeLeaseString("lease 127.0.0.1 {\nuid " + uid + ";\n}"))
+		if err != nil {
+			t.Fatalf("error parsing entry: %s", err)
+		}
+		if result := entry.UIDString(); result != expected {
+			t.Errorf("expected uid %s to be rendered as %q, got %q", uid, expected, result)
+		}
+	}
+}
+
+func TestParserDhcpdLeaseEntriesActiveLeaseForIP(t *testing.T) {
+	entries, err := readDhcpdLeaseEntries(strings.NewReader(`
+lease 192.168.1.10 {
+  starts 1 2024/01/01 00:00:00;
+  ends 1 2024/01/01 01:00:00;
+  hardware ethernet 00:50:56:00:00:01;
+}
+lease 192.168.1.10 {
+  starts 1 2024/01/01 02:00:00;
+  ends 1 2024/01/01 03:00:00;
+  hardware ethernet 00:50:56:00:00:02;
+}
+lease 192.168.1.11 {
+  starts 1 2024/01/01 00:00:00;
+  ends 1 2024/01/01 01:00:00;
+  hardware ethernet 00:50:56:00:00:03;
+}
+`))
+	if err != nil {
+		t.Fatalf("Error reading leases: %s", err)
+	}
+	leases := DhcpLeaseEntries(entries)
+	now := time.Date(2024, 1, 1, 2, 30, 0, 0, time.UTC)
+
+	// The second lease of 192.168.1.10 is active.
+	lease, err := leases.ActiveLeaseForIP(net.ParseIP("192.168.1.10"), now)
+	if err != nil {
+		t.Fatalf("Unable to check address: %s", err)
+	}
+	if lease == nil || lease.HardwareAddress().String() != "00:50:56:00:00:02" {
+		t.Errorf("expected the active lease of 00:50:56:00:00:02, got %v", lease)
+	}
+
+	// The lease of 192.168.1.11 has expired.
+	if lease, err := leases.ActiveLeaseForIP(net.ParseIP("192.168.1.11"), now); err != nil || lease != nil {
+		t.Errorf("expected no active lease for an expired address, got %v (%v)", lease, err)
+	}
+
+	// There is no lease for 192.168.1.12.
+	if lease, err := leases.ActiveLeaseForIP(net.ParseIP("192.168.1.12"), now); err != nil || lease != nil {
+		t.Errorf("expected no active lease for a free address, got %v (%v)", lease, err)
+	}
+
+	if _, err := leases.ActiveLeaseForIP(nil, now); err == nil {
+		t.Errorf("expected an error without an address")
+	}
+}
+
+func TestParserDhcpConfigFreeAddresses(t *testing.T) {
+	config := readDhcpConfigurationFromString(t, `
+subnet 192.168.1.0 netmask 255.255.255.0 {
+	range 192.168.1.10 192.168.1.14;
+	range 192.168.1.100 192.168.1.101;
+}
+subnet 192.168.2.0 netmask 255.255.255.0 {
+}
+`)
+	subnet, err := config.SubnetByAddress(net.ParseIP("192.168.1.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
+	}
+
+	leases, err := readDhcpdLeaseEntries(strings.NewReader(`
+lease 192.168.1.10 {
+  starts 1 2024/01/01 00:00:00;
+  ends 1 2024/01/01 03:00:00;
+  hardware ethernet 00:50:56:00:00:01;
+}
+lease 192.168.1.11 {
+  starts 1 2024/01/01 00:00:00;
+  ends 1 2024/01/01 01:00:00;
+  hardware ethernet 00:50:56:00:00:02;
+}
+lease 192.168.1.12 {
+  starts 1 2024/01/01 00:00:00;
+  ends 1 2024/01/01 03:00:00;
+  hardware ethernet 00:50:56:00:00:03;
+}
+lease 192.168.1.14 {
+  starts 1 2024/01/01 00:00:00;
+  ends 1 2024/01/01 03:00:00;
+  hardware ethernet 00:50:56:00:00:04;
+}
+`))
+	if err != nil {
+		t.Fatalf("Error reading leases: %s", err)
+	}
+	now := time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)
+
+	addresses := func(ips []net.IP) []string {
+		var result []string
+		for _, ip := range ips {
+			result = append(result, ip.String())
+		}
+		return result
+	}
+
+	// The lease of 192.168.1.11 has expired, so it's free again.
+	free, err := subnet.FreeAddresses(leases, now, 10)
+	if err != nil {
+		t.Fatalf("Unable to compute free addresses: %s", err)
+	}
+	expected := []string{"192.168.1.11", "192.168.1.13", "192.168.1.100", "192.168.1.101"}
+	if result := addresses(free); !compareSlice(result, expected) {
+		t.Errorf("expected free addresses %v, got %v", expected, result)
+	}
+
+	free, err = subnet.FreeAddresses(leases, now, 2)
+	if err != nil {
+		t.Fatalf("Unable to compute free addresses: %s", err)
+	}
+	expected = []string{"192.168.1.11", "192.168.1.13"}
+	if result := addresses(free); !compareSlice(result, expected) {
+		t.Errorf("expected free addresses %v up to the limit, got %v", expected, result)
+	}
+
+	// Once every lease has expired, the whole range is free.
+	free, err = subnet.FreeAddresses(leases, now.Add(2*time.Hour), 10)
+	if err != nil {
+		t.Fatalf("Unable to compute free addresses: %s", err)
+	}
+	if len(free) != 7 {
+		t.Errorf("expected 7 free addresses once the leases expired, got %v", addresses(free))
+	}
+
+	if _, err := subnet.FreeAddresses(leases, now, 0); err == nil {
+		t.Errorf("expected an error without a limit")
+	}
+
+	empty, err := config.SubnetByAddress(net.ParseIP("192.168.2.0"))
+	if err != nil {
+		t.Fatalf("Unable to find subnet: %s", err)
+	}
+	if _, err := empty.FreeAddresses(leases, now, 10); err == nil {
+		t.Errorf("expected an error for a subnet without ranges")
+	}
+}
+
+// stallingReader reads its contents and then blocks until it's released, like
+// a lease file on a stalled network share.
+type stallingReader struct {
+	contents io.Reader
+	release  chan struct{}
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	n, err := r.contents.Read(p)
+	if err == io.EOF {
+		<-r.release
+	}
+	return n, err
+}
+
+func TestParserReadDhcpdLeaseEntriesContext(t *testing.T) {
+	leases := `
+lease 192.168.1.10 {
+  starts 1 2024/01/01 00:00:00;
+  ends 1 2024/01/01 01:00:00;
+  hardware ethernet 00:50:56:00:00:01;
+}
+lease 192.168.1.11 {
+  starts 1 2024/01/01 00:00:00;
+  ends 1 2024/01/01 01:00:00;
+  hardware ethernet 00:50:56:00:00:02;
+}
+lease 192.168.1.12 {
+  starts 1 2024/01/01 00:00:00;
+`
+	r := &stallingReader{contents: strings.NewReader(leases), release: make(chan struct{})}
+	defer close(r.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	entries, err := ReadDhcpdLeaseEntriesContext(ctx, r)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected reading to stop promptly at the deadline, took %s", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+
+	// The entry that was being read when the deadline hit is incomplete.
+	var addresses []string
+	for _, entry := range entries {
+		addresses = append(addresses, entry.Address())
+	}
+	expected := []string{"192.168.1.10", "192.168.1.11"}
+	if !compareSlice(addresses, expected) {
+		t.Errorf("expected the entries read before the deadline %v, got %v", expected, addresses)
+	}
+
+	// Without a deadline, the whole file is read.
+	entries, err = ReadDhcpdLeaseEntriesContext(context.Background(), strings.NewReader(leases+"}\n"))
+	if err != nil || len(entries) != 3 {
+		t.Errorf("expected %d entries, got %d (%v)", 3, len(entries), err)
+	}
+}
+
+// slowReader reads its contents a byte at a time, pausing before each one.
+type slowReader struct {
+	contents io.Reader
+	delay    time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.contents.Read(p[:1])
+}
+
+func TestParserReadDhcpdLeaseEntriesContextGoroutines(t *testing.T) {
+	leases := strings.Repeat(`
+lease 192.168.1.10 {
+  starts 1 2024/01/01 00:00:00;
+  ends 1 2024/01/01 01:00:00;
+  hardware ethernet 00:50:56:00:00:01;
+}
+`, 10)
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		r := &slowReader{contents: strings.NewReader(leases), delay: 100 * time.Microsecond}
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Millisecond)
+		_, err := ReadDhcpdLeaseEntriesContext(ctx, r)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the deadline to be exceeded, got %v", err)
+		}
+	}
+
+	// Every stage of the pipeline should exit once its last read returns.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("expected %d goroutines after cancelling, got %d", before, after)
+	}
+}
+
+func TestParserReadDhcpdLeasesMerged(t *testing.T) {
+	older := strings.NewReader(`
+lease 192.168.1.10 {
+  starts 1 2024/01/01 00:00:00;
+  ends 1 2024/01/01 01:00:00;
+  hardware ethernet 00:50:56:00:00:01;
+}
+lease 192.168.1.11 {
+  starts 1 2024/01/01 00:00:00;
+  ends 1 2024/01/01 01:00:00;
+  hardware ethernet 00:50:56:00:00:02;
+}
+`)
+	newer := strings.NewReader(`
+lease 192.168.1.20 {
+  starts 2 2024/01/02 00:00:00;
+  ends 2 2024/01/02 01:00:00;
+  hardware ethernet 00:50:56:00:00:01;
+}
+lease 192.168.1.21 {
+  starts 0 2023/12/31 00:00:00;
+  ends 0 2023/12/31 01:00:00;
+  hardware ethernet 00:50:56:00:00:02;
+}
+`)
+
+	results, err := ReadDhcpdLeasesMerged(older, newer)
+	if err != nil {
+		t.Fatalf("Error reading leases: %s", err)
+	}
+
+	expected := map[string]string{
+		"00:50:56:00:00:01": "192.168.1.20",
+		"00:50:56:00:00:02": "192.168.1.11",
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d leases, got %d", len(expected), len(results))
+	}
+	for _, entry := range results {
+		mac := entry.HardwareAddress().String()
+		if address, ok := expected[mac]; !ok || entry.Address() != address {
+			t.Errorf("expected lease %s for %s, got %s", address, mac, entry.Address())
+		}
+	}
+
+	_, err = ReadDhcpdLeasesMerged(strings.NewReader(""), strings.NewReader("bogus 192.168.1.30 {\n}\n"))
+	if err == nil || !strings.Contains(err.Error(), "lease file #2") {
+		t.Errorf("expected an error naming the lease file, got %v", err)
+	}
+}
+
+func TestParserReadDhcpdLeases(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "dhcpd-example.leases"))
+	if err != nil {
+		t.Fatalf("Unable to open dhcpd.leases sample: %s", err)
+	}
+	defer f.Close()
+
+	results, err := ReadDhcpdLeaseEntries(f)
+	if err != nil {
+		t.Fatalf("Error reading lease: %s", err)
+	}
+
+	// some simple utilities
+	filterAddress := func(address string, items []DhcpLeaseEntry) (result []DhcpLeaseEntry) {
+		for _, item := range items {
+			if item.address == address {
+				result = append(result, item)
+			}
+		}
+		return
+	}
+
+	findUid := func(uid string, items []DhcpLeaseEntry) *DhcpLeaseEntry {
+		for _, item := range items {
+			if uid == hex.EncodeToString(item.uid) {
+				return &item
+			}
+		}
+		return nil
+	}
+
+	findEther := func(ether string, items []DhcpLeaseEntry) *DhcpLeaseEntry {
+		for _, item := range items {
+			if ether == hex.EncodeToString(item.ether) {
+				return &item
+			}
+		}
+		return nil
+	}
+
+	// actual unit tests
+	test1 := map[string]string{
+		"address": "127.0.0.19",
+		"uid":     "010dead099aabb",
+		"ether":   "0dead099aabb",
+	}
+	test1Findings := filterAddress(test1["address"], results)
+	if len(test1Findings) != 2 {
+		t.Errorf("expected %d matching entries, got %d", 2, len(test1Findings))
+	} else {
+		res := findEther(test1["ether"], test1Findings)
+		if res == nil {
+			t.Errorf("unable to find item with ether %v", test1["ether"])
+		} else if hex.EncodeToString(res.uid) != test1["uid"] {
+			t.Errorf("expected uid %s, got %s", test1["uid"], hex.EncodeToString(res.uid))
+		}
+	}
+
+	test2 := map[string]string{
+		"address": "127.0.0.19",
+		"uid":     "010dead0667788",
+		"ether":   "0dead0667788",
+	}
+	test2Findings := filterAddress(test2["address"], results)
+	if len(test2Findings) != 2 {
+		t.Errorf("expected %d matching entries, got %d", 2, len(test2Findings))
+	} else {
+		res := findEther(test2["ether"], test2Findings)
+		if res == nil {
+			t.Errorf("unable to find item with ether %v", test2["ether"])
+		} else if hex.EncodeToString(res.uid) != test2["uid"] {
+			t.Errorf("expected uid %s, got %s", test2["uid"], hex.EncodeToString(res.uid))
+		}
+	}
+
+	test3 := map[string]string{
+		"address": "127.0.0.17",
+		"uid":     "010dead0334455",
+		"ether":   "0dead0667788",
+	}
+	test3Findings := filterAddress(test3["address"], results)
+	if len(test3Findings) != 2 {
+		t.Errorf("expected %d matching entries, got %d", 2, len(test3Findings))
+	} else {
+		res := findUid(test3["uid"], test3Findings)
+		if res == nil {
+			t.Errorf("unable to find item with uid %v", test3["uid"])
+		} else if hex.EncodeToString(res.ether) != test3["ether"] {
+			t.Errorf("expected ethernet hardware %s, got %s", test3["ether"], hex.EncodeToString(res.ether))
+		}
+	}
+
+	test4 := map[string]string{
+		"address": "127.0.0.17",
+		"uid":     "010dead0001122",
+		"ether":   "0dead0667788",
+	}
+	test4Findings := filterAddress(test4["address"], results)
+	if len(test4Findings) != 2 {
+		t.Errorf("expected %d matching entries, got %d", 2, len(test4Findings))
+	} else {
+		res := findUid(test4["uid"], test4Findings)
+		if res == nil {
+			t.Errorf("unable to find item with uid %v", test4["uid"])
+		} else if hex.EncodeToString(res.ether) != test4["ether"] {
+			t.Errorf("expected ethernet hardware %s, got %s", test4["ether"], hex.EncodeToString(res.ether))
+		}
+	}
+}
+
+func consumeAppleLeaseString(s string) chan byte {
+	sch := consumeString(s)
+	uncommentedch := uncomment(sch)
+	return filterOutCharacters([]byte{'\r', '\v'}, uncommentedch)
+}
+
+func TestParserReadDhcpdLeasesLineNumbers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhcpd.leases")
+	contents := `# The first entry is fine
+lease 127.0.0.17 {
+    starts 3 2020/05/13 12:00:37;
+    ends 3 2020/05/13 12:30:37;
+    hardware ethernet 0d:ea:d0:66:77:88;
+}
+
+# The second entry is missing its address
+lease {
+    starts 3 2020/05/13 12:00:37;
+}
+
+lease 127.0.0.19 {
+    starts 4 2020/05/28 11:35:06;
+}
+`
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("Unable to write dhcpd.leases sample: %s", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unable to open dhcpd.leases sample: %s", err)
+	}
+	defer f.Close()
+
+	results, err := ReadDhcpdLeaseEntries(f)
+	if err == nil {
+		t.Fatalf("expected an error for the malformed lease entry")
+	}
+	if !strings.Contains(err.Error(), "line 9: unable to parse lease entry") {
+		t.Errorf("expected error to report line %d, got: %s", 9, err)
+	}
+	if strings.Count(err.Error(), "line ") != 1 {
+		t.Errorf("expected a single malformed entry, got: %s", err)
+	}
+
+	if len(results) != 2 || results[0].address != "127.0.0.17" || results[1].address != "127.0.0.19" {
+		t.Errorf("expected the well-formed entries to be parsed, got %v", results)
+	}
+}
+
+func TestParserReadDhcpdLeasesPreamble(t *testing.T) {
+	contents := `# The format of this file is documented in the dhcpd.leases(5) manual page.
+# This lease file was written by isc-dhcp-4.4.3
+
+# authoring-byte-order entry is generated, DO NOT DELETE
+authoring-byte-order little-endian;
+
+server-duid "\000\001\000\001*;\2363\000PV\300\000\010";
+
+lease 192.168.70.10 {
+  starts 4 2024/05/02 10:00:00;
+  ends 4 2024/05/02 10:30:00;
+  hardware ethernet 00:50:56:00:00:01;
+}
+lease 192.168.70.11 {
+  starts 4 2024/05/02 10:05:00;
+  hardware ethernet 00:50:56:00:00:02;
+}
+`
+
+	results, err := readDhcpdLeaseEntries(strings.NewReader(contents))
+	if err != nil {
+		t.Fatalf("expected the preamble to be skipped, got: %s", err)
+	}
+	if len(results) != 2 || results[0].address != "192.168.70.10" || results[1].address != "192.168.70.11" {
+		t.Fatalf("expected both entries to be parsed, got %v", results)
+	}
+	for _, extra := range results[0].extra {
+		if strings.Contains(extra, "server-duid") || strings.Contains(extra, "authoring-byte-order") {
+			t.Errorf("expected the preamble to be excluded from the entry, got %v", results[0].extra)
+		}
+	}
+
+	header, err := ReadDhcpdLeaseFileHeader(strings.NewReader(contents))
+	if err != nil {
+		t.Fatalf("Unable to read the lease file header: %s", err)
+	}
+	if header.AuthoringByteOrder != "little-endian" {
+		t.Errorf("expected authoring-byte-order %q, got %q", "little-endian", header.AuthoringByteOrder)
+	}
+	duid := []byte("\x00\x01\x00\x01*;\x9e3\x00PV\xc0\x00\x08")
+	if !bytes.Equal(header.ServerDuid, duid) {
+		t.Errorf("expected server-duid %x, got %x", duid, header.ServerDuid)
+	}
+
+	// A file holding nothing but the preamble has no entries and no errors.
+	results, err = readDhcpdLeaseEntries(strings.NewReader("authoring-byte-order little-endian;\nserver-duid 00:01:00:01;\n"))
+	if err != nil || len(results) != 0 {
+		t.Errorf("expected no entries or errors, got %v (%v)", results, err)
+	}
+
+	// The line of a malformed entry still accounts for the preamble.
+	_, err = readDhcpdLeaseEntries(strings.NewReader("authoring-byte-order little-endian;\n\nlease {\n}\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 3: unable to parse lease entry") {
+		t.Errorf("expected an error on line 3, got: %v", err)
+	}
+
+	header, err = ReadDhcpdLeaseFileHeader(strings.NewReader("lease 192.168.70.10 {\n}\n"))
+	if err != nil || header.AuthoringByteOrder != "" || header.ServerDuid != nil {
+		t.Errorf("expected an empty header, got %+v (%v)", header, err)
+	}
+}
+
+func TestParserFollowDhcpdLeases(t *testing.T) {
+	r, w := io.Pipe()
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	entries := make(chan DhcpLeaseEntry)
+	result := make(chan error)
+	go func() {
+		result <- FollowDhcpdLeases(ctx, r, func(entry DhcpLeaseEntry) {
+			entries <- entry
+		})
+	}()
+
+	expectEntry := func(address string) {
+		select {
+		case entry := <-entries:
+			if entry.Address() != address {
+				t.Errorf("expected lease for %s, got %s", address, entry.Address())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for lease for %s", address)
+		}
+	}
+	expectNoEntry := func() {
+		select {
+		case entry := <-entries:
+			t.Errorf("unexpected lease for %s", entry.Address())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// An entry split across writes is only reported once it's complete.
+	chunks := []string{
+		"lease 127.0.0.17 {\n    starts 3 2020/05/13 12:00:37;\n",
+		"    ends 3 2020/05/13 12:30:37;\n    hardware ethernet 0d:ea:d0:66:77:88;\n}\n",
+	}
+	if _, err := io.WriteString(w, chunks[0]); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expectNoEntry()
+	if _, err := io.WriteString(w, chunks[1]); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expectEntry("127.0.0.17")
+
+	if _, err := io.WriteString(w, "lease 127.0.0.18 {\n    starts 3 2020/05/13 12:00:37;\n}\n"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expectEntry("127.0.0.18")
+
+	// Reaching the end of the data should not stop following.
+	w.Close()
+	expectNoEntry()
+
+	cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("expected %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for follow to stop")
+	}
+}
+
+func TestParserReadAppleDhcpdLeaseEntry(t *testing.T) {
+	test1 := `{
+		ip_address=192.168.111.3
+		hw_address=1,0:c:56:3c:e7:22
+		identifier=1,0:c:56:3c:e7:22
+		lease=0x5fd78ae2
+		name=vagrant-2019
+		fake=field
+	}`
+	expected1 := map[string]string{
+		"ipAddress": "192.168.111.3",
+		"hwAddress": "000c563ce722",
+		"id":        "000c563ce722",
+		"lease":     "0x5fd78ae2",
+		"name":      "vagrant-2019",
+	}
+	expectedExtra1 := map[string]string{
+		"fake": "field",
+	}
+
+	result, err := readAppleDhcpdLeaseEntry(consumeAppleLeaseString(test1))
+	if err != nil {
+		t.Errorf("error parsing entry: %s", err)
+	}
+	if result.ipAddress != expected1["ipAddress"] {
+		t.Errorf("expected ipAddress %v, got %v", expected1["ipAddress"], result.ipAddress)
+	}
+	if hex.EncodeToString(result.hwAddress) != expected1["hwAddress"] {
+		t.Errorf("expected hwAddress %v, got %v", expected1["hwAddress"], hex.EncodeToString(result.hwAddress))
+	}
+	if hex.EncodeToString(result.id) != expected1["id"] {
+		t.Errorf("expected id %v, got %v", expected1["id"], hex.EncodeToString(result.id))
+	}
+	if result.lease != expected1["lease"] {
+		t.Errorf("expected lease %v, got %v", expected1["lease"], result.lease)
+	}
+	if result.name != expected1["name"] {
+		t.Errorf("expected name %v, got %v", expected1["name"], result.name)
+	}
+	if result.extra["fake"] != expectedExtra1["fake"] {
+		t.Errorf("expected extra %v, got %v", expectedExtra1["fake"], result.extra["fake"])
+	}
+
+	test2 := `{
+		ip_address=192.168.111.4
+		hw_address=1,0:c:56:3c:e7:23
+		identifier=1,0:c:56:3c:e7:23
+	}`
+	expected2 := map[string]string{
+		"ipAddress": "192.168.111.4",
+		"hwAddress": "000c563ce723",
+		"id":        "000c563ce723",
+	}
+
+	result, err = readAppleDhcpdLeaseEntry(consumeAppleLeaseString(test2))
+	if err != nil {
+		t.Errorf("error parsing entry: %s", err)
+	}
+	if result.ipAddress != expected2["ipAddress"] {
+		t.Errorf("expected ipAddress %v, got %v", expected2["ipAddress"], result.ipAddress)
+	}
+	if hex.EncodeToString(result.hwAddress) != expected2["hwAddress"] {
+		t.Errorf("expected hwAddress %v, got %v", expected2["hwAddress"], hex.EncodeToString(result.hwAddress))
+	}
+	if hex.EncodeToString(result.id) != expected2["id"] {
+		t.Errorf("expected id %v, got %v", expected2["id"], hex.EncodeToString(result.id))
+	}
+}
+
+func TestParserReadAppleDhcpdLeases(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "apple-dhcpd-example.leases"))
+	if err != nil {
+		t.Fatalf("Unable to open dhcpd.leases sample: %s", err)
+	}
+	defer f.Close()
+
+	results, err := ReadAppleDhcpdLeaseEntries(f)
+	if err != nil {
+		t.Fatalf("Error reading lease: %s", err)
+	}
+
+	// some simple utilities
+	filterIpAddress := func(ipAddress string, items []appleDhcpLeaseEntry) (result []appleDhcpLeaseEntry) {
+		for _, item := range items {
+			if item.ipAddress == ipAddress {
+				result = append(result, item)
+			}
+		}
+		return
+	}
+
+	findId := func(id string, items []appleDhcpLeaseEntry) *appleDhcpLeaseEntry {
+		for _, item := range items {
+			if id == hex.EncodeToString(item.id) {
+				return &item
+			}
+		}
+		return nil
+	}
+
+	findHardwareAddress := func(hwAddr string, items []appleDhcpLeaseEntry) *appleDhcpLeaseEntry {
+		for _, item := range items {
+			if hwAddr == hex.EncodeToString(item.hwAddress) {
+				return &item
+			}
+		}
+		return nil
+	}
+
+	// actual unit tests
+	test1 := map[string]string{
+		"ipAddress": "127.0.0.19",
+		"id":        "0dead099aabb",
+		"hwAddress": "0dead099aabb",
+	}
+	test1Findings := filterIpAddress(test1["ipAddress"], results)
+	if len(test1Findings) != 2 {
+		t.Errorf("expected %d matching entries, got %d", 2, len(test1Findings))
+	} else {
+		res := findHardwareAddress(test1["hwAddress"], test1Findings)
+		if res == nil {
+			t.Errorf("unable to find item with hwAddress %v", test1["hwAddress"])
+		} else if hex.EncodeToString(res.id) != test1["id"] {
+			t.Errorf("expected id %s, got %s", test1["id"], hex.EncodeToString(res.id))
+		}
+	}
+
+	test2 := map[string]string{
+		"ipAddress": "127.0.0.19",
+		"id":        "0dead0667788",
+		"hwAddress": "0dead0667788",
+	}
+	test2Findings := filterIpAddress(test2["ipAddress"], results)
+	if len(test2Findings) != 2 {
+		t.Errorf("expected %d matching entries, got %d", 2, len(test2Findings))
+	} else {
+		res := findHardwareAddress(test2["hwAddress"], test2Findings)
+		if res == nil {
+			t.Errorf("unable to find item with hwAddress %v", test2["hwAddress"])
+		} else if hex.EncodeToString(res.id) != test2["id"] {
+			t.Errorf("expected id %s, got %s", test2["id"], hex.EncodeToString(res.id))
+		}
+	}
+
+	test3 := map[string]string{
+		"ipAddress": "127.0.0.17",
+		"id":        "0dead0334455",
+		"hwAddress": "0dead0667788",
+	}
+	test3Findings := filterIpAddress(test3["ipAddress"], results)
+	if len(test3Findings) != 2 {
+		t.Errorf("expected %d matching entries, got %d", 2, len(test3Findings))
+	} else {
+		res := findId(test3["id"], test3Findings)
+		if res == nil {
+			t.Errorf("unable to find item with id %v", test3["id"])
+		} else if hex.EncodeToString(res.hwAddress) != test3["hwAddress"] {
+			t.Errorf("expected hardware address %s, got %s", test3["hwAddress"], hex.EncodeToString(res.hwAddress))
+		}
+	}
+
+	test4 := map[string]string{
+		"ipAddress": "127.0.0.17",
+		"id":        "0dead0001122",
+		"hwAddress": "0dead0667788",
+	}
+	test4Findings := filterIpAddress(test4["ipAddress"], results)
+	if len(test4Findings) != 2 {
+		t.Errorf("expected %d matching entries, got %d", 2, len(test4Findings))
+	} else {
+		res := findId(test4["id"], test4Findings)
+		if res == nil {
+			t.Errorf("unable to find item with id %v", test4["id"])
+		} else if hex.EncodeToString(res.hwAddress) != test4["hwAddress"] {
+			t.Errorf("expected hardware address %s, got %s", test4["hwAddress"], hex.EncodeToString(res.hwAddress))
+		}
+	}
+
+	test5 := map[string]string{
+		"ipAddress": "127.0.0.20",
+		"id":        "0dead099aabc",
+		"hwAddress": "0dead099aabc",
+	}
+	test5Findings := filterIpAddress(test5["ipAddress"], results)
+	if len(test5Findings) != 1 {
+		t.Errorf("expected %d matching entries, got %d", 1, len(test5Findings))
+	} else {
+		res := findId(test5["id"], test5Findings)
+		if res == nil {
+			t.Errorf("unable to find item with id %v", test5["id"])
+		} else if hex.EncodeToString(res.hwAddress) != test5["hwAddress"] {
+			t.Errorf("expected hardware address %s, got %s", test5["hwAddress"], hex.EncodeToString(res.hwAddress))
+		}
+	}
+}
+
+func TestParserTokenizeNetworkingConfig(t *testing.T) {
+	tests := []string{
+		"words       words       words",
+		"newlines\n\n\n\n\n\n\n\nnewlines\r\r\r\r\r\r\r\rnewlines\n\n\n\n",
+		"       newline-less",
+		"answer VNET_8_NAT_XLATE \"some value  with\tspaces\"\nnext",
+	}
+	expects := [][]string{
+		{"words", "words", "words"},
+		{"newlines", "\n", "newlines", "\n", "newlines", "\n"},
+		{"newline-less"},
+		{"answer", "VNET_8_NAT_XLATE", "\"some value  with\tspaces\"", "\n", "next"},
+	}
+
+	for testnum := 0; testnum < len(tests); testnum++ {
+		inCh := consumeString(tests[testnum])
+		outCh := tokenizeNetworkingConfig(inCh)
+		result := collectIntoStringList(outCh)
+
+		expected := expects[testnum]
+		if len(result) != len(expected) {
+			t.Errorf("test %d expected %d items, got %d instead", 1+testnum, len(expected), len(result))
+			continue
+		}
+
+		ok := true
+		for index := 0; index < len(expected); index++ {
+			if result[index] != expected[index] {
+				ok = false
+			}
+		}
+		if !ok {
+			t.Errorf("test %d expected %#v, got %#v", 1+testnum, expects[testnum], result)
+		}
+	}
+}
+
+func TestParserSplitNetworkingConfig(t *testing.T) {
+	tests := []string{
+		"this is a story\n\n\nabout some newlines",
+		"\n\n\nthat can begin and end with newlines\n\n\n",
+		"   in\n\n\nsome\ncases\nit\ncan\nend\nwith\nan\nempty\nstring\n\n\n\n",
+		"\n\n\nand\nbegin\nwith\nan\nempty\nstring   ",
+	}
+	expects := [][]string{
+		{"this is a story", "about some newlines"},
+		{"that can begin and end with newlines"},
+		{"in", "some", "cases", "it", "can", "end", "with", "an", "empty", "string"},
+		{"and", "begin", "with", "an", "empty", "string"},
+	}
+
+	for testnum := 0; testnum < len(tests); testnum++ {
+		inCh := consumeString(tests[testnum])
+		stringCh := tokenizeNetworkingConfig(inCh)
+		outCh := splitNetworkingConfig(stringCh)
+
+		result := make([]string, 0)
+		for item := range outCh {
+			result = append(result, strings.Join(item, " "))
+		}
+
+		expected := expects[testnum]
+		if len(result) != len(expected) {
+			t.Errorf("test %d expected %d items, got %d instead", 1+testnum, len(expected), len(result))
+			continue
+		}
+
+		ok := true
+		for index := 0; index < len(expected); index++ {
+			if result[index] != expected[index] {
+				ok = false
+			}
+		}
+		if !ok {
+			t.Errorf("test %d expected %#v, got %#v", 1+testnum, expects[testnum], result)
+		}
+	}
+}
+
+func TestParserParseNetworkingConfigVersion(t *testing.T) {
+	successTests := []string{"VERSION=4,2"}
+	failureTests := []string{
+		"VERSION=1=2",
+		"VERSION=3,4,5",
+		"VERSION=a,b",
+	}
+
+	for testnum := 0; testnum < len(successTests); testnum++ {
+		test := []string{successTests[testnum]}
+		if _, err := networkingReadVersion(test); err != nil {
+			t.Errorf("success-test %d parsing failed: %v", 1+testnum, err)
+		}
+	}
+
+	for testnum := 0; testnum < len(successTests); testnum++ {
+		test := []string{failureTests[testnum]}
+		if _, err := networkingReadVersion(test); err == nil {
+			t.Errorf("failure-test %d should have failed", 1+testnum)
+		}
+	}
+}
+
+func TestParserParseNetworkingConfigEntries(t *testing.T) {
+	tests := []string{
+		"answer VNET_999_ANYTHING option",
+		"remove_answer VNET_123_ALSOANYTHING",
+		"add_nat_portfwd 24 udp 42 127.0.0.1 24",
+		"remove_nat_portfwd 42 tcp 2502",
+		"add_dhcp_mac_to_ip 57005 00:0d:0e:0a:0d:00 127.0.0.2",
+		"remove_dhcp_mac_to_ip 57005 00:0d:0e:0a:0d:00",
+		"add_bridge_mapping string 51",
+		"remove_bridge_mapping string",
+		"add_nat_prefix 57005 /24",
+		"remove_nat_prefix 57005 /31",
+	}
+
+	for testnum := 0; testnum < len(tests); testnum++ {
+		test := strings.Split(tests[testnum], " ")
+		parser := NetworkingParserByCommand(test[0])
+		if parser == nil {
+			t.Errorf("test %d unable to parse command: %#v", 1+testnum, test)
 			continue
 		}
-		operandParser := *parser
+		operandParser := *parser
+
+		_, err := operandParser(test[1:])
+		if err != nil {
+			t.Errorf("test %d unable to parse command parameters %#v: %v", 1+testnum, test, err)
+		}
+	}
+}
+
+func TestParserReadNetworingConfig(t *testing.T) {
+	expectedAnswerVnet1 := map[string]string{
+		"DHCP":             "yes",
+		"DHCP_CFG_HASH":    "01F4CE0D79A1599698B6E5814CCB68058BB0ED5E",
+		"HOSTONLY_NETMASK": "255.255.255.0",
+		"HOSTONLY_SUBNET":  "192.168.70.0",
+		"NAT":              "no",
+		"VIRTUAL_ADAPTER":  "yes",
+	}
+
+	f, err := os.Open(filepath.Join("testdata", "networking-example"))
+	if err != nil {
+		t.Fatalf("Unable to open networking-example sample: %s", err)
+	}
+	defer f.Close()
+
+	config, err := ReadNetworkingConfig(f)
+	if err != nil {
+		t.Fatalf("error parsing networking-example: %s", err)
+	}
+
+	if vnet, ok := config.answer[1]; ok {
+		for answerKey := range expectedAnswerVnet1 {
+			result, ok := vnet[answerKey]
+			if !ok {
+				t.Errorf("unable to find key %s in VNET_%d answer", answerKey, 1)
+				continue
+			}
+
+			if result != expectedAnswerVnet1[answerKey] {
+				t.Errorf("expected key %s for VNET_%d to be %v, got %v", answerKey, 1, expectedAnswerVnet1[answerKey], result)
+			}
+		}
+
+	} else {
+		t.Errorf("unable to find VNET_%d answer", 1)
+	}
+
+	expectedAnswerVnet8 := map[string]string{
+		"DHCP":             "yes",
+		"DHCP_CFG_HASH":    "C30F14F65A0FE4B5DCC6C67497D7A8A33E5E538C",
+		"HOSTONLY_NETMASK": "255.255.255.0",
+		"HOSTONLY_SUBNET":  "172.16.41.0",
+		"NAT":              "yes",
+		"VIRTUAL_ADAPTER":  "yes",
+	}
+
+	if vnet, ok := config.answer[8]; ok {
+		for answerKey := range expectedAnswerVnet8 {
+			result, ok := vnet[answerKey]
+			if !ok {
+				t.Errorf("unable to find key %s in VNET_%d answer", answerKey, 8)
+				continue
+			}
+
+			if result != expectedAnswerVnet8[answerKey] {
+				t.Errorf("expected key %s for VNET_%d to be %v, got %v", answerKey, 8, expectedAnswerVnet8[answerKey], result)
+			}
+		}
+
+	} else {
+		t.Errorf("unable to find VNET_%d answer", 8)
+	}
+
+	expectedNatPortFwd8 := map[string]string{
+		"tcp/2200":  "172.16.41.129:3389",
+		"tcp/2201":  "172.16.41.129:3389",
+		"tcp/2222":  "172.16.41.129:22",
+		"tcp/3389":  "172.16.41.131:3389",
+		"tcp/55985": "172.16.41.129:5985",
+		"tcp/55986": "172.16.41.129:5986",
+	}
+
+	if vnet, ok := config.natPortFwd[8-1]; ok {
+		for natKey := range expectedNatPortFwd8 {
+			result, ok := vnet[natKey]
+			if !ok {
+				t.Errorf("unable to find key %s in VNET_%d nat_portfwd", natKey, 8)
+				continue
+			}
+
+			if result != expectedNatPortFwd8[natKey] {
+				t.Errorf("expected key %s for VNET_%d to be %v, got %v", natKey, 8, expectedNatPortFwd8[natKey], result)
+			}
+		}
+	} else {
+		t.Errorf("unable to find VNET_%d answer", 8-1)
+	}
+}
+
+func readNetworkingConfigFromString(t *testing.T, s string) NetworkingConfig {
+	path := filepath.Join(t.TempDir(), "networking")
+	if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+		t.Fatalf("Unable to write networking sample: %s", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unable to open networking sample: %s", err)
+	}
+	defer f.Close()
+
+	config, err := ReadNetworkingConfig(f)
+	if err != nil {
+		t.Fatalf("error parsing networking sample: %s", err)
+	}
+	return config
+}
+
+func TestParserNetworkingConfigVersionOnly(t *testing.T) {
+	config := readNetworkingConfigFromString(t, "VERSION=1,0")
+
+	if vmnets := config.Vmnets(); len(vmnets) != 0 {
+		t.Errorf("expected no vmnets, got %v", vmnets)
+	}
+	if device, err := config.NameIntoDevice("nat"); err != nil || device != "vmnet8" {
+		t.Errorf("expected device %q, got %q (%v)", "vmnet8", device, err)
+	}
+	if !config.SetAnswer(8, "NAT", "yes") {
+		t.Errorf("expected the configuration to be mutable")
+	}
+
+	var buf bytes.Buffer
+	if err := WriteNetworkingConfig(&buf, config); err != nil {
+		t.Fatalf("Unable to write networking configuration: %s", err)
+	}
+	if !strings.HasPrefix(buf.String(), "VERSION=1,0\n") {
+		t.Errorf("expected the written configuration to start with its version, got %q", buf.String())
+	}
+
+	for _, input := range []string{"", "\n"} {
+		path := filepath.Join(t.TempDir(), "networking")
+		if err := os.WriteFile(path, []byte(input), 0644); err != nil {
+			t.Fatalf("Unable to write networking sample: %s", err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Unable to open networking sample: %s", err)
+		}
+		_, err = ReadNetworkingConfig(f)
+		f.Close()
+		if err == nil || !strings.Contains(err.Error(), "missing version") {
+			t.Errorf("expected a missing version error for %q, got %v", input, err)
+		}
+	}
+}
+
+func TestParserNetworkingConfigVmnets(t *testing.T) {
+	config := readNetworkingConfigFromString(t, `VERSION=1,0
+answer VNET_1_VIRTUAL_ADAPTER yes
+answer VNET_8_NAT yes
+add_nat_portfwd 4 tcp 2222 172.16.41.129 22
+add_dhcp_mac_to_ip 6 00:50:56:00:00:01 192.168.70.10
+add_bridge_mapping eth0 3
+add_nat_prefix 11 /24
+add_nat_prefix 9 /16
+`)
+
+	// The vmnets are reported as they were written, even though every command
+	// other than `answer` stores its vmnet offset by one.
+	expected := []int{1, 3, 4, 6, 8, 9, 11}
+	result := config.Vmnets()
+	if len(result) != len(expected) {
+		t.Fatalf("expected vmnets %v, got %v", expected, result)
+	}
+	for index := range expected {
+		if result[index] != expected[index] {
+			t.Errorf("expected vmnets %v, got %v", expected, result)
+			break
+		}
+	}
+}
+
+func TestParserNetworkingConfigDisabled(t *testing.T) {
+	config := readNetworkingConfigFromString(t, `VERSION=1,0
+answer VNET_1_VIRTUAL_ADAPTER yes
+answer VNET_1_HOSTONLY_SUBNET 192.168.70.0
+answer VNET_1_HOSTONLY_NETMASK 255.255.255.0
+answer VNET_2_VIRTUAL_ADAPTER yes
+answer VNET_2_HOSTONLY_SUBNET 192.168.71.0
+answer VNET_2_HOSTONLY_NETMASK 255.255.255.0
+answer VNET_2_DISABLED yes
+answer VNET_8_VIRTUAL_ADAPTER yes
+answer VNET_8_NAT yes
+answer VNET_8_DISABLED no
+add_bridge_mapping eth0 1
+answer VNET_0_DISABLED yes
+`)
+
+	if !config.Disabled(2) || !config.Disabled(0) {
+		t.Errorf("expected vmnet0 and vmnet2 to be disabled")
+	}
+	if config.Disabled(1) || config.Disabled(8) {
+		t.Errorf("expected vmnet1 and vmnet8 to be enabled")
+	}
+
+	// Only vmnet1 remains for hostonly, since vmnet2 is disabled.
+	if devices, err := config.NameIntoDevices("hostonly"); err != nil || !compareSlice(devices, []string{"vmnet1"}) {
+		t.Errorf("expected hostonly devices %v, got %v (%v)", []string{"vmnet1"}, devices, err)
+	}
+	if devices, err := config.NameIntoDevices("nat"); err != nil || !compareSlice(devices, []string{"vmnet8"}) {
+		t.Errorf("expected nat devices %v, got %v (%v)", []string{"vmnet8"}, devices, err)
+	}
+
+	// The default bridge is disabled, leaving nothing bridged.
+	if devices, err := config.NameIntoDevices("bridged"); err == nil {
+		t.Errorf("expected an error for a disabled network, got %v", devices)
+	}
+	if name, err := config.DeviceIntoName("vmnet2"); err == nil {
+		t.Errorf("expected an error for a disabled device, got %q", name)
+	}
+}
+
+func TestParserNetworkingConfigString(t *testing.T) {
+	contents := `VERSION=1,0
+answer VNET_8_NAT yes
+answer VNET_8_VIRTUAL_ADAPTER yes
+answer VNET_1_VIRTUAL_ADAPTER yes
+answer VNET_1_HOSTONLY_SUBNET 192.168.70.0
+answer VNET_1_HOSTONLY_NETMASK 255.255.255.0
+add_nat_portfwd 8 tcp 2222 172.16.41.129 22
+add_dhcp_mac_to_ip 8 00:50:56:00:00:02 172.16.41.20
+add_dhcp_mac_to_ip 8 00:50:56:00:00:01 172.16.41.10
+add_bridge_mapping eth1 2
+add_bridge_mapping eth0 1
+add_nat_prefix 8 /24
+add_nat_prefix 8 /16
+`
+	config := readNetworkingConfigFromString(t, contents)
+
+	result := config.String()
+	for i := 0; i < 10; i++ {
+		if repeated := config.String(); repeated != result {
+			t.Fatalf("expected the same rendering every time, got:\n%s\nthen:\n%s", result, repeated)
+		}
+	}
+	if reparsed := readNetworkingConfigFromString(t, contents).String(); reparsed != result {
+		t.Fatalf("expected the same rendering for the same configuration, got:\n%s\nthen:\n%s", result, reparsed)
+	}
+
+	expected := `answer ->
+  1: HOSTONLY_NETMASK=255.255.255.0 HOSTONLY_SUBNET=192.168.70.0 VIRTUAL_ADAPTER=yes
+  8: NAT=yes VIRTUAL_ADAPTER=yes
+nat_portfwd ->
+  7: tcp/2222=172.16.41.129:22
+dhcp_mac_to_ip ->
+  7: 00:50:56:00:00:01=172.16.41.10 00:50:56:00:00:02=172.16.41.20
+bridge_mapping -> eth0=0 eth1=1
+nat_prefix ->
+  7: [24 16]`
+	if result != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, result)
+	}
+}
+
+func TestParserNetworkingConfigNameIntoDevice(t *testing.T) {
+	config := readNetworkingConfigFromString(t, `VERSION=1,0
+answer VNET_1_VIRTUAL_ADAPTER yes
+answer VNET_1_NAT yes
+answer VNET_2_VIRTUAL_ADAPTER yes
+answer VNET_3_VIRTUAL_ADAPTER yes
+answer VNET_8_VIRTUAL_ADAPTER yes
+answer VNET_8_NAT yes
+`)
+
+	// Only one device is bridged.
+	if device, err := config.NameIntoDevice("bridged"); err != nil || device != "vmnet0" {
+		t.Errorf("expected device %q, got %q (%v)", "vmnet0", device, err)
+	}
+
+	// Both vmnet1 and vmnet8 are nat, but vmnet8 is the default.
+	if device, err := config.NameIntoDevice("NAT"); err != nil || device != "vmnet8" {
+		t.Errorf("expected device %q, got %q (%v)", "vmnet8", device, err)
+	}
+
+	// Neither vmnet2 nor vmnet3 is the default for hostonly.
+	if device, err := config.NameIntoDevice("hostonly"); err == nil {
+		t.Errorf("expected an error for an ambiguous name, got %q", device)
+	}
+
+	if device, err := config.NameIntoDevice("custom"); err == nil {
+		t.Errorf("expected an error for a missing name, got %q", device)
+	}
+}
+
+func TestParserNetworkingConfigInterfacePrefix(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "networking-example"))
+	if err != nil {
+		t.Fatalf("Unable to open networking-example sample: %s", err)
+	}
+	defer f.Close()
+
+	config, err := ReadNetworkingConfigWithOptions(f, NetworkingConfigOptions{InterfacePrefix: "vnic"})
+	if err != nil {
+		t.Fatalf("error parsing networking-example: %s", err)
+	}
+
+	if device, err := config.NameIntoDevice("nat"); err != nil || device != "vnic8" {
+		t.Errorf("expected device %q, got %q (%v)", "vnic8", device, err)
+	}
+	if devices, err := config.NameIntoDevices("hostonly"); err != nil || !compareSlice(devices, []string{"vnic1"}) {
+		t.Errorf("expected devices %v, got %v (%v)", []string{"vnic1"}, devices, err)
+	}
+	if name, err := config.DeviceIntoName("VNIC8"); err != nil || name != "nat" {
+		t.Errorf("expected name %q, got %q (%v)", "nat", name, err)
+	}
+
+	// A device without the prefix is assumed to be a custom device.
+	if name, err := config.DeviceIntoName("vmnet8"); err != nil || name != "vmnet8" {
+		t.Errorf("expected name %q, got %q (%v)", "vmnet8", name, err)
+	}
+
+	// The prefix defaults to NetworkingInterfacePrefix.
+	if device, err := readNetworkingConfigFromString(t, "VERSION=1,0\n").NameIntoDevice("nat"); err != nil || device != NetworkingInterfacePrefix+"8" {
+		t.Errorf("expected device %q, got %q (%v)", NetworkingInterfacePrefix+"8", device, err)
+	}
+}
+
+func TestParserNetworkingConfigNameAliases(t *testing.T) {
+	config := readNetworkingConfigFromString(t, `VERSION=1,0
+answer VNET_1_VIRTUAL_ADAPTER yes
+answer VNET_8_VIRTUAL_ADAPTER yes
+answer VNET_8_NAT yes
+`)
+
+	for name, expected := range map[string]string{
+		"hostonly":  "vmnet1",
+		"host-only": "vmnet1",
+		"Host_Only": "vmnet1",
+		"NAT":       "vmnet8",
+		"bridged":   "vmnet0",
+		"Bridge":    "vmnet0",
+	} {
+		if device, err := config.NameIntoDevice(name); err != nil || device != expected {
+			t.Errorf("expected device %q for %s, got %q (%v)", expected, name, device, err)
+		}
+	}
+
+	for _, name := range []string{"host", "bridging", "custom"} {
+		if devices, err := config.NameIntoDevices(name); err == nil {
+			t.Errorf("expected an error for unknown name %s, got %v", name, devices)
+		}
+	}
+
+	// Custom networks are matched by their exact name.
+	if name := NormalizeNetworkName("Custom-Net"); name != "Custom-Net" {
+		t.Errorf("expected a custom network name to be unchanged, got %q", name)
+	}
+}
+
+func TestParserNetworkingConfigNameIntoDevicesMemoized(t *testing.T) {
+	config := readNetworkingConfigFromString(t, `VERSION=1,0
+answer VNET_1_VIRTUAL_ADAPTER yes
+answer VNET_2_VIRTUAL_ADAPTER yes
+answer VNET_8_VIRTUAL_ADAPTER yes
+answer VNET_8_NAT yes
+add_bridge_mapping eth0 3
+`)
+
+	// A configuration without a cache computes the types on every lookup.
+	uncached := config
+	uncached.types = nil
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, name := range []string{"hostonly", "nat", "bridged"} {
+				expected, _ := uncached.NameIntoDevices(name)
+				if result, _ := config.NameIntoDevices(name); !compareSlice(result, expected) {
+					t.Errorf("expected devices %v for %s, got %v", expected, name, result)
+				}
+			}
+			for _, device := range []string{"vmnet0", "vmnet1", "vmnet2", "vmnet8"} {
+				expected, _ := uncached.DeviceIntoName(device)
+				if result, _ := config.DeviceIntoName(device); result != expected {
+					t.Errorf("expected name %q for %s, got %q", expected, device, result)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Mutating the answers has to be reflected by the next lookup.
+	config.SetAnswer(2, "NAT", "yes")
+	if result, _ := config.NameIntoDevices("nat"); !compareSlice(result, []string{"vmnet2", "vmnet8"}) {
+		t.Errorf("expected devices %v for nat, got %v", []string{"vmnet2", "vmnet8"}, result)
+	}
+	if result, _ := config.DeviceIntoName("vmnet2"); result != "nat" {
+		t.Errorf("expected name %q for vmnet2, got %q", "nat", result)
+	}
+}
+
+func BenchmarkNetworkingConfigNameIntoDevices(b *testing.B) {
+	f, err := os.Open(filepath.Join("testdata", "networking-example"))
+	if err != nil {
+		b.Fatalf("Unable to open networking-example sample: %s", err)
+	}
+	defer f.Close()
+
+	config, err := ReadNetworkingConfig(f)
+	if err != nil {
+		b.Fatalf("error parsing networking-example: %s", err)
+	}
+	uncached := config
+	uncached.types = nil
+
+	for name, config := range map[string]NetworkingConfig{"cached": config, "uncached": uncached} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := config.NameIntoDevices("nat"); err != nil {
+					b.Fatalf("Unable to resolve nat: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func TestParserReadVmnetNatConf(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "vmnetnat-example.conf"))
+	if err != nil {
+		t.Fatalf("Unable to open vmnetnat.conf sample: %s", err)
+	}
+	defer f.Close()
+
+	config, err := ReadVmnetNatConf(f)
+	if err != nil {
+		t.Fatalf("Error reading vmnetnat.conf: %s", err)
+	}
+
+	if ip, err := config.GatewayIP(); err != nil || !ip.Equal(net.ParseIP("172.16.41.2")) {
+		t.Errorf("expected gateway ip %s, got %s (%v)", "172.16.41.2", ip, err)
+	}
+	if mask, err := config.Netmask(); err != nil || mask.String() != "ffffff00" {
+		t.Errorf("expected netmask %s, got %s (%v)", "ffffff00", mask, err)
+	}
+
+	// The section is named [DNS] in the sample.
+	if policy, ok := config.DNSPolicy(); !ok || policy != "order" {
+		t.Errorf("expected dns policy %q, got %q (%v)", "order", policy, ok)
+	}
+	if value, ok := config.Value("udp", "timeout"); !ok || value != "30" {
+		t.Errorf("expected udp timeout %q, got %q (%v)", "30", value, ok)
+	}
+
+	tcp, err := config.IncomingTCP()
+	if err != nil {
+		t.Fatalf("Error reading incoming tcp ports: %s", err)
+	}
+	expected := map[int]NatPortForward{
+		2222: {IP: net.ParseIP("172.16.41.129"), Port: 22},
+		5986: {IP: net.ParseIP("172.16.41.129"), Port: 5986},
+	}
+	if !reflect.DeepEqual(tcp, expected) {
+		t.Errorf("expected incoming tcp ports %v, got %v", expected, tcp)
+	}
+
+	udp, err := config.IncomingUDP()
+	if err != nil {
+		t.Fatalf("Error reading incoming udp ports: %s", err)
+	}
+	expected = map[int]NatPortForward{
+		6000: {IP: net.ParseIP("172.16.41.129"), Port: 6001},
+	}
+	if !reflect.DeepEqual(udp, expected) {
+		t.Errorf("expected incoming udp ports %v, got %v", expected, udp)
+	}
+}
+
+func TestParserReadVmnetNatConfErrors(t *testing.T) {
+	for _, input := range []string{
+		"ip = 172.16.41.2\n",
+		"[host\nip = 172.16.41.2\n",
+		"[host]\nip\n",
+	} {
+		if _, err := ReadVmnetNatConf(strings.NewReader(input)); err == nil {
+			t.Errorf("expected an error reading %q", input)
+		}
+	}
+
+	config, err := ReadVmnetNatConf(strings.NewReader("[incomingtcp]\n8080 = 172.16.41.129\n"))
+	if err != nil {
+		t.Fatalf("Error reading vmnetnat.conf: %s", err)
+	}
+	if _, err := config.IncomingTCP(); err == nil {
+		t.Errorf("expected an error for a destination without a port")
+	}
+	if _, err := config.GatewayIP(); err == nil {
+		t.Errorf("expected an error for a missing gateway ip")
+	}
+}
+
+func TestParserNetworkMapNameIntoDevice(t *testing.T) {
+	netmap := NetworkMap{
+		{"name": "Bridged", "device": "vmnet0"},
+		{"name": "HostOnly", "device": "vmnet1"},
+		{"name": "NAT", "device": "vmnet8"},
+		{"name": "NAT", "device": "vmnet9"},
+		{"name": "lab", "device": "vmnet2"},
+		{"name": "lab", "device": "vmnet2"},
+		{"name": "isolated", "device": "vmnet3"},
+		{"name": "isolated", "device": "vmnet4"},
+	}
+
+	expected := map[string]string{
+		"hostonly": "vmnet1",
+		"nat":      "vmnet8",
+		"lab":      "vmnet2",
+	}
+	for name, expected := range expected {
+		if device, err := netmap.NameIntoDevice(name); err != nil || device != expected {
+			t.Errorf("expected device %q for %q, got %q (%v)", expected, name, device, err)
+		}
+	}
 
-		_, err := operandParser(test[1:])
+	if device, err := netmap.NameIntoDevice("isolated"); err == nil {
+		t.Errorf("expected an error for an ambiguous name, got %q", device)
+	}
+
+	if device, err := netmap.NameIntoDevice("custom"); err == nil {
+		t.Errorf("expected an error for a missing name, got %q", device)
+	}
+}
+
+func TestParserNetworkingConfigQuotedAnswer(t *testing.T) {
+	config := readNetworkingConfigFromString(t, `VERSION=1,0
+answer VNET_8_NAT yes
+answer VNET_8_NAT_XLATE "some value with spaces"
+answer VNET_8_DHCP_CONF "C:\ProgramData\VMware\vmnetdhcp.conf"
+answer VNET_8_PATTERN "\d+ \w"
+`)
+
+	expected := map[string]string{
+		"NAT":       "yes",
+		"NAT_XLATE": "some value with spaces",
+		"DHCP_CONF": `C:\ProgramData\VMware\vmnetdhcp.conf`,
+		"PATTERN":   `\d+ \w`,
+	}
+	for key, value := range expected {
+		if result := config.answer[8][key]; result != value {
+			t.Errorf("expected key %s for VNET_%d to be %q, got %q", key, 8, value, result)
+		}
+	}
+}
+
+func TestParserNetworkingConfigAnswer(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "networking-example"))
+	if err != nil {
+		t.Fatalf("Unable to open networking-example sample: %s", err)
+	}
+	defer f.Close()
+
+	config, err := ReadNetworkingConfig(f)
+	if err != nil {
+		t.Fatalf("error parsing networking-example: %s", err)
+	}
+
+	if value, ok := config.Answer(8, "NAT"); !ok || value != "yes" {
+		t.Errorf("expected answer %s for VNET_%d to be %q, got %q (%v)", "NAT", 8, "yes", value, ok)
+	}
+	if value, ok := config.Answer(1, "HOSTONLY_SUBNET"); !ok || value != "192.168.70.0" {
+		t.Errorf("expected answer %s for VNET_%d to be %q, got %q (%v)", "HOSTONLY_SUBNET", 1, "192.168.70.0", value, ok)
+	}
+	if _, ok := config.Answer(8, "MISSING"); ok {
+		t.Errorf("expected answer %s for VNET_%d to be missing", "MISSING", 8)
+	}
+	if _, ok := config.Answer(2, "NAT"); ok {
+		t.Errorf("expected answer %s for VNET_%d to be missing", "NAT", 2)
+	}
+}
+
+func TestParserWriteNetworkingConfig(t *testing.T) {
+	config := readNetworkingConfigFromString(t, `VERSION=1,0
+add_nat_prefix 8 /24
+add_bridge_mapping en1 0
+answer VNET_8_NAT yes
+add_dhcp_mac_to_ip 8 00:50:56:00:00:02 172.16.41.130
+answer VNET_1_NAT no
+add_nat_portfwd 8 udp 53 172.16.41.129 53
+add_nat_portfwd 8 tcp 3389 172.16.41.131 3389
+answer VNET_1_DISPLAY_NAME "Host Only"
+add_nat_portfwd 8 tcp 2222 172.16.41.129 22
+answer VNET_8_DHCP yes
+add_dhcp_mac_to_ip 8 00:50:56:00:00:01 172.16.41.129
+add_nat_prefix 8 /16
+`)
+
+	expected := `VERSION=1,0
+add_bridge_mapping en1 0
+
+answer VNET_1_DISPLAY_NAME "Host Only"
+answer VNET_1_NAT no
+
+answer VNET_8_DHCP yes
+answer VNET_8_NAT yes
+add_nat_portfwd 8 tcp 2222 172.16.41.129 22
+add_nat_portfwd 8 tcp 3389 172.16.41.131 3389
+add_nat_portfwd 8 udp 53 172.16.41.129 53
+add_dhcp_mac_to_ip 8 00:50:56:00:00:01 172.16.41.129
+add_dhcp_mac_to_ip 8 00:50:56:00:00:02 172.16.41.130
+add_nat_prefix 8 /24
+add_nat_prefix 8 /16
+`
+	var written bytes.Buffer
+	if err := WriteNetworkingConfig(&written, config); err != nil {
+		t.Fatalf("error writing networking config: %s", err)
+	}
+	if written.String() != expected {
+		t.Errorf("unexpected networking config written:\n%s\nexpected:\n%s", written.String(), expected)
+	}
+
+	// Writing the configuration that was read back should be idempotent.
+	reread := readNetworkingConfigFromString(t, written.String())
+	var rewritten bytes.Buffer
+	if err := WriteNetworkingConfig(&rewritten, reread); err != nil {
+		t.Fatalf("error writing networking config: %s", err)
+	}
+	if rewritten.String() != written.String() {
+		t.Errorf("expected rewritten networking config to be identical:\n%s\nexpected:\n%s", rewritten.String(), written.String())
+	}
+}
+
+func TestParserWriteNetworkingConfigAnswerRoundTrip(t *testing.T) {
+	config := readNetworkingConfigFromString(t, "VERSION=1,0\n")
+
+	answers := map[string]string{
+		"DHCP_CONF":    `C:\Program Data\VMware\vmnetdhcp.conf`,
+		"DISPLAY_NAME": "Host Only",
+		"PATTERN":      `\d+`,
+		"QUOTED":       `"quoted"`,
+		"EMPTY":        "",
+	}
+	for key, value := range answers {
+		config.SetAnswer(8, key, value)
+	}
+
+	var written bytes.Buffer
+	if err := WriteNetworkingConfig(&written, config); err != nil {
+		t.Fatalf("error writing networking config: %s", err)
+	}
+	if !strings.Contains(written.String(), `answer VNET_8_DHCP_CONF "C:\Program Data\VMware\vmnetdhcp.conf"`) {
+		t.Errorf("expected the path to be written without escapes:\n%s", written.String())
+	}
+
+	reread := readNetworkingConfigFromString(t, written.String())
+	for key, expected := range answers {
+		if value, ok := reread.Answer(8, key); !ok || value != expected {
+			t.Errorf("expected answer %s to read back as %q, got %q (%v)", key, expected, value, ok)
+		}
+	}
+}
+
+func TestParserNetworkingConfigBridgeMappingConflicts(t *testing.T) {
+	config := readNetworkingConfigFromString(t, `VERSION=1,0
+add_bridge_mapping eth0 2
+add_bridge_mapping eth0 3
+add_bridge_mapping eth1 0
+remove_bridge_mapping eth1
+add_bridge_mapping eth1 4
+add_bridge_mapping eth2 3
+`)
+
+	expected := []string{
+		"interface eth0 is bridged to both vmnet2 and vmnet3",
+		"vmnet3 is bridged to multiple interfaces: eth0, eth2",
+	}
+	if conflicts := config.BridgeMappingConflicts(); !compareSlice(conflicts, expected) {
+		t.Errorf("expected conflicts %v, got %v", expected, conflicts)
+	}
+
+	config = readNetworkingConfigFromString(t, `VERSION=1,0
+add_bridge_mapping eth0 2
+add_bridge_mapping eth0 2
+add_bridge_mapping eth1 3
+`)
+	if conflicts := config.BridgeMappingConflicts(); len(conflicts) != 0 {
+		t.Errorf("expected no conflicts, got %v", conflicts)
+	}
+}
+
+func TestParserNetworkingConfigDhcpReservationConflicts(t *testing.T) {
+	config := readNetworkingConfigFromString(t, `VERSION=1,0
+add_dhcp_mac_to_ip 8 00:50:56:00:00:01 172.16.41.10
+add_dhcp_mac_to_ip 8 00:50:56:00:00:01 172.16.41.11
+add_dhcp_mac_to_ip 8 00:50:56:00:00:02 172.16.41.20
+remove_dhcp_mac_to_ip 8 00:50:56:00:00:02
+add_dhcp_mac_to_ip 8 00:50:56:00:00:02 172.16.41.21
+add_dhcp_mac_to_ip 1 00:50:56:00:00:01 192.168.1.10
+`)
+
+	expected := []string{
+		"hardware address 00:50:56:00:00:01 on vmnet8 is reserved both 172.16.41.10 and 172.16.41.11",
+	}
+	if conflicts := config.DhcpReservationConflicts(); !compareSlice(conflicts, expected) {
+		t.Errorf("expected conflicts %v, got %v", expected, conflicts)
+	}
+
+	// Repeating a reservation is only redundant.
+	config = readNetworkingConfigFromString(t, `VERSION=1,0
+add_dhcp_mac_to_ip 8 00:50:56:00:00:01 172.16.41.10
+add_dhcp_mac_to_ip 8 00:50:56:00:00:01 172.16.41.10
+add_dhcp_mac_to_ip 8 00:50:56:00:00:02 172.16.41.20
+`)
+	if conflicts := config.DhcpReservationConflicts(); len(conflicts) != 0 {
+		t.Errorf("expected no conflicts, got %v", conflicts)
+	}
+
+	// Reservations made through the configuration are also tracked.
+	mac, _ := net.ParseMAC("00:50:56:00:00:02")
+	config.AddDhcpMacToIp(8, mac, net.ParseIP("172.16.41.22"))
+	expected = []string{
+		"hardware address 00:50:56:00:00:02 on vmnet8 is reserved both 172.16.41.20 and 172.16.41.22",
+	}
+	if conflicts := config.DhcpReservationConflicts(); !compareSlice(conflicts, expected) {
+		t.Errorf("expected conflicts %v, got %v", expected, conflicts)
+	}
+}
+
+func TestParserNormalizeMAC(t *testing.T) {
+	expected := "00:50:56:0a:0b:0c"
+	for _, input := range []string{
+		"00:50:56:0a:0b:0c",
+		"0:50:56:a:b:c",
+		"00:50:56:0A:0B:0C",
+		"0:50:56:A:B:C",
+		"00-50-56-0A-0B-0C",
+	} {
+		mac, err := parseMAC(input)
 		if err != nil {
-			t.Errorf("test %d unable to parse command parameters %#v: %v", 1+testnum, test, err)
+			t.Fatalf("Unable to parse hardware address %s: %s", input, err)
+		}
+		if result := normalizeMAC(mac); result != expected {
+			t.Errorf("expected %s to normalize to %s, got %s", input, expected, result)
 		}
 	}
+
+	if _, err := parseMAC("0:50:56:a:b"); err == nil {
+		t.Errorf("expected an error for a short hardware address")
+	}
+
+	// A reservation written in one form can be removed in another.
+	config := readNetworkingConfigFromString(t, `VERSION=1,0
+add_dhcp_mac_to_ip 8 0:50:56:A:B:C 172.16.41.10
+add_dhcp_mac_to_ip 8 00:50:56:0a:0b:0c 172.16.41.11
+`)
+	conflicts := []string{"hardware address 00:50:56:0a:0b:0c on vmnet8 is reserved both 172.16.41.10 and 172.16.41.11"}
+	if result := config.DhcpReservationConflicts(); !compareSlice(result, conflicts) {
+		t.Errorf("expected conflicts %v, got %v", conflicts, result)
+	}
+
+	mac, _ := parseMAC("00:50:56:0A:0B:0C")
+	if !config.RemoveDhcpMacToIp(8, mac) {
+		t.Errorf("expected the reservation of %s to be removed", mac)
+	}
 }
 
-func TestParserReadNetworingConfig(t *testing.T) {
-	expectedAnswerVnet1 := map[string]string{
-		"DHCP":             "yes",
-		"DHCP_CFG_HASH":    "01F4CE0D79A1599698B6E5814CCB68058BB0ED5E",
-		"HOSTONLY_NETMASK": "255.255.255.0",
-		"HOSTONLY_SUBNET":  "192.168.70.0",
-		"NAT":              "no",
-		"VIRTUAL_ADAPTER":  "yes",
+func TestParserNetworkingConfigNatPrefixes(t *testing.T) {
+	config := readNetworkingConfigFromString(t, `VERSION=1,0
+answer VNET_8_HOSTONLY_NETMASK 255.255.255.0
+answer VNET_8_HOSTONLY_SUBNET 172.16.41.0
+answer VNET_8_NAT yes
+add_nat_prefix 8 /16
+add_nat_prefix 8 /8
+add_nat_prefix 2 /24
+`)
+
+	if prefixes := config.NatPrefixes(8); !reflect.DeepEqual(prefixes, []int{16, 8}) {
+		t.Errorf("expected prefixes %v for %s%d, got %v", []int{16, 8}, NetworkingInterfacePrefix, 8, prefixes)
+	}
+	if prefixes := config.NatPrefixes(1); len(prefixes) != 0 {
+		t.Errorf("expected no prefixes for %s%d, got %v", NetworkingInterfacePrefix, 1, prefixes)
+	}
+
+	cidrs, err := config.NatPrefixCIDRs(8)
+	if err != nil {
+		t.Fatalf("Unable to retrieve the prefixes for %s%d: %s", NetworkingInterfacePrefix, 8, err)
+	}
+	var result []string
+	for _, cidr := range cidrs {
+		result = append(result, cidr.String())
 	}
+	if expected := []string{"172.16.0.0/16", "172.0.0.0/8"}; !compareSlice(result, expected) {
+		t.Errorf("expected prefixes %v for %s%d, got %v", expected, NetworkingInterfacePrefix, 8, result)
+	}
+
+	// vmnet2 has prefixes but no subnet to apply them to.
+	if _, err := config.NatPrefixCIDRs(2); err == nil {
+		t.Errorf("expected an error for %s%d without a subnet", NetworkingInterfacePrefix, 2)
+	}
+}
 
+func TestParserNetworkingConfigVmnetForSubnet(t *testing.T) {
 	f, err := os.Open(filepath.Join("testdata", "networking-example"))
 	if err != nil {
 		t.Fatalf("Unable to open networking-example sample: %s", err)
@@ -1217,71 +4851,376 @@ func TestParserReadNetworingConfig(t *testing.T) {
 		t.Fatalf("error parsing networking-example: %s", err)
 	}
 
-	if vnet, ok := config.answer[1]; ok {
-		for answerKey := range expectedAnswerVnet1 {
-			result, ok := vnet[answerKey]
-			if !ok {
-				t.Errorf("unable to find key %s in VNET_%d answer", answerKey, 1)
-				continue
-			}
+	for cidr, expected := range map[string]int{
+		"192.168.70.0/24": 1,
+		"172.16.41.0/24":  8,
+	} {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Unable to parse subnet %s: %s", cidr, err)
+		}
+		vmnet, err := config.VmnetForSubnet(*subnet)
+		if err != nil {
+			t.Errorf("Unable to find the vmnet for subnet %s: %s", cidr, err)
+		} else if vmnet != expected {
+			t.Errorf("expected subnet %s to belong to %s%d, got %s%d", cidr, NetworkingInterfacePrefix, expected, NetworkingInterfacePrefix, vmnet)
+		}
+	}
 
-			if result != expectedAnswerVnet1[answerKey] {
-				t.Errorf("expected key %s for VNET_%d to be %v, got %v", answerKey, 1, expectedAnswerVnet1[answerKey], result)
-			}
+	for _, cidr := range []string{"10.0.0.0/24", "192.168.70.0/16"} {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Unable to parse subnet %s: %s", cidr, err)
 		}
+		if vmnet, err := config.VmnetForSubnet(*subnet); err == nil {
+			t.Errorf("expected no vmnet for subnet %s, got %s%d", cidr, NetworkingInterfacePrefix, vmnet)
+		}
+	}
+}
 
-	} else {
-		t.Errorf("unable to find VNET_%d answer", 1)
+func TestParserNetworkingConfigWaitForInterfaces(t *testing.T) {
+	config := readNetworkingConfigFromString(t, `VERSION=1,0
+add_bridge_mapping eth0 2
+add_bridge_mapping usb0 3
+`)
+
+	// The usb0 interface only appears on the third poll.
+	polls := 0
+	interfaces := func() ([]net.Interface, error) {
+		polls++
+		result := []net.Interface{{Name: "eth0"}}
+		if polls >= 3 {
+			result = append(result, net.Interface{Name: "usb0"})
+		}
+		return result, nil
 	}
 
-	expectedAnswerVnet8 := map[string]string{
-		"DHCP":             "yes",
-		"DHCP_CFG_HASH":    "C30F14F65A0FE4B5DCC6C67497D7A8A33E5E538C",
-		"HOSTONLY_NETMASK": "255.255.255.0",
-		"HOSTONLY_SUBNET":  "172.16.41.0",
-		"NAT":              "yes",
-		"VIRTUAL_ADAPTER":  "yes",
+	if err := config.waitForInterfaces(context.Background(), 5*time.Second, interfaces); err != nil {
+		t.Fatalf("Unable to wait for interfaces: %s", err)
+	}
+	if polls != 3 {
+		t.Errorf("expected 3 polls, got %d", polls)
 	}
 
-	if vnet, ok := config.answer[8]; ok {
-		for answerKey := range expectedAnswerVnet8 {
-			result, ok := vnet[answerKey]
-			if !ok {
-				t.Errorf("unable to find key %s in VNET_%d answer", answerKey, 8)
-				continue
-			}
+	// The usb0 interface never appears.
+	interfaces = func() ([]net.Interface, error) {
+		return []net.Interface{{Name: "eth0"}}, nil
+	}
 
-			if result != expectedAnswerVnet8[answerKey] {
-				t.Errorf("expected key %s for VNET_%d to be %v, got %v", answerKey, 8, expectedAnswerVnet8[answerKey], result)
-			}
+	err := config.waitForInterfaces(context.Background(), 100*time.Millisecond, interfaces)
+	if err == nil {
+		t.Fatalf("expected an error waiting for a missing interface")
+	}
+	if !strings.Contains(err.Error(), "usb0") || strings.Contains(err.Error(), "eth0") {
+		t.Errorf("expected error to name only usb0, got %s", err)
+	}
+}
+
+func TestParserNetworkingConfigMutations(t *testing.T) {
+	config := NewNetworkingConfig()
+	host := net.ParseIP("172.16.41.129")
+	mac, _ := net.ParseMAC("00:50:56:00:00:01")
+
+	tests := []struct {
+		name     string
+		mutate   func() bool
+		expected bool
+	}{
+		{"set answer", func() bool { return config.SetAnswer(8, "NAT", "yes") }, true},
+		{"set same answer", func() bool { return config.SetAnswer(8, "NAT", "yes") }, false},
+		{"change answer", func() bool { return config.SetAnswer(8, "NAT", "no") }, true},
+		{"remove answer", func() bool { return config.RemoveAnswer(8, "NAT") }, true},
+		{"remove missing answer", func() bool { return config.RemoveAnswer(8, "NAT") }, false},
+
+		{"add port forward", func() bool { return config.AddNatPortForward(8, "tcp", 2222, host, 22) }, true},
+		{"add duplicate port forward", func() bool { return config.AddNatPortForward(8, "tcp", 2222, host, 22) }, false},
+		{"change port forward", func() bool { return config.AddNatPortForward(8, "tcp", 2222, host, 2222) }, true},
+		{"remove port forward", func() bool { return config.RemoveNatPortForward(8, "tcp", 2222) }, true},
+		{"remove missing port forward", func() bool { return config.RemoveNatPortForward(8, "tcp", 2222) }, false},
+
+		{"add reservation", func() bool { return config.AddDhcpMacToIp(8, mac, host) }, true},
+		{"add duplicate reservation", func() bool { return config.AddDhcpMacToIp(8, mac, host) }, false},
+		{"remove reservation", func() bool { return config.RemoveDhcpMacToIp(8, mac) }, true},
+		{"remove missing reservation", func() bool { return config.RemoveDhcpMacToIp(8, mac) }, false},
+
+		{"add bridge mapping", func() bool { return config.AddBridgeMapping("eth0", 0) }, true},
+		{"add duplicate bridge mapping", func() bool { return config.AddBridgeMapping("eth0", 0) }, false},
+		{"remove bridge mapping", func() bool { return config.RemoveBridgeMapping("eth0") }, true},
+		{"remove missing bridge mapping", func() bool { return config.RemoveBridgeMapping("eth0") }, false},
+
+		{"add prefix", func() bool { return config.AddNatPrefix(8, 24) }, true},
+		{"add duplicate prefix", func() bool { return config.AddNatPrefix(8, 24) }, false},
+		{"remove prefix", func() bool { return config.RemoveNatPrefix(8, 24) }, true},
+		{"remove missing prefix", func() bool { return config.RemoveNatPrefix(8, 24) }, false},
+	}
+	for _, test := range tests {
+		if changed := test.mutate(); changed != test.expected {
+			t.Errorf("%s: expected changed to be %v, got %v", test.name, test.expected, changed)
 		}
+	}
 
-	} else {
-		t.Errorf("unable to find VNET_%d answer", 8)
+	// A zero configuration can be mutated, and the result is written in the
+	// same form as a parsed one.
+	var zero NetworkingConfig
+	zero.SetAnswer(8, "NAT", "yes")
+	zero.AddNatPortForward(8, "tcp", 2222, host, 22)
+	zero.AddDhcpMacToIp(8, mac, host)
+
+	var written bytes.Buffer
+	if err := WriteNetworkingConfig(&written, zero); err != nil {
+		t.Fatalf("error writing networking config: %s", err)
+	}
+	expected := `VERSION=1,0
+answer VNET_8_NAT yes
+add_nat_portfwd 8 tcp 2222 172.16.41.129 22
+add_dhcp_mac_to_ip 8 00:50:56:00:00:01 172.16.41.129
+`
+	if written.String() != expected {
+		t.Errorf("unexpected networking config written:\n%s\nexpected:\n%s", written.String(), expected)
 	}
+}
 
-	expectedNatPortFwd8 := map[string]string{
-		"tcp/2200":  "172.16.41.129:3389",
-		"tcp/2201":  "172.16.41.129:3389",
-		"tcp/2222":  "172.16.41.129:22",
-		"tcp/3389":  "172.16.41.131:3389",
-		"tcp/55985": "172.16.41.129:5985",
-		"tcp/55986": "172.16.41.129:5986",
+func TestParserNetworkingConfigDhcpConf(t *testing.T) {
+	path, err := filepath.Abs(filepath.Join("testdata", "dhcpd-example.conf"))
+	if err != nil {
+		t.Fatalf("Unable to find dhcpd-example.conf sample: %s", err)
 	}
 
-	if vnet, ok := config.natPortFwd[8-1]; ok {
-		for natKey := range expectedNatPortFwd8 {
-			result, ok := vnet[natKey]
-			if !ok {
-				t.Errorf("unable to find key %s in VNET_%d nat_portfwd", natKey, 8)
-				continue
-			}
+	config := readNetworkingConfigFromString(t, fmt.Sprintf(`VERSION=1,0
+answer VNET_1_DHCP yes
+answer VNET_1_DHCP_CONF %q
+answer VNET_8_DHCP yes
+`, path))
 
-			if result != expectedNatPortFwd8[natKey] {
-				t.Errorf("expected key %s for VNET_%d to be %v, got %v", natKey, 8, expectedNatPortFwd8[natKey], result)
-			}
+	if value, ok := config.DhcpConfPath(1); !ok || value != path {
+		t.Errorf("expected dhcp configuration path for VNET_%d to be %q, got %q (%v)", 1, path, value, ok)
+	}
+
+	dhcpConfig, err := config.LoadDhcpConf(1)
+	if err != nil {
+		t.Fatalf("error loading dhcp configuration for VNET_%d: %s", 1, err)
+	}
+	if _, err := dhcpConfig.HostByName("vmnet8"); err != nil {
+		t.Errorf("expected loaded dhcp configuration to contain host: %s", err)
+	}
+
+	if _, ok := config.DhcpConfPath(8); ok {
+		t.Errorf("expected dhcp configuration path for VNET_%d to be missing", 8)
+	}
+	if _, err := config.LoadDhcpConf(8); err == nil {
+		t.Errorf("expected an error loading a missing dhcp configuration for VNET_%d", 8)
+	}
+
+	f, err := os.Open(filepath.Join("testdata", "networking-example"))
+	if err != nil {
+		t.Fatalf("Unable to open networking-example sample: %s", err)
+	}
+	defer f.Close()
+
+	example, err := ReadNetworkingConfig(f)
+	if err != nil {
+		t.Fatalf("error parsing networking-example: %s", err)
+	}
+	for _, vmnet := range example.Vmnets() {
+		if _, ok := example.DhcpConfPath(vmnet); ok {
+			t.Errorf("expected dhcp configuration path for VNET_%d to be missing", vmnet)
 		}
-	} else {
-		t.Errorf("unable to find VNET_%d answer", 8-1)
 	}
 }
+
+func TestParserReadAll(t *testing.T) {
+	specs := []FileSpec{
+		{Path: filepath.Join("testdata", "dhcpd-example.conf"), Format: FileFormatDhcpConfig},
+		{Path: filepath.Join("testdata", "dhcpd-example.leases"), Format: FileFormatDhcpLeases},
+		{Path: filepath.Join("testdata", "apple-dhcpd-example.leases"), Format: FileFormatAppleDhcpLeases},
+		{Path: filepath.Join("testdata", "networking-example"), Format: FileFormatNetworking},
+		{Path: filepath.Join("testdata", "netmap-example.conf"), Format: FileFormatNetmap},
+	}
+
+	results, err := ReadAllWithLimit(specs, 2)
+	if err != nil {
+		t.Fatalf("error reading files concurrently: %s", err)
+	}
+	if len(results) != len(specs) {
+		t.Fatalf("expected %d results, got %d", len(specs), len(results))
+	}
+
+	// The results should match what is read sequentially.
+	for i, spec := range specs {
+		expected := readFileSpec(spec)
+		if expected.Err != nil {
+			t.Fatalf("error reading %s sequentially: %s", spec.Path, expected.Err)
+		}
+		if results[i].Spec != spec {
+			t.Errorf("expected result %d to be for %v, got %v", i, spec, results[i].Spec)
+		}
+		if !reflect.DeepEqual(results[i], expected) {
+			t.Errorf("expected concurrent result for %s to match sequential result", spec.Path)
+		}
+	}
+
+	if len(results[0].DhcpConfig) == 0 || len(results[1].DhcpLeases) == 0 || len(results[2].AppleDhcpLeases) == 0 {
+		t.Errorf("expected entries to be parsed from every file")
+	}
+}
+
+func TestParserReadAllErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.conf")
+	specs := []FileSpec{
+		{Path: filepath.Join("testdata", "networking-example"), Format: FileFormatNetworking},
+		{Path: filepath.Join("testdata", "dhcpd-invalid.conf"), Format: FileFormatDhcpConfig},
+		{Path: missing, Format: FileFormatDhcpConfig},
+		{Path: filepath.Join("testdata", "dhcpd-example.conf"), Format: FileFormatDhcpConfig},
+	}
+
+	results, err := ReadAll(specs)
+	if err == nil {
+		t.Fatalf("expected an error reading invalid files")
+	}
+
+	for i, failed := range []bool{false, true, true, false} {
+		if (results[i].Err != nil) != failed {
+			t.Errorf("expected error for %s to be %v, got %v", specs[i].Path, failed, results[i].Err)
+		}
+		if failed && !strings.Contains(err.Error(), specs[i].Path) {
+			t.Errorf("expected error to name %s, got %s", specs[i].Path, err)
+		}
+		if !failed && strings.Contains(err.Error(), specs[i].Path+":") {
+			t.Errorf("expected error not to name %s, got %s", specs[i].Path, err)
+		}
+	}
+}
+
+func TestParserNetworkingPath(t *testing.T) {
+	env := map[string]string{"ProgramData": `C:\ProgramData`}
+	getenv := func(key string) string { return env[key] }
+
+	expected := map[string]string{
+		osMacOS:   filepath.Join("/", "Library", "Preferences", "VMware Fusion", "networking"),
+		osLinux:   filepath.Join("/etc/vmware", "networking"),
+		osWindows: filepath.Join(`C:\ProgramData`, "VMware", "networking"),
+	}
+	for goos, want := range expected {
+		path, err := networkingPath(goos, getenv)
+		if err != nil {
+			t.Errorf("Unable to resolve the networking path for %s: %s", goos, err)
+			continue
+		}
+		if path != want {
+			t.Errorf("expected networking path for %s to be %q, got %q", goos, want, path)
+		}
+	}
+
+	if _, err := networkingPath(osWindows, func(string) string { return "" }); err == nil {
+		t.Errorf("expected an error resolving the networking path without ProgramData")
+	}
+	if _, err := networkingPath("plan9", getenv); err == nil {
+		t.Errorf("expected an error resolving the networking path for an unsupported operating system")
+	}
+}
+
+// The parsers must never panic or hang on arbitrary input. Fuzzing them
+// turned the following panics into errors: a range statement without an
+// address, a range6 statement with an invalid prefix, a declaration without a
+// hardware address when calling Hardware, and a configuration without a global
+// scope when calling Global.
+
+// fuzzParserFile writes the fuzzed input to a file for the parsers to read.
+func fuzzParserFile(t *testing.T, data []byte) *os.File {
+	path := filepath.Join(t.TempDir(), "input")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Unable to write input: %s", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unable to open input: %s", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// fuzzParserTerminates runs a parser, failing if it doesn't return in time.
+func fuzzParserTerminates(t *testing.T, parse func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		parse()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("parser did not terminate")
+	}
+}
+
+// fuzzParserSeed adds the contents of a fixture to the corpus.
+func fuzzParserSeed(f *testing.F, name string) {
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		f.Fatalf("Unable to read %s: %s", name, err)
+	}
+	f.Add(data)
+}
+
+func FuzzReadDhcpConfiguration(f *testing.F) {
+	fuzzParserSeed(f, "dhcpd-example.conf")
+	fuzzParserSeed(f, "dhcpd-invalid.conf")
+	f.Add([]byte(`subnet 10.0.0.0 netmask 255.0.0.0 { range 10.0.0.1 10.0.0.2; }`))
+	f.Add([]byte(`host "unterminated { hardware ethernet 00:50:56:00:00:01; }`))
+	f.Add([]byte(`}}{{ option routers`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fd := fuzzParserFile(t, data)
+		fuzzParserTerminates(t, func() {
+			config, err := ReadDhcpConfiguration(fd)
+			if err != nil {
+				return
+			}
+
+			// Exercise the accessors on whatever was parsed.
+			_ = config.String()
+			if global, err := config.Global(); err == nil {
+				_, _ = global.Router()
+			}
+			_ = config.Validate()
+			for _, entry := range config {
+				_, _ = entry.IP4Literal()
+				_, _ = entry.IP6Literal()
+				_, _ = entry.Hardware()
+			}
+		})
+	})
+}
+
+func FuzzReadNetworkingConfig(f *testing.F) {
+	fuzzParserSeed(f, "networking-example")
+	f.Add([]byte("VERSION=1,0\nanswer VNET_1_DHCP \"yes\n"))
+	f.Add([]byte("VERSION=1,0\nadd_nat_portfwd 8\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fd := fuzzParserFile(t, data)
+		fuzzParserTerminates(t, func() {
+			config, err := ReadNetworkingConfig(fd)
+			if err != nil {
+				return
+			}
+			_ = WriteNetworkingConfig(io.Discard, config)
+			_ = config.BridgeMappingConflicts()
+		})
+	})
+}
+
+func FuzzReadDhcpdLeaseEntries(f *testing.F) {
+	fuzzParserSeed(f, "dhcpd-example.leases")
+	f.Add([]byte("lease 10.0.0.1 {\n  starts 4 2019/01/01 00:00:00;\n"))
+	f.Add([]byte("lease {\n}\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fd := fuzzParserFile(t, data)
+		fuzzParserTerminates(t, func() {
+			_, _ = ReadDhcpdLeaseEntries(fd)
+		})
+	})
+}
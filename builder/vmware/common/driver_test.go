@@ -0,0 +1,55 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeOvfTool writes a script that prints the given output, and records each
+// time that it is run.
+func fakeOvfTool(t *testing.T, output string) (string, string) {
+	if runtime.GOOS == osWindows {
+		t.Skip("fake ovftool requires a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, appOvfTool)
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho run >> " + calls + "\necho '" + output + "'\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return path, calls
+}
+
+func TestProbeOvfToolVersion(t *testing.T) {
+	path, calls := fakeOvfTool(t, "VMware ovftool 4.6.3 (build-24031167)")
+
+	for i := 0; i < 2; i++ {
+		v, err := ProbeOvfToolVersion(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "4.6.3", v)
+	}
+
+	// The result should have been cached after the first probe.
+	data, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.Equal(t, 1, strings.Count(string(data), "run"))
+}
+
+func TestProbeOvfToolVersion_unknown(t *testing.T) {
+	path, _ := fakeOvfTool(t, "VMware ovftool")
+
+	_, err := ProbeOvfToolVersion(path)
+	assert.EqualError(t, err, "unable to determine the version of ovftool")
+}
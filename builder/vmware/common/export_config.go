@@ -10,6 +10,7 @@ import (
 	"slices"
 	"strings"
 
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
 	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
 )
 
@@ -51,8 +52,9 @@ type ExportConfig struct {
 	//
 	// ~> **Important:** The options `--noSSLVerify`, `--skipManifestCheck`, and
 	// `--targetType` are automatically applied by the plugin for remote exports
-	// and should not be included in the options. For local OVF/OVA exports,
-	// the plugin does not preset any VMware OVF Tool options by default.
+	// and should not be included in the options. Use `skip_ssl_verify` to
+	// control `--noSSLVerify`. For local OVF/OVA exports, the plugin does not
+	// preset any VMware OVF Tool options by default.
 	//
 	// ~> **Note:** Ensure VMware OVF Tool is installed. For the latest version,
 	// visit [VMware OVF Tool](https://developer.broadcom.com/tools/open-virtualization-format-ovf-tool/latest).
@@ -61,6 +63,18 @@ type ExportConfig struct {
 	// output is not the resultant image, but created inside the virtual
 	// machine. This is useful for debugging purposes. Defaults to `false`.
 	SkipExport bool `mapstructure:"skip_export" required:"false"`
+	// Skips the verification of the certificate of the remote hypervisor when
+	// exporting the virtual machine with VMware OVF Tool. Set this to `false`
+	// in environments that require certificate validation, in which case the
+	// certificate must be trusted by the system running the build. Defaults
+	// to `true`.
+	SkipSSLVerify config.Trilean `mapstructure:"skip_ssl_verify" required:"false"`
+	// The inventory path of the virtual machine on the remote hypervisor
+	// that is exported with VMware OVF Tool, such as
+	// `datacenter/vm/folder/name`. Set this when the virtual machine is
+	// organized in folders. Defaults to the display name of the virtual
+	// machine.
+	RemoteInventoryPath string `mapstructure:"remote_inventory_path" required:"false"`
 	// Determines whether a virtual machine built on a remote hypervisor should
 	// remain registered after the build process. Setting this to `true` can be
 	// useful if the virtual machine does not need to be exported. Defaults to
@@ -39,7 +39,8 @@ type HWConfig struct {
 	MemorySize int `mapstructure:"memory" required:"false"`
 	// The network which the virtual machine will connect for local desktop
 	// hypervisors. Use the generic values that map to a device, such as
-	// `hostonly`, `nat`, or `bridged`. Defaults to `nat`.
+	// `hostonly`, `nat`, or `bridged`. The aliases `host-only` and `bridge`
+	// are also accepted. Defaults to `nat`.
 	//
 	// ~> **Note:** If not set to one of these generic values, then it is
 	// assumed to be a network device (_e.g._, `VMnet0..x`).
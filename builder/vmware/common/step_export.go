@@ -4,17 +4,52 @@
 package common
 
 import (
+	"archive/tar"
+	"bufio"
 	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"log"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
 )
 
+// exportPowerOffTimeout is the maximum time to wait for the virtual machine
+// to power off before exporting it.
+const exportPowerOffTimeout = 2 * time.Minute
+
+// The ovftool options that set the timeouts of a remote export, in whole
+// seconds. These are advanced options, which are prefixed with --X: and
+// aren't covered by the OVF Tool User's Guide; the ones accepted by an
+// installed ovftool are listed by `ovftool --help debug`.
+const (
+	ovftoolConnectTimeoutOption   = "--X:connectTimeout"
+	ovftoolOperationTimeoutOption = "--X:operationTimeout"
+)
+
+// ovftoolExtraConfigOption is the ovftool option that adds an entry to the
+// extra configuration of the exported virtual machine.
+const ovftoolExtraConfigOption = "--extraConfig"
+
+// extraConfigKeyRe matches the keys that are accepted for ExtraConfig.
+var extraConfigKeyRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
 // StepExport represents a step to export a virtual machines to specific formats.
 type StepExport struct {
 	Format         string
@@ -22,36 +57,697 @@ type StepExport struct {
 	VMName         string
 	OVFToolOptions []string
 	OutputDir      *string
+
+	// AutoPowerOff powers off the virtual machine if it is still running
+	// when the export begins, instead of failing the step.
+	AutoPowerOff bool
+
+	// CleanupOnFailure removes any files left in the export output path by a
+	// failed export. Files that existed before the export are preserved. The
+	// builders enable this by default.
+	CleanupOnFailure bool
+
+	// UseNativeVmxCopy exports the vmx format by copying the virtual machine
+	// files instead of running ovftool. This is also done when the format is
+	// vmx and ovftool is not installed.
+	UseNativeVmxCopy bool
+
+	// IncludeFiles limits a native vmx copy to the files whose names match
+	// one of the glob patterns. All files are copied if it's empty.
+	IncludeFiles []string
+
+	// ExcludeFiles skips the files whose names match one of the glob patterns
+	// during a native vmx copy. If it's empty, then transient files such as
+	// logs and suspend state are skipped.
+	ExcludeFiles []string
+
+	// OutputWriter, if set, receives the exported bytes of an ova export
+	// instead of them being written to the export output path.
+	OutputWriter io.Writer
+
+	// SkipSSLVerify skips the verification of the certificate of the remote
+	// hypervisor. This is done unless it's explicitly set to false.
+	SkipSSLVerify config.Trilean
+
+	// RemoteInventoryPath is the inventory path of the virtual machine on the
+	// remote hypervisor, such as `datacenter/vm/folder/name`. The display
+	// name of the virtual machine is used if it's empty.
+	RemoteInventoryPath string
+
+	// VerifyManifest checks the digests listed in the manifest of an ovf or
+	// ova export against the exported files, and fails the step if any of
+	// them do not match.
+	VerifyManifest bool
+
+	// AlsoUnpackOva unpacks an ova export into a directory next to it, named
+	// after the virtual machine with an `-ovf` suffix, so that both the ova
+	// and its ovf and disk files are available.
+	AlsoUnpackOva bool
+
+	// ConnectTimeout and OperationTimeout tune how long ovftool waits to
+	// connect to the remote hypervisor and for each operation on it during a
+	// remote export. They're passed to ovftool in whole seconds, and its
+	// defaults are used when they're unset.
+	ConnectTimeout   time.Duration
+	OperationTimeout time.Duration
+
+	// ExtraConfig tags the exported virtual machine with metadata, such as a
+	// build id or commit. Each pair is passed to ovftool as
+	// `--extraConfig:<key>=<value>`, which stores it in the extra
+	// configuration of the virtual machine in the descriptor. Keys may only
+	// contain letters, digits, `.`, `_`, and `-`, and values may not contain
+	// quotes, control characters, or shell metacharacters.
+	ExtraConfig map[string]string
+
+	// OutputName is the file name of the export, such as `build.ova`, which
+	// otherwise defaults to VMName. When Format is empty, the format is
+	// inferred from its extension, which may be `.ova`, `.ovf`, or `.vmx`.
+	// When both are set, they must agree.
+	OutputName string
+
+	exportOutputPath string
+	existingFiles    map[string]bool
+	exportFailed     bool
 }
 
-func (s *StepExport) generateRemoteExportArgs(c *DriverConfig, displayName string, hidePassword bool, exportOutputPath string) ([]string, error) {
+// StateExportResult is the key of the ExportResult that StepExport stores in
+// the state bag after a successful export.
+const StateExportResult = "export_result"
+
+// StateExportOutputFile is the key of the absolute path of the primary file
+// produced by a successful export, which StepExport stores in the state bag.
+// This is the ovf descriptor or ova archive, or the vmx for a vmx export. It
+// isn't stored for a streamed export.
+const StateExportOutputFile = "export_output_file"
+
+// ExportResult describes the artifact produced by a successful export, so
+// that later steps and post-processors don't have to rediscover it.
+type ExportResult struct {
+	// Format is the format of the export, such as `ova`.
+	Format string
+	// Path is the exported ovf or ova file, or the directory of the virtual
+	// machine files for a vmx export. It's empty for a streamed export.
+	Path string
+	// Files are the paths of the files that make up the export.
+	Files []string
+	// Size is the total size of the files in bytes.
+	Size int64
+	// Checksum is the SHA-256 digest of the ovf or ova file in hex. It's
+	// empty for a vmx or streamed export.
+	Checksum string
+	// Duration is how long the export took.
+	Duration time.Duration
+	// Unpacked describes the ovf files that an ova export was unpacked to,
+	// if it was.
+	Unpacked *ExportResult
+}
+
+// ManifestMismatchError is returned when the digest of an exported file does
+// not match the one listed in the manifest.
+type ManifestMismatchError struct {
+	File      string
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *ManifestMismatchError) Error() string {
+	return fmt.Sprintf("%s digest of %s does not match the manifest: expected %s, got %s", e.Algorithm, e.File, e.Expected, e.Actual)
+}
+
+// manifestEntry is a single line of a manifest, such as
+// `SHA256(vm.ovf)= 0123...`.
+type manifestEntry struct {
+	algorithm string
+	file      string
+	digest    string
+}
+
+var manifestLineRe = regexp.MustCompile(`^(SHA1|SHA256|SHA512)\((.+)\)\s*=\s*([0-9a-fA-F]+)$`)
+
+// parseManifest reads the entries of a manifest.
+func parseManifest(r io.Reader) ([]manifestEntry, error) {
+	var entries []manifestEntry
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
 
-	ovftoolUri := fmt.Sprintf("vi://%s/%s", c.RemoteHost, displayName)
-	u, err := url.Parse(ovftoolUri)
+		matches := manifestLineRe.FindStringSubmatch(line)
+		if matches == nil {
+			return nil, fmt.Errorf("unable to parse manifest line: %s", line)
+		}
+		entries = append(entries, manifestEntry{
+			algorithm: matches[1],
+			file:      matches[2],
+			digest:    strings.ToLower(matches[3]),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// newManifestHash returns the hash for an algorithm used by a manifest.
+func newManifestHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "SHA1":
+		return sha1.New()
+	case "SHA512":
+		return sha512.New()
+	default:
+		return sha256.New()
+	}
+}
+
+// checkManifestEntry compares a digest against the manifest entry for a file.
+func checkManifestEntry(entry manifestEntry, digest string) error {
+	if digest != entry.digest {
+		return &ManifestMismatchError{
+			File:      entry.file,
+			Algorithm: entry.algorithm,
+			Expected:  entry.digest,
+			Actual:    digest,
+		}
+	}
+	return nil
+}
+
+// verifyOvfManifest checks the files of an ovf export against the manifest
+// written alongside them.
+func verifyOvfManifest(dir string, name string) error {
+	f, err := os.Open(filepath.Join(dir, name+".mf"))
 	if err != nil {
-		return []string{}, err
+		return err
+	}
+	defer f.Close()
+
+	entries, err := parseManifest(f)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		// Refuse anything that would be read from outside of the directory.
+		if !filepath.IsLocal(entry.file) {
+			return fmt.Errorf("invalid file name %q in %s", entry.file, name+".mf")
+		}
+
+		h := newManifestHash(entry.algorithm)
+		if err := hashFile(h, filepath.Join(dir, entry.file)); err != nil {
+			return err
+		}
+		if err := checkManifestEntry(entry, hex.EncodeToString(h.Sum(nil))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashFile writes the contents of a file to a hash.
+func hashFile(h hash.Hash, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// verifyOvaManifest checks the files within an ova export against the
+// manifest contained in the archive.
+func verifyOvaManifest(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The manifest isn't necessarily the first file in the archive, so
+	// compute every digest it could list while reading through it once.
+	var entries []manifestEntry
+	var found bool
+	digests := make(map[string]map[string]string)
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if strings.HasSuffix(hdr.Name, ".mf") {
+			if entries, err = parseManifest(tr); err != nil {
+				return err
+			}
+			found = true
+			continue
+		}
+
+		hashes := map[string]hash.Hash{
+			"SHA1":   newManifestHash("SHA1"),
+			"SHA256": newManifestHash("SHA256"),
+			"SHA512": newManifestHash("SHA512"),
+		}
+		writers := make([]io.Writer, 0, len(hashes))
+		for _, h := range hashes {
+			writers = append(writers, h)
+		}
+		if _, err := io.Copy(io.MultiWriter(writers...), tr); err != nil {
+			return err
+		}
+
+		digests[hdr.Name] = make(map[string]string, len(hashes))
+		for algorithm, h := range hashes {
+			digests[hdr.Name][algorithm] = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("no manifest found in %s", path)
+	}
+
+	for _, entry := range entries {
+		digest, ok := digests[entry.file]
+		if !ok {
+			return fmt.Errorf("file %s listed in the manifest was not found in %s", entry.file, path)
+		}
+		if err := checkManifestEntry(entry, digest[entry.algorithm]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listExportFiles returns the set of names in the export output path.
+func listExportFiles(path string) (map[string]bool, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		result[entry.Name()] = true
+	}
+	return result, nil
+}
+
+// copyVMFiles copies the files of the virtual machine directory, including
+// the companion files such as the disks and nvram, into the destination. The
+// files can be filtered by glob patterns of their names.
+func copyVMFiles(srcDir string, dstDir string, include []string, exclude []string) error {
+	if len(exclude) == 0 {
+		exclude = defaultExcludeFiles
+	}
+	for _, pattern := range append(slices.Clone(include), exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid file pattern %q: %s", pattern, err)
+		}
+	}
+
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		// Skip lock directories and anything else that isn't a regular file.
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		if len(include) > 0 && !matchesAnyFile(include, entry.Name()) {
+			log.Printf("Skipping %s, which isn't included", entry.Name())
+			continue
+		}
+		if matchesAnyFile(exclude, entry.Name()) {
+			log.Printf("Skipping %s, which is excluded", entry.Name())
+			continue
+		}
+
+		src := filepath.Join(srcDir, entry.Name())
+		dst := filepath.Join(dstDir, entry.Name())
+		log.Printf("Copying %s to %s", src, dst)
+		if err := copyFile(src, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultExcludeFiles are the transient files of a virtual machine that a
+// native vmx copy skips by default.
+var defaultExcludeFiles = []string{"*.log", "*.vmss", "*.vmem", "*.scoreboard"}
+
+// matchesAnyFile returns whether a file name matches any of the glob patterns.
+func matchesAnyFile(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// copyFile copies the contents and permissions of a single file.
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// streamExport runs the export with ovftool writing to a named pipe, and
+// copies the exported bytes through to the output writer.
+func (s *StepExport) streamExport(driver Driver, args []string) error {
+	dir, err := os.MkdirTemp("", "packer-export")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	pipePath := filepath.Join(dir, s.exportFileName())
+	r, w, err := openExportPipe(pipePath)
+	if err != nil {
+		return fmt.Errorf("error creating export pipe: %s", err)
 	}
+	defer r.Close()
 
-	password := c.RemotePassword
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(s.OutputWriter, r)
+		copied <- err
+	}()
+
+	// The target is the last argument; replace it with the pipe.
+	streamArgs := make([]string, len(args))
+	copy(streamArgs, args)
+	streamArgs[len(streamArgs)-1] = pipePath
+
+	// ovftool refuses to write to a target that already exists, which the
+	// pipe does, so it has to be told to overwrite it.
+	exportErr := driver.Export(append([]string{"--overwrite"}, streamArgs...))
+
+	// Closing our end of the pipe lets the copy finish once ovftool is done.
+	w.Close()
+	copyErr := <-copied
+
+	if exportErr != nil {
+		return exportErr
+	}
+	if copyErr != nil {
+		return fmt.Errorf("error streaming export: %s", copyErr)
+	}
+	return nil
+}
+
+// ensurePoweredOff verifies that the virtual machine is not running, powering
+// it off first if AutoPowerOff is set.
+func (s *StepExport) ensurePoweredOff(driver Driver, ui packersdk.Ui, vmxPath string) error {
+	running, err := driver.IsRunning(vmxPath)
+	if err != nil {
+		return fmt.Errorf("error checking virtual machine power state: %s", err)
+	}
+	if !running {
+		return nil
+	}
+
+	if !s.AutoPowerOff {
+		return errors.New("virtual machine is running; shut it down before exporting")
+	}
+
+	ui.Say("Powering off virtual machine before export...")
+	if err := driver.Stop(vmxPath); err != nil {
+		return fmt.Errorf("error powering off virtual machine: %s", err)
+	}
+
+	timeout := time.After(exportPowerOffTimeout)
+	for {
+		running, err := driver.IsRunning(vmxPath)
+		if err != nil {
+			return fmt.Errorf("error checking virtual machine power state: %s", err)
+		}
+		if !running {
+			return nil
+		}
+
+		select {
+		case <-timeout:
+			return fmt.Errorf("timeout waiting for virtual machine to power off after %s", exportPowerOffTimeout)
+		case <-time.After(150 * time.Millisecond):
+		}
+	}
+}
+
+func (s *StepExport) generateRemoteExportArgs(c *DriverConfig, displayName string, hidePassword bool, exportOutputPath string) ([]string, error) {
+
+	var u *url.URL
+	if s.RemoteInventoryPath != "" {
+		u = remoteInventoryURL(c.RemoteHost, s.RemoteInventoryPath)
+	} else {
+		ovftoolUri := fmt.Sprintf("vi://%s/%s", c.RemoteHost, displayName)
+		parsed, err := url.Parse(ovftoolUri)
+		if err != nil {
+			// The remote host may carry credentials of its own, so the error
+			// is scrubbed before it's surfaced.
+			return []string{}, redactPassword(err, c.RemotePassword)
+		}
+		u = parsed
+	}
+
+	// The placeholder for a hidden password is added after the URL is
+	// built, as it would otherwise be escaped.
+	var target string
 	if hidePassword {
-		password = "<password>"
+		u.User = url.User(c.RemoteUser)
+		target = strings.Replace(u.String(), "@", ":<password>@", 1)
+	} else {
+		u.User = url.UserPassword(c.RemoteUser, c.RemotePassword)
+		target = u.String()
 	}
-	u.User = url.UserPassword(c.RemoteUser, password)
 
-	args := []string{
-		"--noSSLVerify=true",
-		"--skipManifestCheck",
-		"-tt=" + s.Format,
-		u.String(),
-		filepath.Join(exportOutputPath, s.VMName+"."+s.Format),
+	var args []string
+	if !s.SkipSSLVerify.False() {
+		args = append(args, "--noSSLVerify=true")
 	}
+	for _, timeout := range []struct {
+		option   string
+		duration time.Duration
+	}{
+		{ovftoolConnectTimeoutOption, s.ConnectTimeout},
+		{ovftoolOperationTimeoutOption, s.OperationTimeout},
+	} {
+		if timeout.duration == 0 {
+			continue
+		}
+		if timeout.duration < 0 {
+			return []string{}, fmt.Errorf("invalid timeout for %s: %s must be positive", timeout.option, timeout.duration)
+		}
+
+		// A timeout of less than a second is rounded up, rather than down
+		// to zero.
+		seconds := int64((timeout.duration + time.Second - 1) / time.Second)
+		args = append(args, fmt.Sprintf("%s=%d", timeout.option, seconds))
+	}
+	extraConfig, err := s.extraConfigArgs()
+	if err != nil {
+		return []string{}, err
+	}
+	args = append(args, extraConfig...)
+	args = append(args,
+		"--skipManifestCheck",
+		"-tt="+s.Format,
+		target,
+		filepath.Join(exportOutputPath, s.exportFileName()),
+	)
 	return append(s.OVFToolOptions, args...), nil
 }
 
+// redactPassword replaces the password in the message of an error, including
+// the forms that it takes when escaped within a URL, so that the error is
+// safe to log.
+func redactPassword(err error, password string) error {
+	if err == nil || password == "" {
+		return err
+	}
+
+	msg := err.Error()
+	for _, form := range []string{
+		password,
+		url.PathEscape(password),
+		url.QueryEscape(password),
+		strings.TrimPrefix(url.UserPassword("", password).String(), ":"),
+	} {
+		msg = strings.ReplaceAll(msg, form, "<password>")
+	}
+	if msg == err.Error() {
+		return err
+	}
+	return errors.New(msg)
+}
+
+// remoteInventoryURL returns the `vi://` URL of a virtual machine on a remote
+// hypervisor from its inventory path, escaping each segment of the path.
+func remoteInventoryURL(host string, inventoryPath string) *url.URL {
+	var segments, escaped []string
+	for _, segment := range strings.Split(inventoryPath, "/") {
+		if segment == "" {
+			continue
+		}
+		segments = append(segments, segment)
+		escaped = append(escaped, url.PathEscape(segment))
+	}
+
+	return &url.URL{
+		Scheme:  "vi",
+		Host:    host,
+		Path:    "/" + strings.Join(segments, "/"),
+		RawPath: "/" + strings.Join(escaped, "/"),
+	}
+}
+
+// OvfToolCommand is the ovftool command that performs an export.
+type OvfToolCommand struct {
+	// Binary is the path to ovftool.
+	Binary string
+	// Args are the arguments that ovftool is run with.
+	Args []string
+	// RedactedArgs are the arguments with the remote password replaced by
+	// `<password>`, so that they're safe to log.
+	RedactedArgs []string
+}
+
+// OvfToolCommand returns the ovftool command that the step would run to
+// export the virtual machine, without running it.
+func (s *StepExport) OvfToolCommand(c *DriverConfig, displayName string, exportOutputPath string) (OvfToolCommand, error) {
+	cmd := OvfToolCommand{Binary: GetOvfTool()}
+
+	if c.RemoteType != "esxi" {
+		args, err := s.generateLocalExportArgs(exportOutputPath)
+		if err != nil {
+			return OvfToolCommand{}, err
+		}
+		cmd.Args = args
+		cmd.RedactedArgs = slices.Clone(args)
+		return cmd, nil
+	}
+
+	args, err := s.generateRemoteExportArgs(c, displayName, false, exportOutputPath)
+	if err != nil {
+		return OvfToolCommand{}, err
+	}
+	redacted, err := s.generateRemoteExportArgs(c, displayName, true, exportOutputPath)
+	if err != nil {
+		return OvfToolCommand{}, err
+	}
+	cmd.Args = args
+	cmd.RedactedArgs = redacted
+	return cmd, nil
+}
+
+// inferExportFormat returns the format of an export, inferring it from the
+// extension of the output name if no format was given.
+// exportBaseName returns the name of the export without its extension, which
+// is taken from OutputName when it's set and is otherwise VMName.
+func (s *StepExport) exportBaseName() string {
+	if s.OutputName != "" {
+		return strings.TrimSuffix(s.OutputName, filepath.Ext(s.OutputName))
+	}
+	return s.VMName
+}
+
+// exportFileName returns the name of the file that the export is written to.
+func (s *StepExport) exportFileName() string {
+	return s.exportBaseName() + "." + s.Format
+}
+
+func inferExportFormat(format string, name string) (string, error) {
+	if name == "" {
+		return format, nil
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	if format == "" {
+		if !slices.Contains(allowedExportFormats, ext) {
+			return "", fmt.Errorf("unable to infer the export format from %q: the extension must be one of %s", name, strings.Join(allowedExportFormats, ", "))
+		}
+		return ext, nil
+	}
+	if ext != format {
+		return "", fmt.Errorf("the extension of %q doesn't match the export format %s", name, format)
+	}
+	return format, nil
+}
+
+// extraConfigArgs returns the ovftool arguments for ExtraConfig, ordered by
+// key so that the command is stable between builds.
+func (s *StepExport) extraConfigArgs() ([]string, error) {
+	keys := make([]string, 0, len(s.ExtraConfig))
+	for key := range s.ExtraConfig {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var args []string
+	for _, key := range keys {
+		value := s.ExtraConfig[key]
+		if !extraConfigKeyRe.MatchString(key) {
+			return nil, fmt.Errorf("invalid extra config key %q: only letters, digits, '.', '_', and '-' are allowed", key)
+		}
+		for _, r := range value {
+			if unicode.IsControl(r) || strings.ContainsRune("\"'`$;&|<>\\", r) {
+				return nil, fmt.Errorf("invalid extra config value for %q: character %q is not allowed", key, r)
+			}
+		}
+		args = append(args, fmt.Sprintf("%s:%s=%s", ovftoolExtraConfigOption, key, value))
+	}
+	return args, nil
+}
+
+// generateLocalExportArgs returns the ovftool arguments for a local export.
+// The source and destination are made absolute, since ovftool may otherwise
+// resolve them against a different working directory.
 func (s *StepExport) generateLocalExportArgs(exportOutputPath string) ([]string, error) {
-	args := []string{
-		filepath.Join(exportOutputPath, s.VMName+".vmx"),
-		filepath.Join(exportOutputPath, s.VMName+"."+s.Format),
+	args, err := s.extraConfigArgs()
+	if err != nil {
+		return []string{}, err
+	}
+	for _, name := range []string{s.VMName + ".vmx", s.exportFileName()} {
+		path, err := filepath.Abs(filepath.Join(exportOutputPath, name))
+		if err != nil {
+			return []string{}, fmt.Errorf("error resolving absolute path for %s: %s", name, err)
+		}
+		args = append(args, path)
 	}
 	return append(s.OVFToolOptions, args...), nil
 }
@@ -67,6 +763,24 @@ func (s *StepExport) Run(ctx context.Context, state multistep.StateBag) multiste
 		return multistep.ActionContinue
 	}
 
+	format, err := inferExportFormat(s.Format, s.OutputName)
+	if err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	s.Format = format
+
+	// The virtual machine must be powered off, otherwise the export may fail
+	// or produce an inconsistent artifact.
+	if vmxPath, ok := state.GetOk("vmx_path"); ok {
+		if err := s.ensurePoweredOff(driver, ui, vmxPath.(string)); err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
 	// load output path from state. If it doesn't exist, just use the local
 	// outputdir.
 	exportOutputPath, ok := state.Get("export_output_path").(string)
@@ -78,7 +792,7 @@ func (s *StepExport) Run(ctx context.Context, state multistep.StateBag) multiste
 		}
 	}
 
-	err := os.MkdirAll(exportOutputPath, 0755)
+	err = os.MkdirAll(exportOutputPath, 0755)
 	if err != nil {
 		err = fmt.Errorf("error creating export directory: %s", err)
 		state.Put("error", err)
@@ -86,54 +800,315 @@ func (s *StepExport) Run(ctx context.Context, state multistep.StateBag) multiste
 		return multistep.ActionHalt
 	}
 
+	// Keep track of what existed before the export, so that if it fails we
+	// know which files were left behind by it.
+	s.exportOutputPath = exportOutputPath
+	s.existingFiles, err = listExportFiles(exportOutputPath)
+	if err != nil {
+		err = fmt.Errorf("error listing export directory: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
 	ui.Say("Exporting virtual machine...")
+	start := time.Now()
 	var displayName string
 	if v, ok := state.GetOk("display_name"); ok {
 		displayName = v.(string)
 	}
 
-	var args, uiArgs []string
-
 	ovftool := GetOvfTool()
-	if c.RemoteType == "esxi" {
-		// Generate arguments for the ovftool command, but obfuscating the
-		// password that we can log the command to the UI for debugging.
-		uiArgs, err := s.generateRemoteExportArgs(c, displayName, true, exportOutputPath)
-		if err != nil {
-			err = fmt.Errorf("error generating ovftool export args: %s", err)
-			state.Put("error", err)
-			ui.Error(err.Error())
-			return multistep.ActionHalt
+
+	// A local vmx export is only a copy of the virtual machine files, so it
+	// doesn't require ovftool.
+	if c.RemoteType == "" && s.Format == ExportFormatVmx && (s.UseNativeVmxCopy || ovftool == "") {
+		srcDir := exportOutputPath
+		if vmxPath, ok := state.GetOk("vmx_path"); ok {
+			srcDir = filepath.Dir(vmxPath.(string))
 		}
-		ui.Sayf("Executing: %s %s", ovftool, strings.Join(uiArgs, " "))
-		// Re-run the generate command, this time without obfuscating the
-		// password, so we can actually use it.
-		args, err = s.generateRemoteExportArgs(c, displayName, false, exportOutputPath)
-		if err != nil {
-			err = fmt.Errorf("error generating ovftool export args: %s", err)
+
+		if filepath.Clean(srcDir) == filepath.Clean(exportOutputPath) {
+			ui.Say("Virtual machine files are already in the export directory...")
+			return s.putExportResult(state, exportOutputPath, start, true, nil)
+		}
+
+		ui.Sayf("Copying virtual machine files to %s...", exportOutputPath)
+		if err := copyVMFiles(srcDir, exportOutputPath, s.IncludeFiles, s.ExcludeFiles); err != nil {
+			s.exportFailed = true
+			err = fmt.Errorf("error copying virtual machine files: %s", err)
 			state.Put("error", err)
 			ui.Error(err.Error())
 			return multistep.ActionHalt
 		}
-	} else {
-		args, err = s.generateLocalExportArgs(exportOutputPath)
-		ui.Sayf("Executing: %s %s", ovftool, strings.Join(uiArgs, " "))
+		return s.putExportResult(state, exportOutputPath, start, false, nil)
 	}
+	// Generate the ovftool command, logging it with the password obfuscated
+	// for debugging.
+	cmd, err := s.OvfToolCommand(c, displayName, exportOutputPath)
 	if err != nil {
 		err := fmt.Errorf("error generating ovftool export args: %s", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
+	ui.Sayf("Executing: %s %s", cmd.Binary, strings.Join(cmd.RedactedArgs, " "))
+	args := cmd.Args
 
-	if err := driver.Export(args); err != nil {
+	streamed := s.OutputWriter != nil && s.Format == ExportFormatOva
+	if streamed {
+		ui.Say("Streaming export to output writer...")
+		err = s.streamExport(driver, args)
+	} else {
+		err = driver.Export(args)
+	}
+	if err != nil {
+		s.exportFailed = true
 		err = fmt.Errorf("error performing ovftool export: %s", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
+	// ovftool may exit successfully without having written the export, so
+	// make sure that it's there.
+	if !streamed {
+		if err := verifyExportOutput(exportOutputPath, s.exportBaseName(), s.Format); err != nil {
+			s.exportFailed = true
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	// A streamed export was never written to the export output path, so
+	// there's nothing to verify.
+	if s.VerifyManifest && !streamed {
+		switch s.Format {
+		case ExportFormatOvf:
+			ui.Say("Verifying export manifest...")
+			err = verifyOvfManifest(exportOutputPath, s.exportBaseName())
+		case ExportFormatOva:
+			ui.Say("Verifying export manifest...")
+			err = verifyOvaManifest(filepath.Join(exportOutputPath, s.exportFileName()))
+		}
+		if err != nil {
+			s.exportFailed = true
+			err = fmt.Errorf("error verifying export manifest: %w", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	// A streamed export only went to the output writer, so there are no
+	// files to describe.
+	if streamed {
+		state.Put(StateExportResult, ExportResult{Format: s.Format, Duration: time.Since(start)})
+		return multistep.ActionContinue
+	}
+
+	var unpacked *ExportResult
+	if s.AlsoUnpackOva && s.Format == ExportFormatOva {
+		ova := filepath.Join(exportOutputPath, s.exportFileName())
+		dir := filepath.Join(exportOutputPath, s.exportBaseName()+"-ovf")
+		ui.Sayf("Unpacking %s to %s...", ova, dir)
+
+		result, err := unpackOva(ova, dir)
+		if err != nil {
+			s.exportFailed = true
+			err = fmt.Errorf("error unpacking ova: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		unpacked = &result
+	}
+	return s.putExportResult(state, exportOutputPath, start, false, unpacked)
+}
+
+// verifyExportOutput checks that an ovf or ova export was written to the
+// export output path and isn't empty. The files of a vmx export depend on
+// ovftool, so they aren't checked.
+func verifyExportOutput(exportOutputPath string, name string, format string) error {
+	if format != ExportFormatOvf && format != ExportFormatOva {
+		return nil
+	}
+
+	path := filepath.Join(exportOutputPath, name+"."+format)
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("ovftool reported success, but the export %s was not written", path)
+	}
+	if err != nil {
+		return fmt.Errorf("error checking export %s: %s", path, err)
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("ovftool reported success, but the export %s is empty", path)
+	}
+	return nil
+}
+
+// unpackOva extracts the files of an ova, which is a tar archive, into a
+// directory and describes the resulting ovf export.
+func unpackOva(path string, dir string) (ExportResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	defer f.Close()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return ExportResult{}, err
+	}
+
+	result := ExportResult{Format: ExportFormatOvf}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ExportResult{}, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// Refuse anything that would be written outside of the directory.
+		if !filepath.IsLocal(hdr.Name) {
+			return ExportResult{}, fmt.Errorf("invalid file name %q in %s", hdr.Name, path)
+		}
+		target := filepath.Join(dir, hdr.Name)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return ExportResult{}, err
+		}
+
+		out, err := os.Create(target)
+		if err != nil {
+			return ExportResult{}, err
+		}
+		n, err := io.Copy(out, tr)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return ExportResult{}, err
+		}
+
+		result.Files = append(result.Files, target)
+		result.Size += n
+		if strings.HasSuffix(hdr.Name, "."+ExportFormatOvf) {
+			result.Path = target
+		}
+	}
+
+	if result.Path == "" {
+		return ExportResult{}, fmt.Errorf("no ovf descriptor found in %s", path)
+	}
+
+	h := sha256.New()
+	if err := hashFile(h, result.Path); err != nil {
+		return ExportResult{}, err
+	}
+	result.Checksum = hex.EncodeToString(h.Sum(nil))
+	return result, nil
+}
+
+// putExportResult describes the files of a successful export in the state
+// bag. Only the files created by the export are included, unless all is set,
+// which is the case when the virtual machine files are exported in place.
+// The export has already succeeded, so if its files can't be described, then
+// only what is known about it is stored.
+func (s *StepExport) putExportResult(state multistep.StateBag, exportOutputPath string, start time.Time, all bool, unpacked *ExportResult) multistep.StepAction {
+	result, err := s.exportResult(exportOutputPath, all)
+	if err != nil {
+		log.Printf("[WARN] Unable to describe the files of the export: %s", err)
+	}
+	result.Duration = time.Since(start)
+	result.Unpacked = unpacked
+
+	state.Put(StateExportResult, result)
+
+	// The virtual machine files keep their names when they're copied, so the
+	// vmx is named after the one that was built.
+	name := s.exportFileName()
+	if vmxPath, ok := state.GetOk("vmx_path"); ok && s.Format == ExportFormatVmx {
+		name = filepath.Base(vmxPath.(string))
+	}
+	path, err := filepath.Abs(filepath.Join(exportOutputPath, name))
+	if err != nil {
+		log.Printf("[WARN] Unable to resolve the absolute path of the export: %s", err)
+		return multistep.ActionContinue
+	}
+	state.Put(StateExportOutputFile, path)
 	return multistep.ActionContinue
 }
 
-func (s *StepExport) Cleanup(state multistep.StateBag) {}
+// exportResult describes the files in the export output path. The format and
+// path are returned even if the files can't be described.
+func (s *StepExport) exportResult(exportOutputPath string, all bool) (ExportResult, error) {
+	result := ExportResult{Format: s.Format, Path: exportOutputPath}
+	if s.Format != ExportFormatVmx {
+		result.Path = filepath.Join(exportOutputPath, s.exportFileName())
+	}
+
+	entries, err := os.ReadDir(exportOutputPath)
+	if err != nil {
+		return result, err
+	}
+
+	var files []string
+	var size int64
+	for _, entry := range entries {
+		path := filepath.Join(exportOutputPath, entry.Name())
+		if entry.IsDir() || (!all && s.existingFiles[entry.Name()] && path != result.Path) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return result, err
+		}
+		files = append(files, path)
+		size += info.Size()
+	}
+
+	var checksum string
+	if s.Format != ExportFormatVmx {
+		h := sha256.New()
+		if err := hashFile(h, result.Path); err != nil {
+			return result, err
+		}
+		checksum = hex.EncodeToString(h.Sum(nil))
+	}
+
+	result.Files, result.Size, result.Checksum = files, size, checksum
+	return result, nil
+}
+
+func (s *StepExport) Cleanup(state multistep.StateBag) {
+	if !s.exportFailed || !s.CleanupOnFailure {
+		return
+	}
+
+	files, err := listExportFiles(s.exportOutputPath)
+	if err != nil {
+		log.Printf("[WARN] Error listing export directory for cleanup: %s", err)
+		return
+	}
+
+	// Anything that wasn't there before the export was left behind by it.
+	for name := range files {
+		if s.existingFiles[name] {
+			continue
+		}
+
+		path := filepath.Join(s.exportOutputPath, name)
+		log.Printf("Removing file left by failed export: %s", path)
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("[WARN] Error removing file left by failed export: %s", err)
+		}
+	}
+}
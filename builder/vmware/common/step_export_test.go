@@ -4,11 +4,22 @@
 package common
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -33,6 +44,17 @@ func remoteExportTestState(t *testing.T) multistep.StateBag {
 	return state
 }
 
+// simulateExport makes the export of the mock driver write its destination,
+// which is the last of its arguments, and removes it when the test completes.
+func simulateExport(t *testing.T, state multistep.StateBag) {
+	d := state.Get("driver").(*DriverMock)
+	d.ExportFunc = func(args []string) error {
+		path := args[len(args)-1]
+		t.Cleanup(func() { os.Remove(path) })
+		return os.WriteFile(path, []byte("export"), 0644)
+	}
+}
+
 func TestStepExport_ReturnIfSkip(t *testing.T) {
 	state := testState(t)
 	driverConfig := &DriverConfig{}
@@ -59,10 +81,783 @@ func TestStepExport_ReturnIfSkip(t *testing.T) {
 	step.Cleanup(state)
 }
 
+func TestStepExport_running(t *testing.T) {
+	state := testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	state.Put("vmx_path", "foo.vmx")
+	step := new(StepExport)
+
+	step.OutputDir = stringPointer(t.TempDir())
+	step.VMName = "test-name"
+	step.Format = "ova"
+
+	d := state.Get("driver").(*DriverMock)
+	d.IsRunningResult = true
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	err, ok := state.GetOk("error")
+	if !ok {
+		t.Fatal("should have error")
+	}
+	assert.Contains(t, err.(error).Error(), "shut it down before exporting")
+
+	if d.StopCalled {
+		t.Fatal("Should not have stopped the virtual machine")
+	}
+	if d.ExportCalled {
+		t.Fatal("Should not have called the driver export func")
+	}
+}
+
+func TestStepExport_runningAutoPowerOff(t *testing.T) {
+	state := testState(t)
+	simulateExport(t, state)
+	state.Put("driverConfig", &DriverConfig{})
+	state.Put("vmx_path", "foo.vmx")
+	step := new(StepExport)
+
+	step.OutputDir = stringPointer(t.TempDir())
+	step.VMName = "test-name"
+	step.Format = "ova"
+	step.AutoPowerOff = true
+
+	d := state.Get("driver").(*DriverMock)
+	d.IsRunningResult = true
+
+	// Set not running after some time
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		d.Lock()
+		defer d.Unlock()
+		d.IsRunningResult = false
+	}()
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	if !d.StopCalled || d.StopPath != "foo.vmx" {
+		t.Fatal("Should have stopped the virtual machine")
+	}
+	if !d.ExportCalled {
+		t.Fatal("Should have called the driver export func")
+	}
+}
+
+func TestStepExport_stopped(t *testing.T) {
+	state := testState(t)
+	simulateExport(t, state)
+	state.Put("driverConfig", &DriverConfig{})
+	state.Put("vmx_path", "foo.vmx")
+	step := new(StepExport)
+
+	step.OutputDir = stringPointer(t.TempDir())
+	step.VMName = "test-name"
+	step.Format = "ova"
+	step.AutoPowerOff = true
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	d := state.Get("driver").(*DriverMock)
+	if !d.IsRunningCalled {
+		t.Fatal("Should have checked whether the virtual machine is running")
+	}
+	if d.StopCalled {
+		t.Fatal("Should not have stopped the virtual machine")
+	}
+	if !d.ExportCalled {
+		t.Fatal("Should have called the driver export func")
+	}
+}
+
+func TestStepExport_missingOutput(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		format   string
+		contents []byte
+		expected string
+	}{
+		{"missing ova", ExportFormatOva, nil, "was not written"},
+		{"missing ovf", ExportFormatOvf, nil, "was not written"},
+		{"empty ova", ExportFormatOva, []byte{}, "is empty"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			outputDir := t.TempDir()
+			state := remoteExportTestState(t)
+			step := new(StepExport)
+			step.OutputDir = stringPointer(outputDir)
+			step.VMName = "test-name"
+			step.Format = tc.format
+
+			// The export succeeds without writing anything, or writes an
+			// empty file.
+			d := state.Get("driver").(*DriverMock)
+			d.ExportFunc = func(args []string) error {
+				if tc.contents == nil {
+					return nil
+				}
+				return os.WriteFile(args[len(args)-1], tc.contents, 0644)
+			}
+
+			if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+				t.Fatalf("bad action: %#v", action)
+			}
+			err, ok := state.GetOk("error")
+			if !ok {
+				t.Fatal("should have error")
+			}
+			assert.Contains(t, err.(error).Error(), filepath.Join(outputDir, "test-name."+tc.format))
+			assert.Contains(t, err.(error).Error(), tc.expected)
+			if _, ok := state.GetOk(StateExportResult); ok {
+				t.Fatal("should NOT have an export result")
+			}
+		})
+	}
+}
+
+func TestStepExport_cleanupOnFailure(t *testing.T) {
+	outputDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outputDir, "test-name.vmx"), []byte("vmx"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	step := new(StepExport)
+
+	step.OutputDir = stringPointer(outputDir)
+	step.VMName = "test-name"
+	step.Format = "ova"
+	step.CleanupOnFailure = true
+
+	// Simulate an export that fails part way through writing its output.
+	d := state.Get("driver").(*DriverMock)
+	d.ExportFunc = func([]string) error {
+		if err := os.WriteFile(filepath.Join(outputDir, "test-name.ova.tmp"), []byte("partial"), 0644); err != nil {
+			return err
+		}
+		return errors.New("export failed")
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	step.Cleanup(state)
+
+	if _, err := os.Stat(filepath.Join(outputDir, "test-name.ova.tmp")); !os.IsNotExist(err) {
+		t.Fatal("partial export file should have been removed")
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "test-name.vmx")); err != nil {
+		t.Fatalf("existing file should have been preserved: %s", err)
+	}
+}
+
+func TestStepExport_cleanupOnSuccess(t *testing.T) {
+	outputDir := t.TempDir()
+
+	state := testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	step := new(StepExport)
+
+	step.OutputDir = stringPointer(outputDir)
+	step.VMName = "test-name"
+	step.Format = "ova"
+	step.CleanupOnFailure = true
+
+	d := state.Get("driver").(*DriverMock)
+	d.ExportFunc = func([]string) error {
+		return os.WriteFile(filepath.Join(outputDir, "test-name.ova"), []byte("ova"), 0644)
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	step.Cleanup(state)
+
+	if _, err := os.Stat(filepath.Join(outputDir, "test-name.ova")); err != nil {
+		t.Fatalf("successful export should have been preserved: %s", err)
+	}
+}
+
+func TestStepExport_exportResult(t *testing.T) {
+	outputDir := t.TempDir()
+
+	// Files that were already in the output directory aren't part of the
+	// export.
+	if err := os.WriteFile(filepath.Join(outputDir, "test-name.vmx"), []byte("vmx"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	step := new(StepExport)
+
+	step.OutputDir = stringPointer(outputDir)
+	step.VMName = "test-name"
+	step.Format = "ova"
+
+	contents := []byte("exported ova")
+	d := state.Get("driver").(*DriverMock)
+	d.ExportFunc = func([]string) error {
+		return os.WriteFile(filepath.Join(outputDir, "test-name.ova"), contents, 0644)
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	result, ok := state.Get(StateExportResult).(ExportResult)
+	if !ok {
+		t.Fatalf("expected an export result in the state bag")
+	}
+
+	path := filepath.Join(outputDir, "test-name.ova")
+	digest := sha256.Sum256(contents)
+	assert.Equal(t, "ova", result.Format)
+	assert.Equal(t, path, result.Path)
+	assert.Equal(t, []string{path}, result.Files)
+	assert.Equal(t, int64(len(contents)), result.Size)
+	assert.Equal(t, fmt.Sprintf("%x", digest), result.Checksum)
+	assert.Greater(t, result.Duration, time.Duration(0))
+}
+
+func TestStepExport_outputFile(t *testing.T) {
+	for _, format := range []string{"ovf", "ova", "vmx"} {
+		t.Run(format, func(t *testing.T) {
+			vmDir := t.TempDir()
+			outputDir := t.TempDir()
+
+			state := testState(t)
+			state.Put("driverConfig", &DriverConfig{})
+			step := new(StepExport)
+
+			step.OutputDir = stringPointer(outputDir)
+			step.VMName = "test-name"
+			step.Format = format
+
+			// The vmx is copied from the virtual machine, so it keeps its name.
+			expected := filepath.Join(outputDir, "test-name."+format)
+			if format == "vmx" {
+				if err := os.WriteFile(filepath.Join(vmDir, "built.vmx"), []byte("displayName = \"test-name\""), 0644); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+				state.Put("vmx_path", filepath.Join(vmDir, "built.vmx"))
+				step.UseNativeVmxCopy = true
+				expected = filepath.Join(outputDir, "built.vmx")
+			}
+
+			d := state.Get("driver").(*DriverMock)
+			d.ExportFunc = func([]string) error {
+				return os.WriteFile(expected, []byte("exported"), 0644)
+			}
+
+			if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+				t.Fatalf("bad action: %#v", action)
+			}
+
+			path, ok := state.Get(StateExportOutputFile).(string)
+			if !ok {
+				t.Fatalf("expected an export output file in the state bag")
+			}
+			assert.True(t, filepath.IsAbs(path), "expected an absolute path, got %s", path)
+			assert.Equal(t, absPath(t, expected), path)
+			assert.FileExists(t, path)
+		})
+	}
+}
+
+func TestStepExport_exportResultNativeVmxCopy(t *testing.T) {
+	vmDir := t.TempDir()
+	outputDir := t.TempDir()
+
+	files := map[string]string{
+		"test-name.vmx":  "displayName = \"test-name\"",
+		"test-name.vmdk": "disk",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(vmDir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	state := testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	state.Put("vmx_path", filepath.Join(vmDir, "test-name.vmx"))
+	step := new(StepExport)
+
+	step.OutputDir = stringPointer(outputDir)
+	step.VMName = "test-name"
+	step.Format = "vmx"
+	step.UseNativeVmxCopy = true
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	result, ok := state.Get(StateExportResult).(ExportResult)
+	if !ok {
+		t.Fatalf("expected an export result in the state bag")
+	}
+
+	assert.Equal(t, "vmx", result.Format)
+	assert.Equal(t, outputDir, result.Path)
+	assert.ElementsMatch(t, []string{
+		filepath.Join(outputDir, "test-name.vmx"),
+		filepath.Join(outputDir, "test-name.vmdk"),
+	}, result.Files)
+	assert.Equal(t, int64(len(files["test-name.vmx"])+len(files["test-name.vmdk"])), result.Size)
+	assert.Empty(t, result.Checksum)
+}
+
+func TestStepExport_nativeVmxCopy(t *testing.T) {
+	vmDir := t.TempDir()
+	outputDir := t.TempDir()
+
+	files := map[string]string{
+		"test-name.vmx":       "displayName = \"test-name\"",
+		"test-name.vmdk":      "disk",
+		"test-name-s001.vmdk": "extent",
+		"test-name.nvram":     "nvram",
+		"test-name.vmsd":      "",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(vmDir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	// Lock directories are transient and should not be copied.
+	if err := os.Mkdir(filepath.Join(vmDir, "test-name.vmx.lck"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	state.Put("vmx_path", filepath.Join(vmDir, "test-name.vmx"))
+	step := new(StepExport)
+
+	step.OutputDir = stringPointer(outputDir)
+	step.VMName = "test-name"
+	step.Format = "vmx"
+	step.UseNativeVmxCopy = true
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	d := state.Get("driver").(*DriverMock)
+	assert.False(t, d.ExportCalled, "should not have called ovftool")
+
+	for name, contents := range files {
+		data, err := os.ReadFile(filepath.Join(outputDir, name))
+		if err != nil {
+			t.Fatalf("expected %s to be copied: %s", name, err)
+		}
+		assert.Equal(t, contents, string(data))
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "test-name.vmx.lck")); !os.IsNotExist(err) {
+		t.Fatal("lock directory should not have been copied")
+	}
+}
+
+func TestStepExport_nativeVmxCopyFilters(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		include  []string
+		exclude  []string
+		expected []string
+	}{
+		{
+			name:     "default",
+			expected: []string{"test-name.nvram", "test-name.vmdk", "test-name.vmx"},
+		},
+		{
+			name:     "exclude",
+			exclude:  []string{"*.nvram"},
+			expected: []string{"test-name.vmdk", "test-name.vmss", "test-name.vmx", "vmware.log"},
+		},
+		{
+			name:     "include",
+			include:  []string{"*.vmx", "*.vmdk"},
+			expected: []string{"test-name.vmdk", "test-name.vmx"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			vmDir := t.TempDir()
+			outputDir := t.TempDir()
+
+			for _, name := range []string{"test-name.vmx", "test-name.vmdk", "test-name.nvram", "test-name.vmss", "vmware.log"} {
+				if err := os.WriteFile(filepath.Join(vmDir, name), []byte(name), 0644); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+			}
+
+			state := testState(t)
+			state.Put("driverConfig", &DriverConfig{})
+			state.Put("vmx_path", filepath.Join(vmDir, "test-name.vmx"))
+			step := new(StepExport)
+
+			step.OutputDir = stringPointer(outputDir)
+			step.VMName = "test-name"
+			step.Format = "vmx"
+			step.UseNativeVmxCopy = true
+			step.IncludeFiles = tc.include
+			step.ExcludeFiles = tc.exclude
+
+			if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+				t.Fatalf("bad action: %#v", action)
+			}
+
+			files, err := listExportFiles(outputDir)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			var copied []string
+			for name := range files {
+				copied = append(copied, name)
+			}
+			slices.Sort(copied)
+			assert.Equal(t, tc.expected, copied)
+		})
+	}
+}
+
+func TestStepExport_nativeVmxCopyInvalidPattern(t *testing.T) {
+	state := testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	state.Put("vmx_path", filepath.Join(t.TempDir(), "test-name.vmx"))
+	step := new(StepExport)
+
+	step.OutputDir = stringPointer(t.TempDir())
+	step.VMName = "test-name"
+	step.Format = "vmx"
+	step.UseNativeVmxCopy = true
+	step.ExcludeFiles = []string{"["}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+}
+
+// writeOvfExport simulates an ovf export. The manifest always lists the
+// digests of the expected contents, which are the names of the files.
+func writeOvfExport(dir string, files map[string]string) error {
+	var manifest string
+	for _, name := range []string{"test-name.ovf", "test-name-disk1.vmdk"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(files[name]), 0644); err != nil {
+			return err
+		}
+		manifest += fmt.Sprintf("SHA256(%s)= %x\n", name, sha256.Sum256([]byte(name)))
+	}
+	return os.WriteFile(filepath.Join(dir, "test-name.mf"), []byte(manifest), 0644)
+}
+
+func TestStepExport_verifyManifestOvf(t *testing.T) {
+	outputDir := t.TempDir()
+
+	state := testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	step := new(StepExport)
+
+	step.OutputDir = stringPointer(outputDir)
+	step.VMName = "test-name"
+	step.Format = "ovf"
+	step.VerifyManifest = true
+
+	d := state.Get("driver").(*DriverMock)
+	d.ExportFunc = func([]string) error {
+		return writeOvfExport(outputDir, map[string]string{
+			"test-name.ovf":        "test-name.ovf",
+			"test-name-disk1.vmdk": "test-name-disk1.vmdk",
+		})
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+}
+
+func TestStepExport_verifyManifestOvfMismatch(t *testing.T) {
+	outputDir := t.TempDir()
+
+	state := testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	step := new(StepExport)
+
+	step.OutputDir = stringPointer(outputDir)
+	step.VMName = "test-name"
+	step.Format = "ovf"
+	step.VerifyManifest = true
+
+	d := state.Get("driver").(*DriverMock)
+	d.ExportFunc = func([]string) error {
+		return writeOvfExport(outputDir, map[string]string{
+			"test-name.ovf":        "test-name.ovf",
+			"test-name-disk1.vmdk": "corrupted",
+		})
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	var mismatch *ManifestMismatchError
+	if !errors.As(state.Get("error").(error), &mismatch) {
+		t.Fatalf("expected a manifest mismatch, got: %s", state.Get("error"))
+	}
+	assert.Equal(t, "test-name-disk1.vmdk", mismatch.File)
+	assert.Equal(t, "SHA256", mismatch.Algorithm)
+}
+
+func TestStepExport_verifyManifestOvfWithOutputWriter(t *testing.T) {
+	outputDir := t.TempDir()
+
+	state := testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	step := new(StepExport)
+
+	step.OutputDir = stringPointer(outputDir)
+	step.VMName = "test-name"
+	step.Format = "ovf"
+	step.VerifyManifest = true
+	// Only an ova is streamed, so an ovf is still written to the output
+	// directory and its manifest must be verified.
+	step.OutputWriter = new(bytes.Buffer)
+
+	d := state.Get("driver").(*DriverMock)
+	d.ExportFunc = func([]string) error {
+		return writeOvfExport(outputDir, map[string]string{
+			"test-name.ovf":        "test-name.ovf",
+			"test-name-disk1.vmdk": "corrupted",
+		})
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	var mismatch *ManifestMismatchError
+	if !errors.As(state.Get("error").(error), &mismatch) {
+		t.Fatalf("expected a manifest mismatch, got: %s", state.Get("error"))
+	}
+	assert.Equal(t, "test-name-disk1.vmdk", mismatch.File)
+}
+
+func TestStepExport_verifyManifestOvfOutsideDir(t *testing.T) {
+	dir := t.TempDir()
+	outputDir := filepath.Join(dir, "output")
+	if err := os.Mkdir(outputDir, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The file outside of the directory matches its digest, so it would
+	// pass verification if it were read.
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	manifest := fmt.Sprintf("SHA256(../secret)= %x\n", sha256.Sum256([]byte("secret")))
+	if err := os.WriteFile(filepath.Join(outputDir, "test-name.mf"), []byte(manifest), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err := verifyOvfManifest(outputDir, "test-name")
+	if err == nil || !strings.Contains(err.Error(), "invalid file name") {
+		t.Fatalf("expected an invalid file name, got: %v", err)
+	}
+}
+
+// writeOvaExport writes an ova, which is a tar archive of the named files.
+func writeOvaExport(path string, files [][2]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: file[0], Mode: 0644, Size: int64(len(file[1]))}); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte(file[1])); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func TestStepExport_verifyManifestOva(t *testing.T) {
+	for _, corrupt := range []bool{false, true} {
+		outputDir := t.TempDir()
+
+		state := testState(t)
+		state.Put("driverConfig", &DriverConfig{})
+		step := new(StepExport)
+
+		step.OutputDir = stringPointer(outputDir)
+		step.VMName = "test-name"
+		step.Format = "ova"
+		step.VerifyManifest = true
+
+		// Simulate an ova export, which is an archive of the ovf, the
+		// manifest, and the disks.
+		d := state.Get("driver").(*DriverMock)
+		d.ExportFunc = func([]string) error {
+			disk := "test-name-disk1.vmdk"
+			manifest := fmt.Sprintf("SHA1(test-name.ovf)= %x\nSHA1(test-name-disk1.vmdk)= %x\n",
+				sha1.Sum([]byte("test-name.ovf")), sha1.Sum([]byte(disk)))
+			if corrupt {
+				disk = "corrupted"
+			}
+
+			return writeOvaExport(filepath.Join(outputDir, "test-name.ova"), [][2]string{
+				{"test-name.ovf", "test-name.ovf"},
+				{"test-name.mf", manifest},
+				{"test-name-disk1.vmdk", disk},
+			})
+		}
+
+		action := step.Run(context.Background(), state)
+		if !corrupt {
+			assert.Equal(t, multistep.ActionContinue, action)
+			continue
+		}
+
+		assert.Equal(t, multistep.ActionHalt, action)
+		var mismatch *ManifestMismatchError
+		if !errors.As(state.Get("error").(error), &mismatch) {
+			t.Fatalf("expected a manifest mismatch, got: %s", state.Get("error"))
+		}
+		assert.Equal(t, "test-name-disk1.vmdk", mismatch.File)
+		assert.Equal(t, "SHA1", mismatch.Algorithm)
+	}
+}
+
+func TestStepExport_alsoUnpackOva(t *testing.T) {
+	outputDir := t.TempDir()
+
+	state := testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	step := new(StepExport)
+
+	step.OutputDir = stringPointer(outputDir)
+	step.VMName = "test-name"
+	step.Format = "ova"
+	step.AlsoUnpackOva = true
+
+	files := [][2]string{
+		{"test-name.ovf", "<Envelope/>"},
+		{"test-name.mf", "SHA256(test-name.ovf)= 00\n"},
+		{"test-name-disk1.vmdk", "disk"},
+	}
+	d := state.Get("driver").(*DriverMock)
+	d.ExportFunc = func([]string) error {
+		return writeOvaExport(filepath.Join(outputDir, "test-name.ova"), files)
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v: %v", action, state.Get("error"))
+	}
+
+	unpackDir := filepath.Join(outputDir, "test-name-ovf")
+	var expected []string
+	var size int64
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(unpackDir, file[0]))
+		if err != nil {
+			t.Fatalf("expected %s to be unpacked: %s", file[0], err)
+		}
+		assert.Equal(t, file[1], string(data))
+		expected = append(expected, filepath.Join(unpackDir, file[0]))
+		size += int64(len(file[1]))
+	}
+
+	result := state.Get(StateExportResult).(ExportResult)
+	assert.Equal(t, filepath.Join(outputDir, "test-name.ova"), result.Path)
+	assert.Equal(t, []string{filepath.Join(outputDir, "test-name.ova")}, result.Files)
+	if assert.NotNil(t, result.Unpacked) {
+		assert.Equal(t, "ovf", result.Unpacked.Format)
+		assert.Equal(t, filepath.Join(unpackDir, "test-name.ovf"), result.Unpacked.Path)
+		assert.Equal(t, expected, result.Unpacked.Files)
+		assert.Equal(t, size, result.Unpacked.Size)
+		assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("<Envelope/>"))), result.Unpacked.Checksum)
+	}
+}
+
+func TestStepExport_alsoUnpackOvaUnsafePath(t *testing.T) {
+	outputDir := t.TempDir()
+
+	state := testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	step := new(StepExport)
+
+	step.OutputDir = stringPointer(outputDir)
+	step.VMName = "test-name"
+	step.Format = "ova"
+	step.AlsoUnpackOva = true
+	step.CleanupOnFailure = true
+
+	d := state.Get("driver").(*DriverMock)
+	d.ExportFunc = func([]string) error {
+		return writeOvaExport(filepath.Join(outputDir, "test-name.ova"), [][2]string{
+			{"test-name.ovf", "<Envelope/>"},
+			{"../escaped.vmdk", "disk"},
+		})
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	step.Cleanup(state)
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(outputDir), "escaped.vmdk")); !os.IsNotExist(err) {
+		t.Fatal("file outside of the unpack directory should not have been written")
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "test-name-ovf")); !os.IsNotExist(err) {
+		t.Fatal("unpack directory should have been removed by cleanup")
+	}
+}
+
+func absPath(t *testing.T, path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return abs
+}
+
+func TestStepExport_localArgsAbsolute(t *testing.T) {
+	step := new(StepExport)
+	step.VMName = "test-name"
+	step.Format = "ovf"
+
+	args, err := step.generateLocalExportArgs(filepath.Join("..", "relative_output"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	assert.Len(t, args, 2)
+	for _, arg := range args {
+		assert.True(t, filepath.IsAbs(arg), "expected %s to be absolute", arg)
+	}
+	assert.Equal(t, absPath(t, filepath.Join("..", "relative_output", "test-name.vmx")), args[0])
+	assert.Equal(t, absPath(t, filepath.Join("..", "relative_output", "test-name.ovf")), args[1])
+}
+
 func TestStepExport_localArgs(t *testing.T) {
 	// Although the remote arguments are available and not being overridden,
 	// the test should ignore them because remoteType is not specified as 'esx'.
 	state := testState(t)
+	simulateExport(t, state)
 	driverConfig := &DriverConfig{}
 	state.Put("driverConfig", driverConfig)
 	step := new(StepExport)
@@ -87,8 +882,8 @@ func TestStepExport_localArgs(t *testing.T) {
 
 	assert.Equal(t, d.ExportArgs,
 		[]string{
-			filepath.Join("test_output", "test-name.vmx"),
-			filepath.Join("test_output", "test-name.ova")})
+			absPath(t, filepath.Join("test_output", "test-name.vmx")),
+			absPath(t, filepath.Join("test_output", "test-name.ova"))})
 
 	// Cleanup
 	step.Cleanup(state)
@@ -98,6 +893,7 @@ func TestStepExport_localArgsExportOutputPath(t *testing.T) {
 	// Although the remote arguments are available and not being overridden,
 	// the test should ignore them because remoteType is not specified as 'esx'.
 	state := testState(t)
+	simulateExport(t, state)
 	driverConfig := &DriverConfig{}
 	state.Put("driverConfig", driverConfig)
 	state.Put("export_output_path", "local_output")
@@ -123,8 +919,8 @@ func TestStepExport_localArgsExportOutputPath(t *testing.T) {
 
 	assert.Equal(t, d.ExportArgs,
 		[]string{
-			filepath.Join("local_output", "test-name.vmx"),
-			filepath.Join("local_output", "test-name.ova")})
+			absPath(t, filepath.Join("local_output", "test-name.vmx")),
+			absPath(t, filepath.Join("local_output", "test-name.ova"))})
 
 	// Cleanup
 	step.Cleanup(state)
@@ -134,6 +930,7 @@ func TestStepExport_localArgs_OvftoolOptions(t *testing.T) {
 	// Although the remote arguments are available and not being overridden,
 	// the test should ignore them because remoteType is not specified as 'esx'.
 	state := testState(t)
+	simulateExport(t, state)
 	driverConfig := &DriverConfig{}
 	state.Put("driverConfig", driverConfig)
 	step := new(StepExport)
@@ -159,8 +956,8 @@ func TestStepExport_localArgs_OvftoolOptions(t *testing.T) {
 
 	assert.Equal(t, d.ExportArgs, []string{"--option=value",
 		"--second-option=\"quoted value\"",
-		filepath.Join("test_output", "test-name.vmx"),
-		filepath.Join("test_output", "test-name.ova")})
+		absPath(t, filepath.Join("test_output", "test-name.vmx")),
+		absPath(t, filepath.Join("test_output", "test-name.ova"))})
 
 	// Cleanup
 	step.Cleanup(state)
@@ -170,6 +967,7 @@ func TestStepExport_RemoteArgs(t *testing.T) {
 	// Although the remote arguments are available and not being overridden,
 	// the test should ignore them because remoteType is not specified as 'esx'.
 	state := remoteExportTestState(t)
+	simulateExport(t, state)
 	step := new(StepExport)
 
 	step.SkipExport = false
@@ -204,6 +1002,7 @@ func TestStepExport_RemoteArgsWithExportOutputPath(t *testing.T) {
 	// Although the remote arguments are available and not being overridden,
 	// the test should ignore them because remoteType is not specified as 'esx'.
 	state := remoteExportTestState(t)
+	simulateExport(t, state)
 	state.Put("export_output_path", "local_output")
 	step := new(StepExport)
 
@@ -234,3 +1033,353 @@ func TestStepExport_RemoteArgsWithExportOutputPath(t *testing.T) {
 	// Cleanup
 	step.Cleanup(state)
 }
+
+func TestStepExport_RemoteArgsSSLVerify(t *testing.T) {
+	for _, tc := range []struct {
+		skip     config.Trilean
+		expected bool
+	}{
+		{config.TriUnset, true},
+		{config.TriTrue, true},
+		{config.TriFalse, false},
+	} {
+		step := new(StepExport)
+		step.VMName = "test-name"
+		step.Format = "ova"
+		step.SkipSSLVerify = tc.skip
+
+		args, err := step.generateRemoteExportArgs(&DriverConfig{
+			RemoteHost:     "123.45.67.8",
+			RemoteUser:     "user",
+			RemotePassword: "password",
+		}, "vm_name", false, "test_output")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		assert.Equal(t, tc.expected, slices.Contains(args, "--noSSLVerify=true"),
+			"unexpected --noSSLVerify for skip_ssl_verify %s", tc.skip.ToString())
+	}
+}
+
+func TestStepExport_RemoteArgsInventoryPath(t *testing.T) {
+	step := new(StepExport)
+	step.VMName = "test-name"
+	step.Format = "ova"
+	step.RemoteInventoryPath = "/Data Center/vm/team #1/build?vm/"
+
+	args, err := step.generateRemoteExportArgs(&DriverConfig{
+		RemoteHost:     "123.45.67.8",
+		RemoteUser:     "user",
+		RemotePassword: "password",
+	}, "vm_name", false, "test_output")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	assert.Contains(t, args, "vi://user:password@123.45.67.8/Data%20Center/vm/team%20%231/build%3Fvm")
+	assert.NotContains(t, args, "vi://user:password@123.45.67.8/vm_name")
+}
+
+func TestStepExport_RemoteArgsTimeouts(t *testing.T) {
+	c := &DriverConfig{
+		RemoteHost:     "123.45.67.8",
+		RemoteUser:     "user",
+		RemotePassword: "password",
+	}
+
+	for _, tc := range []struct {
+		name      string
+		connect   time.Duration
+		operation time.Duration
+		expected  []string
+	}{
+		{"unset", 0, 0, nil},
+		{"connect", 30 * time.Second, 0, []string{"--X:connectTimeout=30"}},
+		{"operation", 0, 2 * time.Hour, []string{"--X:operationTimeout=7200"}},
+		{"both", time.Minute, 90 * time.Minute, []string{"--X:connectTimeout=60", "--X:operationTimeout=5400"}},
+		{"rounded up", 1500 * time.Millisecond, time.Millisecond, []string{"--X:connectTimeout=2", "--X:operationTimeout=1"}},
+		{"millisecond", time.Millisecond, time.Millisecond, []string{"--X:connectTimeout=1", "--X:operationTimeout=1"}},
+		{"under a second", 999 * time.Millisecond, 999 * time.Millisecond, []string{"--X:connectTimeout=1", "--X:operationTimeout=1"}},
+		{"exactly a second", time.Second, time.Second, []string{"--X:connectTimeout=1", "--X:operationTimeout=1"}},
+		{"over a second", 1001 * time.Millisecond, 1001 * time.Millisecond, []string{"--X:connectTimeout=2", "--X:operationTimeout=2"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			step := new(StepExport)
+			step.VMName = "test-name"
+			step.Format = "ova"
+			step.ConnectTimeout = tc.connect
+			step.OperationTimeout = tc.operation
+
+			args, err := step.generateRemoteExportArgs(c, "vm_name", false, "test_output")
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			var timeouts []string
+			for _, arg := range args {
+				if strings.HasPrefix(arg, "--X:connectTimeout") || strings.HasPrefix(arg, "--X:operationTimeout") {
+					timeouts = append(timeouts, arg)
+				}
+			}
+			assert.Equal(t, tc.expected, timeouts)
+		})
+	}
+
+	step := new(StepExport)
+	step.VMName = "test-name"
+	step.Format = "ova"
+	step.OperationTimeout = -time.Second
+	if _, err := step.generateRemoteExportArgs(c, "vm_name", false, "test_output"); err == nil {
+		t.Fatal("expected an error for a negative timeout")
+	}
+}
+
+func TestStepExport_ExtraConfig(t *testing.T) {
+	c := &DriverConfig{
+		RemoteHost:     "123.45.67.8",
+		RemoteUser:     "user",
+		RemotePassword: "password",
+	}
+
+	step := new(StepExport)
+	step.VMName = "test-name"
+	step.Format = "ova"
+	step.ExtraConfig = map[string]string{
+		"packer.build_id":  "01HZX8K2",
+		"packer.git-sha":   "4f2a9c1",
+		"packer.timestamp": "2024-05-01T12:00:00Z",
+	}
+	expected := []string{
+		"--extraConfig:packer.build_id=01HZX8K2",
+		"--extraConfig:packer.git-sha=4f2a9c1",
+		"--extraConfig:packer.timestamp=2024-05-01T12:00:00Z",
+	}
+
+	args, err := step.generateRemoteExportArgs(c, "vm_name", false, "test_output")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var extraConfig []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--extraConfig:") {
+			extraConfig = append(extraConfig, arg)
+		}
+	}
+	assert.Equal(t, expected, extraConfig)
+
+	args, err = step.generateLocalExportArgs("test_output")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.Equal(t, expected, args[:len(expected)])
+
+	for _, tc := range []struct {
+		name  string
+		key   string
+		value string
+	}{
+		{"key with space", "packer build", "1"},
+		{"key with equals", "packer=build", "1"},
+		{"empty key", "", "1"},
+		{"value with semicolon", "packer.build", "1; rm -rf /"},
+		{"value with quote", "packer.build", `1"`},
+		{"value with substitution", "packer.build", "$(id)"},
+		{"value with newline", "packer.build", "1\n2"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			step := new(StepExport)
+			step.VMName = "test-name"
+			step.Format = "ova"
+			step.ExtraConfig = map[string]string{tc.key: tc.value}
+
+			if _, err := step.generateRemoteExportArgs(c, "vm_name", false, "test_output"); err == nil {
+				t.Fatal("expected an error for the remote export")
+			}
+			if _, err := step.generateLocalExportArgs("test_output"); err == nil {
+				t.Fatal("expected an error for the local export")
+			}
+		})
+	}
+}
+
+func TestStepExport_inferExportFormat(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		format   string
+		output   string
+		expected string
+		err      bool
+	}{
+		{"ova", "", "build.ova", ExportFormatOva, false},
+		{"ovf", "", "build.ovf", ExportFormatOvf, false},
+		{"vmx", "", "build.vmx", ExportFormatVmx, false},
+		{"uppercase", "", "BUILD.OVA", ExportFormatOva, false},
+		{"agreeing", ExportFormatOvf, "build.ovf", ExportFormatOvf, false},
+		{"no name", ExportFormatOva, "", ExportFormatOva, false},
+		{"mismatch", ExportFormatOva, "build.ovf", "", true},
+		{"unrecognized", "", "build.zip", "", true},
+		{"no extension", "", "build", "", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			format, err := inferExportFormat(tc.format, tc.output)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, format)
+		})
+	}
+}
+
+func TestStepExport_inferredFormat(t *testing.T) {
+	state := testState(t)
+	simulateExport(t, state)
+	state.Put("driverConfig", &DriverConfig{})
+	step := new(StepExport)
+	step.OutputDir = stringPointer(t.TempDir())
+	step.VMName = "test-name"
+	step.OutputName = "test-name.ovf"
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	assert.Equal(t, ExportFormatOvf, step.Format)
+
+	d := state.Get("driver").(*DriverMock)
+	assert.Equal(t, absPath(t, filepath.Join(*step.OutputDir, "test-name.ovf")), d.ExportArgs[len(d.ExportArgs)-1])
+
+	step = new(StepExport)
+	step.OutputDir = stringPointer(t.TempDir())
+	step.VMName = "test-name"
+	step.Format = ExportFormatOva
+	step.OutputName = "test-name.ovf"
+	state = testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("expected a mismatched format to halt, got %#v", action)
+	}
+}
+
+func TestStepExport_outputName(t *testing.T) {
+	outputDir := t.TempDir()
+
+	state := testState(t)
+	simulateExport(t, state)
+	state.Put("driverConfig", &DriverConfig{})
+	step := new(StepExport)
+	step.OutputDir = stringPointer(outputDir)
+	step.VMName = "test-name"
+	step.OutputName = "build.ova"
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatalf("should NOT have error: %s", state.Get("error"))
+	}
+
+	// The export is written to the output name rather than the vm name.
+	if _, err := os.Stat(filepath.Join(outputDir, "build.ova")); err != nil {
+		t.Fatalf("expected the export to be written to build.ova: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "test-name.ova")); !os.IsNotExist(err) {
+		t.Fatalf("expected no export named after the vm, got: %v", err)
+	}
+
+	assert.Equal(t, absPath(t, filepath.Join(outputDir, "build.ova")), state.Get(StateExportOutputFile))
+	assert.Equal(t, filepath.Join(outputDir, "build.ova"), state.Get(StateExportResult).(ExportResult).Path)
+}
+
+func TestStepExport_RemoteArgsRedactPassword(t *testing.T) {
+	step := new(StepExport)
+	step.VMName = "test-name"
+	step.Format = "ova"
+
+	// A remote host carrying its own credentials and an invalid escape puts
+	// the password into the error from parsing the URL.
+	c := &DriverConfig{
+		RemoteType:     "esxi",
+		RemoteHost:     "root:s3cr3t@123.45.67.8%zz",
+		RemoteUser:     "user",
+		RemotePassword: "s3cr3t",
+	}
+
+	_, err := step.generateRemoteExportArgs(c, "vm_name", false, "test_output")
+	if err == nil {
+		t.Fatal("expected an error for an unparseable remote host")
+	}
+	assert.NotContains(t, err.Error(), "s3cr3t")
+	assert.Contains(t, err.Error(), "<password>")
+
+	_, err = step.OvfToolCommand(c, "vm_name", "test_output")
+	if err == nil {
+		t.Fatal("expected an error for an unparseable remote host")
+	}
+	assert.NotContains(t, err.Error(), "s3cr3t")
+}
+
+func TestStepExport_redactPassword(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		password string
+		err      error
+		expected string
+	}{
+		{"plain", "s3cr3t", errors.New("bad url vi://user:s3cr3t@host"), "bad url vi://user:<password>@host"},
+		{"escaped", "p@ss word", errors.New("bad url vi://user:p%40ss%20word@host"), "bad url vi://user:<password>@host"},
+		{"query escaped", "p@ss word", errors.New("bad value p%40ss+word"), "bad value <password>"},
+		{"absent", "s3cr3t", errors.New("bad url vi://host"), "bad url vi://host"},
+		{"empty password", "", errors.New("bad url vi://host"), "bad url vi://host"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.EqualError(t, redactPassword(tc.err, tc.password), tc.expected)
+		})
+	}
+
+	assert.NoError(t, redactPassword(nil, "s3cr3t"))
+}
+
+func TestStepExport_OvfToolCommand(t *testing.T) {
+	step := new(StepExport)
+	step.VMName = "test-name"
+	step.Format = "ova"
+
+	c := &DriverConfig{
+		RemoteType:     "esxi",
+		RemoteHost:     "123.45.67.8",
+		RemoteUser:     "user",
+		RemotePassword: "s3cr3t",
+	}
+	cmd, err := step.OvfToolCommand(c, "vm_name", "test_output")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	assert.Equal(t, GetOvfTool(), cmd.Binary)
+	assert.Equal(t, []string{"--noSSLVerify=true",
+		"--skipManifestCheck",
+		"-tt=ova",
+		"vi://user:s3cr3t@123.45.67.8/vm_name",
+		filepath.Join("test_output", "test-name.ova")}, cmd.Args)
+	assert.Equal(t, []string{"--noSSLVerify=true",
+		"--skipManifestCheck",
+		"-tt=ova",
+		"vi://user:<password>@123.45.67.8/vm_name",
+		filepath.Join("test_output", "test-name.ova")}, cmd.RedactedArgs)
+
+	for _, arg := range cmd.RedactedArgs {
+		assert.NotContains(t, arg, c.RemotePassword)
+	}
+
+	// A local export has no password, so nothing is redacted.
+	c.RemoteType = ""
+	cmd, err = step.OvfToolCommand(c, "vm_name", "test_output")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.Equal(t, []string{absPath(t, filepath.Join("test_output", "test-name.vmx")),
+		absPath(t, filepath.Join("test_output", "test-name.ova"))}, cmd.Args)
+	assert.Equal(t, cmd.Args, cmd.RedactedArgs)
+}
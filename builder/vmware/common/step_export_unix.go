@@ -0,0 +1,35 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !windows
+
+package common
+
+import (
+	"os"
+	"syscall"
+)
+
+// openExportPipe creates a named pipe that ovftool can write an export to,
+// and opens both of its ends. The write end is held open by the caller until
+// the export completes, so that the read end doesn't see the end of the
+// stream before ovftool has opened the pipe.
+func openExportPipe(path string) (*os.File, *os.File, error) {
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		return nil, nil, err
+	}
+
+	// Opening the read end without blocking lets the write end be opened
+	// without waiting for another process.
+	r, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return r, w, nil
+}
@@ -0,0 +1,115 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !windows
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStepExport_outputWriter(t *testing.T) {
+	outputDir := t.TempDir()
+
+	state := testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	step := new(StepExport)
+
+	var buf bytes.Buffer
+	step.OutputDir = stringPointer(outputDir)
+	step.VMName = "test-name"
+	step.Format = "ova"
+	step.OutputWriter = &buf
+
+	exported := bytes.Repeat([]byte("ova"), 64*1024)
+
+	d := state.Get("driver").(*DriverMock)
+	d.ExportFunc = func(args []string) error {
+		return os.WriteFile(args[len(args)-1], exported, 0644)
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	assert.Equal(t, "--overwrite", d.ExportArgs[0])
+	assert.Equal(t, exported, buf.Bytes())
+
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.Empty(t, entries, "stream should not have been written to the export output path")
+}
+
+func TestStepExport_outputWriterArgs(t *testing.T) {
+	outputDir := t.TempDir()
+
+	state := testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	step := new(StepExport)
+
+	var buf bytes.Buffer
+	step.OutputDir = stringPointer(outputDir)
+	step.VMName = "test-name"
+	step.Format = "ova"
+	step.OutputWriter = &buf
+	step.OVFToolOptions = []string{"--option=value"}
+
+	var pipePath string
+	d := state.Get("driver").(*DriverMock)
+	d.ExportFunc = func(args []string) error {
+		pipePath = args[len(args)-1]
+		return os.WriteFile(pipePath, []byte("ova"), 0644)
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	// The pipe replaces the target, and --overwrite precedes everything else.
+	assert.Equal(t, "test-name.ova", filepath.Base(pipePath))
+	assert.NotEqual(t, outputDir, filepath.Dir(pipePath))
+	assert.Equal(t, []string{"--overwrite",
+		"--option=value",
+		absPath(t, filepath.Join(outputDir, "test-name.vmx")),
+		pipePath}, d.ExportArgs)
+}
+
+func TestStepExport_outputWriterExportError(t *testing.T) {
+	state := testState(t)
+	state.Put("driverConfig", &DriverConfig{})
+	step := new(StepExport)
+
+	var buf bytes.Buffer
+	step.OutputDir = stringPointer(t.TempDir())
+	step.VMName = "test-name"
+	step.Format = "ova"
+	step.OutputWriter = &buf
+
+	// The export fails without ever opening the pipe.
+	d := state.Get("driver").(*DriverMock)
+	d.ExportErr = os.ErrPermission
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+	assert.Empty(t, buf.Bytes())
+}
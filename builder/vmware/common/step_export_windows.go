@@ -0,0 +1,17 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build windows
+
+package common
+
+import (
+	"errors"
+	"os"
+)
+
+// openExportPipe is not supported on Windows, which doesn't provide named
+// pipes on the filesystem.
+func openExportPipe(_ string) (*os.File, *os.File, error) {
+	return nil, nil, errors.New("streaming exports are not supported on Windows")
+}
@@ -17,14 +17,45 @@ import (
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 )
 
+// defaultShutdownHeartbeatInterval is the interval between progress messages
+// while waiting for the virtual machine to shut down gracefully.
+const defaultShutdownHeartbeatInterval = 30 * time.Second
+
+// defaultShutdownSnapshotName is the name of the snapshot taken before
+// shutdown when SnapshotName is unset.
+const defaultShutdownSnapshotName = "packer-pre-shutdown"
+
 // StepShutdown shuts down the machine. It first attempts to do so gracefully,
 // but ultimately forcefully shuts it down if that fails.
 type StepShutdown struct {
 	Command string
 	Timeout time.Duration
 
+	// HeartbeatInterval is the interval between progress messages while
+	// waiting for a graceful shutdown. Defaults to 30 seconds.
+	HeartbeatInterval time.Duration
+
+	// SnapshotBeforeShutdown takes a snapshot of the virtual machine, named
+	// SnapshotName, just before it's shut down, so that its state can be
+	// inspected when debugging a failed build. If the snapshot fails, then
+	// the build is halted, unless ContinueOnSnapshotError is set, in which
+	// case the failure is only reported.
+	SnapshotBeforeShutdown  bool
+	SnapshotName            string
+	ContinueOnSnapshotError bool
+
 	// Set this to true if we're testing
 	Testing bool
+
+	// newTicker returns the channel of a ticker that paces the heartbeat and
+	// a function to stop it. Defaults to a time.Ticker.
+	newTicker func(time.Duration) (<-chan time.Time, func())
+}
+
+// newTimeTicker paces the heartbeat with a time.Ticker.
+func newTimeTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
 }
 
 func (s *StepShutdown) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
@@ -34,6 +65,25 @@ func (s *StepShutdown) Run(ctx context.Context, state multistep.StateBag) multis
 	ui := state.Get("ui").(packersdk.Ui)
 	vmxPath := state.Get("vmx_path").(string)
 
+	if s.SnapshotBeforeShutdown {
+		name := s.SnapshotName
+		if name == "" {
+			name = defaultShutdownSnapshotName
+		}
+
+		ui.Sayf("Creating snapshot %q before halting virtual machine...", name)
+		if err := driver.CreateSnapshot(vmxPath, name); err != nil {
+			err := fmt.Errorf("error creating snapshot before shutdown: %s", err)
+			if !s.ContinueOnSnapshotError {
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
+			log.Printf("[WARN] %s", err)
+			ui.Sayf("Continuing without a snapshot: %s", err)
+		}
+	}
+
 	if s.Command != "" {
 		ui.Say("Gracefully halting virtual machine...")
 		log.Printf("Executing shutdown command: %s", s.Command)
@@ -54,6 +104,19 @@ func (s *StepShutdown) Run(ctx context.Context, state multistep.StateBag) multis
 		// Wait for the machine to actually shut down
 		log.Printf("Waiting up to %s for shutdown to complete", s.Timeout)
 		shutdownTimer := time.After(s.Timeout)
+
+		heartbeatInterval := s.HeartbeatInterval
+		if heartbeatInterval <= 0 {
+			heartbeatInterval = defaultShutdownHeartbeatInterval
+		}
+		newTicker := s.newTicker
+		if newTicker == nil {
+			newTicker = newTimeTicker
+		}
+		heartbeat, stopHeartbeat := newTicker(heartbeatInterval)
+		defer stopHeartbeat()
+
+		start := time.Now()
 		for {
 			running, _ := driver.IsRunning(vmxPath)
 			if !running {
@@ -68,14 +131,21 @@ func (s *StepShutdown) Run(ctx context.Context, state multistep.StateBag) multis
 				state.Put("error", err)
 				ui.Error(err.Error())
 				return multistep.ActionHalt
+			case <-heartbeat:
+				elapsed := time.Since(start).Round(time.Second)
+				remaining := (s.Timeout - elapsed).Round(time.Second)
+				if remaining < 0 {
+					remaining = 0
+				}
+				ui.Message(fmt.Sprintf("Waiting for virtual machine to shut down (%s elapsed, %s remaining)...", elapsed, remaining))
 			default:
 				time.Sleep(150 * time.Millisecond)
 			}
 		}
 	} else {
 		ui.Say("Forcibly halting virtual machine...")
-		if err := driver.Stop(vmxPath); err != nil {
-			err := fmt.Errorf("error stopping virtual machine: %s", err)
+		if err := stopContext(ctx, driver, vmxPath); err != nil {
+			err := fmt.Errorf("error stopping virtual machine: %w", err)
 			state.Put("error", err)
 			ui.Error(err.Error())
 			return multistep.ActionHalt
@@ -136,3 +206,20 @@ LockWaitLoop:
 }
 
 func (s *StepShutdown) Cleanup(state multistep.StateBag) {}
+
+// stopContext forcibly stops the virtual machine, returning the error of the
+// context if it's done first. The stop can block for a long time, so it isn't
+// waited for once the build is cancelled.
+func stopContext(ctx context.Context, driver Driver, vmxPath string) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- driver.Stop(vmxPath)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
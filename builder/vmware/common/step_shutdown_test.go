@@ -4,9 +4,12 @@
 package common
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -107,6 +110,63 @@ func TestStepShutdown_command(t *testing.T) {
 	}
 }
 
+func TestStepShutdown_commandHeartbeat(t *testing.T) {
+	state := testStepShutdownState(t)
+	step := new(StepShutdown)
+	step.Command = "foo"
+	step.Timeout = 10 * time.Second
+	step.HeartbeatInterval = 100 * time.Millisecond
+	step.Testing = true
+
+	ticks := make(chan time.Time)
+	var interval time.Duration
+	step.newTicker = func(d time.Duration) (<-chan time.Time, func()) {
+		interval = d
+		return ticks, func() {}
+	}
+
+	driver := state.Get("driver").(*DriverMock)
+	driver.IsRunningResult = true
+
+	// Each tick is only sent once the step receives it, so after three of
+	// them the machine can stop running without racing the heartbeat.
+	go func() {
+		for i := 0; i < 3; i++ {
+			ticks <- time.Now()
+		}
+		driver.Lock()
+		defer driver.Unlock()
+		driver.IsRunningResult = false
+	}()
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	if interval != step.HeartbeatInterval {
+		t.Fatalf("expected a heartbeat interval of %s, got %s", step.HeartbeatInterval, interval)
+	}
+
+	ui := state.Get("ui").(*packersdk.BasicUi)
+	output := ui.Writer.(*bytes.Buffer).String()
+
+	if heartbeats := strings.Count(output, "Waiting for virtual machine to shut down"); heartbeats != 3 {
+		t.Fatalf("expected 3 heartbeat messages, got %d: %s", heartbeats, output)
+	}
+	if !strings.Contains(output, "remaining") {
+		t.Fatalf("heartbeat should report the remaining time: %s", output)
+	}
+
+	// Clean up the created test output directory
+	dir := state.Get("dir").(*LocalOutputDir)
+	if err := dir.RemoveAll(); err != nil {
+		t.Fatalf("Error cleaning up directory: %s", err)
+	}
+}
+
 func TestStepShutdown_noCommand(t *testing.T) {
 	state := testStepShutdownState(t)
 	step := new(StepShutdown)
@@ -141,6 +201,155 @@ func TestStepShutdown_noCommand(t *testing.T) {
 	}
 }
 
+// shutdownOrderDriver records the order in which the snapshot and stop calls
+// of a shutdown are made.
+type shutdownOrderDriver struct {
+	*DriverMock
+	calls []string
+}
+
+func (d *shutdownOrderDriver) CreateSnapshot(vmxPath string, snapshotName string) error {
+	d.calls = append(d.calls, "snapshot")
+	return d.DriverMock.CreateSnapshot(vmxPath, snapshotName)
+}
+
+func (d *shutdownOrderDriver) Stop(path string) error {
+	d.calls = append(d.calls, "stop")
+	return d.DriverMock.Stop(path)
+}
+
+func TestStepShutdown_snapshot(t *testing.T) {
+	state := testStepShutdownState(t)
+	driver := &shutdownOrderDriver{DriverMock: state.Get("driver").(*DriverMock)}
+	state.Put("driver", driver)
+
+	step := new(StepShutdown)
+	step.SnapshotBeforeShutdown = true
+	step.Testing = true
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	if strings.Join(driver.calls, ",") != "snapshot,stop" {
+		t.Fatalf("expected the snapshot to be created before stopping, got %v", driver.calls)
+	}
+	if driver.CreateSnapshotVMXPath != "foo" {
+		t.Fatalf("bad snapshot path: %s", driver.CreateSnapshotVMXPath)
+	}
+	if driver.CreateSnapshotName != defaultShutdownSnapshotName {
+		t.Fatalf("bad snapshot name: %s", driver.CreateSnapshotName)
+	}
+
+	dir := state.Get("dir").(*LocalOutputDir)
+	if err := dir.RemoveAll(); err != nil {
+		t.Fatalf("Error cleaning up directory: %s", err)
+	}
+}
+
+func TestStepShutdown_snapshotError(t *testing.T) {
+	for _, continueOnError := range []bool{false, true} {
+		state := testStepShutdownState(t)
+		driver := &shutdownOrderDriver{DriverMock: state.Get("driver").(*DriverMock)}
+		driver.CreateSnapshotErr = errors.New("snapshot failed")
+		state.Put("driver", driver)
+
+		step := new(StepShutdown)
+		step.SnapshotBeforeShutdown = true
+		step.SnapshotName = "debug"
+		step.ContinueOnSnapshotError = continueOnError
+		step.Testing = true
+
+		action := step.Run(context.Background(), state)
+		_, hasError := state.GetOk("error")
+		if continueOnError {
+			if action != multistep.ActionContinue || hasError {
+				t.Fatalf("expected the shutdown to continue, got %#v", action)
+			}
+			if strings.Join(driver.calls, ",") != "snapshot,stop" {
+				t.Fatalf("expected the virtual machine to be stopped, got %v", driver.calls)
+			}
+		} else {
+			if action != multistep.ActionHalt || !hasError {
+				t.Fatalf("expected the shutdown to halt, got %#v", action)
+			}
+			if driver.StopCalled {
+				t.Fatal("stop should not be called")
+			}
+		}
+		if driver.CreateSnapshotName != "debug" {
+			t.Fatalf("bad snapshot name: %s", driver.CreateSnapshotName)
+		}
+
+		dir := state.Get("dir").(*LocalOutputDir)
+		if err := dir.RemoveAll(); err != nil {
+			t.Fatalf("Error cleaning up directory: %s", err)
+		}
+	}
+}
+
+// blockingStopDriver blocks in Stop until its context is done.
+type blockingStopDriver struct {
+	*DriverMock
+	ctx     context.Context
+	stopped chan struct{}
+}
+
+func (d *blockingStopDriver) Stop(path string) error {
+	close(d.stopped)
+	<-d.ctx.Done()
+	return d.ctx.Err()
+}
+
+func TestStepShutdown_noCommandCancel(t *testing.T) {
+	state := testStepShutdownState(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The driver is released well after the step should have returned, so
+	// that a step waiting on it would be noticed.
+	driverCtx, release := context.WithTimeout(context.Background(), 10*time.Second)
+	defer release()
+	driver := &blockingStopDriver{
+		DriverMock: state.Get("driver").(*DriverMock),
+		ctx:        driverCtx,
+		stopped:    make(chan struct{}),
+	}
+	state.Put("driver", driver)
+
+	step := new(StepShutdown)
+	step.Testing = true
+
+	go func() {
+		<-driver.stopped
+		cancel()
+	}()
+
+	start := time.Now()
+	if action := step.Run(ctx, state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the step to return promptly, took %s", elapsed)
+	}
+
+	err, ok := state.GetOk("error")
+	if !ok {
+		t.Fatal("should have error")
+	}
+	if !errors.Is(err.(error), context.Canceled) {
+		t.Fatalf("expected a cancellation error, got %s", err)
+	}
+
+	dir := state.Get("dir").(*LocalOutputDir)
+	if err := dir.RemoveAll(); err != nil {
+		t.Fatalf("Error cleaning up directory: %s", err)
+	}
+}
+
 func TestStepShutdown_locks(t *testing.T) {
 	if os.Getenv("PACKER_ACC") == "" {
 		t.Skip("This test is only run with PACKER_ACC=1 due to the requirement of access to the VMware binaries.")
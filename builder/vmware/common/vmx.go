@@ -4,10 +4,12 @@
 package common
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"regexp"
 	"sort"
@@ -79,6 +81,65 @@ func EncodeVMX(contents map[string]string) string {
 	return buf.String()
 }
 
+// ReadVmx reads the `key = "value"` lines of a VMX file from a reader into a
+// k/v mapping. Keys are lowercased, since VMware treats them without regard
+// to case, and the quotes surrounding values are removed. Blank lines and
+// comments are skipped, and any other line without a key is an error.
+func ReadVmx(r io.Reader) (map[string]string, error) {
+	results := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: expected a key and value, got %q", line, text)
+		}
+		if len(value) >= 2 && strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
+			value = value[1 : len(value)-1]
+		}
+		results[strings.ToLower(key)] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// WriteVmx writes a k/v mapping to a writer as the lines of a VMX file. The
+// keys are written in sorted order, so that the same mapping always produces
+// the same contents.
+func WriteVmx(w io.Writer, kv map[string]string) error {
+	_, err := io.WriteString(w, EncodeVMX(kv))
+	return err
+}
+
+// VmxMACAddress returns the MAC address of a network adapter from a parsed
+// VMX, preferring an explicitly configured `ethernetN.address` over the
+// `ethernetN.generatedAddress` assigned by VMware.
+func VmxMACAddress(kv map[string]string, nic int) (net.HardwareAddr, error) {
+	prefix := fmt.Sprintf("ethernet%d.", nic)
+
+	address := kv[prefix+"address"]
+	if address == "" {
+		address = kv[prefix+"generatedaddress"]
+	}
+	if address == "" {
+		return nil, fmt.Errorf("unable to determine MAC address: no address found for network adapter ethernet%d", nic)
+	}
+
+	mac, err := parseMAC(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC address %q for network adapter ethernet%d: %s", address, nic, err)
+	}
+	return mac, nil
+}
+
 // WriteVMX takes a path to a VMX file and contents in the form of a
 // map and writes it out.
 func WriteVMX(path string, data map[string]string) (err error) {
@@ -3,7 +3,14 @@
 
 package common
 
-import "testing"
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestParseVMX(t *testing.T) {
 	contents := `
@@ -47,3 +54,106 @@ scsi0:0.virtualSSD = 1
 		t.Errorf("invalid results: %s", result)
 	}
 }
+
+func TestReadVmx(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "vmx-example.vmx"))
+	if err != nil {
+		t.Fatalf("Unable to open vmx sample: %s", err)
+	}
+	defer f.Close()
+
+	results, err := ReadVmx(f)
+	if err != nil {
+		t.Fatalf("Unable to read vmx sample: %s", err)
+	}
+
+	if len(results) != 18 {
+		t.Fatalf("not correct number of results: %d", len(results))
+	}
+
+	for key, expected := range map[string]string{
+		".encoding":                  "UTF-8",
+		"displayname":                "packer-example",
+		"scsi0:0.virtualssd":         "1",
+		"ethernet0.generatedaddress": "00:0c:29:3e:1a:2b",
+		"annotation":                 `Built with = signs and \"quotes\"`,
+	} {
+		if results[key] != expected {
+			t.Errorf("invalid %s: %s", key, results[key])
+		}
+	}
+
+	if _, err := ReadVmx(strings.NewReader("displayName = \"a\"\nbogus\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected an error for line 2, got %v", err)
+	}
+}
+
+func TestWriteVmx(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "vmx-example.vmx"))
+	if err != nil {
+		t.Fatalf("Unable to open vmx sample: %s", err)
+	}
+	defer f.Close()
+
+	original, err := ReadVmx(f)
+	if err != nil {
+		t.Fatalf("Unable to read vmx sample: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteVmx(&buf, original); err != nil {
+		t.Fatalf("Unable to write vmx: %s", err)
+	}
+	written := buf.String()
+
+	result, err := ReadVmx(strings.NewReader(written))
+	if err != nil {
+		t.Fatalf("Unable to read written vmx: %s", err)
+	}
+	if !reflect.DeepEqual(original, result) {
+		t.Errorf("expected round-trip to preserve %v, got %v", original, result)
+	}
+
+	// The same mapping always produces the same contents.
+	buf.Reset()
+	if err := WriteVmx(&buf, result); err != nil {
+		t.Fatalf("Unable to write vmx: %s", err)
+	}
+	if buf.String() != written {
+		t.Errorf("expected the same contents, got %s and %s", written, buf.String())
+	}
+}
+
+func TestVmxMACAddress(t *testing.T) {
+	kv, err := ReadVmx(strings.NewReader(`
+ethernet0.present = "TRUE"
+ethernet0.addressType = "static"
+ethernet0.address = "00:50:56:3f:00:01"
+ethernet0.generatedAddress = "00:0c:29:3e:1a:2b"
+ethernet1.present = "TRUE"
+ethernet1.generatedAddress = "00:0c:29:3e:1a:35"
+ethernet2.present = "TRUE"
+ethernet3.address = "bogus"
+`))
+	if err != nil {
+		t.Fatalf("Unable to read vmx: %s", err)
+	}
+
+	// The explicit address is preferred over the generated one.
+	if mac, err := VmxMACAddress(kv, 0); err != nil || mac.String() != "00:50:56:3f:00:01" {
+		t.Errorf("expected explicit address for ethernet0, got %s (%v)", mac, err)
+	}
+	if mac, err := VmxMACAddress(kv, 1); err != nil || mac.String() != "00:0c:29:3e:1a:35" {
+		t.Errorf("expected generated address for ethernet1, got %s (%v)", mac, err)
+	}
+
+	for nic, expected := range map[int]string{
+		2: "no address found for network adapter ethernet2",
+		4: "no address found for network adapter ethernet4",
+		3: `invalid MAC address "bogus" for network adapter ethernet3`,
+	} {
+		if _, err := VmxMACAddress(kv, nic); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error for ethernet%d to contain %s, got %v", nic, expected, err)
+		}
+	}
+}
@@ -136,6 +136,8 @@ type FlatConfig struct {
 	Format                         *string           `mapstructure:"format" required:"false" cty:"format" hcl:"format"`
 	OVFToolOptions                 []string          `mapstructure:"ovftool_options" required:"false" cty:"ovftool_options" hcl:"ovftool_options"`
 	SkipExport                     *bool             `mapstructure:"skip_export" required:"false" cty:"skip_export" hcl:"skip_export"`
+	SkipSSLVerify                  *bool             `mapstructure:"skip_ssl_verify" required:"false" cty:"skip_ssl_verify" hcl:"skip_ssl_verify"`
+	RemoteInventoryPath            *string           `mapstructure:"remote_inventory_path" required:"false" cty:"remote_inventory_path" hcl:"remote_inventory_path"`
 	KeepRegistered                 *bool             `mapstructure:"keep_registered" required:"false" cty:"keep_registered" hcl:"keep_registered"`
 	SkipCompaction                 *bool             `mapstructure:"skip_compaction" required:"false" cty:"skip_compaction" hcl:"skip_compaction"`
 	AdditionalDiskSize             []uint            `mapstructure:"disk_additional_size" required:"false" cty:"disk_additional_size" hcl:"disk_additional_size"`
@@ -291,6 +293,8 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 		"format":                         &hcldec.AttrSpec{Name: "format", Type: cty.String, Required: false},
 		"ovftool_options":                &hcldec.AttrSpec{Name: "ovftool_options", Type: cty.List(cty.String), Required: false},
 		"skip_export":                    &hcldec.AttrSpec{Name: "skip_export", Type: cty.Bool, Required: false},
+		"skip_ssl_verify":                &hcldec.AttrSpec{Name: "skip_ssl_verify", Type: cty.Bool, Required: false},
+		"remote_inventory_path":          &hcldec.AttrSpec{Name: "remote_inventory_path", Type: cty.String, Required: false},
 		"keep_registered":                &hcldec.AttrSpec{Name: "keep_registered", Type: cty.Bool, Required: false},
 		"skip_compaction":                &hcldec.AttrSpec{Name: "skip_compaction", Type: cty.Bool, Required: false},
 		"disk_additional_size":           &hcldec.AttrSpec{Name: "disk_additional_size", Type: cty.List(cty.Number), Required: false},
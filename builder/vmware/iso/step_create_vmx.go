@@ -236,7 +236,7 @@ func (s *stepCreateVMX) Run(ctx context.Context, state multistep.StateBag) multi
 			// and for device-specific operations like GuestIP, try to go over all
 			// devices that match a name (e.g. "nat").
 			// https://pubs.vmware.com/workstation-9/index.jsp?topic=%2Fcom.vmware.ws.using.doc%2FGUID-3B504F2F-7A0B-415F-AE01-62363A95D052.html
-			templateData.NetworkType = network
+			templateData.NetworkType = common.NormalizeNetworkName(network)
 			templateData.NetworkDevice = ""
 		} else {
 			// otherwise, we were unable to find the type, so assume it's a custom device
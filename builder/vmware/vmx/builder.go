@@ -189,11 +189,15 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 			SnapshotName: &b.config.SnapshotName,
 		},
 		&vmwcommon.StepExport{
-			Format:         b.config.Format,
-			SkipExport:     b.config.SkipExport,
-			VMName:         b.config.VMName,
-			OVFToolOptions: b.config.OVFToolOptions,
-			OutputDir:      &b.config.OutputDir,
+			Format:           b.config.Format,
+			SkipExport:       b.config.SkipExport,
+			VMName:           b.config.VMName,
+			OVFToolOptions:   b.config.OVFToolOptions,
+			OutputDir:        &b.config.OutputDir,
+			CleanupOnFailure: true,
+			SkipSSLVerify:    b.config.SkipSSLVerify,
+
+			RemoteInventoryPath: b.config.RemoteInventoryPath,
 		},
 	}
 